@@ -0,0 +1,414 @@
+// Command fwctl controls a running fwld daemon through its admin socket.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/admin"
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/firewall"
+	"github.com/cyra/foxhole-fw/internal/rules"
+)
+
+const usage = `Usage: fwctl [-socket PATH] COMMAND [ARGS]
+
+Commands:
+  bans list [--rule ID] [--json]     list active bans
+  bans get IP [--json]               show one ban
+  ban IP --for DURATION [--reason R] ban an IP (whitelist and dry-run apply)
+  unban IP                           lift a ban
+  extend IP --for DURATION           push a ban's expiry back
+  extend IP --until TIME             move a ban's expiry, earlier or later
+  whitelist list [--json]            show whitelist entries
+  whitelist add IP|CIDR              whitelist until the daemon restarts
+  stats [--json]                     daemon statistics
+  top [-n N] [--interval D] [--once] live view of IPs closest to a ban
+  reload                             reload the daemon config
+`
+
+func main() {
+	fs := flag.NewFlagSet("fwctl", flag.ExitOnError)
+	socket := fs.String("socket", config.DefaultAdminSocket, "Path to the fwld admin socket")
+	fs.Usage = func() { fmt.Fprint(fs.Output(), usage, "\nFlags:\n"); fs.PrintDefaults() }
+	_ = fs.Parse(os.Args[1:])
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c := admin.NewClient(*socket)
+	if err := run(ctx, c, fs.Arg(0), fs.Args()[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			fs.Usage()
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "fwctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("usage")
+
+func run(ctx context.Context, c *admin.Client, cmd string, args []string) error {
+	switch cmd {
+	case "bans":
+		if len(args) == 0 {
+			return errUsage
+		}
+		switch args[0] {
+		case "list", "ls":
+			return bansList(ctx, c, args[1:])
+		case "get":
+			return bansGet(ctx, c, args[1:])
+		}
+		return errUsage
+	case "ban":
+		return ban(ctx, c, args)
+	case "unban":
+		return unban(ctx, c, args)
+	case "extend":
+		return extend(ctx, c, args)
+	case "whitelist":
+		if len(args) == 0 {
+			return errUsage
+		}
+		switch args[0] {
+		case "list", "ls":
+			return whitelistList(ctx, c, args[1:])
+		case "add":
+			return whitelistAdd(ctx, c, args[1:])
+		}
+		return errUsage
+	case "stats":
+		return stats(ctx, c, args)
+	case "top":
+		return top(ctx, c, args)
+	case "reload":
+		return reload(ctx, c)
+	default:
+		return errUsage
+	}
+}
+
+// parseArgs parses flags that may appear before or after positional
+// arguments, e.g. "ban 1.2.3.4 --for 1h", and returns the positional ones.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		_ = fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func newFlags(name string) *flag.FlagSet {
+	return flag.NewFlagSet("fwctl "+name, flag.ExitOnError)
+}
+
+func bansList(ctx context.Context, c *admin.Client, args []string) error {
+	fs := newFlags("bans list")
+	rule := fs.String("rule", "", "Only bans from this rule")
+	asJSON := fs.Bool("json", false, "Print JSON")
+	parseArgs(fs, args)
+
+	bans, err := c.Bans(ctx, *rule)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(bans)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tRULE\tSTATE\tBACKENDS\tEXPIRES\tREMAINING\tREASON")
+	for _, b := range bans {
+		rule := b.RuleID
+		if b.DryRun {
+			rule += " (dry-run)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", b.IP, rule, b.State, backendList(b.Backends),
+			b.ExpiresAt.Local().Format(time.DateTime), remaining(b.ExpiresAt), b.Reason)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d active ban(s)\n", len(bans))
+	return nil
+}
+
+func bansGet(ctx context.Context, c *admin.Client, args []string) error {
+	fs := newFlags("bans get")
+	asJSON := fs.Bool("json", false, "Print JSON")
+	pos := parseArgs(fs, args)
+	if len(pos) != 1 {
+		return errUsage
+	}
+	b, err := c.GetBan(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(b)
+	}
+	fmt.Printf("ip:       %s\nrule:     %s\nreason:   %s\nstate:    %s\nexpires:  %s (in %s)\nbackends: %s\ndry-run:  %t\n",
+		b.IP, b.RuleID, b.Reason, b.State, b.ExpiresAt.Local().Format(time.DateTime), remaining(b.ExpiresAt), backendList(b.Backends), b.DryRun)
+	if len(b.Evidence) > 0 {
+		fmt.Printf("evidence: %d line(s)\n", len(b.Evidence))
+		for _, line := range b.Evidence {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+	return nil
+}
+
+// backendList formats the backends holding a ban; "-" while none does.
+func backendList(names []string) string {
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, ",")
+}
+
+func ban(ctx context.Context, c *admin.Client, args []string) error {
+	fs := newFlags("ban")
+	d := fs.Duration("for", 0, "Ban duration, e.g. 1h")
+	reason := fs.String("reason", "manual", "Reason recorded with the ban")
+	pos := parseArgs(fs, args)
+	if len(pos) != 1 || *d <= 0 {
+		return errUsage
+	}
+	b, err := c.Ban(ctx, pos[0], *d, *reason)
+	if err != nil {
+		return err
+	}
+	suffix := ""
+	if b.DryRun {
+		suffix = " (dry-run: not installed)"
+	}
+	fmt.Printf("banned %s until %s%s\n", pos[0], b.ExpiresAt.Local().Format(time.DateTime), suffix)
+	return nil
+}
+
+func unban(ctx context.Context, c *admin.Client, args []string) error {
+	pos := parseArgs(newFlags("unban"), args)
+	if len(pos) != 1 {
+		return errUsage
+	}
+	if err := c.Unban(ctx, pos[0]); err != nil {
+		return err
+	}
+	fmt.Printf("unbanned %s\n", pos[0])
+	return nil
+}
+
+func extend(ctx context.Context, c *admin.Client, args []string) error {
+	fs := newFlags("extend")
+	d := fs.Duration("for", 0, "Time added to the current expiry, e.g. 1h")
+	untilFlag := fs.String("until", "", "New expiry, RFC 3339 or local \"2006-01-02 15:04:05\"")
+	pos := parseArgs(fs, args)
+	if len(pos) != 1 || (*d > 0) == (*untilFlag != "") || *d < 0 {
+		return errUsage
+	}
+	var b firewall.ActiveBan
+	var err error
+	if *untilFlag != "" {
+		until, perr := parseTime(*untilFlag)
+		if perr != nil {
+			return perr
+		}
+		b, err = c.ExtendUntil(ctx, pos[0], until)
+	} else {
+		b, err = c.Extend(ctx, pos[0], *d)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s banned until %s\n", b.IP, b.ExpiresAt.Local().Format(time.DateTime))
+	return nil
+}
+
+func whitelistList(ctx context.Context, c *admin.Client, args []string) error {
+	fs := newFlags("whitelist list")
+	asJSON := fs.Bool("json", false, "Print JSON")
+	parseArgs(fs, args)
+	wl, err := c.Whitelist(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(wl)
+	}
+	for _, e := range wl.Configured {
+		fmt.Printf("%s\tconfig\n", e)
+	}
+	for _, e := range wl.Runtime {
+		fmt.Printf("%s\truntime\n", e)
+	}
+	return nil
+}
+
+func whitelistAdd(ctx context.Context, c *admin.Client, args []string) error {
+	pos := parseArgs(newFlags("whitelist add"), args)
+	if len(pos) != 1 {
+		return errUsage
+	}
+	if _, err := c.WhitelistAdd(ctx, pos[0]); err != nil {
+		return err
+	}
+	fmt.Printf("whitelisted %s until the daemon restarts; add it to backend.whitelist to keep it\n", pos[0])
+	return nil
+}
+
+func stats(ctx context.Context, c *admin.Client, args []string) error {
+	fs := newFlags("stats")
+	asJSON := fs.Bool("json", false, "Print JSON")
+	parseArgs(fs, args)
+	st, err := c.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(st)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "uptime:\t%s\n", time.Since(st.StartedAt).Round(time.Second))
+	fmt.Fprintf(tw, "backend:\t%s (dry-run=%t)\n", st.Backend, st.DryRun)
+	fmt.Fprintf(tw, "active bans:\t%d\n", st.ActiveBans)
+	ruleIDs := make([]string, 0, len(st.BansByRule))
+	for r := range st.BansByRule {
+		ruleIDs = append(ruleIDs, r)
+	}
+	sort.Strings(ruleIDs)
+	for _, r := range ruleIDs {
+		fmt.Fprintf(tw, "  %s:\t%d\n", r, st.BansByRule[r])
+	}
+	fmt.Fprintf(tw, "pending bans:\t%d\n", st.PendingBans)
+	fmt.Fprintf(tw, "pending retries:\t%d\n", st.PendingRetries)
+	fmt.Fprintf(tw, "tracked ips:\t%d\n", st.TrackedIPs)
+	if st.LogSource != "" {
+		fmt.Fprintf(tw, "log:\t%s (parse errors=%d)\n", st.LogSource, st.ParseErrors)
+	}
+	for _, q := range st.Queues {
+		fmt.Fprintf(tw, "queue %s:\t%d/%d (dropped=%d)\n", q.Name, q.Len, q.Cap, q.Dropped)
+	}
+	if r := st.Reload; r != nil && !r.Time.IsZero() {
+		outcome := "ok"
+		if !r.OK {
+			outcome = "failed: " + r.Error
+		}
+		fmt.Fprintf(tw, "last reload:\t%s (%s) %s\n", r.Time.Local().Format(time.DateTime), r.Trigger, outcome)
+	}
+	return tw.Flush()
+}
+
+func top(ctx context.Context, c *admin.Client, args []string) error {
+	fs := newFlags("top")
+	n := fs.Int("n", 20, "Number of IPs to show")
+	interval := fs.Duration("interval", 2*time.Second, "Refresh interval")
+	once := fs.Bool("once", false, "Print once and exit")
+	parseArgs(fs, args)
+	if *interval <= 0 {
+		return errUsage
+	}
+
+	if *once {
+		counters, err := c.Counters(ctx, *n)
+		if err != nil {
+			return err
+		}
+		printTop(os.Stdout, counters)
+		return nil
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		counters, err := c.Counters(ctx, *n)
+		if err != nil {
+			return err
+		}
+		fmt.Print("\033[H\033[2J") // clear screen
+		fmt.Printf("fwctl top - %s - every %s, Ctrl-C to quit\n\n", time.Now().Format(time.TimeOnly), *interval)
+		printTop(os.Stdout, counters)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func printTop(w io.Writer, counters []rules.IPCounter) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tERRORS\tRULE\tCOUNT/MAX\tPROGRESS\tLAST ERROR")
+	for _, c := range counters {
+		p, ok := c.Closest()
+		if !ok {
+			fmt.Fprintf(tw, "%s\t%d\t-\t-\t\t%s\n", c.IP, c.Errors, c.LastError.Local().Format(time.TimeOnly))
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d/%d\t%s\t%s\n", c.IP, c.Errors, p.RuleID, p.Count, p.MaxErrors, bar(p.Ratio(), 10), c.LastError.Local().Format(time.TimeOnly))
+	}
+	_ = tw.Flush()
+}
+
+func reload(ctx context.Context, c *admin.Client) error {
+	st, err := c.Reload(ctx)
+	if err != nil {
+		return err
+	}
+	if !st.OK {
+		return fmt.Errorf("reload failed, old config kept: %s", st.Error)
+	}
+	fmt.Printf("config reloaded: %s\n", st.Changes)
+	return nil
+}
+
+// parseTime parses s as RFC 3339, or as a local time in the format bans are
+// printed in.
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateTime, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: want RFC 3339 or %q", s, time.DateTime)
+	}
+	return t, nil
+}
+
+// bar renders ratio (0..1, clamped) as a fixed-width progress bar.
+func bar(ratio float64, width int) string {
+	filled := int(ratio*float64(width) + 0.5)
+	filled = max(0, min(filled, width))
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", width-filled) + "]"
+}
+
+func remaining(t time.Time) time.Duration {
+	return time.Until(t).Round(time.Second)
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/rules"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args       []string
+		positional []string
+		dur        time.Duration
+		reason     string
+	}{
+		{[]string{"198.51.100.7", "--for", "1h"}, []string{"198.51.100.7"}, time.Hour, ""},
+		{[]string{"--for", "1h", "198.51.100.7"}, []string{"198.51.100.7"}, time.Hour, ""},
+		{[]string{"198.51.100.7", "--reason", "scanner", "extra", "-for=2m"}, []string{"198.51.100.7", "extra"}, 2 * time.Minute, "scanner"},
+		{[]string{"198.51.100.7", "--", "--for"}, []string{"198.51.100.7", "--for"}, 0, ""},
+		{nil, nil, 0, ""},
+	}
+	for _, tt := range tests {
+		fs := newFlags("ban")
+		dur := fs.Duration("for", 0, "")
+		reason := fs.String("reason", "", "")
+		got := parseArgs(fs, tt.args)
+		if !slices.Equal(got, tt.positional) || *dur != tt.dur || *reason != tt.reason {
+			t.Errorf("parseArgs(%q) = %q, for=%v reason=%q; want %q, for=%v reason=%q",
+				tt.args, got, *dur, *reason, tt.positional, tt.dur, tt.reason)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	want := time.Date(2024, 1, 15, 18, 0, 0, 0, time.UTC)
+	for _, s := range []string{"2024-01-15T18:00:00Z", want.Local().Format(time.DateTime)} {
+		got, err := parseTime(s)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("parseTime(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	if _, err := parseTime("tomorrow"); err == nil {
+		t.Error("parseTime accepted \"tomorrow\"")
+	}
+}
+
+func TestExtendUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{"198.51.100.7"},
+		{"198.51.100.7", "--for", "1h", "--until", "2024-01-15T18:00:00Z"},
+		{"198.51.100.7", "--for", "-1h"},
+	} {
+		if err := extend(context.Background(), nil, args); !errors.Is(err, errUsage) {
+			t.Errorf("extend %q: err %v, want errUsage", args, err)
+		}
+	}
+}
+
+func TestBar(t *testing.T) {
+	tests := []struct {
+		ratio float64
+		want  string
+	}{
+		{0, "[..........]"},
+		{0.04, "[..........]"},
+		{0.05, "[#.........]"},
+		{0.5, "[#####.....]"},
+		{1, "[##########]"},
+		{2.5, "[##########]"},
+		{-1, "[..........]"},
+	}
+	for _, tt := range tests {
+		if got := bar(tt.ratio, 10); got != tt.want {
+			t.Errorf("bar(%v, 10) = %s, want %s", tt.ratio, got, tt.want)
+		}
+	}
+}
+
+func TestPrintTop(t *testing.T) {
+	last := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	at := last.Local().Format(time.TimeOnly)
+	var b strings.Builder
+	printTop(&b, []rules.IPCounter{
+		{IP: "198.51.100.7", Errors: 8, LastError: last, Rules: []rules.RuleProgress{
+			{RuleID: "login", Count: 4, MaxErrors: 5},
+			{RuleID: "scan", Count: 8, MaxErrors: 100},
+		}},
+		{IP: "2001:db8::1", Errors: 2, LastError: last},
+	})
+
+	want := "IP            ERRORS  RULE   COUNT/MAX  PROGRESS      LAST ERROR\n" +
+		"198.51.100.7  8       login  4/5        [########..]  " + at + "\n" +
+		"2001:db8::1   2       -      -                        " + at + "\n"
+	if got := b.String(); got != want {
+		t.Errorf("printTop mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestTopRejectsInterval(t *testing.T) {
+	for _, args := range [][]string{{"--interval", "0s"}, {"--interval=-1s", "--once"}} {
+		if err := top(context.Background(), nil, args); !errors.Is(err, errUsage) {
+			t.Errorf("top %q: err %v, want errUsage", args, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/firewall"
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/notify"
+	"github.com/cyra/foxhole-fw/internal/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// probeTimeout bounds the credential probe made by "fwld check".
+const probeTimeout = 15 * time.Second
+
+// runCheck implements "fwld check": it loads and validates the config, builds
+// the parser and backend without applying anything, probes backend
+// credentials where a read-only request exists, and prints the effective
+// config with secrets redacted. It exits non-zero listing every problem.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	cfgPath := fs.String("config", "/etc/foxhole-fw/config.yaml", "Path to configuration file")
+	noProbe := fs.Bool("no-probe", false, "Skip contacting the firewall backend")
+	quiet := fs.Bool("q", false, "Do not print the effective config")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: fwld check [flags]\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		var verr *config.ValidationError
+		if errors.As(err, &verr) {
+			for _, p := range verr.Problems {
+				fmt.Fprintln(os.Stderr, p)
+			}
+			fmt.Fprintf(os.Stderr, "%s: %d problem(s)\n", *cfgPath, len(verr.Problems))
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *cfgPath, err)
+		}
+		return 1
+	}
+
+	var problems []string
+	if _, err := parser.New(cfg.Log.Parser); err != nil {
+		problems = append(problems, fmt.Sprintf("log.parser: %v", err))
+	}
+	if _, err := os.Stat(cfg.Log.Path); err != nil {
+		// Not fatal: the daemon waits for the log to appear.
+		fmt.Fprintf(os.Stderr, "warning: log.path: %v\n", err)
+	}
+
+	if len(cfg.Notify.Sinks) > 0 {
+		if _, err := notify.New(&cfg.Notify, logging.NewLoggerTo(io.Discard)); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	backends, err := firewall.NewBackends(&cfg.Backend, logging.NewLoggerTo(io.Discard))
+	switch {
+	case err != nil:
+		problems = append(problems, fmt.Sprintf("backend: %v", err))
+	case *noProbe:
+	default:
+		for _, backend := range backends {
+			prober, ok := firewall.AsProber(backend)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "note: backend %s has no read-only probe; credentials not verified\n", backend.Name())
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+			err := prober.Probe(ctx)
+			cancel()
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("backend %s probe: %v", backend.Name(), err))
+			}
+		}
+	}
+
+	if !*quiet {
+		out, err := yaml.Marshal(cfg.Redacted())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "check: marshal config: %v\n", err)
+			return 1
+		}
+		os.Stdout.Write(out)
+	}
+
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, p)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d problem(s)\n", *cfgPath, len(problems))
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%s: OK\n", *cfgPath)
+	return 0
+}
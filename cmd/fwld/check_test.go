@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// captureOutput runs fn with os.Stdout and os.Stderr redirected and returns
+// what it wrote to each.
+func captureOutput(t *testing.T, fn func()) (stdout, stderr string) {
+	t.Helper()
+	dir := t.TempDir()
+	open := func(name string) *os.File {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	outFile, errFile := open("stdout"), open("stderr")
+	origOut, origErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = outFile, errFile
+	defer func() { os.Stdout, os.Stderr = origOut, origErr }()
+
+	fn()
+
+	read := func(f *os.File) string {
+		f.Close()
+		data, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	return read(outFile), read(errFile)
+}
+
+// proxmoxConfig is a valid config whose backend is probed at apiURL.
+func proxmoxConfig(apiURL string) string {
+	return strings.Replace(testConfig, `  type: iptables
+  iptables:
+    table: filter
+    chain: INPUT
+`, `  type: proxmox
+  proxmox:
+    api_url: `+apiURL+`
+    token_id: root@pam!fw
+    token_secret: pve-secret-value
+    node: pve1
+`, 1)
+}
+
+// fakeProxmox answers every request with status and counts them.
+func fakeProxmox(t *testing.T, status int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestRunCheckInvalidConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, strings.NewReplacer("max_errors: 10", "max_errors: 0", "window: 1m", "window: soon").Replace(testConfig))
+
+	var code int
+	stdout, stderr := captureOutput(t, func() { code = runCheck([]string{"-config", path}) })
+	if code != 1 {
+		t.Errorf("exit status %d, want 1", code)
+	}
+	if stdout != "" {
+		t.Errorf("stdout = %q, want nothing for an invalid config", stdout)
+	}
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if want := path + ": 2 problem(s)"; lines[len(lines)-1] != want {
+		t.Errorf("last stderr line = %q, want %q", lines[len(lines)-1], want)
+	}
+	for _, field := range []string{"rules[0].max_errors", "rules[0].window"} {
+		if !strings.Contains(stderr, field) {
+			t.Errorf("stderr does not list %s:\n%s", field, stderr)
+		}
+	}
+}
+
+func TestRunCheckRedactsSecrets(t *testing.T) {
+	srv, calls := fakeProxmox(t, http.StatusOK)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, proxmoxConfig(srv.URL))
+
+	var code int
+	stdout, stderr := captureOutput(t, func() { code = runCheck([]string{"-config", path}) })
+	if code != 0 {
+		t.Fatalf("exit status %d, want 0; stderr:\n%s", code, stderr)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("backend probed %d times, want once", calls.Load())
+	}
+	if strings.Contains(stdout+stderr, "pve-secret-value") {
+		t.Errorf("output contains the token secret:\n%s", stdout)
+	}
+	if !strings.Contains(stdout, "token_id: root@pam!fw") {
+		t.Errorf("stdout is missing the effective config:\n%s", stdout)
+	}
+	if !strings.HasSuffix(stderr, path+": OK\n") {
+		t.Errorf("stderr = %q, want it to end with OK", stderr)
+	}
+}
+
+func TestRunCheckProbe(t *testing.T) {
+	srv, calls := fakeProxmox(t, http.StatusUnauthorized)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, proxmoxConfig(srv.URL))
+
+	var code int
+	_, stderr := captureOutput(t, func() { code = runCheck([]string{"-config", path, "-q"}) })
+	if code != 1 {
+		t.Errorf("exit status %d with rejected credentials, want 1", code)
+	}
+	if !strings.Contains(stderr, "backend proxmox probe: proxmox: credentials rejected") ||
+		!strings.Contains(stderr, path+": 1 problem(s)") {
+		t.Errorf("stderr does not report the failed probe:\n%s", stderr)
+	}
+
+	calls.Store(0)
+	stdout, stderr := captureOutput(t, func() { code = runCheck([]string{"-config", path, "-no-probe", "-q"}) })
+	if code != 0 {
+		t.Errorf("exit status %d with -no-probe, want 0; stderr:\n%s", code, stderr)
+	}
+	if calls.Load() != 0 {
+		t.Errorf("backend probed %d times with -no-probe", calls.Load())
+	}
+	if stdout != "" {
+		t.Errorf("stdout = %q with -q, want nothing", stdout)
+	}
+}
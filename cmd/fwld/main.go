@@ -8,12 +8,19 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/cyra/foxhole-fw/internal/admin"
+	"github.com/cyra/foxhole-fw/internal/audit"
+	"github.com/cyra/foxhole-fw/internal/clock"
 	"github.com/cyra/foxhole-fw/internal/config"
 	"github.com/cyra/foxhole-fw/internal/firewall"
 	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/notify"
 	"github.com/cyra/foxhole-fw/internal/parser"
 	"github.com/cyra/foxhole-fw/internal/pipeline"
+	"github.com/cyra/foxhole-fw/internal/queue"
+	"github.com/cyra/foxhole-fw/internal/report"
 	"github.com/cyra/foxhole-fw/internal/rules"
 )
 
@@ -24,6 +31,17 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		case "report":
+			os.Exit(runReport(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
 	if *showVersion {
@@ -31,69 +49,166 @@ func main() {
 		os.Exit(0)
 	}
 
-	logger := logging.NewLogger()
-
 	cfg, err := config.Load(*configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
 		os.Exit(1)
 	}
 
-	logger.Infof("foxhole-fw starting (version=%s)", version)
-	logger.Infof("config loaded from %s (backend=%s)", *configPath, cfg.Backend.Type)
+	logger, err := logging.New(os.Stdout, &cfg.Logging)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up logging: %v\n", err)
+		os.Exit(1)
+	}
+
+	logger.Info("foxhole-fw starting", "version", version)
+	logger.Info("config loaded", "path", *configPath, "backends", len(cfg.Backend.Specs()))
 
 	// Set up root context with cancellation on SIGINT/SIGTERM.
 	ctx, cancel := signalContext()
+	hangups := hangupChannel()
 
 	store := config.NewStore(cfg)
 
-	watcherStop, err := config.WatchFile(*configPath, store, logger)
-	if err != nil {
-		logger.Errorf("config watcher disabled: %v", err)
-	}
+	events := pipeline.NewQueue[*parser.Event]("events", cfg.Pipeline.EventsBuffer, &cfg.Pipeline)
+	// Decisions always block: under a drop policy a flood from one IP could
+	// evict ban decisions for others. Backend latency is absorbed by the ban
+	// manager's job queue.
+	decisions := queue.New[*rules.Decision]("decisions", cfg.Pipeline.DecisionsBuffer, queue.Block, 0)
 
-	events := make(chan *parser.Event, 100)
-	decisions := make(chan *rules.Decision, 100)
-
-	if pipelineErr := pipeline.StartLogPipeline(ctx, cfg, logger, events); pipelineErr != nil {
+	logPipeline := pipeline.NewLogPipeline(logger, events, clock.Real)
+	if pipelineErr := logPipeline.Start(ctx, cfg); pipelineErr != nil {
 		fmt.Fprintf(os.Stderr, "failed to start log pipeline: %v\n", pipelineErr)
 		cancel()
 		os.Exit(1)
 	}
 
-	engine := rules.NewEngine(store, logger)
+	engine := rules.NewEngine(store, logger, clock.Real)
 
-	backend, backendErr := firewall.NewBackend(cfg, logger)
+	backends, backendErr := firewall.NewBackends(&cfg.Backend, logger)
 	if backendErr != nil {
 		fmt.Fprintf(os.Stderr, "failed to create firewall backend: %v\n", backendErr)
 		cancel()
 		os.Exit(1)
 	}
-	logger.Infof("firewall backend initialized: %s", backend.Name())
 
-	banManager := firewall.NewBanManager(backend, &cfg.Backend, logger)
+	banManager := firewall.NewBanManager(backends, &cfg.Backend, logger, clock.Real)
+	banManager.SetShutdown(cfg.Shutdown)
+	if err := banManager.LoadState(cfg.StateDir); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load state: %v\n", err)
+		cancel()
+		os.Exit(1)
+	}
+	logger.Info("firewall backend initialized", "backend", banManager.BackendName(), "mode", cfg.Backend.Mode)
+
+	var auditLog *audit.Log
+	if cfg.Audit.Path != "" {
+		auditLog, err = audit.Open(&cfg.Audit, logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open audit log: %v\n", err)
+			cancel()
+			os.Exit(1)
+		}
+		banManager.Subscribe(auditLog.Record)
+		logger.Info("audit log enabled", "path", cfg.Audit.Path)
+	}
+
+	var notifier *notify.Notifier
+	if len(cfg.Notify.Sinks) > 0 {
+		notifier, err = notify.New(&cfg.Notify, logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to set up notifications: %v\n", err)
+			cancel()
+			os.Exit(1)
+		}
+		banManager.Subscribe(notifier.Notify)
+		logger.Info("notifications enabled", "sinks", len(cfg.Notify.Sinks))
+	}
+
+	// Components rebuild their own state when the config is reloaded.
+	store.Subscribe(logger.Reload)
+	store.Subscribe(logPipeline.Reload)
+	store.Subscribe(engine.Reload)
+	store.Subscribe(banManager.Reload)
+
+	reloader := config.NewReloader(*configPath, store, logger)
+	watcherStop, err := reloader.Watch()
+	if err != nil {
+		logger.Error("config watcher disabled", "err", err)
+	}
+	go reloadOnHangup(ctx, hangups, reloader)
+
+	var adminServer *admin.Server
+	if !cfg.Admin.Disabled {
+		adminServer = admin.NewServer(&cfg.Admin, store, reloader, engine, banManager, logger)
+		adminServer.SetPipeline(logPipeline, events, decisions)
+		if err := adminServer.Start(); err != nil {
+			logger.Error("admin api disabled", "err", err)
+			adminServer = nil
+		}
+	}
+
+	registerStateMetrics(banManager, engine, logPipeline, events, decisions)
+	var stopMetrics func()
+	if cfg.Metrics.Listen != "" {
+		stopMetrics, err = serveMetrics(cfg.Metrics.Listen, logger)
+		if err != nil {
+			logger.Error("metrics endpoint disabled", "err", err)
+		}
+	}
 
 	var wg sync.WaitGroup
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		engine.Run(ctx, events, decisions)
-		close(decisions)
+		engine.Run(ctx, events.C(), decisions)
+		decisions.Close()
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		banManager.Run(ctx, decisions)
+		banManager.Run(ctx, decisions.C())
 	}()
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pipeline.ReportDrops(ctx, logger, clock.Real, time.Minute, events, decisions)
+	}()
+
+	if notifier != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			notifier.Run(ctx)
+		}()
+	}
+
+	if cfg.Report.Schedule != "" {
+		reporter := report.New(&cfg.Report, &cfg.Audit, logger)
+		logger.Info("reports scheduled", "schedule", cfg.Report.Schedule, "next", reporter.Next(time.Now()))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reporter.Run(ctx)
+		}()
+	}
+
 	// Block until shutdown signal.
 	<-ctx.Done()
-	logger.Info("shutting down...")
+	logger.Info("shutting down")
+
+	// Close events queue to signal pipeline shutdown.
+	events.Close()
 
-	// Close events channel to signal pipeline shutdown.
-	close(events)
+	if adminServer != nil {
+		adminServer.Close()
+	}
+	if stopMetrics != nil {
+		stopMetrics()
+	}
 
 	// Stop config watcher if running.
 	if watcherStop != nil {
@@ -105,6 +220,9 @@ func main() {
 
 	// Wait for goroutines to finish.
 	wg.Wait()
+	if auditLog != nil {
+		_ = auditLog.Close()
+	}
 	cancel()
 	logger.Info("shutdown complete")
 }
@@ -120,3 +238,22 @@ func signalContext() (context.Context, context.CancelFunc) {
 	}()
 	return ctx, cancel
 }
+
+// hangupChannel starts capturing SIGHUP so it no longer terminates the process.
+func hangupChannel() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	return ch
+}
+
+// reloadOnHangup reloads the configuration on every SIGHUP until ctx is done.
+func reloadOnHangup(ctx context.Context, hangups <-chan os.Signal, reloader *config.Reloader) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			_ = reloader.Reload("SIGHUP")
+		}
+	}
+}
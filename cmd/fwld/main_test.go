@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/logging"
+)
+
+const testConfig = `log:
+  path: /var/log/nginx/access.log
+  parser: nginx_combined
+backend:
+  type: iptables
+  iptables:
+    table: filter
+    chain: INPUT
+rules:
+  - id: errors
+    max_errors: 10
+    window: 1m
+    ban_duration: 10m
+    method: GET
+    path: /
+`
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReloadOnHangup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, testConfig)
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := config.NewStore(cfg)
+	reloader := config.NewReloader(path, store, logging.NewLoggerTo(io.Discard))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hangups := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reloadOnHangup(ctx, hangups, reloader)
+	}()
+
+	writeConfig(t, path, strings.Replace(testConfig, "max_errors: 10", "max_errors: 20", 1))
+	hangups <- syscall.SIGHUP
+	eventually(t, "the reload", func() bool { return store.Current().Rules[0].MaxErrors == 20 })
+	if s := reloader.Status(); !s.OK || s.Trigger != "SIGHUP" {
+		t.Errorf("status = %+v, want a successful SIGHUP reload", s)
+	}
+
+	writeConfig(t, path, "rules: [")
+	hangups <- syscall.SIGHUP
+	eventually(t, "the failed reload", func() bool { return !reloader.Status().OK })
+	if got := store.Current().Rules[0].MaxErrors; got != 20 {
+		t.Errorf("max_errors = %d after a broken config, want 20 kept", got)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reloadOnHangup did not return after cancel")
+	}
+}
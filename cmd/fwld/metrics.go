@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/firewall"
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/metrics"
+	"github.com/cyra/foxhole-fw/internal/pipeline"
+	"github.com/cyra/foxhole-fw/internal/queue"
+	"github.com/cyra/foxhole-fw/internal/rules"
+)
+
+// registerStateMetrics registers gauges read from the running daemon at scrape time.
+func registerStateMetrics(bans *firewall.BanManager, engine *rules.Engine, lp *pipeline.LogPipeline, queues ...queue.Stats) {
+	metrics.Default.NewGaugeFunc("foxhole_active_bans", "Bans currently in effect, by dry_run mode.",
+		[]string{"dry_run"}, func(emit func(float64, ...string)) {
+			counts := map[bool]int{false: 0, true: 0}
+			for _, b := range bans.List() {
+				if b.State == firewall.StateActive {
+					counts[b.DryRun]++
+				}
+			}
+			for _, dry := range []bool{false, true} {
+				emit(float64(counts[dry]), strconv.FormatBool(dry))
+			}
+		})
+
+	metrics.Default.NewGaugeFunc("foxhole_backend_retries_pending", "Failed firewall backend calls waiting to be retried.",
+		nil, func(emit func(float64, ...string)) {
+			emit(float64(bans.PendingRetries()))
+		})
+
+	metrics.Default.NewGaugeFunc("foxhole_tracked_ips", "IPs with recorded errors in the rules store.",
+		nil, func(emit func(float64, ...string)) {
+			emit(float64(engine.TrackedIPs()))
+		})
+
+	// The lines queue is replaced when the log pipeline restarts, so it is looked up on each scrape.
+	all := func() []queue.Stats {
+		out := queues
+		if lines := lp.Lines(); lines != nil {
+			out = append([]queue.Stats{lines}, queues...)
+		}
+		return out
+	}
+	metrics.Default.NewGaugeFunc("foxhole_queue_depth", "Items waiting in a pipeline queue.",
+		[]string{"queue"}, func(emit func(float64, ...string)) {
+			for _, q := range all() {
+				emit(float64(q.Len()), q.Name())
+			}
+		})
+	metrics.Default.NewGaugeFunc("foxhole_queue_capacity", "Capacity of a pipeline queue.",
+		[]string{"queue"}, func(emit func(float64, ...string)) {
+			for _, q := range all() {
+				emit(float64(q.Cap()), q.Name())
+			}
+		})
+	metrics.Default.NewCounterFunc("foxhole_queue_dropped_total", "Items dropped by a full pipeline queue.",
+		[]string{"queue"}, func(emit func(float64, ...string)) {
+			for _, q := range all() {
+				emit(float64(q.Dropped()), q.Name())
+			}
+		})
+}
+
+// serveMetrics serves /metrics on addr in the background. The returned
+// function shuts the server down.
+func serveMetrics(addr string, logger *logging.Logger) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Default.Handler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics endpoint stopped", "err", err)
+		}
+	}()
+	logger.Info("metrics listening", "addr", ln.Addr().String())
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}, nil
+}
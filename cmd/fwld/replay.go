@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cyra/foxhole-fw/internal/batch"
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/logging"
+)
+
+// runReplay implements "fwld replay": it evaluates historical (optionally
+// gzip/zstd compressed) log files against the configured rules and prints the
+// bans that would have been applied. The firewall backend is never called.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	cfgPath := fs.String("config", "/etc/foxhole-fw/config.yaml", "Path to configuration file")
+	parserName := fs.String("parser", "", "Override log.parser from the config")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	keepOrder := fs.Bool("keep-order", false, "Replay files in the given order instead of oldest-modified first")
+	verbose := fs.Bool("v", false, "Log rule violations to stderr while replaying")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: fwld replay [flags] FILE...\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		return 1
+	}
+	if *parserName != "" {
+		cfg.Log.Parser = *parserName
+	}
+
+	if !*keepOrder {
+		if err := batch.SortByModTime(paths); err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+			return 1
+		}
+	}
+
+	var logOut io.Writer = io.Discard
+	if *verbose {
+		logOut = os.Stderr
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	report, err := batch.Run(ctx, cfg, paths, logging.NewLoggerTo(logOut))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		err = report.WriteJSON(os.Stdout)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: write report: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/report"
+)
+
+// runReport implements "fwld report": it summarizes the audit log over a
+// recent period and prints the report, or mails it with -send.
+func runReport(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	cfgPath := fs.String("config", "/etc/foxhole-fw/config.yaml", "Path to configuration file")
+	since := fs.Duration("since", 0, "Report period ending now (default: one day, or one week for weekly reports)")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	send := fs.Bool("send", false, "Mail the report using report.smtp instead of printing it")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: fwld report [flags]\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		return 1
+	}
+	if cfg.Audit.Path == "" {
+		fmt.Fprintln(os.Stderr, "report: audit.path is not set; reports are built from the audit log")
+		return 1
+	}
+	if *send && cfg.Report.SMTP.Host == "" {
+		fmt.Fprintln(os.Stderr, "report: report.smtp is not configured")
+		return 1
+	}
+
+	r := report.New(&cfg.Report, &cfg.Audit, logging.NewLoggerTo(io.Discard))
+	until := time.Now()
+	start := r.Period(until)
+	if *since > 0 {
+		start = until.Add(-*since)
+	}
+	rep, err := r.Build(start, until)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		return 1
+	}
+
+	switch {
+	case *send:
+		err = r.Send(rep)
+	case *asJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rep)
+	default:
+		err = rep.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -5,6 +5,7 @@ go 1.24.0
 require (
 	github.com/fsnotify/fsnotify v1.9.0
 	github.com/hpcloud/tail v1.0.0
+	github.com/klauspost/compress v1.17.11
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -0,0 +1,64 @@
+// Package admin serves the daemon's local control API: JSON over HTTP on a
+// Unix domain socket, authorized by the socket's file permissions.
+package admin
+
+import (
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+)
+
+// BanRequest is the body of POST /v1/bans.
+type BanRequest struct {
+	IP       string `json:"ip"`
+	Duration string `json:"duration"` // Go duration, e.g. "1h"
+	Reason   string `json:"reason,omitempty"`
+}
+
+// ExtendRequest is the body of POST /v1/bans/{ip}/extend. Exactly one of
+// Duration (added to the current expiry) or Until must be set; Until may be
+// earlier than the current expiry to shorten the ban.
+type ExtendRequest struct {
+	Duration string    `json:"duration,omitempty"`
+	Until    time.Time `json:"until,omitempty"`
+}
+
+// ErrorResponse is returned with every non-2xx status.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// WhitelistRequest is the body of POST /v1/whitelist.
+type WhitelistRequest struct {
+	Entry string `json:"entry"` // IP or CIDR
+}
+
+// Whitelist is returned by GET /v1/whitelist.
+type Whitelist struct {
+	Configured []string `json:"configured"`
+	Runtime    []string `json:"runtime"` // added through the API; lost on restart
+}
+
+// QueueStats describes one pipeline queue.
+type QueueStats struct {
+	Name    string `json:"name"`
+	Len     int    `json:"len"`
+	Cap     int    `json:"cap"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// Stats is returned by GET /v1/stats.
+type Stats struct {
+	StartedAt      time.Time            `json:"started_at"`
+	Backend        string               `json:"backend"`
+	DryRun         bool                 `json:"dry_run"`
+	ActiveBans     int                  `json:"active_bans"`
+	BansByRule     map[string]int       `json:"bans_by_rule"`
+	PendingBans    int                  `json:"pending_bans"`    // backend calls waiting for a worker
+	PendingRetries int                  `json:"pending_retries"` // failed backend calls waiting to be retried
+	TrackedIPs     int                  `json:"tracked_ips"`
+	LogSource      string               `json:"log_source,omitempty"`
+	ParseErrors    uint64               `json:"parse_errors"`
+	Queues         []QueueStats         `json:"queues"`
+	Reload         *config.ReloadStatus `json:"reload,omitempty"`
+}
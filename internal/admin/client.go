@@ -0,0 +1,163 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/firewall"
+	"github.com/cyra/foxhole-fw/internal/rules"
+)
+
+// Client talks to the admin API of a running daemon.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a client for the admin socket at path.
+func NewClient(socket string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &Client{http: &http.Client{Transport: transport, Timeout: 30 * time.Second}}
+}
+
+// Bans lists active bans, optionally only those from rule.
+func (c *Client) Bans(ctx context.Context, rule string) ([]firewall.ActiveBan, error) {
+	path := "/v1/bans"
+	if rule != "" {
+		path += "?rule=" + url.QueryEscape(rule)
+	}
+	var out []firewall.ActiveBan
+	err := c.do(ctx, http.MethodGet, path, nil, &out)
+	return out, err
+}
+
+// GetBan returns the active ban on ip.
+func (c *Client) GetBan(ctx context.Context, ip string) (firewall.ActiveBan, error) {
+	var out firewall.ActiveBan
+	err := c.do(ctx, http.MethodGet, "/v1/bans/"+url.PathEscape(ip), nil, &out)
+	return out, err
+}
+
+// Ban bans ip for d.
+func (c *Client) Ban(ctx context.Context, ip string, d time.Duration, reason string) (firewall.ActiveBan, error) {
+	var out firewall.ActiveBan
+	req := BanRequest{IP: ip, Duration: d.String(), Reason: reason}
+	err := c.do(ctx, http.MethodPost, "/v1/bans", req, &out)
+	return out, err
+}
+
+// Unban lifts the ban on ip.
+func (c *Client) Unban(ctx context.Context, ip string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/bans/"+url.PathEscape(ip), nil, nil)
+}
+
+// Extend adds d to the expiry of the ban on ip.
+func (c *Client) Extend(ctx context.Context, ip string, d time.Duration) (firewall.ActiveBan, error) {
+	var out firewall.ActiveBan
+	req := ExtendRequest{Duration: d.String()}
+	err := c.do(ctx, http.MethodPost, "/v1/bans/"+url.PathEscape(ip)+"/extend", req, &out)
+	return out, err
+}
+
+// ExtendUntil moves the expiry of the ban on ip to until, which may be
+// earlier than the current expiry but must be in the future.
+func (c *Client) ExtendUntil(ctx context.Context, ip string, until time.Time) (firewall.ActiveBan, error) {
+	var out firewall.ActiveBan
+	req := ExtendRequest{Until: until}
+	err := c.do(ctx, http.MethodPost, "/v1/bans/"+url.PathEscape(ip)+"/extend", req, &out)
+	return out, err
+}
+
+// Counters returns up to limit per-IP counters (all if limit <= 0), closest to a ban first.
+func (c *Client) Counters(ctx context.Context, limit int) ([]rules.IPCounter, error) {
+	path := "/v1/counters"
+	if limit > 0 {
+		path += "?limit=" + strconv.Itoa(limit)
+	}
+	var out []rules.IPCounter
+	err := c.do(ctx, http.MethodGet, path, nil, &out)
+	return out, err
+}
+
+// Whitelist returns the configured and runtime whitelist entries.
+func (c *Client) Whitelist(ctx context.Context) (Whitelist, error) {
+	var out Whitelist
+	err := c.do(ctx, http.MethodGet, "/v1/whitelist", nil, &out)
+	return out, err
+}
+
+// WhitelistAdd whitelists an IP or CIDR until the daemon restarts.
+func (c *Client) WhitelistAdd(ctx context.Context, entry string) (Whitelist, error) {
+	var out Whitelist
+	err := c.do(ctx, http.MethodPost, "/v1/whitelist", WhitelistRequest{Entry: entry}, &out)
+	return out, err
+}
+
+// Stats returns daemon statistics.
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	var out Stats
+	err := c.do(ctx, http.MethodGet, "/v1/stats", nil, &out)
+	return out, err
+}
+
+// Reload asks the daemon to reload its config and returns the outcome.
+func (c *Client) Reload(ctx context.Context) (config.ReloadStatus, error) {
+	var out config.ReloadStatus
+	err := c.do(ctx, http.MethodPost, "/v1/reload", nil, &out)
+	return out, err
+}
+
+// do sends a request with an optional JSON body and decodes the JSON response into out.
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var r io.Reader = http.NoBody
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshal request: %w", err)
+		}
+		r = bytes.NewReader(data)
+	}
+	// The host is ignored; the transport always dials the socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://fwld"+path, r)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return fmt.Errorf("admin api: %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/firewall"
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/metrics"
+	"github.com/cyra/foxhole-fw/internal/pipeline"
+	"github.com/cyra/foxhole-fw/internal/queue"
+	"github.com/cyra/foxhole-fw/internal/rules"
+)
+
+// shutdownTimeout bounds how long Close waits for in-flight requests.
+const shutdownTimeout = 5 * time.Second
+
+// Server is the admin API server.
+type Server struct {
+	socket   string
+	group    string
+	store    *config.Store
+	reloader *config.Reloader
+	engine   *rules.Engine
+	bans     *firewall.BanManager
+	logger   *logging.Logger
+
+	started  time.Time
+	pipeline *pipeline.LogPipeline
+	queues   []queue.Stats
+
+	srv *http.Server
+}
+
+// NewServer creates an admin API server for the given components.
+// reloader may be nil if config reloads are not available.
+func NewServer(cfg *config.AdminConfig, store *config.Store, reloader *config.Reloader, engine *rules.Engine, bans *firewall.BanManager, logger *logging.Logger) *Server {
+	s := &Server{
+		socket:   cfg.Socket,
+		group:    cfg.Group,
+		store:    store,
+		reloader: reloader,
+		engine:   engine,
+		bans:     bans,
+		logger:   logger,
+		started:  time.Now(),
+	}
+	s.srv = &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// SetPipeline adds the log pipeline's parse errors and the given queues to /v1/stats.
+func (s *Server) SetPipeline(lp *pipeline.LogPipeline, queues ...queue.Stats) {
+	s.pipeline = lp
+	s.queues = queues
+}
+
+// Handler returns the HTTP handler serving the API.
+//
+//	GET    /v1/bans[?rule=ID]      active bans
+//	POST   /v1/bans                ban an IP (BanRequest)
+//	GET    /v1/bans/{ip}           one ban
+//	DELETE /v1/bans/{ip}           unban
+//	POST   /v1/bans/{ip}/extend    move a ban's expiry (ExtendRequest)
+//	GET    /v1/counters[?limit=N]  per-IP error counters, closest to a ban first
+//	GET    /v1/rules               loaded rules
+//	GET    /v1/whitelist           configured and runtime whitelist entries
+//	POST   /v1/whitelist           whitelist an IP or CIDR until restart (WhitelistRequest)
+//	GET    /v1/stats               daemon statistics
+//	GET    /v1/reload              outcome of the last config reload
+//	POST   /v1/reload              reload the config now
+//	GET    /metrics                Prometheus metrics
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/bans", s.listBans)
+	mux.HandleFunc("POST /v1/bans", s.ban)
+	mux.HandleFunc("GET /v1/bans/{ip}", s.getBan)
+	mux.HandleFunc("DELETE /v1/bans/{ip}", s.unban)
+	mux.HandleFunc("POST /v1/bans/{ip}/extend", s.extend)
+	mux.HandleFunc("GET /v1/counters", s.counters)
+	mux.HandleFunc("GET /v1/rules", s.rules)
+	mux.HandleFunc("GET /v1/whitelist", s.listWhitelist)
+	mux.HandleFunc("POST /v1/whitelist", s.addWhitelist)
+	mux.HandleFunc("GET /v1/stats", s.stats)
+	mux.HandleFunc("GET /v1/reload", s.reloadStatus)
+	mux.HandleFunc("POST /v1/reload", s.reload)
+	mux.Handle("GET /metrics", metrics.Default.Handler())
+	return mux
+}
+
+// Start listens on the admin socket and serves requests in the background.
+func (s *Server) Start() error {
+	ln, err := listenUnix(s.socket, s.group)
+	if err != nil {
+		return fmt.Errorf("admin socket %s: %w", s.socket, err)
+	}
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("admin api stopped", "err", err)
+		}
+	}()
+	s.logger.Info("admin api listening", "socket", s.socket)
+	return nil
+}
+
+// Close stops the server and removes the socket.
+func (s *Server) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	_ = s.srv.Shutdown(ctx)
+	_ = os.Remove(s.socket)
+}
+
+func (s *Server) listBans(w http.ResponseWriter, r *http.Request) {
+	bans := s.bans.List()
+	if rule := r.URL.Query().Get("rule"); rule != "" {
+		filtered := bans[:0]
+		for _, b := range bans {
+			if b.RuleID == rule {
+				filtered = append(filtered, b)
+			}
+		}
+		bans = filtered
+	}
+	writeJSON(w, http.StatusOK, bans)
+}
+
+func (s *Server) getBan(w http.ResponseWriter, r *http.Request) {
+	ban, ok := s.bans.Get(r.PathValue("ip"))
+	if !ok {
+		writeError(w, http.StatusNotFound, firewall.ErrNotBanned)
+		return
+	}
+	writeJSON(w, http.StatusOK, ban)
+}
+
+func (s *Server) ban(w http.ResponseWriter, r *http.Request) {
+	var req BanRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if err := firewall.ValidateIP(req.IP); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("duration must be a positive Go duration, got %q", req.Duration))
+		return
+	}
+	ban, err := s.bans.Ban(r.Context(), req.IP, d, req.Reason)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	s.logger.Info("admin api: ban", "ip", req.IP, "for", d, "reason", req.Reason)
+	writeJSON(w, http.StatusCreated, ban)
+}
+
+func (s *Server) unban(w http.ResponseWriter, r *http.Request) {
+	ip := r.PathValue("ip")
+	if err := s.bans.Unban(r.Context(), ip); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	s.logger.Info("admin api: unban", "ip", ip)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) extend(w http.ResponseWriter, r *http.Request) {
+	ip := r.PathValue("ip")
+	var req ExtendRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	until := req.Until
+	switch {
+	case req.Duration != "" && !until.IsZero():
+		writeError(w, http.StatusBadRequest, errors.New("set only one of duration and until"))
+		return
+	case req.Duration != "":
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("duration must be a positive Go duration, got %q", req.Duration))
+			return
+		}
+		cur, ok := s.bans.Get(ip)
+		if !ok {
+			writeError(w, http.StatusNotFound, firewall.ErrNotBanned)
+			return
+		}
+		until = cur.ExpiresAt.Add(d)
+	case until.IsZero():
+		writeError(w, http.StatusBadRequest, errors.New("duration or until is required"))
+		return
+	}
+
+	ban, err := s.bans.Extend(ip, until)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	s.logger.Info("admin api: extend", "ip", ip, "until", until)
+	writeJSON(w, http.StatusOK, ban)
+}
+
+func (s *Server) counters(w http.ResponseWriter, r *http.Request) {
+	counters := s.engine.Counters(time.Now())
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+		if n < len(counters) {
+			counters = counters[:n]
+		}
+	}
+	writeJSON(w, http.StatusOK, counters)
+}
+
+// ruleInfo is a rule as returned by GET /v1/rules, with durations as strings.
+type ruleInfo struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	MaxErrors   int    `json:"max_errors"`
+	Window      string `json:"window"`
+	BanDuration string `json:"ban_duration"`
+}
+
+func (s *Server) rules(w http.ResponseWriter, _ *http.Request) {
+	cfg := s.store.Current()
+	out := make([]ruleInfo, 0, len(cfg.Rules))
+	for _, r := range cfg.Rules {
+		out = append(out, ruleInfo{
+			ID:          r.ID,
+			Description: r.Description,
+			Method:      r.Method,
+			Path:        r.Path,
+			MaxErrors:   r.MaxErrors,
+			Window:      r.Window.String(),
+			BanDuration: r.BanDuration.String(),
+		})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) listWhitelist(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, Whitelist{
+		Configured: append([]string{}, s.store.Current().Backend.Whitelist...),
+		Runtime:    s.bans.RuntimeWhitelist(),
+	})
+}
+
+func (s *Server) addWhitelist(w http.ResponseWriter, r *http.Request) {
+	var req WhitelistRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if err := s.bans.AddWhitelist(req.Entry); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	s.logger.Info("admin api: whitelist add", "entry", req.Entry)
+	s.listWhitelist(w, r)
+}
+
+func (s *Server) stats(w http.ResponseWriter, _ *http.Request) {
+	bans := s.bans.List()
+	st := Stats{
+		StartedAt:      s.started,
+		Backend:        s.bans.BackendName(),
+		DryRun:         s.bans.DryRun(),
+		ActiveBans:     len(bans),
+		BansByRule:     make(map[string]int),
+		PendingBans:    s.bans.PendingJobs(),
+		PendingRetries: s.bans.PendingRetries(),
+		TrackedIPs:     s.engine.TrackedIPs(),
+		Queues:         make([]QueueStats, 0, len(s.queues)),
+	}
+	for _, b := range bans {
+		st.BansByRule[b.RuleID]++
+	}
+	if s.pipeline != nil {
+		if t := s.pipeline.ParseErrors(); t != nil {
+			st.LogSource = t.Source()
+			st.ParseErrors = t.Errors()
+		}
+	}
+	for _, q := range s.queues {
+		st.Queues = append(st.Queues, QueueStats{Name: q.Name(), Len: q.Len(), Cap: q.Cap(), Dropped: q.Dropped()})
+	}
+	if s.reloader != nil {
+		status := s.reloader.Status()
+		st.Reload = &status
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+func (s *Server) reloadStatus(w http.ResponseWriter, _ *http.Request) {
+	if s.reloader == nil {
+		writeError(w, http.StatusNotFound, errors.New("config reloads are not available"))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.reloader.Status())
+}
+
+func (s *Server) reload(w http.ResponseWriter, _ *http.Request) {
+	if s.reloader == nil {
+		writeError(w, http.StatusNotFound, errors.New("config reloads are not available"))
+		return
+	}
+	// The outcome, including any error, is part of the status.
+	_ = s.reloader.Reload("admin api")
+	writeJSON(w, http.StatusOK, s.reloader.Status())
+}
+
+// statusFor maps BanManager errors to HTTP status codes.
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, firewall.ErrNotBanned):
+		return http.StatusNotFound
+	case errors.Is(err, firewall.ErrWhitelisted), errors.Is(err, firewall.ErrAlreadyBanned):
+		return http.StatusConflict
+	case errors.Is(err, firewall.ErrInvalidEntry), errors.Is(err, firewall.ErrPastExpiry):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ErrorResponse{Error: err.Error()})
+}
@@ -0,0 +1,198 @@
+package admin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/clock"
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/firewall"
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/rules"
+)
+
+// fakeBackend records the IPs it currently blocks.
+type fakeBackend struct {
+	mu      sync.Mutex
+	blocked map[string]string // ip -> reason
+}
+
+func (b *fakeBackend) Ban(_ context.Context, ip string, _ time.Duration, reason, _ string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blocked[ip] = reason
+	return nil
+}
+
+func (b *fakeBackend) Unban(_ context.Context, ip string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.blocked, ip)
+	return nil
+}
+
+func (b *fakeBackend) Name() string { return "fake" }
+
+func (b *fakeBackend) isBlocked(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.blocked[ip]
+	return ok
+}
+
+// startServer serves the admin API on a socket in a temporary directory,
+// backed by a running BanManager with a fake backend. Only the ban
+// endpoints are usable: there is no config store or rule engine.
+func startServer(t *testing.T) (*Client, *fakeBackend) {
+	t.Helper()
+	logger := logging.NewLoggerTo(io.Discard)
+	backend := &fakeBackend{blocked: make(map[string]string)}
+	bans := firewall.NewBanManager([]firewall.Backend{backend}, &config.BackendConfig{
+		Workers:   1,
+		QueueSize: 10,
+		Whitelist: []string{"192.0.2.0/28"},
+	}, logger, clock.Real)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bans.Run(ctx, make(chan *rules.Decision))
+	}()
+
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	srv := NewServer(&config.AdminConfig{Socket: socket}, nil, nil, nil, bans, logger)
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+		<-done
+	})
+	return NewClient(socket), backend
+}
+
+// status sends a request with an optional JSON body and returns the status code.
+func status(t *testing.T, c *Client, method, path, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://fwld"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServerBanLifecycle(t *testing.T) {
+	c, backend := startServer(t)
+	ctx := context.Background()
+	const ip = "198.51.100.7"
+
+	ban, err := c.Ban(ctx, ip, time.Hour, "scanner")
+	if err != nil {
+		t.Fatalf("Ban: %v", err)
+	}
+	if ban.IP != ip || ban.Reason != "scanner" || ban.RuleID != firewall.ManualRuleID {
+		t.Fatalf("Ban = %+v", ban)
+	}
+	eventually(t, "backend ban", func() bool { return backend.isBlocked(ip) })
+
+	got, err := c.GetBan(ctx, ip)
+	if err != nil {
+		t.Fatalf("GetBan: %v", err)
+	}
+	if !got.ExpiresAt.Equal(ban.ExpiresAt) {
+		t.Errorf("GetBan expires %v, want %v", got.ExpiresAt, ban.ExpiresAt)
+	}
+	bans, err := c.Bans(ctx, firewall.ManualRuleID)
+	if err != nil || len(bans) != 1 || bans[0].IP != ip {
+		t.Errorf("Bans = %+v, %v; want only %s", bans, err, ip)
+	}
+
+	extended, err := c.Extend(ctx, ip, 30*time.Minute)
+	if err != nil {
+		t.Fatalf("Extend: %v", err)
+	}
+	if want := ban.ExpiresAt.Add(30 * time.Minute); !extended.ExpiresAt.Equal(want) {
+		t.Errorf("Extend expires %v, want %v", extended.ExpiresAt, want)
+	}
+
+	shortened, err := c.ExtendUntil(ctx, ip, ban.ExpiresAt.Add(-30*time.Minute))
+	if err != nil {
+		t.Fatalf("ExtendUntil: %v", err)
+	}
+	if want := ban.ExpiresAt.Add(-30 * time.Minute); !shortened.ExpiresAt.Equal(want) {
+		t.Errorf("ExtendUntil expires %v, want %v", shortened.ExpiresAt, want)
+	}
+	if _, err := c.ExtendUntil(ctx, ip, time.Now().Add(-time.Minute)); err == nil {
+		t.Error("ExtendUntil to a past time succeeded")
+	}
+
+	if err := c.Unban(ctx, ip); err != nil {
+		t.Fatalf("Unban: %v", err)
+	}
+	if backend.isBlocked(ip) {
+		t.Error("backend still blocks the ip after Unban")
+	}
+	if _, err := c.GetBan(ctx, ip); err == nil || err.Error() != firewall.ErrNotBanned.Error() {
+		t.Errorf("GetBan after Unban: err %v, want %q", err, firewall.ErrNotBanned)
+	}
+}
+
+func TestServerErrorCodes(t *testing.T) {
+	c, backend := startServer(t)
+	ctx := context.Background()
+
+	if _, err := c.Ban(ctx, "192.0.2.1", time.Hour, ""); err == nil || !strings.Contains(err.Error(), firewall.ErrWhitelisted.Error()) {
+		t.Errorf("Ban of a whitelisted ip: err %v, want %q", err, firewall.ErrWhitelisted)
+	}
+	if backend.isBlocked("192.0.2.1") {
+		t.Error("whitelisted ip reached the backend")
+	}
+	if err := c.Unban(ctx, "198.51.100.8"); err == nil || err.Error() != firewall.ErrNotBanned.Error() {
+		t.Errorf("Unban of an unbanned ip: err %v, want %q", err, firewall.ErrNotBanned)
+	}
+
+	tests := []struct {
+		name         string
+		method, path string
+		body         string
+		want         int
+	}{
+		{"ban whitelisted", http.MethodPost, "/v1/bans", `{"ip":"192.0.2.1","duration":"1h"}`, http.StatusConflict},
+		{"get unbanned", http.MethodGet, "/v1/bans/198.51.100.8", "", http.StatusNotFound},
+		{"unban unbanned", http.MethodDelete, "/v1/bans/198.51.100.8", "", http.StatusNotFound},
+		{"extend unbanned", http.MethodPost, "/v1/bans/198.51.100.8/extend", `{"duration":"1h"}`, http.StatusNotFound},
+		{"extend until unbanned", http.MethodPost, "/v1/bans/198.51.100.8/extend", `{"until":"2030-01-01T00:00:00Z"}`, http.StatusNotFound},
+		{"invalid ip", http.MethodPost, "/v1/bans", `{"ip":"not-an-ip","duration":"1h"}`, http.StatusBadRequest},
+		{"invalid duration", http.MethodPost, "/v1/bans", `{"ip":"198.51.100.8","duration":"soon"}`, http.StatusBadRequest},
+		{"unknown field", http.MethodPost, "/v1/bans", `{"ip":"198.51.100.8","duration":"1h","ttl":3}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if got := status(t, c, tt.method, tt.path, tt.body); got != tt.want {
+			t.Errorf("%s: %s %s = %d, want %d", tt.name, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Package audit writes an append-only JSONL trail of ban decisions, separate
+// from the operational log.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/firewall"
+	"github.com/cyra/foxhole-fw/internal/logging"
+)
+
+// Record is one line of the audit log.
+type Record struct {
+	Time      time.Time  `json:"time"`
+	Action    string     `json:"action"` // ban, unban, skip or extend
+	IP        string     `json:"ip"`
+	RuleID    string     `json:"rule,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Backend   string     `json:"backend,omitempty"`
+	DryRun    bool       `json:"dry_run"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Count     int        `json:"count,omitempty"`
+	Source    string     `json:"source"` // engine, manual or system
+	Path      string     `json:"path,omitempty"`
+	Lines     []string   `json:"lines,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// NewRecord converts a BanEvent, keeping at most maxLines raw lines (the most recent).
+func NewRecord(ev firewall.BanEvent, maxLines int) Record {
+	r := Record{
+		Time:    ev.Time.UTC(),
+		Action:  string(ev.Action),
+		IP:      ev.IP,
+		RuleID:  ev.RuleID,
+		Reason:  ev.Reason,
+		Backend: ev.Backend,
+		DryRun:  ev.DryRun,
+		Count:   ev.Count,
+		Source:  ev.Source,
+		Path:    ev.Path,
+		Lines:   ev.Lines,
+	}
+	if !ev.ExpiresAt.IsZero() {
+		t := ev.ExpiresAt.UTC()
+		r.ExpiresAt = &t
+	}
+	if maxLines > 0 && len(r.Lines) > maxLines {
+		r.Lines = r.Lines[len(r.Lines)-maxLines:]
+	}
+	if ev.Err != nil {
+		r.Error = ev.Err.Error()
+	}
+	return r
+}
+
+// Log appends records to a file, rotating it to path.1 ... path.N once it
+// reaches the configured size.
+type Log struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	maxLines   int
+	logger     *logging.Logger
+
+	mu     sync.Mutex
+	f      *os.File // nil after Close or a failed reopen
+	size   int64
+	closed bool
+}
+
+// Open opens or creates the audit log at cfg.Path for appending.
+func Open(cfg *config.AuditConfig, logger *logging.Logger) (*Log, error) {
+	l := &Log{
+		path:       cfg.Path,
+		maxSize:    cfg.MaxSize,
+		maxBackups: cfg.MaxBackups,
+		maxLines:   cfg.MaxLines,
+		logger:     logger,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("stat audit log: %w", err)
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// Write appends r as one JSON line.
+func (l *Log) Write(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal audit record: %w", err)
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return fmt.Errorf("audit log %s is closed", l.path)
+	}
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			if l.f == nil {
+				return err
+			}
+			// Keep appending to the current file; the next write retries.
+			l.logger.Error("audit log rotation failed", "path", l.path, "err", err)
+		}
+	}
+	n, err := l.f.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write audit log: %w", err)
+	}
+	return nil
+}
+
+// Record writes ev to the log, logging failures. It is meant to be
+// registered with firewall.BanManager.Subscribe.
+func (l *Log) Record(ev firewall.BanEvent) {
+	if err := l.Write(NewRecord(ev, l.maxLines)); err != nil {
+		l.logger.Error("audit log write failed", "ip", ev.IP, "action", string(ev.Action), "err", err)
+	}
+}
+
+// rotate shifts path.N-1 to path.N, ..., path to path.1 and starts a new file.
+// If the rename fails, path is reopened so writes go on; l.f is nil only if
+// that reopen failed too.
+// Caller must hold l.mu.
+func (l *Log) rotate() error {
+	err := l.f.Close()
+	l.f = nil
+	if err != nil {
+		err = fmt.Errorf("close audit log: %w", err)
+	} else {
+		for i := l.maxBackups - 1; i >= 1; i-- {
+			_ = os.Rename(backupName(l.path, i), backupName(l.path, i+1))
+		}
+		if err = os.Rename(l.path, backupName(l.path, 1)); err != nil {
+			err = fmt.Errorf("rotate audit log: %w", err)
+		}
+	}
+	return errors.Join(err, l.open())
+}
+
+func backupName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
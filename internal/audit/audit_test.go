@@ -0,0 +1,141 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/firewall"
+	"github.com/cyra/foxhole-fw/internal/logging"
+)
+
+// openTestLog opens a log that rotates before every record but the first in
+// a file, so each file holds exactly one record.
+func openTestLog(t *testing.T, maxBackups int) (*Log, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(&config.AuditConfig{Path: path, MaxSize: 1, MaxBackups: maxBackups}, logging.NewLoggerTo(io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	return l, path
+}
+
+func writeIP(t *testing.T, l *Log, ip string) {
+	t.Helper()
+	if err := l.Write(Record{Time: time.Unix(0, 0), Action: "ban", IP: ip, Source: "engine"}); err != nil {
+		t.Fatalf("write %s: %v", ip, err)
+	}
+}
+
+// fileIPs returns the IPs recorded in name, in order.
+func fileIPs(t *testing.T, name string) []string {
+	t.Helper()
+	var ips []string
+	if _, err := Read([]string{name}, func(r Record) { ips = append(ips, r.IP) }); err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return ips
+}
+
+func TestLogRotationOrder(t *testing.T) {
+	l, path := openTestLog(t, 2)
+	for i := 1; i <= 4; i++ {
+		writeIP(t, l, fmt.Sprintf("192.0.2.%d", i))
+	}
+
+	want := map[string][]string{
+		path:        {"192.0.2.4"},
+		path + ".1": {"192.0.2.3"},
+		path + ".2": {"192.0.2.2"},
+	}
+	for name, ips := range want {
+		if got := fileIPs(t, name); !slices.Equal(got, ips) {
+			t.Errorf("%s = %v, want %v", filepath.Base(name), got, ips)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s.3 exists beyond max_backups (err %v)", filepath.Base(path), err)
+	}
+	if got, want := Files(path, 2), []string{path + ".2", path + ".1", path}; !slices.Equal(got, want) {
+		t.Errorf("Files = %v, want %v", got, want)
+	}
+}
+
+func TestLogRecoversFromFailedRotation(t *testing.T) {
+	l, path := openTestLog(t, 1)
+	writeIP(t, l, "192.0.2.1")
+
+	// A non-empty directory in the way of path.1 makes the rename fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeIP(t, l, "192.0.2.2")
+	if got, want := fileIPs(t, path), []string{"192.0.2.1", "192.0.2.2"}; !slices.Equal(got, want) {
+		t.Fatalf("after failed rotation log = %v, want %v", got, want)
+	}
+
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeIP(t, l, "192.0.2.3")
+	if got, want := fileIPs(t, path+".1"), []string{"192.0.2.1", "192.0.2.2"}; !slices.Equal(got, want) {
+		t.Errorf("backup = %v, want %v", got, want)
+	}
+	if got, want := fileIPs(t, path), []string{"192.0.2.3"}; !slices.Equal(got, want) {
+		t.Errorf("log = %v, want %v", got, want)
+	}
+}
+
+func TestLogWriteAfterClose(t *testing.T) {
+	l, _ := openTestLog(t, 1)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(Record{IP: "192.0.2.1"}); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+}
+
+func TestNewRecordMaxLines(t *testing.T) {
+	ev := firewall.BanEvent{
+		Time:   time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600)),
+		Action: firewall.ActionBan,
+		IP:     "192.0.2.1",
+		Lines:  []string{"l1", "l2", "l3", "l4"},
+		Err:    errors.New("backend down"),
+	}
+	tests := []struct {
+		maxLines int
+		want     []string
+	}{
+		{0, []string{"l1", "l2", "l3", "l4"}},
+		{2, []string{"l3", "l4"}},
+		{4, []string{"l1", "l2", "l3", "l4"}},
+		{10, []string{"l1", "l2", "l3", "l4"}},
+	}
+	for _, tt := range tests {
+		r := NewRecord(ev, tt.maxLines)
+		if !slices.Equal(r.Lines, tt.want) {
+			t.Errorf("max_lines %d: lines = %v, want %v", tt.maxLines, r.Lines, tt.want)
+		}
+	}
+
+	r := NewRecord(ev, 2)
+	if r.Time.Location() != time.UTC || !r.Time.Equal(ev.Time) {
+		t.Errorf("time = %v, want %v in UTC", r.Time, ev.Time)
+	}
+	if r.ExpiresAt != nil {
+		t.Errorf("expires_at = %v, want unset for a zero expiry", r.ExpiresAt)
+	}
+	if r.Error != "backend down" {
+		t.Errorf("error = %q", r.Error)
+	}
+}
@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// maxRecordSize bounds one audit line when reading; records with many long
+// evidence lines can exceed bufio's default.
+const maxRecordSize = 4 << 20
+
+// Files returns the audit log at path and its rotated backups that exist,
+// oldest first.
+func Files(path string, maxBackups int) []string {
+	var files []string
+	for i := maxBackups; i >= 1; i-- {
+		if _, err := os.Stat(backupName(path, i)); err == nil {
+			files = append(files, backupName(path, i))
+		}
+	}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files
+}
+
+// Read calls fn for every record in files, in order, and returns the number
+// of lines skipped because they were not valid records.
+func Read(files []string, fn func(Record)) (skipped int, err error) {
+	for _, name := range files {
+		n, err := readFile(name, fn)
+		skipped += n
+		if err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, nil
+}
+
+func readFile(name string, fn func(Record)) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, fmt.Errorf("open audit log: %w", err)
+	}
+	defer f.Close()
+
+	skipped := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), maxRecordSize)
+	for sc.Scan() {
+		var r Record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			skipped++
+			continue
+		}
+		fn(r)
+	}
+	if err := sc.Err(); err != nil {
+		return skipped, fmt.Errorf("read %s: %w", name, err)
+	}
+	return skipped, nil
+}
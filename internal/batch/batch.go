@@ -0,0 +1,201 @@
+// Package batch replays historical log files through the rule engine and
+// reports the bans that would have been issued, without touching the firewall.
+package batch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/firewall"
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/parser"
+	"github.com/cyra/foxhole-fw/internal/rules"
+)
+
+// maxLineSize bounds a single log line; longer lines are reported as read errors.
+const maxLineSize = 1 << 20
+
+// FileStats summarizes a single replayed file.
+type FileStats struct {
+	Path        string `json:"path"`
+	Lines       int    `json:"lines"`
+	ParseErrors int    `json:"parse_errors"`
+}
+
+// Ban is a ban that would have been applied during the replay.
+type Ban struct {
+	IP     string    `json:"ip"`
+	RuleID string    `json:"rule_id"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+	Until  time.Time `json:"until"`
+	// Hits counts decisions for this IP while the ban was active.
+	Hits int    `json:"hits"`
+	Line string `json:"line"`
+}
+
+// Report is the outcome of a replay.
+type Report struct {
+	Files       []FileStats `json:"files"`
+	Lines       int         `json:"lines"`
+	Events      int         `json:"events"`
+	ParseErrors int         `json:"parse_errors"`
+	Violations  int         `json:"violations"`
+	Whitelisted int         `json:"whitelisted"`
+	Start       time.Time   `json:"start"`
+	End         time.Time   `json:"end"`
+	Bans        []Ban       `json:"bans"`
+}
+
+// Run parses every file in order, evaluates the events against cfg.Rules using
+// the log timestamps as the clock, and returns the resulting report.
+// Whitelisting and duplicate suppression follow the same rules as BanManager.
+func Run(ctx context.Context, cfg *config.Config, paths []string, logger *logging.Logger) (*Report, error) {
+	p, err := parser.New(cfg.Log.Parser)
+	if err != nil {
+		return nil, fmt.Errorf("parser %q: %w", cfg.Log.Parser, err)
+	}
+
+	engine := rules.NewReplayEngine(config.NewStore(cfg), logger)
+	defer engine.Close()
+
+	r := &replay{
+		report:    &Report{},
+		parser:    p,
+		engine:    engine,
+		whitelist: firewall.NewWhitelist(cfg.Backend.Whitelist),
+		active:    make(map[string]int),
+	}
+
+	for _, path := range paths {
+		if err := r.replayFile(ctx, path); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	sort.SliceStable(r.report.Bans, func(i, j int) bool {
+		return r.report.Bans[i].At.Before(r.report.Bans[j].At)
+	})
+	return r.report, nil
+}
+
+type replay struct {
+	report    *Report
+	parser    parser.Parser
+	engine    *rules.Engine
+	whitelist *firewall.Whitelist
+	active    map[string]int // ip -> index into report.Bans of the latest ban
+}
+
+func (r *replay) replayFile(ctx context.Context, path string) error {
+	rc, err := Open(path)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	stats := FileStats{Path: path}
+	sc := bufio.NewScanner(rc)
+	sc.Buffer(make([]byte, 64*1024), maxLineSize)
+	for sc.Scan() {
+		if stats.Lines%1024 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		stats.Lines++
+
+		ev, err := r.parser.Parse(sc.Text())
+		if err != nil {
+			stats.ParseErrors++
+			continue
+		}
+		r.observe(ev)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	r.report.Files = append(r.report.Files, stats)
+	r.report.Lines += stats.Lines
+	r.report.ParseErrors += stats.ParseErrors
+	return nil
+}
+
+func (r *replay) observe(ev *parser.Event) {
+	r.report.Events++
+	if !ev.Timestamp.IsZero() {
+		if r.report.Start.IsZero() || ev.Timestamp.Before(r.report.Start) {
+			r.report.Start = ev.Timestamp
+		}
+		if ev.Timestamp.After(r.report.End) {
+			r.report.End = ev.Timestamp
+		}
+	}
+
+	for _, d := range r.engine.Evaluate(ev) {
+		r.report.Violations++
+		if r.whitelist.Contains(d.IP) {
+			r.report.Whitelisted++
+			continue
+		}
+		if i, ok := r.active[d.IP]; ok && r.report.Bans[i].Until.After(d.Timestamp) {
+			r.report.Bans[i].Hits++
+			continue
+		}
+		r.active[d.IP] = len(r.report.Bans)
+		r.report.Bans = append(r.report.Bans, Ban{
+			IP:     d.IP,
+			RuleID: d.RuleID,
+			Reason: d.Reason,
+			At:     d.Timestamp,
+			Until:  d.Timestamp.Add(d.BanFor),
+			Hits:   1,
+			Line:   d.Event.Raw,
+		})
+	}
+}
+
+// UniqueIPs returns the number of distinct IPs that would have been banned.
+func (rep *Report) UniqueIPs() int {
+	seen := make(map[string]struct{}, len(rep.Bans))
+	for _, b := range rep.Bans {
+		seen[b.IP] = struct{}{}
+	}
+	return len(seen)
+}
+
+// WriteJSON writes the report as indented JSON.
+func (rep *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
+
+// WriteText writes a human-readable summary followed by one row per ban.
+func (rep *Report) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "replayed %d file(s): %d lines, %d events, %d parse errors\n",
+		len(rep.Files), rep.Lines, rep.Events, rep.ParseErrors)
+	if !rep.Start.IsZero() {
+		fmt.Fprintf(w, "log time: %s .. %s\n", rep.Start.Format(time.RFC3339), rep.End.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "would ban %d IP(s) with %d ban(s) from %d violations (%d whitelisted)\n",
+		rep.UniqueIPs(), len(rep.Bans), rep.Violations, rep.Whitelisted)
+	if len(rep.Bans) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "AT\tIP\tRULE\tUNTIL\tHITS")
+	for _, b := range rep.Bans {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n",
+			b.At.Format(time.RFC3339), b.IP, b.RuleID, b.Until.Format(time.RFC3339), b.Hits)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,109 @@
+package batch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/logging"
+)
+
+var epoch = time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+// loginFailure is an nginx line for a failed login from ip, offset after epoch.
+func loginFailure(ip string, offset time.Duration) string {
+	return fmt.Sprintf(`%s - - [%s] "POST /login HTTP/1.1" 401 12 "-" "curl/8.0"`,
+		ip, epoch.Add(offset).Format("02/Jan/2006:15:04:05 -0700"))
+}
+
+func testConfig() *config.Config {
+	return &config.Config{
+		Log:      config.LogConfig{Parser: "nginx_combined"},
+		Pipeline: config.PipelineConfig{EngineShards: 1},
+		Backend:  config.BackendConfig{Whitelist: []string{"192.0.2.0/24"}},
+		Rules: []config.Rule{{ID: "login", Method: "POST", Path: "/login",
+			MaxErrors: 3, Window: time.Minute, BanDuration: 10 * time.Minute}},
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	first := writeLog(t, dir, "access.log.1.gz", strings.Join([]string{
+		// Three failures within the window: banned at +20s.
+		loginFailure("198.51.100.1", 0),
+		loginFailure("198.51.100.1", 10*time.Second),
+		loginFailure("198.51.100.1", 20*time.Second),
+		// While the ban is active, further violations only add hits.
+		loginFailure("198.51.100.1", 30*time.Second),
+		// Spread over more than the window of log time: never banned, however
+		// fast the replay runs.
+		loginFailure("198.51.100.2", 0),
+		loginFailure("198.51.100.2", 2*time.Minute),
+		loginFailure("198.51.100.2", 4*time.Minute),
+		// Whitelisted.
+		loginFailure("192.0.2.7", 0),
+		loginFailure("192.0.2.7", time.Second),
+		loginFailure("192.0.2.7", 2*time.Second),
+		"garbage",
+	}, "\n")+"\n")
+	second := writeLog(t, dir, "access.log", strings.Join([]string{
+		// The first ban has expired: a new one is reported.
+		loginFailure("198.51.100.1", 20*time.Minute),
+		loginFailure("198.51.100.1", 20*time.Minute+time.Second),
+		loginFailure("198.51.100.1", 20*time.Minute+2*time.Second),
+	}, "\n")+"\n")
+
+	rep, err := Run(context.Background(), testConfig(), []string{first, second}, logging.NewLoggerTo(io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rep.Lines != 14 || rep.Events != 13 || rep.ParseErrors != 1 || len(rep.Files) != 2 {
+		t.Errorf("lines %d, events %d, parse errors %d, files %d; want 14, 13, 1, 2",
+			rep.Lines, rep.Events, rep.ParseErrors, len(rep.Files))
+	}
+	if !rep.Start.Equal(epoch) || !rep.End.Equal(epoch.Add(20*time.Minute+2*time.Second)) {
+		t.Errorf("log time %v .. %v", rep.Start, rep.End)
+	}
+	if rep.Violations != 4 || rep.Whitelisted != 1 {
+		t.Errorf("violations %d, whitelisted %d; want 4, 1", rep.Violations, rep.Whitelisted)
+	}
+
+	type ban struct {
+		ip   string
+		at   time.Duration
+		hits int
+	}
+	want := []ban{
+		{"198.51.100.1", 20 * time.Second, 2},
+		{"198.51.100.1", 20*time.Minute + 2*time.Second, 1},
+	}
+	if len(rep.Bans) != len(want) {
+		t.Fatalf("bans = %+v, want %d", rep.Bans, len(want))
+	}
+	for i, w := range want {
+		b := rep.Bans[i]
+		if b.IP != w.ip || !b.At.Equal(epoch.Add(w.at)) || b.Hits != w.hits || b.RuleID != "login" {
+			t.Errorf("ban %d = %s %s at %v hits %d, want %s at +%v hits %d", i, b.IP, b.RuleID, b.At, b.Hits, w.ip, w.at, w.hits)
+		}
+		if !b.Until.Equal(b.At.Add(10 * time.Minute)) {
+			t.Errorf("ban %d until %v, want 10m after %v", i, b.Until, b.At)
+		}
+	}
+	if rep.UniqueIPs() != 1 {
+		t.Errorf("unique IPs = %d, want 1", rep.UniqueIPs())
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	path := writeLog(t, t.TempDir(), "access.log", loginFailure("198.51.100.1", 0)+"\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Run(ctx, testConfig(), []string{path}, logging.NewLoggerTo(io.Discard)); err == nil {
+		t.Error("Run with a canceled context succeeded")
+	}
+}
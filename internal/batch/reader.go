@@ -0,0 +1,100 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Open opens a log file for reading, transparently decompressing gzip and
+// zstd content. The format is detected from the file header, not the name.
+func Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(f)
+	head, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		return &stackedReader{Reader: zr, closers: []io.Closer{zr, f}}, nil
+	case bytes.HasPrefix(head, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+		return &stackedReader{Reader: zr, closers: []io.Closer{zstdCloser{zr}, f}}, nil
+	default:
+		return &stackedReader{Reader: br, closers: []io.Closer{f}}, nil
+	}
+}
+
+// SortByModTime orders paths oldest first by modification time, which matches
+// the write order of logrotate-style rotated files (access.log.3.gz, ..., access.log).
+// Ties are broken by name.
+func SortByModTime(paths []string) error {
+	mtimes := make(map[string]int64, len(paths))
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		mtimes[p] = info.ModTime().UnixNano()
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		if mtimes[paths[i]] != mtimes[paths[j]] {
+			return mtimes[paths[i]] < mtimes[paths[j]]
+		}
+		return paths[i] < paths[j]
+	})
+	return nil
+}
+
+// stackedReader closes a decompressor and its underlying file in order.
+type stackedReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *stackedReader) Close() error {
+	var first error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// zstdCloser adapts zstd.Decoder, whose Close has no return value.
+type zstdCloser struct {
+	d *zstd.Decoder
+}
+
+func (c zstdCloser) Close() error {
+	c.d.Close()
+	return nil
+}
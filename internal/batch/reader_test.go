@@ -0,0 +1,139 @@
+package batch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// writeLog writes lines to name in dir, compressed as the name suggests by
+// its last extension, and returns its path.
+func writeLog(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	switch filepath.Ext(name) {
+	case ".gz":
+		zw := gzip.NewWriter(&buf)
+		if _, err := io.WriteString(zw, content); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case ".zst":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(zw, content); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		buf.WriteString(content)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpen(t *testing.T) {
+	const content = "first line\nsecond line\n"
+	dir := t.TempDir()
+	tests := []struct {
+		name, file string
+	}{
+		{"plain", "access.log"},
+		{"gzip", "access.log.1.gz"},
+		{"zstd", "access.log.2.zst"},
+		{"short plain", "tiny.log"},
+		{"empty", "empty.log"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := content
+			switch tt.name {
+			case "short plain":
+				want = "ab"
+			case "empty":
+				want = ""
+			}
+			path := writeLog(t, dir, tt.file, want)
+			// Detection goes by content: a compressed file keeps working when renamed.
+			renamed := filepath.Join(dir, tt.name+".renamed")
+			if err := os.Rename(path, renamed); err != nil {
+				t.Fatal(err)
+			}
+
+			rc, err := Open(renamed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("read %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestOpenCorruptGzip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.gz")
+	if err := os.WriteFile(path, []byte{0x1f, 0x8b, 0x00}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if rc, err := Open(path); err == nil {
+		rc.Close()
+		t.Error("Open of a truncated gzip header succeeded")
+	}
+}
+
+func TestSortByModTime(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	mtimes := map[string]time.Time{
+		"access.log":      base.Add(3 * time.Hour),
+		"access.log.1":    base.Add(2 * time.Hour),
+		"access.log.2.gz": base.Add(time.Hour),
+		"b.log":           base, // ties with a.log: broken by name
+		"a.log":           base,
+	}
+	var paths []string
+	for name, mtime := range mtimes {
+		path := writeLog(t, dir, name, "")
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	if err := SortByModTime(paths); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range paths {
+		got = append(got, filepath.Base(p))
+	}
+	if want := []string{"a.log", "b.log", "access.log.2.gz", "access.log.1", "access.log"}; !slices.Equal(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+
+	if err := SortByModTime([]string{filepath.Join(dir, "missing.log")}); err == nil {
+		t.Error("SortByModTime of a missing file succeeded")
+	}
+}
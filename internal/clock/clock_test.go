@@ -0,0 +1,138 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+
+func fired(c <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-c:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeTimer(t *testing.T) {
+	f := NewFake(epoch)
+	timer := f.NewTimer(time.Minute)
+	if f.Timers() != 1 {
+		t.Fatalf("Timers() = %d, want 1", f.Timers())
+	}
+
+	f.Advance(59 * time.Second)
+	if _, ok := fired(timer.C()); ok {
+		t.Fatal("timer fired early")
+	}
+	f.Advance(time.Second)
+	at, ok := fired(timer.C())
+	if !ok || !at.Equal(epoch.Add(time.Minute)) {
+		t.Fatalf("fired = %v, %v; want %v", at, ok, epoch.Add(time.Minute))
+	}
+	if f.Timers() != 0 {
+		t.Fatalf("Timers() = %d after firing, want 0", f.Timers())
+	}
+	if timer.Stop() {
+		t.Fatal("Stop() = true for a fired timer")
+	}
+}
+
+func TestFakeTimerStop(t *testing.T) {
+	f := NewFake(epoch)
+	timer := f.NewTimer(time.Minute)
+	if !timer.Stop() {
+		t.Fatal("Stop() = false for a pending timer")
+	}
+	f.Advance(time.Hour)
+	if _, ok := fired(timer.C()); ok {
+		t.Fatal("stopped timer fired")
+	}
+}
+
+func TestFakeTimerNonPositive(t *testing.T) {
+	f := NewFake(epoch)
+	for _, d := range []time.Duration{0, -time.Second} {
+		if _, ok := fired(f.NewTimer(d).C()); !ok {
+			t.Fatalf("NewTimer(%v) did not fire right away", d)
+		}
+	}
+	if f.Timers() != 0 {
+		t.Fatalf("Timers() = %d, want 0", f.Timers())
+	}
+}
+
+func TestFakeSet(t *testing.T) {
+	f := NewFake(epoch)
+	timer := f.NewTimer(time.Hour)
+	later := epoch.Add(2 * time.Hour)
+	f.Set(later)
+	if !f.Now().Equal(later) {
+		t.Fatalf("Now() = %v, want %v", f.Now(), later)
+	}
+	if at, ok := fired(timer.C()); !ok || !at.Equal(later) {
+		t.Fatalf("fired = %v, %v; want %v", at, ok, later)
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(epoch)
+	ticker := f.NewTicker(time.Minute)
+
+	f.Advance(30 * time.Second)
+	if _, ok := fired(ticker.C()); ok {
+		t.Fatal("ticker fired early")
+	}
+	for i := 1; i <= 3; i++ {
+		f.Advance(time.Minute)
+		if _, ok := fired(ticker.C()); !ok {
+			t.Fatalf("tick %d missing", i)
+		}
+	}
+
+	// Several periods at once make one tick, and the next is a period on.
+	f.Advance(10 * time.Minute)
+	if _, ok := fired(ticker.C()); !ok {
+		t.Fatal("tick missing after a long advance")
+	}
+	if _, ok := fired(ticker.C()); ok {
+		t.Fatal("more than one tick after a long advance")
+	}
+	f.Advance(time.Minute)
+	if _, ok := fired(ticker.C()); !ok {
+		t.Fatal("tick missing a period after a long advance")
+	}
+
+	ticker.Stop()
+	if f.Timers() != 0 {
+		t.Fatalf("Timers() = %d after Stop, want 0", f.Timers())
+	}
+	f.Advance(time.Hour)
+	if _, ok := fired(ticker.C()); ok {
+		t.Fatal("stopped ticker fired")
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(epoch)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.BlockUntil(2)
+	}()
+
+	f.NewTimer(time.Minute)
+	select {
+	case <-done:
+		t.Fatal("BlockUntil(2) returned with one timer")
+	case <-time.After(20 * time.Millisecond):
+	}
+	f.NewTicker(time.Minute)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("BlockUntil(2) did not return")
+	}
+}
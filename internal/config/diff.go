@@ -0,0 +1,159 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Changes summarizes what differs between two configurations.
+type Changes struct {
+	LogSource    bool // log path, parser or parse settings; the log pipeline restarts
+	RulesAdded   []string
+	RulesRemoved []string
+	RulesChanged []string
+	Backend      bool // backend type or settings; bans migrate to a new backend
+	Whitelist    bool
+	DryRun       bool
+	Logging      bool // logging.level
+	Evidence     bool // pipeline.evidence_lines
+	Shutdown     bool // shutdown policy or drain timeout
+
+	// RestartRequired lists changed settings that only take effect on restart.
+	RestartRequired []string
+}
+
+// Diff compares two configurations.
+func Diff(old, cur *Config) Changes {
+	var c Changes
+	if old == nil || cur == nil {
+		return c
+	}
+
+	c.LogSource = !reflect.DeepEqual(old.Log, cur.Log) ||
+		old.Pipeline.LinesBuffer != cur.Pipeline.LinesBuffer ||
+		old.Pipeline.ParseWorkers != cur.Pipeline.ParseWorkers
+
+	oldRules := make(map[string]Rule, len(old.Rules))
+	for _, r := range old.Rules {
+		oldRules[r.ID] = r
+	}
+	seen := make(map[string]bool, len(cur.Rules))
+	for _, r := range cur.Rules {
+		seen[r.ID] = true
+		prev, ok := oldRules[r.ID]
+		switch {
+		case !ok:
+			c.RulesAdded = append(c.RulesAdded, r.ID)
+		case !reflect.DeepEqual(prev, r):
+			c.RulesChanged = append(c.RulesChanged, r.ID)
+		}
+	}
+	for _, r := range old.Rules {
+		if !seen[r.ID] {
+			c.RulesRemoved = append(c.RulesRemoved, r.ID)
+		}
+	}
+
+	c.Backend = BackendChanged(&old.Backend, &cur.Backend)
+	c.Whitelist = !reflect.DeepEqual(old.Backend.Whitelist, cur.Backend.Whitelist)
+	c.DryRun = old.Backend.DryRun != cur.Backend.DryRun
+	c.Logging = old.Logging.Level != cur.Logging.Level
+	c.Evidence = old.Pipeline.EvidenceLines != cur.Pipeline.EvidenceLines
+	c.Shutdown = old.Shutdown != cur.Shutdown
+
+	if old.Backend.Workers != cur.Backend.Workers || old.Backend.QueueSize != cur.Backend.QueueSize {
+		c.RestartRequired = append(c.RestartRequired, "backend.workers/queue_size")
+	}
+	if old.Backend.Retry != cur.Backend.Retry {
+		c.RestartRequired = append(c.RestartRequired, "backend.retry")
+	}
+	if old.StateDir != cur.StateDir {
+		c.RestartRequired = append(c.RestartRequired, "state_dir")
+	}
+	if old.Pipeline.EventsBuffer != cur.Pipeline.EventsBuffer || old.Pipeline.DecisionsBuffer != cur.Pipeline.DecisionsBuffer ||
+		old.Pipeline.OverloadPolicy != cur.Pipeline.OverloadPolicy || old.Pipeline.SampleRate != cur.Pipeline.SampleRate {
+		c.RestartRequired = append(c.RestartRequired, "pipeline queues")
+	}
+	if old.Pipeline.EngineShards != cur.Pipeline.EngineShards {
+		c.RestartRequired = append(c.RestartRequired, "pipeline.engine_shards")
+	}
+	if old.Logging.JSON != cur.Logging.JSON {
+		c.RestartRequired = append(c.RestartRequired, "logging.json")
+	}
+	if old.Admin != cur.Admin {
+		c.RestartRequired = append(c.RestartRequired, "admin")
+	}
+	if !reflect.DeepEqual(old.Notify, cur.Notify) {
+		c.RestartRequired = append(c.RestartRequired, "notify")
+	}
+	if !reflect.DeepEqual(old.Report, cur.Report) {
+		c.RestartRequired = append(c.RestartRequired, "report")
+	}
+	if old.Audit != cur.Audit {
+		c.RestartRequired = append(c.RestartRequired, "audit")
+	}
+	if old.Metrics != cur.Metrics {
+		c.RestartRequired = append(c.RestartRequired, "metrics")
+	}
+	return c
+}
+
+// BackendChanged reports whether the backend itself differs, ignoring settings
+// the ban manager applies in place (dry-run, whitelist) or only at startup.
+func BackendChanged(old, cur *BackendConfig) bool {
+	a, b := *old, *cur
+	a.DryRun, b.DryRun = false, false
+	a.Whitelist, b.Whitelist = nil, nil
+	a.Workers, b.Workers = 0, 0
+	a.QueueSize, b.QueueSize = 0, 0
+	a.Retry, b.Retry = RetryConfig{}, RetryConfig{}
+	return !reflect.DeepEqual(a, b)
+}
+
+// RulesModified reports whether any rule was added, removed or modified.
+func (c Changes) RulesModified() bool {
+	return len(c.RulesAdded)+len(c.RulesRemoved)+len(c.RulesChanged) > 0
+}
+
+// Empty reports whether nothing changed.
+func (c Changes) Empty() bool {
+	return !c.LogSource && !c.RulesModified() && !c.Backend && !c.Whitelist &&
+		!c.DryRun && !c.Logging && !c.Evidence && !c.Shutdown && len(c.RestartRequired) == 0
+}
+
+// String returns a one-line summary suitable for logging.
+func (c Changes) String() string {
+	if c.Empty() {
+		return "no changes"
+	}
+	var parts []string
+	if c.LogSource {
+		parts = append(parts, "log source")
+	}
+	if c.RulesModified() {
+		parts = append(parts, fmt.Sprintf("rules (added=%v removed=%v changed=%v)", c.RulesAdded, c.RulesRemoved, c.RulesChanged))
+	}
+	if c.Backend {
+		parts = append(parts, "backend")
+	}
+	if c.Whitelist {
+		parts = append(parts, "whitelist")
+	}
+	if c.DryRun {
+		parts = append(parts, "dry_run")
+	}
+	if c.Logging {
+		parts = append(parts, "logging.level")
+	}
+	if c.Evidence {
+		parts = append(parts, "pipeline.evidence_lines")
+	}
+	if c.Shutdown {
+		parts = append(parts, "shutdown")
+	}
+	if len(c.RestartRequired) > 0 {
+		parts = append(parts, fmt.Sprintf("needs restart: %s", strings.Join(c.RestartRequired, ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,242 @@
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultRulesDir is read next to the main config file when rules_dir is unset.
+const defaultRulesDir = "rules.d"
+
+// Fragment is the content of an included file or a rules.d entry.
+type Fragment struct {
+	Rules     []Rule   `yaml:"rules"`
+	Whitelist []string `yaml:"whitelist"`
+}
+
+// includeSpec is the part of the main config that decides which fragments to load.
+type includeSpec struct {
+	Include  []string `yaml:"include"`
+	RulesDir string   `yaml:"rules_dir"`
+}
+
+// mergeFragments loads every fragment referenced by cfg, appends its rules and
+// whitelist entries, and reports rule IDs defined more than once. Fragments
+// are decoded strictly; their paths are remapped to the merged config
+// ("rules[0]" in a fragment becomes "rules[N]") so later checks point at the
+// right file. Errors that prevent loading a fragment at all are returned.
+func mergeFragments(path string, cfg *Config, probs *problems) error {
+	files, err := fragmentFiles(path, includeSpec{Include: cfg.Include, RulesDir: cfg.RulesDir})
+	if err != nil {
+		return err
+	}
+
+	defined := make(map[string]string, len(cfg.Rules)) // rule id -> file
+	addRules := func(rules []Rule, base int, file string) {
+		for j, r := range rules {
+			if r.ID == "" {
+				continue // reported by validate
+			}
+			if prev, ok := defined[r.ID]; ok {
+				probs.addf(fmt.Sprintf("rules[%d].id", base+j), "duplicate rule id %q (first defined in %s)", r.ID, prev)
+				continue
+			}
+			defined[r.ID] = file
+		}
+	}
+	addRules(cfg.Rules, 0, path)
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("read include: %w", err)
+		}
+		rbase, wbase := len(cfg.Rules), len(cfg.Backend.Whitelist)
+		remap := func(p string) string {
+			switch {
+			case strings.HasPrefix(p, "rules["):
+				return remapIndex(p, "rules[", "rules[", rbase)
+			case strings.HasPrefix(p, "whitelist["):
+				return remapIndex(p, "whitelist[", "backend.whitelist[", wbase)
+			}
+			return file + ":" + p // not part of the merged config
+		}
+		var frag Fragment
+		if err := decodeStrict(file, data, &frag, probs, remap); err != nil {
+			return fmt.Errorf("parse include: %w", err)
+		}
+		addRules(frag.Rules, rbase, file)
+		cfg.Rules = append(cfg.Rules, frag.Rules...)
+		cfg.Backend.Whitelist = append(cfg.Backend.Whitelist, frag.Whitelist...)
+	}
+
+	cfg.Sources = append([]string{path}, files...)
+	return nil
+}
+
+// remapIndex rewrites "<from>i]..." to "<to>(base+i)]...".
+func remapIndex(p, from, to string, base int) string {
+	rest := p[len(from):]
+	end := strings.IndexByte(rest, ']')
+	i, err := strconv.Atoi(rest[:max(end, 0)])
+	if end < 0 || err != nil {
+		return p
+	}
+	return fmt.Sprintf("%s%d%s", to, base+i, rest[end:])
+}
+
+// fragmentFiles resolves include globs and the rules directory, relative to
+// the directory of the main config file, into a sorted, de-duplicated list.
+// A missing default rules.d is ignored; a missing explicit rules_dir is an error.
+func fragmentFiles(path string, spec includeSpec) ([]string, error) {
+	base := filepath.Dir(path)
+	self, _ := filepath.Abs(path)
+	seen := map[string]bool{self: true}
+	var files []string
+	add := func(file string) {
+		abs, err := filepath.Abs(file)
+		if err != nil || seen[abs] {
+			return
+		}
+		seen[abs] = true
+		files = append(files, file)
+	}
+
+	for _, pattern := range spec.Include {
+		matches, err := filepath.Glob(resolve(base, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("include %q: %w", pattern, err)
+		}
+		for _, m := range matches {
+			add(m)
+		}
+	}
+
+	dir, explicit := spec.RulesDir, spec.RulesDir != ""
+	if !explicit {
+		dir = defaultRulesDir
+	}
+	dir = resolve(base, dir)
+	entries, err := os.ReadDir(dir)
+	switch {
+	case os.IsNotExist(err) && !explicit:
+	case err != nil:
+		return nil, fmt.Errorf("rules_dir: %w", err)
+	default:
+		var names []string
+		for _, e := range entries {
+			name := e.Name()
+			if e.IsDir() || strings.HasPrefix(name, ".") {
+				continue
+			}
+			if ext := filepath.Ext(name); ext == ".yaml" || ext == ".yml" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			add(filepath.Join(dir, name))
+		}
+	}
+
+	return files, nil
+}
+
+// sourceFiles returns the main config file followed by every fragment it
+// currently references. Unlike Config.Sources, it picks up files added since the last load.
+func sourceFiles(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var spec includeSpec
+	if yaml.Unmarshal(data, &spec) != nil {
+		// Unparseable: Load reports the error, the main file alone decides whether it changed.
+		return []string{path}, nil
+	}
+	files, err := fragmentFiles(path, spec)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{path}, files...), nil
+}
+
+// watchPaths returns the directories to watch for changes to path or any of
+// its fragments: their directories, symlink targets, include glob directories
+// and the rules directory.
+func watchPaths(path string) []string {
+	base := filepath.Dir(path)
+	var dirs []string
+	seen := make(map[string]bool)
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	files, _ := sourceFiles(path)
+	for _, f := range files {
+		add(filepath.Dir(f))
+		if target, err := filepath.EvalSymlinks(f); err == nil {
+			add(filepath.Dir(target))
+		}
+	}
+
+	if data, err := os.ReadFile(path); err == nil {
+		var spec includeSpec
+		if yaml.Unmarshal(data, &spec) == nil {
+			for _, pattern := range spec.Include {
+				if dir := filepath.Dir(resolve(base, pattern)); !hasMeta(dir) {
+					add(dir)
+				}
+			}
+			dir := spec.RulesDir
+			if dir == "" {
+				dir = defaultRulesDir
+			}
+			if info, err := os.Stat(resolve(base, dir)); err == nil && info.IsDir() {
+				add(resolve(base, dir))
+			}
+		}
+	}
+	return dirs
+}
+
+// hashSources hashes the names and contents of path and all its fragments.
+func hashSources(path string) ([sha256.Size]byte, error) {
+	files, err := sourceFiles(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	h := sha256.New()
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return [sha256.Size]byte{}, err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", f, len(data))
+		h.Write(data)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+func resolve(base, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(base, p)
+}
+
+func hasMeta(p string) bool {
+	return strings.ContainsAny(p, `*?[\`)
+}
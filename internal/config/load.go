@@ -2,112 +2,181 @@ package config
 
 import (
 	"fmt"
+	"log/slog"
+	"net"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
 
-	"gopkg.in/yaml.v3"
+	"github.com/cyra/foxhole-fw/internal/parser"
+	"github.com/cyra/foxhole-fw/internal/queue"
 )
 
-// Load reads, parses, and validates configuration from the provided path.
-// Warns if the config file has insecure permissions (world-readable).
+// Defaults for optional settings.
+const (
+	DefaultBufferSize     = 100
+	DefaultSampleRate     = 10
+	DefaultBackendWorkers = 4
+	DefaultBackendQueue   = 1000
+
+	DefaultRetryMaxAttempts = 8
+	DefaultRetryBackoff     = 5 * time.Second
+	DefaultRetryMaxBackoff  = 10 * time.Minute
+	DefaultRetryJitter      = 0.2
+
+	DefaultAdminSocket = "/run/foxhole-fw/admin.sock"
+	DefaultStateDir    = "/var/lib/foxhole-fw" // StateDirectory= of the systemd unit
+
+	DefaultDrainTimeout = 30 * time.Second
+
+	DefaultVultrAPIURL = "https://api.vultr.com/v2"
+
+	DefaultErrorLogInterval  = 10 * time.Second
+	DefaultQuarantineMaxSize = 100 << 20
+	DefaultSelfCheckLines    = 20
+
+	DefaultAuditMaxSize    = 100 << 20
+	DefaultAuditMaxBackups = 5
+	DefaultAuditMaxLines   = 10
+	DefaultEvidenceLines   = 10
+
+	DefaultNotifyInterval     = time.Minute
+	DefaultNotifyBurst        = 5
+	DefaultNotifyRetries      = 3
+	DefaultNotifyRetryBackoff = 2 * time.Second
+	DefaultNotifyTimeout      = 10 * time.Second
+
+	DefaultReportAt      = "08:00"
+	DefaultReportWeekday = "monday"
+	DefaultReportTop     = 10
+	DefaultSMTPPort      = 587
+	DefaultSMTPTLSPort   = 465
+	DefaultSMTPTimeout   = 30 * time.Second
+)
+
+// Load reads, parses, and validates configuration from the provided path,
+// merging rules and whitelist entries from included files and the rules directory
+// and resolving ${ENV} and *_file secrets.
+// Unknown fields are rejected. All problems found are returned together as a
+// *ValidationError, each with its file:line:column.
+// Warns if the config file holds inline secrets and is world-readable.
 func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	var cfg Config
+	probs := newProblems(path)
+	if err := decodeStrict(path, data, &cfg, probs, nil); err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+
 	// Check file permissions (Unix only).
-	if runtime.GOOS != "windows" {
+	if runtime.GOOS != "windows" && cfg.hasInlineSecrets() {
 		if info, err := os.Stat(path); err == nil {
 			mode := info.Mode().Perm()
-			// Warn if file is world-readable (contains API keys).
+			// Warn if file is world-readable and contains API keys.
 			if mode&0o004 != 0 {
-				fmt.Fprintf(os.Stderr, "WARNING: config file %s is world-readable (mode %o). Consider: chmod 600 %s\n", path, mode, path)
+				fmt.Fprintf(os.Stderr, "WARNING: config file %s contains secrets and is world-readable (mode %o). Consider: chmod 600 %s, or use *_file / ${ENV} secrets\n", path, mode, path)
 			}
 		}
 	}
 
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("read config: %w", err)
-	}
+	resolveSecrets(&cfg, filepath.Dir(path), probs)
 
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("parse config: %w", err)
+	if err := mergeFragments(path, &cfg, probs); err != nil {
+		return nil, fmt.Errorf("load includes: %w", err)
 	}
 
-	if err := validate(&cfg); err != nil {
-		return nil, fmt.Errorf("validate config: %w", err)
+	validate(&cfg, probs)
+	if err := probs.err(); err != nil {
+		return nil, err
 	}
 
 	return &cfg, nil
 }
 
-func validate(c *Config) error {
+// validate checks semantic constraints, records every violation in probs and
+// fills in defaults.
+func validate(c *Config, probs *problems) {
 	if c.Log.Path == "" {
-		return fmt.Errorf("log.path is required")
+		probs.addf("log.path", "is required")
 	}
 
 	if c.Log.Parser == "" {
 		c.Log.Parser = "nginx_combined"
 	}
-
-	if c.Backend.Type == "" {
-		return fmt.Errorf("backend.type is required")
+	if _, err := parser.New(c.Log.Parser); err != nil {
+		probs.addf("log.parser", "unknown parser %q (known: auto, %s)", c.Log.Parser, strings.Join(parser.Names(), ", "))
 	}
-
-	switch c.Backend.Type {
-	case "iptables":
-		if c.Backend.IPTables == nil {
-			return fmt.Errorf("backend.iptables must be set when backend.type=iptables")
-		}
-		if c.Backend.IPTables.Table == "" || c.Backend.IPTables.Chain == "" {
-			return fmt.Errorf("backend.iptables.table and backend.iptables.chain are required")
-		}
-	case "http_api":
-		if c.Backend.HTTP == nil {
-			return fmt.Errorf("backend.http_api must be set when backend.type=http_api")
-		}
-		if c.Backend.HTTP.URL == "" {
-			return fmt.Errorf("backend.http_api.url is required")
-		}
-	case "vultr":
-		if c.Backend.Vultr == nil {
-			return fmt.Errorf("backend.vultr must be set when backend.type=vultr")
-		}
-		if c.Backend.Vultr.APIKey == "" || c.Backend.Vultr.FirewallID == "" {
-			return fmt.Errorf("backend.vultr.api_key and backend.vultr.firewall_id are required")
-		}
-	case "proxmox":
-		if c.Backend.Proxmox == nil {
-			return fmt.Errorf("backend.proxmox must be set when backend.type=proxmox")
-		}
-		if c.Backend.Proxmox.APIURL == "" || c.Backend.Proxmox.Node == "" {
-			return fmt.Errorf("backend.proxmox.api_url and backend.proxmox.node are required")
-		}
-	default:
-		return fmt.Errorf("unsupported backend.type %q", c.Backend.Type)
+	if c.Log.ErrorLogInterval < 0 {
+		probs.addf("log.error_log_interval", "must be >= 0")
+	}
+	if c.Log.QuarantineMaxSize < 0 {
+		probs.addf("log.quarantine_max_size", "must be >= 0")
+	}
+	if c.Log.ErrorLogInterval == 0 {
+		c.Log.ErrorLogInterval = DefaultErrorLogInterval
 	}
+	if c.Log.QuarantineMaxSize == 0 {
+		c.Log.QuarantineMaxSize = DefaultQuarantineMaxSize
+	}
+	if c.Log.SelfCheckLines == 0 {
+		c.Log.SelfCheckLines = DefaultSelfCheckLines
+	}
+
+	validateBackend(&c.Backend, probs)
 
 	if len(c.Rules) == 0 {
-		return fmt.Errorf("at least one rule is required")
+		probs.addf("rules", "at least one rule is required")
 	}
 
 	for i := range c.Rules {
 		r := &c.Rules[i]
+		field := func(name string) string { return fmt.Sprintf("rules[%d].%s", i, name) }
 		if r.ID == "" {
-			return fmt.Errorf("rule at index %d is missing id", i)
+			probs.addf(field("id"), "is required")
 		}
 		if r.Method == "" {
-			return fmt.Errorf("rule %q: method is required", r.ID)
+			probs.addf(field("method"), "is required")
 		}
 		if r.Path == "" {
-			return fmt.Errorf("rule %q: path is required", r.ID)
+			probs.addf(field("path"), "is required")
 		}
 		if r.MaxErrors <= 0 {
-			return fmt.Errorf("rule %q: max_errors must be > 0", r.ID)
+			probs.addf(field("max_errors"), "must be > 0")
 		}
 		if r.Window <= 0 {
-			return fmt.Errorf("rule %q: window must be > 0", r.ID)
+			probs.addf(field("window"), "must be > 0")
 		}
 		if r.BanDuration <= 0 {
-			return fmt.Errorf("rule %q: ban_duration must be > 0", r.ID)
+			probs.addf(field("ban_duration"), "must be > 0")
+		}
+		for j, name := range r.Backends {
+			if _, ok := c.Backend.Spec(name); !ok {
+				probs.addf(fmt.Sprintf("rules[%d].backends[%d]", i, j), "unknown backend %q", name)
+			}
+		}
+	}
+
+	validatePipeline(&c.Pipeline, probs)
+
+	if c.Admin.Socket == "" {
+		c.Admin.Socket = DefaultAdminSocket
+	}
+	if c.StateDir == "" {
+		c.StateDir = DefaultStateDir
+	}
+	validateAudit(&c.Audit, probs)
+	validateNotify(&c.Notify, probs)
+	validateReport(&c.Report, &c.Audit, probs)
+	validateShutdown(&c.Shutdown, probs)
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			probs.addf("metrics.listen", "%v", err)
 		}
 	}
 
@@ -115,6 +184,381 @@ func validate(c *Config) error {
 	if c.Logging.Level == "" {
 		c.Logging.Level = "info"
 	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Logging.Level)); err != nil {
+		probs.addf("logging.level", "unknown level %q (known: debug, info, warn, error)", c.Logging.Level)
+	}
+}
+
+func validateShutdown(s *ShutdownConfig, probs *problems) {
+	switch s.Policy {
+	case "":
+		s.Policy = ShutdownKeep
+	case ShutdownKeep, ShutdownRemove:
+	default:
+		probs.addf("shutdown.policy", "unknown policy %q (known: keep, remove)", s.Policy)
+	}
+	if s.DrainTimeout < 0 {
+		probs.addf("shutdown.drain_timeout", "must be >= 0")
+	}
+	if s.DrainTimeout == 0 {
+		s.DrainTimeout = DefaultDrainTimeout
+	}
+}
+
+func validateAudit(a *AuditConfig, probs *problems) {
+	if a.MaxSize < 0 {
+		probs.addf("audit.max_size", "must be >= 0")
+	}
+	if a.MaxBackups < 0 {
+		probs.addf("audit.max_backups", "must be >= 0")
+	}
+	if a.MaxLines < 0 {
+		probs.addf("audit.max_lines", "must be >= 0")
+	}
+	if a.MaxSize == 0 {
+		a.MaxSize = DefaultAuditMaxSize
+	}
+	if a.MaxBackups == 0 {
+		a.MaxBackups = DefaultAuditMaxBackups
+	}
+	if a.MaxLines == 0 {
+		a.MaxLines = DefaultAuditMaxLines
+	}
+}
+
+func validateNotify(n *NotifyConfig, probs *problems) {
+	for i, a := range n.Actions {
+		switch a {
+		case "ban", "unban", "skip", "extend":
+		default:
+			probs.addf(fmt.Sprintf("notify.actions[%d]", i), "unknown action %q (known: ban, unban, skip, extend)", a)
+		}
+	}
+	if len(n.Actions) == 0 {
+		n.Actions = []string{"ban"}
+	}
+
+	durations := []struct {
+		name string
+		v    *time.Duration
+		def  time.Duration
+	}{
+		{"notify.interval", &n.Interval, DefaultNotifyInterval},
+		{"notify.retry_backoff", &n.RetryBackoff, DefaultNotifyRetryBackoff},
+		{"notify.timeout", &n.Timeout, DefaultNotifyTimeout},
+	}
+	for _, d := range durations {
+		if *d.v < 0 {
+			probs.addf(d.name, "must be >= 0")
+		}
+		if *d.v == 0 {
+			*d.v = d.def
+		}
+	}
+	if n.Burst < 0 {
+		probs.addf("notify.burst", "must be > 0")
+	}
+	if n.Burst == 0 {
+		n.Burst = DefaultNotifyBurst
+	}
+	if n.Retries < -1 {
+		probs.addf("notify.retries", "must be >= -1")
+	}
+	if n.Retries == 0 {
+		n.Retries = DefaultNotifyRetries
+	}
 
-	return nil
+	for i := range n.Sinks {
+		s := &n.Sinks[i]
+		field := func(name string) string { return fmt.Sprintf("notify.sinks[%d].%s", i, name) }
+		switch s.Type {
+		case "webhook", "slack":
+			if s.URL == "" && s.URLFile == "" {
+				probs.addf(field("url"), "is required for type %s", s.Type)
+			}
+		case "matrix":
+			if s.Homeserver == "" {
+				probs.addf(field("homeserver"), "is required for type matrix")
+			}
+			if s.RoomID == "" {
+				probs.addf(field("room_id"), "is required for type matrix")
+			}
+			if s.AccessToken == "" && s.AccessTokenFile == "" {
+				probs.addf(field("access_token"), "is required for type matrix")
+			}
+		case "":
+			probs.addf(field("type"), "is required (webhook, slack or matrix)")
+		default:
+			probs.addf(field("type"), "unknown sink type %q (known: webhook, slack, matrix)", s.Type)
+		}
+		if s.Name == "" {
+			s.Name = s.Type
+		}
+	}
+}
+
+func validateReport(r *ReportConfig, audit *AuditConfig, probs *problems) {
+	// Without a schedule, SMTP settings are still used by "fwld report -send".
+	if r.Schedule == "" && r.SMTP.Host == "" {
+		return
+	}
+	switch r.Schedule {
+	case "", "daily", "weekly":
+	default:
+		probs.addf("report.schedule", "unknown schedule %q (known: daily, weekly)", r.Schedule)
+	}
+	if audit.Path == "" {
+		probs.addf("report", "requires audit.path; reports are built from the audit log")
+	}
+
+	if r.At == "" {
+		r.At = DefaultReportAt
+	}
+	if _, err := time.Parse("15:04", r.At); err != nil {
+		probs.addf("report.at", "want HH:MM, got %q", r.At)
+	}
+	if r.Weekday == "" {
+		r.Weekday = DefaultReportWeekday
+	}
+	if !validWeekday(r.Weekday) {
+		probs.addf("report.weekday", "unknown weekday %q", r.Weekday)
+	}
+	if r.Top < 0 {
+		probs.addf("report.top", "must be > 0")
+	}
+	if r.Top == 0 {
+		r.Top = DefaultReportTop
+	}
+
+	s := &r.SMTP
+	if s.Host == "" {
+		probs.addf("report.smtp.host", "is required")
+	}
+	if s.Port == 0 {
+		s.Port = DefaultSMTPPort
+		if s.TLS {
+			s.Port = DefaultSMTPTLSPort
+		}
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		probs.addf("report.smtp.port", "out of range: %d", s.Port)
+	}
+	if s.From == "" {
+		probs.addf("report.smtp.from", "is required")
+	}
+	if len(s.To) == 0 {
+		probs.addf("report.smtp.to", "at least one recipient is required")
+	}
+	if s.Password != "" || s.PasswordFile != "" {
+		if s.Username == "" {
+			probs.addf("report.smtp.username", "is required with a password")
+		}
+	}
+	if s.Timeout < 0 {
+		probs.addf("report.smtp.timeout", "must be >= 0")
+	}
+	if s.Timeout == 0 {
+		s.Timeout = DefaultSMTPTimeout
+	}
+}
+
+func validWeekday(name string) bool {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateBackend(b *BackendConfig, probs *problems) {
+	if len(b.Backends) > 0 {
+		if b.BackendSpec != (BackendSpec{}) {
+			probs.addf("backend.type", "cannot be combined with backend.backends; move it into the list")
+		}
+		seen := make(map[string]bool, len(b.Backends))
+		for i := range b.Backends {
+			s := &b.Backends[i]
+			prefix := fmt.Sprintf("backend.backends[%d]", i)
+			validateBackendSpec(prefix, s, probs)
+			if seen[s.Name] {
+				probs.addf(prefix+".name", "duplicate backend name %q", s.Name)
+			}
+			seen[s.Name] = true
+		}
+	} else {
+		validateBackendSpec("backend", &b.BackendSpec, probs)
+	}
+
+	switch b.Mode {
+	case "":
+		b.Mode = BackendModeFanout
+	case BackendModeFanout, BackendModeFallback:
+	default:
+		probs.addf("backend.mode", "unknown mode %q (known: fanout, fallback)", b.Mode)
+	}
+
+	for i, entry := range b.Whitelist {
+		if net.ParseIP(entry) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			probs.addf(fmt.Sprintf("backend.whitelist[%d]", i), "%q is not an IP address or CIDR", entry)
+		}
+	}
+
+	if b.Workers < 0 {
+		probs.addf("backend.workers", "must be >= 0")
+	}
+	if b.QueueSize < 0 {
+		probs.addf("backend.queue_size", "must be >= 0")
+	}
+	if b.Workers == 0 {
+		b.Workers = DefaultBackendWorkers
+	}
+	if b.QueueSize == 0 {
+		b.QueueSize = DefaultBackendQueue
+	}
+	validateRetry(&b.Retry, probs)
+}
+
+func validateRetry(r *RetryConfig, probs *problems) {
+	if r.MaxAttempts < -1 {
+		probs.addf("backend.retry.max_attempts", "must be >= 1, or -1 for no limit")
+	}
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if r.Backoff < 0 {
+		probs.addf("backend.retry.backoff", "must be >= 0")
+	}
+	if r.Backoff == 0 {
+		r.Backoff = DefaultRetryBackoff
+	}
+	if r.MaxBackoff < 0 {
+		probs.addf("backend.retry.max_backoff", "must be >= 0")
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = max(DefaultRetryMaxBackoff, r.Backoff)
+	}
+	if r.MaxBackoff < r.Backoff {
+		probs.addf("backend.retry.max_backoff", "must be >= backend.retry.backoff (%s)", r.Backoff)
+	}
+	switch {
+	case r.Jitter == 0:
+		r.Jitter = DefaultRetryJitter
+	case r.Jitter == -1:
+	case r.Jitter < 0 || r.Jitter > 1:
+		probs.addf("backend.retry.jitter", "must be between 0 and 1, or -1 to disable")
+	}
+}
+
+// validateBackendSpec checks one backend; prefix is its YAML path.
+func validateBackendSpec(prefix string, s *BackendSpec, probs *problems) {
+	switch s.Type {
+	case "":
+		probs.addf(prefix+".type", "is required")
+	case "iptables":
+		if s.IPTables == nil {
+			probs.addf(prefix+".iptables", "must be set when %s.type=iptables", prefix)
+			break
+		}
+		if s.IPTables.Table == "" {
+			probs.addf(prefix+".iptables.table", "is required")
+		}
+		if s.IPTables.Chain == "" {
+			probs.addf(prefix+".iptables.chain", "is required")
+		}
+	case "http_api":
+		if s.HTTP == nil {
+			probs.addf(prefix+".http_api", "must be set when %s.type=http_api", prefix)
+			break
+		}
+		if s.HTTP.URL == "" {
+			probs.addf(prefix+".http_api.url", "is required")
+		}
+	case "vultr":
+		if s.Vultr == nil {
+			probs.addf(prefix+".vultr", "must be set when %s.type=vultr", prefix)
+			break
+		}
+		if s.Vultr.APIKey == "" && s.Vultr.APIKeyFile == "" {
+			probs.addf(prefix+".vultr.api_key", "is required (or set api_key_file)")
+		}
+		if s.Vultr.FirewallID == "" {
+			probs.addf(prefix+".vultr.firewall_id", "is required")
+		}
+		if s.Vultr.APIURL == "" {
+			s.Vultr.APIURL = DefaultVultrAPIURL
+		}
+	case "proxmox":
+		if s.Proxmox == nil {
+			probs.addf(prefix+".proxmox", "must be set when %s.type=proxmox", prefix)
+			break
+		}
+		if s.Proxmox.APIURL == "" {
+			probs.addf(prefix+".proxmox.api_url", "is required")
+		}
+		if s.Proxmox.Node == "" {
+			probs.addf(prefix+".proxmox.node", "is required")
+		}
+	default:
+		probs.addf(prefix+".type", "unsupported backend type %q", s.Type)
+	}
+	if s.Name == "" {
+		s.Name = s.Type
+	}
+}
+
+func validatePipeline(p *PipelineConfig, probs *problems) {
+	buffers := []struct {
+		name string
+		v    *int
+	}{
+		{"pipeline.lines_buffer", &p.LinesBuffer},
+		{"pipeline.events_buffer", &p.EventsBuffer},
+		{"pipeline.decisions_buffer", &p.DecisionsBuffer},
+	}
+	for _, b := range buffers {
+		if *b.v < 0 {
+			probs.addf(b.name, "must be >= 0")
+		}
+		if *b.v == 0 {
+			*b.v = DefaultBufferSize
+		}
+	}
+
+	if p.ParseWorkers < 0 {
+		probs.addf("pipeline.parse_workers", "must be >= 0")
+	}
+	if p.EngineShards < 0 {
+		probs.addf("pipeline.engine_shards", "must be >= 0")
+	}
+	if p.ParseWorkers == 0 {
+		p.ParseWorkers = 1
+	}
+	if p.EngineShards == 0 {
+		p.EngineShards = 1
+	}
+
+	if policy, err := queue.ParsePolicy(p.OverloadPolicy); err != nil {
+		probs.addf("pipeline.overload_policy", "%v", err)
+	} else {
+		p.OverloadPolicy = string(policy)
+	}
+
+	if p.SampleRate < 0 {
+		probs.addf("pipeline.sample_rate", "must be >= 0")
+	}
+	if p.SampleRate == 0 {
+		p.SampleRate = DefaultSampleRate
+	}
+
+	if p.EvidenceLines < -1 {
+		probs.addf("pipeline.evidence_lines", "must be >= -1")
+	}
+	if p.EvidenceLines == 0 {
+		p.EvidenceLines = DefaultEvidenceLines
+	}
 }
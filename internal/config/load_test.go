@@ -0,0 +1,331 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const baseConfig = `log:
+  path: /var/log/nginx/access.log
+  parser: nginx_combined
+backend:
+  type: iptables
+  iptables:
+    table: filter
+    chain: INPUT
+rules:
+  - id: errors
+    max_errors: 10
+    window: 1m
+    ban_duration: 10m
+    method: GET
+    path: /
+`
+
+// writeFile writes content to name in dir and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// loadProblems loads the config at path and returns its validation problems,
+// failing the test if it loads or fails for another reason.
+func loadProblems(t *testing.T, path string) []Problem {
+	t.Helper()
+	cfg, err := Load(path)
+	if err == nil {
+		t.Fatalf("Load succeeded: %+v", cfg)
+	}
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Load error %v is not a *ValidationError", err)
+	}
+	return verr.Problems
+}
+
+// findProblem returns the problem reported for path.
+func findProblem(t *testing.T, probs []Problem, path string) Problem {
+	t.Helper()
+	for _, p := range probs {
+		if p.Path == path {
+			return p
+		}
+	}
+	t.Fatalf("no problem for %s in %v", path, probs)
+	return Problem{}
+}
+
+func TestLoadBase(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", baseConfig)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Rules) != 1 || cfg.Rules[0].ID != "errors" {
+		t.Errorf("rules = %+v, want only errors", cfg.Rules)
+	}
+}
+
+func TestLoadUnknownField(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", strings.Replace(baseConfig, "backend:\n", "backend:\n  dry_rn: true\n", 1))
+	p := findProblem(t, loadProblems(t, path), "backend.dry_rn")
+
+	if want := `unknown field (did you mean "dry_run"?)`; p.Message != want {
+		t.Errorf("message = %q, want %q", p.Message, want)
+	}
+	if want := (Position{File: path, Line: 5, Column: 3}); p.Pos != want {
+		t.Errorf("position = %v, want %v", p.Pos, want)
+	}
+}
+
+func TestLoadTypeErrorPosition(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", strings.Replace(baseConfig, "max_errors: 10", "max_errors: lots", 1))
+	p := findProblem(t, loadProblems(t, path), "rules[0].max_errors")
+
+	if want := path + ":11:17"; p.Pos.String() != want {
+		t.Errorf("position = %v, want %s", p.Pos, want)
+	}
+	if !strings.Contains(p.Message, "`lots` into int") {
+		t.Errorf("message = %q, want it to name the value and type", p.Message)
+	}
+}
+
+func TestLoadDuplicateRuleAcrossFragments(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.yaml", baseConfig+"include:\n  - conf.d/*.yaml\n")
+	writeFile(t, dir, "conf.d/a.yaml", `rules:
+  - id: login
+    max_errors: 5
+    window: 1m
+    ban_duration: 1h
+    method: POST
+    path: /login
+`)
+	b := writeFile(t, dir, "rules.d/b.yaml", `whitelist:
+  - 10.0.0.0/8
+rules:
+  - id: login
+    max_errors: 3
+    window: 1m
+    ban_duration: 1h
+    method: POST
+    path: /login
+`)
+	probs := loadProblems(t, path)
+	if len(probs) != 1 {
+		t.Fatalf("problems = %v, want only the duplicate", probs)
+	}
+	p := findProblem(t, probs, "rules[2].id")
+	if want := `duplicate rule id "login" (first defined in ` + filepath.Join(dir, "conf.d/a.yaml") + ")"; p.Message != want {
+		t.Errorf("message = %q, want %q", p.Message, want)
+	}
+	if want := (Position{File: b, Line: 4, Column: 9}); p.Pos != want {
+		t.Errorf("position = %v, want %v", p.Pos, want)
+	}
+}
+
+func TestLoadAuditMaxBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.yaml", baseConfig+"audit:\n  path: audit.jsonl\n")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Audit.MaxBackups != DefaultAuditMaxBackups {
+		t.Errorf("max_backups = %d, want the default %d", cfg.Audit.MaxBackups, DefaultAuditMaxBackups)
+	}
+
+	path = writeFile(t, dir, "config.yaml", baseConfig+"audit:\n  path: audit.jsonl\n  max_backups: -1\n")
+	if p := findProblem(t, loadProblems(t, path), "audit.max_backups"); p.Message != "must be >= 0" {
+		t.Errorf("message = %q, want %q", p.Message, "must be >= 0")
+	}
+}
+
+func TestLoadMissingEnv(t *testing.T) {
+	t.Setenv("FOXHOLE_TEST_TOKEN", "") // restored after the test
+	os.Unsetenv("FOXHOLE_TEST_TOKEN")
+	path := writeFile(t, t.TempDir(), "config.yaml", strings.Replace(baseConfig, `  type: iptables
+  iptables:
+    table: filter
+    chain: INPUT
+`, `  type: http_api
+  http_api:
+    url: https://firewall.example.com/api
+    auth_token: "${FOXHOLE_TEST_TOKEN}"
+`, 1))
+	p := findProblem(t, loadProblems(t, path), "backend.http_api.auth_token")
+
+	if want := "environment variable FOXHOLE_TEST_TOKEN is not set"; p.Message != want {
+		t.Errorf("message = %q, want %q", p.Message, want)
+	}
+	if want := (Position{File: path, Line: 8, Column: 17}); p.Pos != want {
+		t.Errorf("position = %v, want %v", p.Pos, want)
+	}
+}
+
+// redactedRules completes the configs of TestRedacted.
+const redactedRules = `log:
+  path: /var/log/nginx/access.log
+rules:
+  - id: errors
+    max_errors: 10
+    window: 1m
+    ban_duration: 10m
+    method: GET
+    path: /
+`
+
+func TestRedacted(t *testing.T) {
+	type field = func(c *Config) string
+	tests := []struct {
+		name    string
+		config  string
+		secrets map[string]field // must be redacted, and kept in the original
+		kept    map[string]field // must be left alone
+	}{
+		{
+			name: "http_api",
+			config: `backend:
+  type: http_api
+  http_api:
+    url: https://firewall.example.com/api
+    auth_token: "${FOXHOLE_TEST_TOKEN}"
+    headers:
+      X-Api-Key: api-key
+      X-Request-Source: foxhole
+`,
+			secrets: map[string]field{
+				"auth_token":        func(c *Config) string { return c.Backend.HTTP.AuthToken },
+				"headers.X-Api-Key": func(c *Config) string { return c.Backend.HTTP.Headers["X-Api-Key"] },
+			},
+			kept: map[string]field{
+				"url":                      func(c *Config) string { return c.Backend.HTTP.URL },
+				"headers.X-Request-Source": func(c *Config) string { return c.Backend.HTTP.Headers["X-Request-Source"] },
+			},
+		},
+		{
+			name: "vultr",
+			config: `backend:
+  type: vultr
+  vultr:
+    api_key_file: vultr-key
+    firewall_id: fw-1
+`,
+			secrets: map[string]field{"api_key": func(c *Config) string { return c.Backend.Vultr.APIKey }},
+			kept:    map[string]field{"firewall_id": func(c *Config) string { return c.Backend.Vultr.FirewallID }},
+		},
+		{
+			name: "proxmox",
+			config: `backend:
+  type: proxmox
+  proxmox:
+    api_url: https://pve.example.com:8006/api2/json
+    token_id: root@pam!fw
+    token_secret: pve-secret
+    node: pve1
+`,
+			secrets: map[string]field{"token_secret": func(c *Config) string { return c.Backend.Proxmox.TokenSecret }},
+			kept:    map[string]field{"token_id": func(c *Config) string { return c.Backend.Proxmox.TokenID }},
+		},
+		{
+			name: "notify",
+			config: `backend:
+  type: iptables
+  iptables: {table: filter, chain: INPUT}
+notify:
+  sinks:
+    - type: slack
+      url: "${FOXHOLE_TEST_WEBHOOK}"
+    - type: matrix
+      homeserver: https://matrix.example.org
+      room_id: "!room:example.org"
+      access_token: matrix-token
+    - type: webhook
+      url: https://hooks.example.com/foxhole
+      headers:
+        Authorization: Bearer hook-token
+        X-Env: prod
+`,
+			secrets: map[string]field{
+				"sinks[0].url":                   func(c *Config) string { return c.Notify.Sinks[0].URL },
+				"sinks[1].access_token":          func(c *Config) string { return c.Notify.Sinks[1].AccessToken },
+				"sinks[2].headers.Authorization": func(c *Config) string { return c.Notify.Sinks[2].Headers["Authorization"] },
+			},
+			kept: map[string]field{
+				"sinks[1].room_id":       func(c *Config) string { return c.Notify.Sinks[1].RoomID },
+				"sinks[2].headers.X-Env": func(c *Config) string { return c.Notify.Sinks[2].Headers["X-Env"] },
+			},
+		},
+		{
+			name: "smtp",
+			config: `backend:
+  type: iptables
+  iptables: {table: filter, chain: INPUT}
+audit:
+  path: /var/log/foxhole-fw/audit.jsonl
+report:
+  smtp:
+    host: smtp.example.org
+    username: foxhole
+    password_file: smtp-password
+    from: foxhole@example.org
+    to: [ops@example.org]
+`,
+			secrets: map[string]field{"password": func(c *Config) string { return c.Report.SMTP.Password }},
+			kept:    map[string]field{"username": func(c *Config) string { return c.Report.SMTP.Username }},
+		},
+		{
+			name: "backends",
+			config: `backend:
+  backends:
+    - name: host
+      type: iptables
+      iptables: {table: filter, chain: INPUT}
+    - name: edge
+      type: vultr
+      vultr:
+        api_key: vultr-key
+        firewall_id: fw-1
+`,
+			secrets: map[string]field{"backends[1].vultr.api_key": func(c *Config) string { return c.Backend.Backends[1].Vultr.APIKey }},
+			kept:    map[string]field{"backends[1].name": func(c *Config) string { return c.Backend.Backends[1].Name }},
+		},
+	}
+	t.Setenv("FOXHOLE_TEST_TOKEN", "api-token")
+	t.Setenv("FOXHOLE_TEST_WEBHOOK", "https://hooks.example.com/T000/B000/secret")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "vultr-key", "vultr-key\n")
+			writeFile(t, dir, "smtp-password", "hunter2\n")
+			cfg, err := Load(writeFile(t, dir, "config.yaml", redactedRules+tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			red := cfg.Redacted()
+			for name, get := range tt.secrets {
+				if v := get(red); v != Redacted {
+					t.Errorf("%s = %q, want it redacted", name, v)
+				}
+				if v := get(cfg); v == "" || v == Redacted {
+					t.Errorf("original %s = %q, want the resolved secret", name, v)
+				}
+			}
+			for name, get := range tt.kept {
+				if v := get(red); v == "" || v != get(cfg) {
+					t.Errorf("%s = %q, want %q", name, v, get(cfg))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces secret values in configs returned by Config.Redacted.
+const Redacted = "[REDACTED]"
+
+// envRef matches ${NAME} references. Bare $NAME is left alone so secrets
+// containing '$' are not mangled.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// secretField is a secret value that may be given inline (with ${ENV}
+// expansion) or read from a file.
+type secretField struct {
+	name  string // YAML path, for errors
+	value *string
+	file  *string
+}
+
+func (c *Config) secretFields() []secretField {
+	var fields []secretField
+	c.Backend.eachSpec(func(prefix string, s *BackendSpec) {
+		if h := s.HTTP; h != nil {
+			fields = append(fields, secretField{prefix + ".http_api.auth_token", &h.AuthToken, &h.AuthTokenFile})
+		}
+		if v := s.Vultr; v != nil {
+			fields = append(fields, secretField{prefix + ".vultr.api_key", &v.APIKey, &v.APIKeyFile})
+		}
+		if p := s.Proxmox; p != nil {
+			fields = append(fields, secretField{prefix + ".proxmox.token_secret", &p.TokenSecret, &p.TokenSecretFile})
+		}
+	})
+	fields = append(fields, secretField{"report.smtp.password", &c.Report.SMTP.Password, &c.Report.SMTP.PasswordFile})
+	for i := range c.Notify.Sinks {
+		s := &c.Notify.Sinks[i]
+		prefix := fmt.Sprintf("notify.sinks[%d].", i)
+		fields = append(fields,
+			secretField{prefix + "url", &s.URL, &s.URLFile},
+			secretField{prefix + "access_token", &s.AccessToken, &s.AccessTokenFile})
+	}
+	return fields
+}
+
+// eachSpec calls fn for the inline backend and every listed backend, with
+// its YAML path.
+func (b *BackendConfig) eachSpec(fn func(prefix string, s *BackendSpec)) {
+	fn("backend", &b.BackendSpec)
+	for i := range b.Backends {
+		fn(fmt.Sprintf("backend.backends[%d]", i), &b.Backends[i])
+	}
+}
+
+// hasInlineSecrets reports whether any secret is written literally in the
+// config rather than referenced from the environment or a file.
+func (c *Config) hasInlineSecrets() bool {
+	for _, f := range c.secretFields() {
+		if *f.value != "" && !envRef.MatchString(*f.value) {
+			return true
+		}
+	}
+	inline := false
+	c.Backend.eachSpec(func(_ string, s *BackendSpec) {
+		if s.HTTP == nil {
+			return
+		}
+		for k, v := range s.HTTP.Headers {
+			if sensitiveHeader(k) && !envRef.MatchString(v) {
+				inline = true
+			}
+		}
+	})
+	if inline {
+		return true
+	}
+	for _, s := range c.Notify.Sinks {
+		for k, v := range s.Headers {
+			if sensitiveHeader(k) && !envRef.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveSecrets expands ${ENV} references in secret values and HTTP headers
+// and reads *_file secrets, recording failures in probs. Relative secret files
+// are looked up in $CREDENTIALS_DIRECTORY (systemd LoadCredential=) if set,
+// else next to the config file.
+func resolveSecrets(c *Config, configDir string, probs *problems) {
+	for _, f := range c.secretFields() {
+		if *f.file != "" {
+			if *f.value != "" {
+				probs.addf(f.name, "%s and %s_file are mutually exclusive", f.name, f.name)
+				continue
+			}
+			v, err := readSecretFile(*f.file, configDir)
+			if err != nil {
+				probs.addf(f.name+"_file", "%v", err)
+				continue
+			}
+			*f.value = v
+			continue
+		}
+		v, err := expandEnv(*f.value)
+		if err != nil {
+			probs.addf(f.name, "%v", err)
+			continue
+		}
+		*f.value = v
+	}
+
+	c.Backend.eachSpec(func(prefix string, s *BackendSpec) {
+		if s.HTTP == nil {
+			return
+		}
+		for k, v := range s.HTTP.Headers {
+			expanded, err := expandEnv(v)
+			if err != nil {
+				probs.addf(prefix+".http_api.headers."+k, "%v", err)
+				continue
+			}
+			s.HTTP.Headers[k] = expanded
+		}
+	})
+	for i, s := range c.Notify.Sinks {
+		for k, v := range s.Headers {
+			expanded, err := expandEnv(v)
+			if err != nil {
+				probs.addf(fmt.Sprintf("notify.sinks[%d].headers.%s", i, k), "%v", err)
+				continue
+			}
+			s.Headers[k] = expanded
+		}
+	}
+}
+
+func expandEnv(s string) (string, error) {
+	var missing []string
+	out := envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRef.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+func readSecretFile(path, configDir string) (string, error) {
+	if !filepath.IsAbs(path) {
+		if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+			path = filepath.Join(dir, path)
+		} else {
+			path = filepath.Join(configDir, path)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	v := strings.TrimRight(string(data), "\r\n")
+	if v == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return v, nil
+}
+
+// Redacted returns a copy of the config with secret values and sensitive HTTP
+// headers replaced, safe to print or log.
+func (c *Config) Redacted() *Config {
+	out := *c
+	out.Backend.BackendSpec = c.Backend.BackendSpec.clone()
+	if len(c.Backend.Backends) > 0 {
+		out.Backend.Backends = make([]BackendSpec, len(c.Backend.Backends))
+		for i, s := range c.Backend.Backends {
+			out.Backend.Backends[i] = s.clone()
+		}
+	}
+	if len(c.Notify.Sinks) > 0 {
+		out.Notify.Sinks = make([]NotifySink, len(c.Notify.Sinks))
+		for i, s := range c.Notify.Sinks {
+			s.Headers = redactHeaders(s.Headers)
+			out.Notify.Sinks[i] = s
+		}
+	}
+	for _, f := range out.secretFields() {
+		if *f.value != "" {
+			*f.value = Redacted
+		}
+	}
+	return &out
+}
+
+// clone copies the backend settings so secrets can be replaced in the copy.
+// Sensitive HTTP headers are redacted.
+func (s BackendSpec) clone() BackendSpec {
+	if h := s.HTTP; h != nil {
+		cp := *h
+		cp.Headers = redactHeaders(h.Headers)
+		s.HTTP = &cp
+	}
+	if v := s.Vultr; v != nil {
+		cp := *v
+		s.Vultr = &cp
+	}
+	if p := s.Proxmox; p != nil {
+		cp := *p
+		s.Proxmox = &cp
+	}
+	return s
+}
+
+// redactHeaders returns a copy of headers with sensitive values replaced.
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	out := make(map[string]string, len(headers))
+	for k, v := range headers {
+		if sensitiveHeader(k) {
+			v = Redacted
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// sensitiveHeader reports whether an HTTP header likely carries a credential.
+func sensitiveHeader(name string) bool {
+	n := strings.ToLower(name)
+	if n == "authorization" || n == "cookie" || n == "proxy-authorization" {
+		return true
+	}
+	for _, s := range []string{"token", "key", "secret", "password", "auth"} {
+		if strings.Contains(n, s) {
+			return true
+		}
+	}
+	return false
+}
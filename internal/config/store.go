@@ -1,10 +1,19 @@
 package config
 
-import "sync/atomic"
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Subscriber is notified after the configuration is replaced.
+type Subscriber func(old, cur *Config)
 
 // Store holds the current configuration and supports atomic swaps.
 type Store struct {
 	v atomic.Value // *Config
+
+	mu   sync.Mutex // serializes updates and subscriber notification
+	subs []Subscriber
 }
 
 // NewStore creates a Store with the initial configuration.
@@ -27,7 +36,22 @@ func (s *Store) Current() *Config {
 	return cfg
 }
 
-// Update replaces the current configuration.
+// Subscribe registers fn to be called after every Update, in registration order.
+func (s *Store) Subscribe(fn Subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs = append(s.subs, fn)
+}
+
+// Update replaces the current configuration and notifies subscribers so they
+// can rebuild whatever depends on the changed settings. Subscribers run
+// synchronously on the caller's goroutine.
 func (s *Store) Update(cfg *Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.Current()
 	s.v.Store(cfg)
+	for _, fn := range s.subs {
+		fn(old, cfg)
+	}
 }
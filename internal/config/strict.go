@@ -0,0 +1,288 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Position is a location in a config file. Line and Column are 1-based; zero
+// means unknown.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	switch {
+	case p.Line == 0:
+		return p.File
+	case p.Column == 0:
+		return fmt.Sprintf("%s:%d", p.File, p.Line)
+	default:
+		return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+	}
+}
+
+// Problem is a single configuration error.
+type Problem struct {
+	Pos     Position
+	Path    string // e.g. "rules[2].max_errors"; empty if not tied to a field
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Path == "" {
+		return fmt.Sprintf("%s: %s", p.Pos, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", p.Pos, p.Path, p.Message)
+}
+
+// ValidationError lists every problem found while loading a config.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].String()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d problems:", len(e.Problems))
+	for _, p := range e.Problems {
+		b.WriteString("\n  ")
+		b.WriteString(p.String())
+	}
+	return b.String()
+}
+
+// problems collects errors together with the source position of every config
+// path, so semantic checks can point at the offending line.
+type problems struct {
+	main string              // main config file, used when a path has no position
+	pos  map[string]Position // config path -> position of its value
+	list []Problem
+}
+
+func newProblems(mainFile string) *problems {
+	return &problems{main: mainFile, pos: make(map[string]Position)}
+}
+
+// addf records a problem at path, located at the closest known ancestor.
+// A path that already has a problem, e.g. a value that failed to decode, is
+// not reported again.
+func (p *problems) addf(path, format string, args ...any) {
+	for _, prev := range p.list {
+		if prev.Path == path {
+			return
+		}
+	}
+	p.list = append(p.list, Problem{Pos: p.lookup(path), Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (p *problems) lookup(path string) Position {
+	for {
+		if pos, ok := p.pos[path]; ok {
+			return pos
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i <= 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return Position{File: p.main}
+}
+
+func (p *problems) err() error {
+	if len(p.list) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: p.list}
+}
+
+// decodeStrict decodes a YAML document into out, recording unknown fields,
+// type mismatches and the position of every path. remap rewrites a path in
+// this document to its path in the merged config (nil keeps it). Only YAML
+// syntax errors are returned directly.
+func decodeStrict(file string, data []byte, out any, probs *problems, remap func(string) string) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil // empty document
+	}
+	if remap == nil {
+		remap = func(p string) string { return p }
+	}
+	root := doc.Content[0]
+
+	scalars := make(map[int]Problem) // line -> last scalar value on it
+	indexPositions(root, "", func(path string, n *yaml.Node) {
+		pos := Position{File: file, Line: n.Line, Column: n.Column}
+		probs.pos[remap(path)] = pos
+		if n.Kind == yaml.ScalarNode {
+			scalars[n.Line] = Problem{Pos: pos, Path: remap(path)}
+		}
+	})
+	checkFields(file, root, reflect.TypeOf(out), "", probs, remap)
+
+	if err := root.Decode(out); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		for _, msg := range typeErr.Errors {
+			probs.list = append(probs.list, typeProblem(file, msg, scalars))
+		}
+	}
+	return nil
+}
+
+// indexPositions calls visit for n and every mapping value and sequence item below it.
+func indexPositions(n *yaml.Node, path string, visit func(path string, n *yaml.Node)) {
+	visit(path, n)
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			indexPositions(n.Content[i+1], joinPath(path, n.Content[i].Value), visit)
+		}
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			indexPositions(item, fmt.Sprintf("%s[%d]", path, i), visit)
+		}
+	}
+}
+
+// checkFields reports mapping keys that do not correspond to a field of t.
+func checkFields(file string, n *yaml.Node, t reflect.Type, path string, probs *problems, remap func(string) string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return // reported as a type error by the decoder
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, val := n.Content[i], n.Content[i+1]
+			child := joinPath(path, key.Value)
+			ft, ok := fields[key.Value]
+			if !ok {
+				msg := "unknown field"
+				if s := suggest(key.Value, fields); s != "" {
+					msg += fmt.Sprintf(" (did you mean %q?)", s)
+				}
+				probs.list = append(probs.list, Problem{
+					Pos:     Position{File: file, Line: key.Line, Column: key.Column},
+					Path:    remap(child),
+					Message: msg,
+				})
+				continue
+			}
+			checkFields(file, val, ft, child, probs, remap)
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, item := range n.Content {
+			checkFields(file, item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), probs, remap)
+		}
+	}
+}
+
+// yamlFields maps YAML keys to field types for a struct, including the
+// fields of ",inline" structs.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if opts == "inline" && f.Type.Kind() == reflect.Struct {
+			for k, v := range yamlFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// suggest returns the known field closest to name, if it is a likely typo.
+func suggest(name string, fields map[string]reflect.Type) string {
+	best, bestDist := "", 3
+	for f := range fields {
+		if d := editDistance(name, f); d < bestDist || (d == bestDist && f < best) {
+			best, bestDist = f, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+var typeErrLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// typeProblem converts a yaml.TypeError message ("line N: ...") into a
+// Problem, attributed to the scalar value on that line when there is one.
+func typeProblem(file, msg string, scalars map[int]Problem) Problem {
+	m := typeErrLine.FindStringSubmatch(msg)
+	if m == nil {
+		return Problem{Pos: Position{File: file}, Message: msg}
+	}
+	line, _ := strconv.Atoi(m[1])
+	p, ok := scalars[line]
+	if !ok {
+		p = Problem{Pos: Position{File: file, Line: line}}
+	}
+	p.Message = m[2]
+	return p
+}
+
+func joinPath(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
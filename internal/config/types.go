@@ -4,10 +4,28 @@ import "time"
 
 // Config is the root configuration structure loaded from YAML.
 type Config struct {
-	Logging LoggingConfig `yaml:"logging"`
-	Log     LogConfig     `yaml:"log"`
-	Rules   []Rule        `yaml:"rules"`
-	Backend BackendConfig `yaml:"backend"`
+	Logging  LoggingConfig  `yaml:"logging"`
+	Log      LogConfig      `yaml:"log"`
+	Pipeline PipelineConfig `yaml:"pipeline"`
+	Rules    []Rule         `yaml:"rules"`
+	Backend  BackendConfig  `yaml:"backend"`
+	Admin    AdminConfig    `yaml:"admin"`
+	Metrics  MetricsConfig  `yaml:"metrics"`
+	Audit    AuditConfig    `yaml:"audit"`
+	Notify   NotifyConfig   `yaml:"notify"`
+	Report   ReportConfig   `yaml:"report"`
+	Shutdown ShutdownConfig `yaml:"shutdown"`
+
+	// StateDir holds state that must survive a restart: active bans and
+	// backend calls waiting to be retried. Defaults to DefaultStateDir.
+	StateDir string `yaml:"state_dir,omitempty"`
+
+	// Additional files contributing rules and whitelist entries.
+	Include  []string `yaml:"include,omitempty"`   // globs, relative to this file
+	RulesDir string   `yaml:"rules_dir,omitempty"` // *.yaml fragments; defaults to rules.d next to this file
+
+	// Sources lists every file the config was loaded from, main file first.
+	Sources []string `yaml:"-"`
 }
 
 // LoggingConfig controls log verbosity and format.
@@ -20,31 +38,206 @@ type LoggingConfig struct {
 type LogConfig struct {
 	Path   string `yaml:"path"`   // e.g. /var/log/nginx/access.log
 	Parser string `yaml:"parser"` // e.g. "nginx_combined"
+
+	// Parse error handling.
+	ErrorLogInterval  time.Duration `yaml:"error_log_interval,omitempty"`  // at most one parse error logged per interval
+	QuarantineFile    string        `yaml:"quarantine_file,omitempty"`     // append unparseable lines here
+	QuarantineMaxSize int64         `yaml:"quarantine_max_size,omitempty"` // bytes; stop quarantining once reached
+	SelfCheckLines    int           `yaml:"self_check_lines,omitempty"`    // lines parsed at startup to verify the parser; -1 disables
+}
+
+// PipelineConfig sizes the queues between pipeline stages and decides what
+// happens when a stage falls behind.
+type PipelineConfig struct {
+	LinesBuffer     int    `yaml:"lines_buffer,omitempty"`     // tailer -> parser
+	EventsBuffer    int    `yaml:"events_buffer,omitempty"`    // parser -> rule engine
+	DecisionsBuffer int    `yaml:"decisions_buffer,omitempty"` // rule engine -> ban manager
+	OverloadPolicy  string `yaml:"overload_policy,omitempty"`  // "block", "drop_oldest", "drop_newest", "sample"; decisions always block
+	SampleRate      int    `yaml:"sample_rate,omitempty"`      // keep 1 in N items when full (policy "sample")
+
+	// Concurrency for high-traffic logs. Per-IP event order is preserved either way.
+	ParseWorkers int `yaml:"parse_workers,omitempty"` // goroutines parsing lines
+	EngineShards int `yaml:"engine_shards,omitempty"` // rule state shards, each evaluated on its own goroutine
+
+	// Raw log lines kept per tracked IP and attached to bans as evidence; -1 disables.
+	EvidenceLines int `yaml:"evidence_lines,omitempty"`
+}
+
+// AdminConfig controls the local admin API, served over a Unix socket.
+// Access is granted by file permissions: the socket is mode 0600 (owner
+// only), or 0660 when Group is set.
+type AdminConfig struct {
+	Disabled bool   `yaml:"disabled,omitempty"`
+	Socket   string `yaml:"socket,omitempty"` // default /run/foxhole-fw/admin.sock
+	Group    string `yaml:"group,omitempty"`  // group allowed to connect
+}
+
+// MetricsConfig controls the Prometheus metrics endpoint. Metrics are always
+// available at /metrics on the admin socket; Listen additionally serves them
+// over TCP for a scraper.
+type MetricsConfig struct {
+	Listen string `yaml:"listen,omitempty"` // e.g. 127.0.0.1:9477; empty disables
+}
+
+// AuditConfig controls the audit log: one JSON line per ban, unban or skipped
+// ban, kept apart from the operational log for abuse reports and compliance.
+type AuditConfig struct {
+	Path       string `yaml:"path,omitempty"`        // empty disables the audit log
+	MaxSize    int64  `yaml:"max_size,omitempty"`    // bytes; rotate once reached
+	MaxBackups int    `yaml:"max_backups,omitempty"` // rotated files kept as path.1 ... path.N
+	MaxLines   int    `yaml:"max_lines,omitempty"`   // raw log lines recorded per ban
+}
+
+// NotifyConfig sends ban events to webhooks and chat rooms. Once more than
+// Burst messages were sent in an Interval, further events are held back and
+// sent as one digest at the end of the interval.
+type NotifyConfig struct {
+	Actions      []string      `yaml:"actions,omitempty"`       // ban, unban, skip, extend; default ban
+	Interval     time.Duration `yaml:"interval,omitempty"`      // rate limit window
+	Burst        int           `yaml:"burst,omitempty"`         // messages per interval before digesting
+	Retries      int           `yaml:"retries,omitempty"`       // attempts after a failed one; -1 disables
+	RetryBackoff time.Duration `yaml:"retry_backoff,omitempty"` // first retry delay, doubled after each attempt
+	Timeout      time.Duration `yaml:"timeout,omitempty"`       // per request
+	Sinks        []NotifySink  `yaml:"sinks,omitempty"`
+}
+
+// NotifySink is one notification target.
+// Secrets may use ${ENV_VAR} references or be read from a *_file.
+type NotifySink struct {
+	Name string `yaml:"name,omitempty"` // shown in logs and metrics; defaults to the type
+	Type string `yaml:"type"`           // "webhook", "slack", "matrix"
+
+	// webhook and slack (Slack-compatible endpoints such as Discord's /slack URL)
+	URL     string            `yaml:"url,omitempty"`
+	URLFile string            `yaml:"url_file,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"` // webhook only; values support ${ENV_VAR}
+
+	// matrix
+	Homeserver      string `yaml:"homeserver,omitempty"` // e.g. https://matrix.org
+	RoomID          string `yaml:"room_id,omitempty"`
+	AccessToken     string `yaml:"access_token,omitempty"`
+	AccessTokenFile string `yaml:"access_token_file,omitempty"`
+
+	// Go templates; the webhook body, or the message text for slack and matrix.
+	Template       string `yaml:"template,omitempty"`        // one event
+	DigestTemplate string `yaml:"digest_template,omitempty"` // events held back by the rate limit
+}
+
+// ReportConfig schedules an email summary of the bans recorded in the audit
+// log over the past day or week.
+type ReportConfig struct {
+	Schedule string     `yaml:"schedule,omitempty"` // "daily" or "weekly"; empty sends none on its own
+	At       string     `yaml:"at,omitempty"`       // local time of day, "HH:MM"; default 08:00
+	Weekday  string     `yaml:"weekday,omitempty"`  // weekly reports only; default monday
+	Top      int        `yaml:"top,omitempty"`      // entries per top list
+	Subject  string     `yaml:"subject,omitempty"`  // default "foxhole-fw <schedule> report for <host>"
+	SMTP     SMTPConfig `yaml:"smtp"`
+}
+
+// SMTPConfig is the mail server reports are sent through.
+// The password may use a ${ENV_VAR} reference or be read from a file.
+type SMTPConfig struct {
+	Host         string        `yaml:"host"`
+	Port         int           `yaml:"port,omitempty"` // default 587, or 465 with tls
+	TLS          bool          `yaml:"tls,omitempty"`  // implicit TLS; otherwise STARTTLS is used when offered
+	Username     string        `yaml:"username,omitempty"`
+	Password     string        `yaml:"password,omitempty"`
+	PasswordFile string        `yaml:"password_file,omitempty"`
+	From         string        `yaml:"from"`
+	To           []string      `yaml:"to"`
+	Timeout      time.Duration `yaml:"timeout,omitempty"`
+}
+
+// Shutdown policies: what happens to installed bans when the daemon stops.
+const (
+	ShutdownKeep   = "keep"   // leave them installed and resume them on the next start
+	ShutdownRemove = "remove" // lift them before exiting
+)
+
+// ShutdownConfig decides what happens to active bans on SIGTERM. Backend
+// calls still in flight, and the unbans of ShutdownRemove, get DrainTimeout
+// to finish before the daemon exits.
+type ShutdownConfig struct {
+	Policy       string        `yaml:"policy,omitempty"` // ShutdownKeep (default) or ShutdownRemove
+	DrainTimeout time.Duration `yaml:"drain_timeout,omitempty"`
 }
 
 // Rule defines expected request properties and thresholds.
 type Rule struct {
 	ID          string        `yaml:"id"`
 	Description string        `yaml:"description,omitempty"`
-	Method      string        `yaml:"method"`       // e.g. GET, POST
-	Path        string        `yaml:"path"`         // exact path for MVP
-	MaxErrors   int           `yaml:"max_errors"`   // number of 4xx/5xx from same IP
-	Window      time.Duration `yaml:"window"`       // rolling window (e.g. "1m")
-	BanDuration time.Duration `yaml:"ban_duration"` // how long to ban IP
+	Method      string        `yaml:"method"`             // e.g. GET, POST
+	Path        string        `yaml:"path"`               // exact path for MVP
+	MaxErrors   int           `yaml:"max_errors"`         // number of 4xx/5xx from same IP
+	Window      time.Duration `yaml:"window"`             // rolling window (e.g. "1m")
+	BanDuration time.Duration `yaml:"ban_duration"`       // how long to ban IP
+	Backends    []string      `yaml:"backends,omitempty"` // backend names to ban on; default all
 }
 
-// BackendConfig selects and configures the firewall backend.
+// Backend modes: how bans are spread over several backends.
+const (
+	BackendModeFanout   = "fanout"   // ban on every backend
+	BackendModeFallback = "fallback" // ban on the first backend that succeeds, in order
+)
+
+// BackendConfig selects and configures the firewall backends. A single
+// backend is configured inline (type and its section); several are listed
+// in Backends and combined according to Mode.
 type BackendConfig struct {
-	Type string `yaml:"type"` // "iptables", "http_api", "vultr", "proxmox"`
+	BackendSpec `yaml:",inline"`
+
+	Backends []BackendSpec `yaml:"backends,omitempty"`
+	Mode     string        `yaml:"mode,omitempty"` // BackendModeFanout (default) or BackendModeFallback
+
+	// Global behavior flags.
+	DryRun    bool     `yaml:"dry_run,omitempty"`   // if true, do not actually ban/unban, just log
+	Whitelist []string `yaml:"whitelist,omitempty"` // CIDR or IPs never to ban
+
+	// Backend calls run on a worker pool so a slow API does not stall rule evaluation.
+	Workers   int `yaml:"workers,omitempty"`    // concurrent backend calls
+	QueueSize int `yaml:"queue_size,omitempty"` // pending backend calls before decisions block
+
+	Retry RetryConfig `yaml:"retry"`
+}
+
+// RetryConfig controls how failed ban and unban calls are retried. The delay
+// before each retry doubles, up to MaxBackoff, and is randomized by Jitter so
+// many failed calls do not hit a recovering API at once.
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"max_attempts,omitempty"` // calls per ban or unban, the first included; -1 retries until the ban expires
+	Backoff     time.Duration `yaml:"backoff,omitempty"`      // delay before the first retry
+	MaxBackoff  time.Duration `yaml:"max_backoff,omitempty"`
+	Jitter      float64       `yaml:"jitter,omitempty"` // each delay varies by up to this fraction, 0..1; -1 disables
+}
+
+// BackendSpec configures one firewall backend.
+type BackendSpec struct {
+	Name string `yaml:"name,omitempty"` // defaults to the type; referenced by rules[].backends
+	Type string `yaml:"type,omitempty"` // "iptables", "http_api", "vultr", "proxmox"
 
 	IPTables *IPTablesConfig `yaml:"iptables,omitempty"`
 	HTTP     *HTTPAPIConfig  `yaml:"http_api,omitempty"`
 	Vultr    *VultrConfig    `yaml:"vultr,omitempty"`
 	Proxmox  *ProxmoxConfig  `yaml:"proxmox,omitempty"`
+}
 
-	// Global behavior flags.
-	DryRun    bool     `yaml:"dry_run,omitempty"`   // if true, do not actually ban/unban, just log
-	Whitelist []string `yaml:"whitelist,omitempty"` // CIDR or IPs never to ban
+// Specs returns the configured backends in order: Backends if set, else the
+// inline backend.
+func (b *BackendConfig) Specs() []BackendSpec {
+	if len(b.Backends) > 0 {
+		return b.Backends
+	}
+	return []BackendSpec{b.BackendSpec}
+}
+
+// Spec returns the backend named name.
+func (b *BackendConfig) Spec(name string) (BackendSpec, bool) {
+	for _, s := range b.Specs() {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return BackendSpec{}, false
 }
 
 // IPTablesConfig controls iptables backend behavior.
@@ -54,23 +247,28 @@ type IPTablesConfig struct {
 }
 
 // HTTPAPIConfig controls the generic HTTP firewall API backend.
+// Secrets may use ${ENV_VAR} references or be read from a *_file.
 type HTTPAPIConfig struct {
-	URL       string            `yaml:"url"`
-	AuthToken string            `yaml:"auth_token,omitempty"`
-	Headers   map[string]string `yaml:"headers,omitempty"`
+	URL           string            `yaml:"url"`
+	AuthToken     string            `yaml:"auth_token,omitempty"`
+	AuthTokenFile string            `yaml:"auth_token_file,omitempty"`
+	Headers       map[string]string `yaml:"headers,omitempty"` // values support ${ENV_VAR}
 }
 
 // VultrConfig configures the Vultr firewall backend.
 type VultrConfig struct {
 	APIKey     string `yaml:"api_key"`
-	FirewallID string `yaml:"firewall_id"` // firewall group ID
+	APIKeyFile string `yaml:"api_key_file,omitempty"`
+	FirewallID string `yaml:"firewall_id"`       // firewall group ID
+	APIURL     string `yaml:"api_url,omitempty"` // default DefaultVultrAPIURL
 }
 
 // ProxmoxConfig configures the Proxmox firewall backend.
 type ProxmoxConfig struct {
-	APIURL      string `yaml:"api_url"` // e.g. https://proxmox.local:8006/api2/json
-	TokenID     string `yaml:"token_id"`
-	TokenSecret string `yaml:"token_secret"`
-	Node        string `yaml:"node"`
-	VMID        string `yaml:"vmid"` // optional; if empty, apply at node level
+	APIURL          string `yaml:"api_url"` // e.g. https://proxmox.local:8006/api2/json
+	TokenID         string `yaml:"token_id"`
+	TokenSecret     string `yaml:"token_secret"`
+	TokenSecretFile string `yaml:"token_secret_file,omitempty"`
+	Node            string `yaml:"node"`
+	VMID            string `yaml:"vmid"` // optional; if empty, apply at node level
 }
@@ -1,30 +1,141 @@
 package config
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
+// watchDebounce is how long the watcher waits after the last filesystem event
+// before reloading, so editors and atomic writers finish first.
+const watchDebounce = 300 * time.Millisecond
+
 // Logger defines the logging interface needed by the config watcher.
 type Logger interface {
-	Infof(string, ...any)
-	Errorf(string, ...any)
+	Info(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// ReloadStatus describes the outcome of the most recent reload attempt.
+type ReloadStatus struct {
+	Time        time.Time `json:"time"`    // zero if no reload was attempted yet
+	Trigger     string    `json:"trigger"` // what caused it, e.g. "file change" or "SIGHUP"
+	OK          bool      `json:"ok"`
+	Error       string    `json:"error,omitempty"`
+	Changes     string    `json:"changes,omitempty"`
+	LastSuccess time.Time `json:"last_success"`
+}
+
+// Reloader loads the config file into a Store on demand, either from a
+// filesystem watch or an explicit request such as SIGHUP, and records the outcome.
+type Reloader struct {
+	path   string
+	store  *Store
+	logger Logger
+
+	mu       sync.Mutex
+	status   ReloadStatus
+	lastHash [sha256.Size]byte
+}
+
+// NewReloader creates a Reloader for the file the store's config was loaded from.
+func NewReloader(path string, store *Store, logger Logger) *Reloader {
+	r := &Reloader{
+		path:   path,
+		store:  store,
+		logger: logger,
+	}
+	r.lastHash, _ = hashSources(path)
+	return r
+}
+
+// Status returns the outcome of the most recent reload attempt.
+func (r *Reloader) Status() ReloadStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// Reload loads the config file and, if it is valid and differs from the
+// current config, updates the store so subscribers rebuild what changed.
+// On error the old config is kept. trigger is recorded in the status.
+func (r *Reloader) Reload(trigger string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reloadLocked(trigger)
+}
+
+func (r *Reloader) reloadLocked(trigger string) error {
+	r.logger.Info("config reload requested", "trigger", trigger, "path", r.path)
+	r.status.Time = time.Now()
+	r.status.Trigger = trigger
+
+	// Remember what was attempted, valid or not, so unrelated directory events
+	// do not retry a broken file until it changes again.
+	if hash, err := hashSources(r.path); err == nil {
+		r.lastHash = hash
+	}
+
+	cfg, err := Load(r.path)
+	if err != nil {
+		r.status.OK = false
+		r.status.Error = err.Error()
+		r.status.Changes = ""
+		r.logger.Error("config reload failed", "path", r.path, "err", err)
+		return err
+	}
+
+	changes := Diff(r.store.Current(), cfg)
+	r.status.OK = true
+	r.status.Error = ""
+	r.status.Changes = changes.String()
+	r.status.LastSuccess = r.status.Time
+	if changes.Empty() {
+		r.logger.Info("config reloaded", "changes", "none")
+		return nil
+	}
+	r.store.Update(cfg)
+	r.logger.Info("config reloaded", "changes", changes.String())
+	return nil
 }
 
-// WatchFile watches a single config file for changes and reloads it into the Store.
-// On successful reload, the store is updated; on error, the old config is kept.
+// reloadIfChanged reloads only if the config or any included file differs from
+// the last load, which filters out unrelated events in the watched directories.
+func (r *Reloader) reloadIfChanged(trigger string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hash, err := hashSources(r.path)
+	if err == nil && hash == r.lastHash {
+		return
+	}
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		// Mid-swap; the create event that follows triggers the reload.
+		return
+	}
+	_ = r.reloadLocked(trigger)
+}
+
+// Watch watches the directories holding the config file, its included files
+// and the rules directory (plus symlink targets) rather than the files
+// themselves, so new rule files and replacements by rename or symlink swap —
+// as done by Kubernetes ConfigMaps and atomic writers — are noticed.
 // Returns a stop function to cleanly shut down the watcher, or an error if setup fails.
-func WatchFile(path string, store *Store, logger Logger) (stop func(), err error) {
+func (r *Reloader) Watch() (stop func(), err error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, fmt.Errorf("create watcher: %w", err)
 	}
 
-	if err := watcher.Add(path); err != nil {
-		watcher.Close()
-		return nil, fmt.Errorf("watch file: %w", err)
+	for _, dir := range watchPaths(r.path) {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("watch %s: %w", dir, err)
+		}
 	}
 
 	done := make(chan struct{})
@@ -32,37 +143,28 @@ func WatchFile(path string, store *Store, logger Logger) (stop func(), err error
 	go func() {
 		defer watcher.Close()
 
-		var lastEvent time.Time
+		var debounce <-chan time.Time
 		for {
 			select {
 			case <-done:
 				return
-			case ev, ok := <-watcher.Events:
+			case _, ok := <-watcher.Events:
 				if !ok {
 					return
 				}
-				// Debounce rapid successive events.
-				now := time.Now()
-				if now.Sub(lastEvent) < 500*time.Millisecond {
-					continue
-				}
-				lastEvent = now
-
-				if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
-					logger.Infof("config file change detected: %s", ev.Name)
-					cfg, err := Load(path)
-					if err != nil {
-						logger.Errorf("failed to reload config: %v", err)
-						continue
-					}
-					store.Update(cfg)
-					logger.Infof("config reloaded successfully")
+				debounce = time.After(watchDebounce)
+			case <-debounce:
+				debounce = nil
+				r.reloadIfChanged("file change")
+				// A symlink swap or new include may have added directories.
+				for _, dir := range watchPaths(r.path) {
+					_ = watcher.Add(dir)
 				}
 			case err, ok := <-watcher.Errors:
 				if !ok {
 					return
 				}
-				logger.Errorf("config watcher error: %v", err)
+				r.logger.Error("config watcher error", "err", err)
 			}
 		}
 	}()
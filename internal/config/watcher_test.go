@@ -0,0 +1,182 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingLogger counts reload attempts.
+type countingLogger struct {
+	mu       sync.Mutex
+	attempts int
+}
+
+func (l *countingLogger) Info(msg string, _ ...any) {
+	if msg == "config reload requested" {
+		l.mu.Lock()
+		l.attempts++
+		l.mu.Unlock()
+	}
+}
+
+func (l *countingLogger) Error(string, ...any) {}
+
+func (l *countingLogger) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.attempts
+}
+
+const loginFragment = `rules:
+  - id: login
+    max_errors: 5
+    window: 1m
+    ban_duration: 1h
+    method: POST
+    path: /login
+`
+
+// startWatch loads the config at path and watches it until the test ends.
+func startWatch(t *testing.T, path string) (*Reloader, *Store, *countingLogger) {
+	t.Helper()
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(cfg)
+	logger := &countingLogger{}
+	r := NewReloader(path, store, logger)
+	stop, err := r.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	return r, store, logger
+}
+
+// replace writes content to a temporary file next to path and renames it over path.
+func replace(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := writeFile(t, filepath.Dir(path), "."+filepath.Base(path)+".tmp", content)
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func ruleMaxErrors(cfg *Config, id string) int {
+	for _, r := range cfg.Rules {
+		if r.ID == id {
+			return r.MaxErrors
+		}
+	}
+	return 0
+}
+
+func TestWatchReloadsOnce(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, config, fragment string)
+		rule   string
+	}{
+		{"write config", func(t *testing.T, config, _ string) {
+			writeFile(t, filepath.Dir(config), filepath.Base(config), strings.Replace(baseConfig, "max_errors: 10", "max_errors: 20", 1)+"include:\n  - conf.d/*.yaml\n")
+		}, "errors"},
+		{"rename config", func(t *testing.T, config, _ string) {
+			replace(t, config, strings.Replace(baseConfig, "max_errors: 10", "max_errors: 20", 1)+"include:\n  - conf.d/*.yaml\n")
+		}, "errors"},
+		{"write fragment", func(t *testing.T, _, fragment string) {
+			writeFile(t, filepath.Dir(fragment), filepath.Base(fragment), strings.Replace(loginFragment, "max_errors: 5", "max_errors: 20", 1))
+		}, "login"},
+		{"rename fragment", func(t *testing.T, _, fragment string) {
+			replace(t, fragment, strings.Replace(loginFragment, "max_errors: 5", "max_errors: 20", 1))
+		}, "login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			config := writeFile(t, dir, "config.yaml", baseConfig+"include:\n  - conf.d/*.yaml\n")
+			fragment := writeFile(t, dir, "conf.d/login.yaml", loginFragment)
+			r, store, logger := startWatch(t, config)
+
+			tt.change(t, config, fragment)
+			eventually(t, "the reload", func() bool { return ruleMaxErrors(store.Current(), tt.rule) == 20 })
+			if s := r.Status(); !s.OK || s.Trigger != "file change" {
+				t.Errorf("status = %+v, want a successful file change reload", s)
+			}
+
+			// Give a second, undebounced reload time to happen.
+			time.Sleep(3 * watchDebounce)
+			if n := logger.count(); n != 1 {
+				t.Errorf("%d reload attempts, want 1", n)
+			}
+		})
+	}
+}
+
+func TestWatchIgnoresUnchangedSources(t *testing.T) {
+	dir := t.TempDir()
+	config := writeFile(t, dir, "config.yaml", baseConfig)
+	r, _, logger := startWatch(t, config)
+
+	// Rewriting the same content and touching other files keeps the hash.
+	writeFile(t, dir, "config.yaml", baseConfig)
+	replace(t, config, baseConfig)
+	writeFile(t, dir, "notes.txt", "unrelated")
+
+	time.Sleep(3 * watchDebounce)
+	if n := logger.count(); n != 0 {
+		t.Errorf("%d reload attempts, want none", n)
+	}
+	if s := r.Status(); !s.Time.IsZero() {
+		t.Errorf("status = %+v, want no reload recorded", s)
+	}
+}
+
+func TestReloadFailureKeepsConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.yaml", baseConfig)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(cfg)
+	r := NewReloader(path, store, &countingLogger{})
+
+	writeFile(t, dir, "config.yaml", strings.Replace(baseConfig, "max_errors: 10", "max_errors: -1", 1))
+	if err := r.Reload("SIGHUP"); err == nil {
+		t.Fatal("Reload of an invalid config succeeded")
+	}
+	s := r.Status()
+	if s.OK || s.Error == "" || s.Trigger != "SIGHUP" || !s.LastSuccess.IsZero() {
+		t.Errorf("status after a failed reload = %+v", s)
+	}
+	if store.Current() != cfg {
+		t.Error("failed reload replaced the config")
+	}
+
+	writeFile(t, dir, "config.yaml", strings.Replace(baseConfig, "max_errors: 10", "max_errors: 20", 1))
+	if err := r.Reload("SIGHUP"); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if s := r.Status(); !s.OK || s.Error != "" || !s.LastSuccess.Equal(s.Time) || s.Changes == "" {
+		t.Errorf("status after a fixed reload = %+v", s)
+	}
+	if got := ruleMaxErrors(store.Current(), "errors"); got != 20 {
+		t.Errorf("max_errors = %d after reload, want 20", got)
+	}
+}
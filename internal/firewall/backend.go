@@ -19,18 +19,55 @@ type Backend interface {
 	Name() string
 }
 
-// NewBackend constructs a Backend from configuration.
-func NewBackend(cfg *config.Config, logger *logging.Logger) (Backend, error) {
-	switch cfg.Backend.Type {
+// NewBackend constructs the Backend described by spec. A backend whose
+// configured name differs from its type reports the configured name.
+func NewBackend(spec *config.BackendSpec, logger *logging.Logger) (Backend, error) {
+	var b Backend
+	switch spec.Type {
 	case "iptables":
-		return NewIPTablesBackend(cfg.Backend.IPTables, logger), nil
+		b = NewIPTablesBackend(spec.IPTables, logger)
 	case "http_api":
-		return NewHTTPAPIBackend(cfg.Backend.HTTP, logger), nil
+		b = NewHTTPAPIBackend(spec.HTTP, logger)
 	case "vultr":
-		return NewVultrBackend(cfg.Backend.Vultr, logger), nil
+		b = NewVultrBackend(spec.Vultr, logger)
 	case "proxmox":
-		return NewProxmoxBackend(cfg.Backend.Proxmox, logger), nil
+		b = NewProxmoxBackend(spec.Proxmox, logger)
 	default:
-		return nil, fmt.Errorf("unsupported backend.type %q", cfg.Backend.Type)
+		return nil, fmt.Errorf("unsupported backend type %q", spec.Type)
 	}
+	if spec.Name != "" && spec.Name != b.Name() {
+		b = namedBackend{Backend: b, name: spec.Name}
+	}
+	return b, nil
+}
+
+// NewBackends constructs every configured backend, in order.
+func NewBackends(cfg *config.BackendConfig, logger *logging.Logger) ([]Backend, error) {
+	specs := cfg.Specs()
+	backends := make([]Backend, 0, len(specs))
+	for i := range specs {
+		b, err := NewBackend(&specs[i], logger)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", specs[i].Name, err)
+		}
+		backends = append(backends, b)
+	}
+	return backends, nil
+}
+
+// namedBackend reports a configured name instead of the backend type.
+type namedBackend struct {
+	Backend
+	name string
+}
+
+func (b namedBackend) Name() string { return b.name }
+
+// AsProber returns b as a Prober if the underlying backend implements it.
+func AsProber(b Backend) (Prober, bool) {
+	if n, ok := b.(namedBackend); ok {
+		b = n.Backend
+	}
+	p, ok := b.(Prober)
+	return p, ok
 }
@@ -2,50 +2,202 @@ package firewall
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cyra/foxhole-fw/internal/clock"
 	"github.com/cyra/foxhole-fw/internal/config"
 	"github.com/cyra/foxhole-fw/internal/logging"
 	"github.com/cyra/foxhole-fw/internal/rules"
 )
 
-// banInfo tracks a single active ban.
+// migrateTimeout bounds each backend call made while moving bans to a new backend.
+const migrateTimeout = 30 * time.Second
+
+// Ban states, as reported in ActiveBan.State.
+const (
+	StatePending  = "pending"  // waiting for a backend to accept the ban
+	StateActive   = "active"   // held by at least one backend
+	StateFailed   = "failed"   // no backend accepted the ban and retries gave up
+	StateExpiring = "expiring" // lifted or expired; waiting for backends to remove it
+)
+
+// banInfo tracks a single active ban. It is saved to the state directory
+// on shutdown.
 type banInfo struct {
-	ExpiresAt time.Time
-	RuleID    string
+	ExpiresAt time.Time `json:"expires_at"`
+	RuleID    string    `json:"rule_id"`
+	Reason    string    `json:"reason"`
+	State     string    `json:"state"`
+	DryRun    bool      `json:"-"`                  // recorded in dry-run mode; nothing was installed
+	Evidence  []string  `json:"evidence,omitempty"` // raw log lines that led to the ban
+	Backends  []string  `json:"backends,omitempty"` // backends holding the ban
+	Selected  []string  `json:"selected,omitempty"` // backends the rule bans on; empty means all
+}
+
+// banJob is a backend ban call waiting for a worker.
+type banJob struct {
+	decision *rules.Decision
+	expiry   time.Time
 }
 
-// BanManager consumes decisions and applies bans/unbans via a Backend.
+// BanManager consumes decisions and applies bans/unbans via one or more
+// Backends, remembering which backends hold each ban so unbans go to them.
+// Backend calls run on a pool of workers so a slow backend does not hold up
+// decision processing until the job queue itself is full. Failed calls are
+// retried with backoff until they succeed or use up their attempts.
 type BanManager struct {
-	backend   Backend
-	logger    *logging.Logger
+	logger  *logging.Logger
+	clock   clock.Clock
+	workers int
+	jobs    chan banJob
+	retries *retryQueue
+	expiry  *expiryScheduler
+
+	stateDir string // set by LoadState
+
+	// backendMu guards the backends pointer only; calls take a snapshot
+	// with acquire and are never made under it.
+	backendMu sync.RWMutex
+	backends  *backendSet
+
+	// background bounds backend calls not tied to a decision, such as
+	// migrations; Run cancels it once calls are cut off at shutdown.
+	background     context.Context
+	stopBackground context.CancelFunc
+	migrateMu      sync.Mutex     // serializes migrations
+	migrations     sync.WaitGroup // migrations in progress
+
+	mu        sync.Mutex
 	dryRun    bool
-	whitelist *whitelistMatcher
+	shutdown  config.ShutdownConfig
+	whitelist *Whitelist
+	allowed   []string           // configured whitelist entries
+	extra     []string           // whitelist entries added at runtime
+	bans      map[string]banInfo // ip -> banInfo
 
-	mu   sync.Mutex
-	bans map[string]banInfo // ip -> banInfo
+	subsMu sync.RWMutex
+	subs   []func(BanEvent)
 }
 
-// NewBanManager creates a new BanManager.
-func NewBanManager(backend Backend, backendCfg *config.BackendConfig, logger *logging.Logger) *BanManager {
+// NewBanManager creates a new BanManager for backends, in configured order.
+// Ban expiries and retry delays are measured on clk.
+func NewBanManager(backends []Backend, backendCfg *config.BackendConfig, logger *logging.Logger, clk clock.Clock) *BanManager {
+	workers := backendCfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	queueSize := backendCfg.QueueSize
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	background, stop := context.WithCancel(context.Background())
 	return &BanManager{
-		backend:   backend,
-		logger:    logger,
-		dryRun:    backendCfg.DryRun,
-		whitelist: newWhitelistMatcher(backendCfg),
-		bans:      make(map[string]banInfo),
+		backends:       newBackendSet(backends, backendCfg.Mode),
+		background:     background,
+		stopBackground: stop,
+		logger:         logger,
+		clock:          clk,
+		dryRun:         backendCfg.DryRun,
+		whitelist:      NewWhitelist(backendCfg.Whitelist),
+		allowed:        backendCfg.Whitelist,
+		workers:        workers,
+		jobs:           make(chan banJob, queueSize),
+		retries:        newRetryQueue(backendCfg.Retry, logger, clk),
+		expiry:         newExpiryScheduler(clk),
+		bans:           make(map[string]banInfo),
+		shutdown:       config.ShutdownConfig{Policy: config.ShutdownKeep, DrainTimeout: config.DefaultDrainTimeout},
 	}
 }
 
-// Run starts processing decisions until ctx is done.
+// SetShutdown sets what happens to installed bans when Run returns.
+func (m *BanManager) SetShutdown(cfg config.ShutdownConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.shutdown = cfg
+}
+
+// PendingJobs returns the number of backend calls waiting for a worker.
+func (m *BanManager) PendingJobs() int {
+	return len(m.jobs)
+}
+
+// acquire returns the current backends for making calls on. The caller
+// marks the calls done with set.calls.Done once it has recorded their
+// outcome, so a migration away from set sees it.
+func (m *BanManager) acquire() *backendSet {
+	m.backendMu.RLock()
+	defer m.backendMu.RUnlock()
+	m.backends.calls.Add(1)
+	return m.backends
+}
+
+// BackendName returns the names of the current backends, comma-separated.
+func (m *BanManager) BackendName() string {
+	m.backendMu.RLock()
+	defer m.backendMu.RUnlock()
+	return m.backends.name()
+}
+
+// Run starts processing decisions until ctx is done, then applies the
+// shutdown policy. Backend calls are made on their own context, which
+// outlives ctx by at most the drain timeout, so calls in flight at shutdown
+// can finish; Run returns once they have.
 func (m *BanManager) Run(ctx context.Context, decisions <-chan *rules.Decision) {
+	calls, stopCalls := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopCalls()
+	defer context.AfterFunc(calls, m.stopBackground)()
+	m.resume(calls)
+
+	// Expired bans are lifted until the very end, drain included.
+	var expiring sync.WaitGroup
+	expiring.Add(1)
+	go func() {
+		defer expiring.Done()
+		m.expiry.run(calls, func(ips []string) { m.expire(calls, ips) })
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < m.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.worker(ctx, calls)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.retryLoop(ctx, calls)
+	}()
+
 	for {
 		select {
 		case <-ctx.Done():
-			m.logger.Infof("ban manager shutting down (backend=%s)", m.backend.Name())
+			m.mu.Lock()
+			policy := m.shutdown
+			m.mu.Unlock()
+			m.logger.Info("ban manager shutting down", "backend", m.BackendName(), "policy", policy.Policy, "drain_timeout", policy.DrainTimeout)
+			drain := time.AfterFunc(policy.DrainTimeout, stopCalls)
+			defer drain.Stop()
+			wg.Wait()
+			m.migrations.Wait()
+			m.stop(calls, policy.Policy)
+			stopCalls()
+			expiring.Wait()
 			return
-		case d := <-decisions:
+		case d, ok := <-decisions:
+			if !ok {
+				// Engine has stopped; keep workers running until shutdown.
+				decisions = nil
+				continue
+			}
 			if d == nil {
 				continue
 			}
@@ -57,69 +209,444 @@ func (m *BanManager) Run(ctx context.Context, decisions <-chan *rules.Decision)
 	}
 }
 
-func (m *BanManager) handleDecision(ctx context.Context, d *rules.Decision) {
-	if m.whitelist.Contains(d.IP) {
-		m.logger.Infof("ban skipped (whitelisted ip): ip=%s rule=%s backend=%s", d.IP, d.RuleID, m.backend.Name())
+// Reload applies dry-run, whitelist and shutdown policy changes in place and, if the backend
+// settings changed, builds the new backends and migrates active bans off
+// backends that were changed or removed.
+// Whitelist entries added at runtime are kept.
+// It is meant to be registered with config.Store.Subscribe.
+func (m *BanManager) Reload(old, cur *config.Config) {
+	m.mu.Lock()
+	m.dryRun = cur.Backend.DryRun
+	m.shutdown = cur.Shutdown
+	m.allowed = cur.Backend.Whitelist
+	m.rebuildWhitelist()
+	if old.Backend.DryRun && !cur.Backend.DryRun {
+		// Forget simulated bans so the next violation installs a real one.
+		for ip, info := range m.bans {
+			if info.DryRun {
+				delete(m.bans, ip)
+				m.expiry.cancel(ip)
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	if config.BackendChanged(&old.Backend, &cur.Backend) {
+		set, err := m.rebuildBackends(&old.Backend, &cur.Backend)
+		if err != nil {
+			m.logger.Error("backend not reloaded", "keeping", m.BackendName(), "err", err)
+		} else {
+			m.swapBackends(set)
+		}
+	}
+
+	if !reflect.DeepEqual(old.Backend.Whitelist, cur.Backend.Whitelist) {
+		m.releaseWhitelisted()
+	}
+}
+
+// rebuildWhitelist combines configured and runtime entries. m.mu must be held.
+func (m *BanManager) rebuildWhitelist() {
+	entries := make([]string, 0, len(m.allowed)+len(m.extra))
+	entries = append(entries, m.allowed...)
+	m.whitelist = NewWhitelist(append(entries, m.extra...))
+}
+
+// rebuildBackends builds the backends for cur, reusing the running instance
+// of every backend whose settings did not change.
+func (m *BanManager) rebuildBackends(old, cur *config.BackendConfig) (*backendSet, error) {
+	m.backendMu.RLock()
+	prev := m.backends
+	m.backendMu.RUnlock()
+
+	specs := cur.Specs()
+	backends := make([]Backend, 0, len(specs))
+	for i := range specs {
+		spec := &specs[i]
+		if was, ok := old.Spec(spec.Name); ok && reflect.DeepEqual(was, *spec) {
+			if b := prev.get(spec.Name); b != nil {
+				backends = append(backends, b)
+				continue
+			}
+		}
+		b, err := NewBackend(spec, m.logger)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", spec.Name, err)
+		}
+		backends = append(backends, b)
+	}
+	return newBackendSet(backends, cur.Mode), nil
+}
+
+// swapBackends installs set and, in the background, moves active bans off
+// backends that are no longer in it (removed, or rebuilt with new settings)
+// onto the backends each ban now belongs on. Migrations run one after the
+// other, each once the calls still in flight on the backends it replaces
+// have returned.
+func (m *BanManager) swapBackends(set *backendSet) {
+	m.backendMu.Lock()
+	prev := m.backends
+	m.backends = set
+	m.backendMu.Unlock()
+	m.logger.Info("backend swapped", "old", prev.name(), "new", set.name())
+
+	m.migrations.Add(1)
+	go func() {
+		defer m.migrations.Done()
+		m.migrateMu.Lock()
+		defer m.migrateMu.Unlock()
+		prev.calls.Wait()
+		m.migrate(prev, set)
+	}()
+}
+
+// migrate moves the active bans held by backends of prev that set replaced,
+// making as many backend calls at once as there are workers.
+func (m *BanManager) migrate(prev, set *backendSet) {
+	now := m.clock.Now()
+	moves := make(map[string]banInfo)
+	m.mu.Lock()
+	for ip, info := range m.bans {
+		if info.DryRun || info.State != StateActive || !info.ExpiresAt.After(now) {
+			continue
+		}
+		if slices.ContainsFunc(info.Backends, func(name string) bool { return replaced(prev, set, name) }) {
+			moves[ip] = info
+		}
+	}
+	m.mu.Unlock()
+	if len(moves) == 0 {
 		return
 	}
 
+	var migrated, failed atomic.Int64
+	m.parallel(moves, func(ip string, info banInfo) {
+		if m.migrateBan(prev, set, ip, info) {
+			migrated.Add(1)
+		} else {
+			failed.Add(1)
+		}
+	})
+	m.logger.Info("bans migrated", "old", prev.name(), "new", set.name(), "migrated", migrated.Load(), "failed", failed.Load())
+}
+
+// replaced reports whether the backend called name in prev is not in set.
+func replaced(prev, set *backendSet, name string) bool {
+	b := set.get(name)
+	return b == nil || b != prev.get(name)
+}
+
+// migrateBan installs the ban on ip on the backends of set it belongs on and
+// removes it from the replaced backends of prev. Failed bans are queued for
+// retry; a rule the old backend failed to remove is recorded in the
+// dead-letter file, as nothing will manage it any more. It reports whether
+// the ban moved without a retry.
+func (m *BanManager) migrateBan(prev, set *backendSet, ip string, info banInfo) bool {
+	var keep, stale []string
+	for _, name := range info.Backends {
+		if replaced(prev, set, name) {
+			stale = append(stale, name)
+		} else {
+			keep = append(keep, name)
+		}
+	}
+	var targets []Backend
+	if set.mode != config.BackendModeFallback || len(keep) == 0 {
+		for _, b := range set.targets(info.Selected) {
+			if !slices.Contains(keep, b.Name()) {
+				targets = append(targets, b)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(m.background, migrateTimeout)
+	defer cancel()
+	var failed []string
+	var lastErr error
+	added := set.ban(ctx, targets, ip, info.ExpiresAt.Sub(m.clock.Now()), info.Reason, info.RuleID, func(b Backend, err error) {
+		if err != nil {
+			failed, lastErr = append(failed, b.Name()), err
+			m.logger.Error("failed to migrate ban, retrying", "ip", ip, "rule", info.RuleID, "backend", b.Name(), "err", err)
+		}
+	})
+	for _, name := range stale {
+		old := prev.get(name)
+		if old == nil {
+			continue
+		}
+		if err := old.Unban(ctx, ip); err != nil {
+			m.logger.Error("failed to remove migrated ban", "ip", ip, "backend", name, "err", err)
+			m.retries.deadLetter(&retryOp{Action: ActionUnban, IP: ip, Backend: name, RuleID: info.RuleID, Reason: "migrated",
+				Source: SourceSystem, ExpiresAt: info.ExpiresAt, Attempts: 1, LastError: err.Error()})
+		}
+	}
+
+	m.moveHolders(ip, stale, added, info)
+	retry := len(failed) > 0 && (set.mode != config.BackendModeFallback || len(added) == 0)
+	if retry {
+		m.queueBanRetries(m.background, ip, info, SourceSystem, failed, lastErr)
+	}
+	return !retry
+}
+
+// moveHolders records that the backends in removed no longer hold the ban
+// on ip and those in added do. An expiring ban no backend holds any more is
+// forgotten; new rules for a ban lifted meanwhile are queued for removal.
+func (m *BanManager) moveHolders(ip string, removed, added []string, info banInfo) {
 	m.mu.Lock()
+	if cur, ok := m.bans[ip]; ok {
+		cur.Backends = slices.DeleteFunc(slices.Clone(cur.Backends), func(n string) bool { return slices.Contains(removed, n) })
+		if cur.State == StateExpiring && len(cur.Backends) == 0 && len(added) == 0 {
+			delete(m.bans, ip)
+		} else {
+			m.bans[ip] = cur
+		}
+	}
+	m.mu.Unlock()
+	if len(added) > 0 {
+		m.addHolders(m.background, ip, added, info, SourceSystem)
+	}
+}
+
+// liftBan removes the ban on ip from every backend holding it, reporting
+// each call as an unban event, and returns the backends that still hold it.
+// Dry-run bans and bans no backend accepted only produce the event.
+func (m *BanManager) liftBan(ctx context.Context, ip string, info banInfo, reason, source string) ([]string, error) {
+	ev := BanEvent{Action: ActionUnban, IP: ip, RuleID: info.RuleID, Reason: reason, DryRun: info.DryRun, Source: source}
+	if len(info.Backends) == 0 {
+		ev.Backend = m.BackendName()
+		m.emit(ev)
+		return nil, nil
+	}
+	if info.DryRun {
+		for _, name := range info.Backends {
+			ev.Backend = name
+			m.emit(ev)
+		}
+		return nil, nil
+	}
+
+	set := m.acquire()
+	defer set.calls.Done()
+	var remaining []string
+	var errs []error
+	for _, name := range info.Backends {
+		b := set.get(name)
+		if b == nil {
+			// Removed from the config; its bans were migrated or dropped then.
+			continue
+		}
+		err := b.Unban(ctx, ip)
+		ev.Backend, ev.Err = name, err
+		m.emit(ev)
+		if err != nil {
+			remaining = append(remaining, name)
+			errs = append(errs, fmt.Errorf("backend=%s: %w", name, err))
+		}
+	}
+	return remaining, errors.Join(errs...)
+}
+
+// releaseWhitelisted lifts active bans on IPs that are now whitelisted.
+func (m *BanManager) releaseWhitelisted() {
+	m.mu.Lock()
+	released := make(map[string]banInfo)
+	for ip, info := range m.bans {
+		if m.whitelist.Contains(ip) && info.State != StateExpiring {
+			released[ip] = info
+		}
+	}
+	m.mu.Unlock()
+
+	for ip, info := range released {
+		ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+		err := m.lift(ctx, ip, info, "whitelisted", SourceSystem)
+		cancel()
+		if err != nil {
+			m.logger.Error("failed to unban whitelisted ip, retrying", "ip", ip, "err", err)
+			continue
+		}
+		m.logger.Info("unban (whitelisted)", "ip", ip, "backend", strings.Join(info.Backends, ","), "dry_run", info.DryRun)
+	}
+}
+
+// handleDecision records a ban for d and queues the backend call. It returns
+// ErrWhitelisted or ErrAlreadyBanned if the ban is skipped.
+func (m *BanManager) handleDecision(ctx context.Context, d *rules.Decision) error {
+	m.backendMu.RLock()
+	targets := names(m.backends.targets(d.Backends))
+	m.backendMu.RUnlock()
+
+	m.mu.Lock()
+	if m.whitelist.Contains(d.IP) {
+		dryRun := m.dryRun
+		m.mu.Unlock()
+		m.logger.Info("ban skipped (whitelisted ip)", "ip", d.IP, "rule", d.RuleID, "backend", m.BackendName())
+		m.emitSkip(d, dryRun, "whitelisted")
+		return ErrWhitelisted
+	}
+
 	existing, ok := m.bans[d.IP]
-	if ok && existing.ExpiresAt.After(time.Now()) {
+	if ok && existing.ExpiresAt.After(m.clock.Now()) && (existing.State == StatePending || existing.State == StateActive) {
 		// Already banned and not yet expired; skip duplicate.
-		m.logger.Infof("ban skipped (already active): ip=%s rule=%s backend=%s", d.IP, existing.RuleID, m.backend.Name())
+		dryRun := m.dryRun
 		m.mu.Unlock()
-		return
+		m.logger.Debug("ban skipped (already active)", "ip", d.IP, "rule", existing.RuleID, "backend", m.BackendName())
+		m.emitSkip(d, dryRun, "already banned by rule "+existing.RuleID)
+		return ErrAlreadyBanned
 	}
-	expiry := time.Now().Add(d.BanFor)
-	m.bans[d.IP] = banInfo{
+	expiry := m.clock.Now().Add(d.BanFor)
+	dryRun := m.dryRun
+	info := banInfo{
 		ExpiresAt: expiry,
 		RuleID:    d.RuleID,
+		Reason:    d.Reason,
+		DryRun:    dryRun,
+		Evidence:  decisionEvidence(d),
+		Selected:  d.Backends,
+		State:     StatePending,
+	}
+	if dryRun {
+		// Record where the ban would have gone.
+		info.Backends = targets
+		info.State = StateActive
+	} else if ok {
+		m.retries.cancel(d.IP, ActionBan, ActionUnban)
+		if existing.State == StateExpiring && !existing.DryRun {
+			// Not yet removed from these backends; keep it there.
+			info.Backends = existing.Backends
+		}
 	}
+	m.bans[d.IP] = info
 	m.mu.Unlock()
 
-	if m.dryRun {
-		m.logger.Infof("DRY-RUN ban: ip=%s rule=%s backend=%s until=%s", d.IP, d.RuleID, m.backend.Name(), expiry.Format(time.RFC3339))
-		return
+	if dryRun {
+		m.expiry.schedule(d.IP, expiry)
+		m.logger.Info("ban applied", "ip", d.IP, "rule", d.RuleID, "backend", strings.Join(info.Backends, ","), "until", expiry, "dry_run", true)
+		m.emit(decisionEvent(ActionBan, d, strings.Join(info.Backends, ","), true, expiry))
+		return nil
 	}
 
-	// Apply ban via backend.
-	if err := m.backend.Ban(ctx, d.IP, d.BanFor, d.Reason, d.RuleID); err != nil {
-		m.logger.Errorf("failed to apply ban: ip=%s rule=%s backend=%s err=%v", d.IP, d.RuleID, m.backend.Name(), err)
-		return
+	select {
+	case m.jobs <- banJob{decision: d, expiry: expiry}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	m.logger.Infof("ban applied: ip=%s rule=%s backend=%s until=%s", d.IP, d.RuleID, m.backend.Name(), expiry.Format(time.RFC3339))
+// emitSkip reports a decision that did not lead to a ban.
+func (m *BanManager) emitSkip(d *rules.Decision, dryRun bool, why string) {
+	ev := decisionEvent(ActionSkip, d, m.BackendName(), dryRun, time.Time{})
+	ev.Reason = why
+	m.emit(ev)
+}
 
-	// Schedule unban if duration is positive.
-	if d.BanFor > 0 {
-		go m.scheduleUnban(ctx, d.IP, expiry)
+// worker applies queued bans, calling backends with calls, until ctx is done.
+func (m *BanManager) worker(ctx, calls context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-m.jobs:
+			m.applyBan(calls, job.decision, job.expiry)
+		}
 	}
 }
 
-func (m *BanManager) scheduleUnban(ctx context.Context, ip string, expiry time.Time) {
-	delay := time.Until(expiry)
-	if delay <= 0 {
-		delay = time.Second
+// applyBan installs the ban for d, queueing the backend calls that fail for
+// retry. It reports one ban event listing the backends holding the ban, or,
+// if none does, the failed calls.
+func (m *BanManager) applyBan(ctx context.Context, d *rules.Decision, expiry time.Time) {
+	m.mu.Lock()
+	info, ok := m.bans[d.IP]
+	m.mu.Unlock()
+	if !ok || info.State != StatePending || !info.ExpiresAt.Equal(expiry) {
+		// Lifted while the job was queued.
+		return
 	}
 
-	timer := time.NewTimer(delay)
-	defer timer.Stop()
-
-	select {
-	case <-ctx.Done():
-		return
-	case <-timer.C:
+	set := m.acquire()
+	defer set.calls.Done()
+	targets := set.targets(d.Backends)
+	if len(info.Backends) > 0 {
+		// Still installed on some backends from an earlier ban.
+		if set.mode == config.BackendModeFallback {
+			targets = nil
+		} else {
+			targets = slices.DeleteFunc(slices.Clone(targets), func(b Backend) bool { return slices.Contains(info.Backends, b.Name()) })
+		}
 	}
+	var failed []string
+	var errs []error
+	var lastErr error
+	holders := set.ban(ctx, targets, d.IP, d.BanFor, d.Reason, d.RuleID, func(b Backend, err error) {
+		if err != nil {
+			failed, lastErr = append(failed, b.Name()), err
+			errs = append(errs, fmt.Errorf("backend=%s: %w", b.Name(), err))
+			m.logger.Error("failed to apply ban", "ip", d.IP, "rule", d.RuleID, "backend", b.Name(), "err", err)
+			return
+		}
+		m.logger.Info("ban applied", "ip", d.IP, "rule", d.RuleID, "backend", b.Name(), "until", expiry)
+	})
+	fallback := set.mode == config.BackendModeFallback
 
-	if err := m.backend.Unban(ctx, ip); err != nil {
-		m.logger.Errorf("failed to unban ip=%s backend=%s err=%v", ip, m.backend.Name(), err)
-		return
+	holders = append(holders, info.Backends...)
+	ev := decisionEvent(ActionBan, d, strings.Join(holders, ","), false, expiry)
+	if len(holders) == 0 {
+		ev.Backend, ev.Err = strings.Join(failed, ","), errors.Join(errs...)
+	}
+	m.emit(ev)
+	if len(holders) > 0 {
+		m.addHolders(ctx, d.IP, holders, info, d.Source)
+	}
+	if len(failed) > 0 && (!fallback || len(holders) == 0) {
+		m.queueBanRetries(ctx, d.IP, info, d.Source, failed, lastErr)
 	}
+	m.settle(ctx, d.IP)
+}
 
+// expire lifts the bans on ips, which the scheduler found expired, making
+// as many backend calls at once as there are workers. Dry-run and failed
+// bans are just forgotten.
+func (m *BanManager) expire(ctx context.Context, ips []string) {
+	now := m.clock.Now()
+	lifts := make(map[string]banInfo)
 	m.mu.Lock()
-	delete(m.bans, ip)
+	for _, ip := range ips {
+		info, ok := m.bans[ip]
+		switch {
+		case !ok || info.State == StatePending || info.State == StateExpiring:
+		case info.ExpiresAt.After(now):
+			m.expiry.schedule(ip, info.ExpiresAt)
+		case info.DryRun || info.State == StateFailed:
+			delete(m.bans, ip)
+		default:
+			lifts[ip] = info
+		}
+	}
 	m.mu.Unlock()
 
-	m.logger.Infof("unbanned ip=%s backend=%s", ip, m.backend.Name())
+	m.parallel(lifts, func(ip string, info banInfo) {
+		if err := m.lift(ctx, ip, info, "expired", SourceSystem); err != nil {
+			m.logger.Error("failed to unban, retrying", "ip", ip, "err", err)
+			return
+		}
+		m.logger.Info("unban", "ip", ip, "backend", strings.Join(info.Backends, ","))
+	})
+}
+
+// parallel calls fn for every ban, as many at once as there are workers.
+func (m *BanManager) parallel(bans map[string]banInfo, fn func(ip string, info banInfo)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, m.workers)
+	for ip, info := range bans {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			fn(ip, info)
+		}()
+	}
+	wg.Wait()
 }
@@ -0,0 +1,830 @@
+package firewall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/clock"
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/rules"
+)
+
+var epoch = time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+
+// call is a backend call seen by fakeBackend.
+type call struct {
+	op       string // "ban" or "unban"
+	ip       string
+	duration time.Duration
+}
+
+// fakeBackend records calls and fails the next failBan bans and failUnban unbans.
+// If gate is set, bans wait for it to be closed, or for their context to end,
+// before returning.
+type fakeBackend struct {
+	name  string
+	calls chan call
+
+	mu        sync.Mutex
+	gate      chan struct{}
+	failBan   int
+	failUnban int
+}
+
+func newFakeBackend(name string) *fakeBackend {
+	return &fakeBackend{name: name, calls: make(chan call, 1000)}
+}
+
+func (b *fakeBackend) Name() string { return b.name }
+
+func (b *fakeBackend) Ban(ctx context.Context, ip string, d time.Duration, _, _ string) error {
+	b.calls <- call{"ban", ip, d}
+	b.mu.Lock()
+	gate := b.gate
+	b.mu.Unlock()
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failBan != 0 {
+		b.failBan--
+		return errors.New("ban refused")
+	}
+	return nil
+}
+
+func (b *fakeBackend) Unban(_ context.Context, ip string) error {
+	b.calls <- call{"unban", ip, 0}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failUnban != 0 {
+		b.failUnban--
+		return errors.New("unban refused")
+	}
+	return nil
+}
+
+// fail makes the next bans and unbans fail; -1 fails all of them.
+func (b *fakeBackend) fail(bans, unbans int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failBan, b.failUnban = bans, unbans
+}
+
+// hold makes bans wait until the returned channel is closed.
+func (b *fakeBackend) hold() chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gate = make(chan struct{})
+	return b.gate
+}
+
+// expect waits for the next call and checks it; an empty ip matches any.
+func (b *fakeBackend) expect(t *testing.T, op, ip string) call {
+	t.Helper()
+	select {
+	case c := <-b.calls:
+		if c.op != op || (ip != "" && c.ip != ip) {
+			t.Fatalf("%s: got %s %s, want %s %s", b.name, c.op, c.ip, op, ip)
+		}
+		return c
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s: no call, want %s %s", b.name, op, ip)
+	}
+	return call{}
+}
+
+// expectNone checks that no call arrives for a little while.
+func (b *fakeBackend) expectNone(t *testing.T) {
+	t.Helper()
+	select {
+	case c := <-b.calls:
+		t.Fatalf("%s: got %s %s, want no call", b.name, c.op, c.ip)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func testBackendConfig() config.BackendConfig {
+	return config.BackendConfig{
+		Workers:   2,
+		QueueSize: 100,
+		Mode:      config.BackendModeFanout,
+		Whitelist: []string{"192.168.0.0/16"},
+		Retry:     config.RetryConfig{MaxAttempts: 3, Backoff: 10 * time.Second, MaxBackoff: time.Minute, Jitter: -1},
+	}
+}
+
+// testManager is a running BanManager on a fake clock.
+type testManager struct {
+	*BanManager
+	clock     *clock.Fake
+	decisions chan *rules.Decision
+	stop      func()
+}
+
+func startManager(t *testing.T, cfg config.BackendConfig, backends ...Backend) *testManager {
+	t.Helper()
+	return startManagerAt(t, clock.NewFake(epoch), cfg, "", backends...)
+}
+
+// startManagerAt starts a manager on clk, loading state from stateDir if set.
+func startManagerAt(t *testing.T, clk *clock.Fake, cfg config.BackendConfig, stateDir string, backends ...Backend) *testManager {
+	t.Helper()
+	m := NewBanManager(backends, &cfg, logging.NewLoggerTo(io.Discard), clk)
+	if stateDir != "" {
+		if err := m.LoadState(stateDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tm := &testManager{BanManager: m, clock: clk, decisions: make(chan *rules.Decision)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx, tm.decisions)
+	}()
+	var once sync.Once
+	tm.stop = func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+	t.Cleanup(tm.stop)
+	return tm
+}
+
+// decide sends a rule decision banning ip for d.
+func (tm *testManager) decide(ip string, d time.Duration) {
+	tm.decisions <- &rules.Decision{IP: ip, RuleID: "login", Reason: "max_errors exceeded", Violation: true, Ban: true,
+		BanFor: d, Timestamp: tm.clock.Now(), Source: rules.SourceEngine}
+}
+
+// eventually waits for cond to hold.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitState waits until the ban on ip is in state; "" waits for it to be gone.
+func (tm *testManager) waitState(t *testing.T, ip, state string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		ban, ok := tm.Get(ip)
+		if (state == "" && !ok) || (ok && ban.State == state) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ban on %s: got %+v (listed %v), want state %q", ip, ban, ok, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBanManagerBanAndExpire(t *testing.T) {
+	b := newFakeBackend("fw")
+	tm := startManager(t, testBackendConfig(), b)
+
+	tm.decide("10.0.0.1", time.Hour)
+	if c := b.expect(t, "ban", "10.0.0.1"); c.duration != time.Hour {
+		t.Fatalf("banned for %v, want 1h", c.duration)
+	}
+	tm.waitState(t, "10.0.0.1", StateActive)
+	ban, _ := tm.Get("10.0.0.1")
+	if !ban.ExpiresAt.Equal(epoch.Add(time.Hour)) || ban.RuleID != "login" || len(ban.Backends) != 1 || ban.Backends[0] != "fw" {
+		t.Fatalf("unexpected ban %+v", ban)
+	}
+
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(time.Hour - time.Second)
+	b.expectNone(t)
+	if len(tm.List()) != 1 {
+		t.Fatal("ban not listed before it expired")
+	}
+
+	tm.clock.Advance(time.Second)
+	b.expect(t, "unban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", "")
+	if len(tm.List()) != 0 {
+		t.Fatalf("List() = %+v after expiry, want none", tm.List())
+	}
+}
+
+func TestBanManagerDuplicateAndReban(t *testing.T) {
+	b := newFakeBackend("fw")
+	tm := startManager(t, testBackendConfig(), b)
+
+	var mu sync.Mutex
+	var skips []BanEvent
+	tm.Subscribe(func(ev BanEvent) {
+		if ev.Action == ActionSkip {
+			mu.Lock()
+			skips = append(skips, ev)
+			mu.Unlock()
+		}
+	})
+
+	tm.decide("10.0.0.1", time.Hour)
+	b.expect(t, "ban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StateActive)
+
+	// A violation while banned changes nothing.
+	tm.clock.Advance(30 * time.Minute)
+	tm.decide("10.0.0.1", time.Hour)
+	if _, err := tm.Ban(context.Background(), "10.0.0.1", time.Hour, ""); !errors.Is(err, ErrAlreadyBanned) {
+		t.Fatalf("manual ban of a banned ip: err %v, want ErrAlreadyBanned", err)
+	}
+	b.expectNone(t)
+	mu.Lock()
+	if len(skips) != 2 || skips[0].Source == skips[1].Source {
+		t.Fatalf("skip events %+v, want one from the engine and one manual", skips)
+	}
+	mu.Unlock()
+	if ban, _ := tm.Get("10.0.0.1"); !ban.ExpiresAt.Equal(epoch.Add(time.Hour)) {
+		t.Fatalf("duplicate moved the expiry to %v", ban.ExpiresAt)
+	}
+
+	tm.clock.Advance(30 * time.Minute)
+	b.expect(t, "unban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", "")
+
+	// Once expired, the next violation bans again for the full duration.
+	tm.decide("10.0.0.1", 2*time.Hour)
+	if c := b.expect(t, "ban", "10.0.0.1"); c.duration != 2*time.Hour {
+		t.Fatalf("re-banned for %v, want 2h", c.duration)
+	}
+	tm.waitState(t, "10.0.0.1", StateActive)
+	if ban, _ := tm.Get("10.0.0.1"); !ban.ExpiresAt.Equal(epoch.Add(3 * time.Hour)) {
+		t.Fatalf("re-ban expires at %v, want %v", ban.ExpiresAt, epoch.Add(3*time.Hour))
+	}
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(2 * time.Hour)
+	b.expect(t, "unban", "10.0.0.1")
+}
+
+func TestBanManagerBatchedExpiry(t *testing.T) {
+	b := newFakeBackend("fw")
+	tm := startManager(t, testBackendConfig(), b)
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		tm.decide(fmt.Sprintf("10.0.%d.%d", i/256, i%256), time.Hour)
+	}
+	for i := 0; i < n; i++ {
+		<-b.calls
+	}
+	for i := 0; i < n; i++ {
+		tm.waitState(t, fmt.Sprintf("10.0.%d.%d", i/256, i%256), StateActive)
+	}
+
+	// One timer however many bans there are.
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(time.Hour)
+	unbanned := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		select {
+		case c := <-b.calls:
+			if c.op != "unban" || unbanned[c.ip] {
+				t.Fatalf("unexpected %s %s", c.op, c.ip)
+			}
+			unbanned[c.ip] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d of %d bans lifted", len(unbanned), n)
+		}
+	}
+}
+
+func TestBanManagerExtend(t *testing.T) {
+	b := newFakeBackend("fw")
+	tm := startManager(t, testBackendConfig(), b)
+
+	tm.decide("10.0.0.1", time.Hour)
+	b.expect(t, "ban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StateActive)
+
+	if _, err := tm.Extend("10.0.0.1", epoch); !errors.Is(err, ErrPastExpiry) {
+		t.Fatalf("Extend to now: err %v, want ErrPastExpiry", err)
+	}
+	if _, err := tm.Extend("10.0.0.2", epoch.Add(2*time.Hour)); !errors.Is(err, ErrNotBanned) {
+		t.Fatalf("Extend of an unbanned ip: err %v, want ErrNotBanned", err)
+	}
+	ban, err := tm.Extend("10.0.0.1", epoch.Add(2*time.Hour))
+	if err != nil || !ban.ExpiresAt.Equal(epoch.Add(2*time.Hour)) {
+		t.Fatalf("Extend = %+v, %v", ban, err)
+	}
+
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(time.Hour)
+	b.expectNone(t)
+	tm.waitState(t, "10.0.0.1", StateActive)
+
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(time.Hour)
+	b.expect(t, "unban", "10.0.0.1")
+}
+
+func TestBanManagerShortenBan(t *testing.T) {
+	b := newFakeBackend("fw")
+	tm := startManager(t, testBackendConfig(), b)
+
+	tm.decide("10.0.0.1", time.Hour)
+	b.expect(t, "ban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StateActive)
+
+	ban, err := tm.Extend("10.0.0.1", epoch.Add(10*time.Minute))
+	if err != nil || !ban.ExpiresAt.Equal(epoch.Add(10*time.Minute)) {
+		t.Fatalf("Extend = %+v, %v", ban, err)
+	}
+
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(10 * time.Minute)
+	b.expect(t, "unban", "10.0.0.1")
+}
+
+func TestBanManagerManualUnban(t *testing.T) {
+	b := newFakeBackend("fw")
+	tm := startManager(t, testBackendConfig(), b)
+
+	if _, err := tm.Ban(context.Background(), "10.0.0.1", time.Hour, "by hand"); err != nil {
+		t.Fatal(err)
+	}
+	b.expect(t, "ban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StateActive)
+
+	if err := tm.Unban(context.Background(), "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	b.expect(t, "unban", "10.0.0.1")
+	if _, ok := tm.Get("10.0.0.1"); ok {
+		t.Fatal("ban still listed after Unban")
+	}
+	if err := tm.Unban(context.Background(), "10.0.0.1"); !errors.Is(err, ErrNotBanned) {
+		t.Fatalf("second Unban: err %v, want ErrNotBanned", err)
+	}
+
+	// The expiry was cancelled along with the ban.
+	tm.clock.Advance(2 * time.Hour)
+	b.expectNone(t)
+}
+
+func TestBanManagerWhitelist(t *testing.T) {
+	b := newFakeBackend("fw")
+	tm := startManager(t, testBackendConfig(), b)
+
+	if _, err := tm.Ban(context.Background(), "192.168.1.1", time.Hour, ""); !errors.Is(err, ErrWhitelisted) {
+		t.Fatalf("ban of a whitelisted ip: err %v, want ErrWhitelisted", err)
+	}
+	tm.decide("192.168.1.2", time.Hour)
+	b.expectNone(t)
+
+	// Whitelisting a banned IP lifts its ban.
+	tm.decide("10.0.0.1", time.Hour)
+	b.expect(t, "ban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StateActive)
+	if err := tm.AddWhitelist("10.0.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	b.expect(t, "unban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", "")
+}
+
+func TestBanManagerDryRun(t *testing.T) {
+	b := newFakeBackend("fw")
+	cfg := testBackendConfig()
+	cfg.DryRun = true
+	tm := startManager(t, cfg, b)
+
+	tm.decide("10.0.0.1", time.Hour)
+	tm.waitState(t, "10.0.0.1", StateActive)
+	if ban, _ := tm.Get("10.0.0.1"); !ban.DryRun || len(ban.Backends) != 1 {
+		t.Fatalf("dry-run ban %+v, want DryRun with the backend it would use", ban)
+	}
+
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(time.Hour)
+	tm.waitState(t, "10.0.0.1", "")
+	b.expectNone(t)
+}
+
+func TestBanManagerBanRetry(t *testing.T) {
+	b := newFakeBackend("fw")
+	b.fail(2, 0)
+	tm := startManager(t, testBackendConfig(), b)
+
+	tm.decide("10.0.0.1", time.Hour)
+	b.expect(t, "ban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StatePending)
+	if tm.PendingRetries() != 1 {
+		t.Fatalf("PendingRetries() = %d, want 1", tm.PendingRetries())
+	}
+
+	// Backoff doubles: 10s after the first failure, 20s after the second.
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(9 * time.Second)
+	b.expectNone(t)
+	tm.clock.Advance(time.Second)
+	c := b.expect(t, "ban", "10.0.0.1")
+	if c.duration != time.Hour-10*time.Second {
+		t.Fatalf("retry banned for %v, want the time left", c.duration)
+	}
+
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(19 * time.Second)
+	b.expectNone(t)
+	tm.clock.Advance(time.Second)
+	b.expect(t, "ban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StateActive)
+	if tm.PendingRetries() != 0 {
+		t.Fatalf("PendingRetries() = %d after success, want 0", tm.PendingRetries())
+	}
+
+	// The ban still expires on its original schedule.
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(time.Hour - 30*time.Second)
+	b.expect(t, "unban", "10.0.0.1")
+}
+
+func TestBanManagerRetriesInParallel(t *testing.T) {
+	b := newFakeBackend("fw")
+	b.fail(2, 0)
+	tm := startManager(t, testBackendConfig(), b)
+	tm.decide("10.0.0.1", time.Hour)
+	tm.decide("10.0.0.2", time.Hour)
+	b.expect(t, "ban", "10.0.0.1")
+	b.expect(t, "ban", "10.0.0.2")
+	eventually(t, "both bans to be queued", func() bool { return tm.PendingRetries() == 2 })
+
+	// Two workers: the second retry starts while the first hangs.
+	gate := b.hold()
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(10 * time.Second)
+	got := map[string]bool{b.expect(t, "ban", "").ip: true}
+	got[b.expect(t, "ban", "").ip] = true
+	if !got["10.0.0.1"] || !got["10.0.0.2"] {
+		t.Fatalf("retried %v, want both IPs at once", got)
+	}
+	close(gate)
+	tm.waitState(t, "10.0.0.1", StateActive)
+	tm.waitState(t, "10.0.0.2", StateActive)
+}
+
+func TestBanManagerBanRetryGivesUp(t *testing.T) {
+	b := newFakeBackend("fw")
+	b.fail(-1, 0)
+	tm := startManager(t, testBackendConfig(), b)
+
+	tm.decide("10.0.0.1", time.Hour)
+	b.expect(t, "ban", "10.0.0.1")
+	for _, backoff := range []time.Duration{10 * time.Second, 20 * time.Second} {
+		tm.clock.BlockUntil(1)
+		tm.clock.Advance(backoff)
+		b.expect(t, "ban", "10.0.0.1")
+	}
+	tm.waitState(t, "10.0.0.1", StateFailed)
+	if tm.PendingRetries() != 0 {
+		t.Fatalf("PendingRetries() = %d after giving up, want 0", tm.PendingRetries())
+	}
+
+	// A failed ban is forgotten on expiry without unbanning anything.
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(time.Hour)
+	tm.waitState(t, "10.0.0.1", "")
+	b.expectNone(t)
+}
+
+func TestBanManagerUnbanRetry(t *testing.T) {
+	b := newFakeBackend("fw")
+	tm := startManager(t, testBackendConfig(), b)
+
+	tm.decide("10.0.0.1", time.Hour)
+	b.expect(t, "ban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StateActive)
+
+	b.fail(0, 1)
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(time.Hour)
+	b.expect(t, "unban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StateExpiring)
+
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(10 * time.Second)
+	b.expect(t, "unban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", "")
+}
+
+func TestBanManagerRebanWhileExpiring(t *testing.T) {
+	b := newFakeBackend("fw")
+	tm := startManager(t, testBackendConfig(), b)
+
+	tm.decide("10.0.0.1", time.Hour)
+	b.expect(t, "ban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StateActive)
+
+	b.fail(0, -1)
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(time.Hour)
+	b.expect(t, "unban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StateExpiring)
+
+	// The rule is still installed, so a new violation keeps it there instead
+	// of banning again, and the pending unban is dropped.
+	tm.decide("10.0.0.1", time.Hour)
+	tm.waitState(t, "10.0.0.1", StateActive)
+	b.expectNone(t)
+	if tm.PendingRetries() != 0 {
+		t.Fatalf("PendingRetries() = %d, want the unban retry cancelled", tm.PendingRetries())
+	}
+	if ban, _ := tm.Get("10.0.0.1"); !ban.ExpiresAt.Equal(epoch.Add(2*time.Hour)) || len(ban.Backends) != 1 {
+		t.Fatalf("re-ban %+v, want held by fw until %v", ban, epoch.Add(2*time.Hour))
+	}
+
+	b.fail(0, 0)
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(time.Hour)
+	b.expect(t, "unban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", "")
+}
+
+func TestBanManagerFanout(t *testing.T) {
+	a, b := newFakeBackend("a"), newFakeBackend("b")
+	tm := startManager(t, testBackendConfig(), a, b)
+	events := make(chan BanEvent, 10)
+	tm.Subscribe(func(ev BanEvent) {
+		if ev.Action == ActionBan {
+			events <- ev
+		}
+	})
+	nextEvent := func() BanEvent {
+		t.Helper()
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(2 * time.Second):
+			t.Fatal("no ban event")
+		}
+		return BanEvent{}
+	}
+	noEvent := func() {
+		t.Helper()
+		select {
+		case ev := <-events:
+			t.Fatalf("unexpected ban event %+v", ev)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	tm.decide("10.0.0.1", time.Hour)
+	a.expect(t, "ban", "10.0.0.1")
+	b.expect(t, "ban", "10.0.0.1")
+	if ev := nextEvent(); ev.IP != "10.0.0.1" || ev.Backend != "a,b" || ev.Err != nil {
+		t.Fatalf("ban event %+v, want one for both backends", ev)
+	}
+	noEvent()
+
+	// A backend that fails is left out and reported when a retry installs the ban.
+	b.fail(1, 0)
+	tm.decide("10.0.0.2", time.Hour)
+	a.expect(t, "ban", "10.0.0.2")
+	b.expect(t, "ban", "10.0.0.2")
+	first := nextEvent()
+	if first.Backend != "a" || first.Err != nil {
+		t.Fatalf("ban event %+v, want one for a only", first)
+	}
+	noEvent()
+	tm.clock.BlockUntil(2) // expiry and retry timers
+	tm.clock.Advance(10 * time.Second)
+	b.expect(t, "ban", "10.0.0.2")
+	if ev := nextEvent(); ev.Backend != "b" || !ev.ExpiresAt.Equal(first.ExpiresAt) {
+		t.Fatalf("retry ban event %+v, want b with the same expiry", ev)
+	}
+	eventually(t, "both backends to hold the ban", func() bool {
+		ban, _ := tm.Get("10.0.0.2")
+		return len(ban.Backends) == 2
+	})
+
+	// When every backend fails, the event carries the errors.
+	a.fail(1, 0)
+	b.fail(1, 0)
+	tm.decide("10.0.0.3", time.Hour)
+	a.expect(t, "ban", "10.0.0.3")
+	b.expect(t, "ban", "10.0.0.3")
+	if ev := nextEvent(); ev.Backend != "a,b" || ev.Err == nil {
+		t.Fatalf("ban event %+v, want a failure for both backends", ev)
+	}
+	noEvent()
+}
+
+func TestBanManagerFallback(t *testing.T) {
+	primary, secondary := newFakeBackend("primary"), newFakeBackend("secondary")
+	primary.fail(-1, 0)
+	cfg := testBackendConfig()
+	cfg.Mode = config.BackendModeFallback
+	tm := startManager(t, cfg, primary, secondary)
+
+	tm.decide("10.0.0.1", time.Hour)
+	primary.expect(t, "ban", "10.0.0.1")
+	secondary.expect(t, "ban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StateActive)
+	if ban, _ := tm.Get("10.0.0.1"); len(ban.Backends) != 1 || ban.Backends[0] != "secondary" {
+		t.Fatalf("held by %v, want only secondary", ban.Backends)
+	}
+	if tm.PendingRetries() != 0 {
+		t.Fatal("failed primary retried although secondary holds the ban")
+	}
+
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(time.Hour)
+	secondary.expect(t, "unban", "10.0.0.1")
+	primary.expectNone(t)
+}
+
+func TestBanManagerRestartKeepsBans(t *testing.T) {
+	dir := t.TempDir()
+	clk := clock.NewFake(epoch)
+	b := newFakeBackend("fw")
+	tm := startManagerAt(t, clk, testBackendConfig(), dir, b)
+
+	tm.decide("10.0.0.1", time.Hour)
+	tm.decide("10.0.0.2", 3*time.Hour)
+	b.expect(t, "ban", "10.0.0.1")
+	b.expect(t, "ban", "10.0.0.2")
+	tm.waitState(t, "10.0.0.1", StateActive)
+	tm.waitState(t, "10.0.0.2", StateActive)
+	tm.stop()
+	b.expectNone(t)
+
+	// Down for two hours: the first ban expired meanwhile, the second has an hour left.
+	clk.Advance(2 * time.Hour)
+	tm = startManagerAt(t, clk, testBackendConfig(), dir, b)
+	b.expect(t, "unban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", "")
+	if ban, ok := tm.Get("10.0.0.2"); !ok || ban.State != StateActive {
+		t.Fatalf("restored ban %+v (listed %v), want active", ban, ok)
+	}
+
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(time.Hour)
+	b.expect(t, "unban", "10.0.0.2")
+}
+
+func TestBanManagerShutdownRemove(t *testing.T) {
+	dir := t.TempDir()
+	clk := clock.NewFake(epoch)
+	a, b := newFakeBackend("a"), newFakeBackend("b")
+	tm := startManagerAt(t, clk, testBackendConfig(), dir, a, b)
+	tm.SetShutdown(config.ShutdownConfig{Policy: config.ShutdownRemove, DrainTimeout: time.Minute})
+
+	ips := []string{"10.0.0.1", "10.0.0.2"}
+	for _, ip := range ips {
+		tm.decide(ip, time.Hour)
+		a.expect(t, "ban", ip)
+		b.expect(t, "ban", ip)
+		tm.waitState(t, ip, StateActive)
+	}
+	b.fail(0, 1)
+	tm.stop()
+
+	// Every holder is asked to lift every ban, in any order.
+	for _, fb := range []*fakeBackend{a, b} {
+		seen := make(map[string]bool)
+		for range ips {
+			seen[fb.expect(t, "unban", "").ip] = true
+		}
+		if len(seen) != len(ips) {
+			t.Fatalf("%s lifted %v, want %v", fb.name, seen, ips)
+		}
+		fb.expectNone(t)
+	}
+
+	// The unban b refused is saved and retried on the next start.
+	data, err := os.ReadFile(filepath.Join(dir, retryFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []*retryOp
+	if err := json.Unmarshal(data, &ops); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].Action != ActionUnban || ops[0].Backend != "b" {
+		t.Fatalf("saved retries %+v, want one unban on b", ops)
+	}
+	tm = startManagerAt(t, clk, testBackendConfig(), dir, a, b)
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(10 * time.Second) // the backoff after the failure
+	b.expect(t, "unban", ops[0].IP)
+	tm.waitState(t, ops[0].IP, "")
+	a.expectNone(t)
+}
+
+func TestBanManagerDrainTimeout(t *testing.T) {
+	b := newFakeBackend("fw")
+	gate := b.hold()
+	defer close(gate)
+	tm := startManager(t, testBackendConfig(), b)
+	const drain = 100 * time.Millisecond
+	tm.SetShutdown(config.ShutdownConfig{Policy: config.ShutdownKeep, DrainTimeout: drain})
+
+	tm.decide("10.0.0.1", time.Hour)
+	b.expect(t, "ban", "10.0.0.1")
+	start := time.Now()
+	stopped := make(chan struct{})
+	go func() {
+		tm.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return although the drain timeout passed")
+	}
+	if elapsed := time.Since(start); elapsed < drain {
+		t.Fatalf("Run returned after %v, before the drain timeout", elapsed)
+	}
+	if ban, ok := tm.Get("10.0.0.1"); !ok || ban.State != StatePending || tm.PendingRetries() != 1 {
+		t.Fatalf("ban %+v (listed %v) with %d retries, want it pending a retry", ban, ok, tm.PendingRetries())
+	}
+}
+
+func TestBanManagerSwapMigratesInBackground(t *testing.T) {
+	old := newFakeBackend("fw")
+	tm := startManager(t, testBackendConfig(), old)
+	tm.decide("10.0.0.1", time.Hour)
+	old.expect(t, "ban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StateActive)
+
+	// Same name, new settings: the ban moves to the rebuilt backend, whose
+	// first call hangs and then fails.
+	rebuilt := newFakeBackend("fw")
+	gate := rebuilt.hold()
+	rebuilt.fail(1, 0)
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		tm.swapBackends(newBackendSet([]Backend{rebuilt}, config.BackendModeFanout))
+	}()
+	select {
+	case <-swapped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("swapBackends waited for the migration")
+	}
+	rebuilt.expect(t, "ban", "10.0.0.1")
+	if got := tm.BackendName(); got != "fw" {
+		t.Fatalf("BackendName() = %q during the migration", got)
+	}
+	close(gate)
+
+	// The old rule is removed and the failed ban is retried.
+	old.expect(t, "unban", "10.0.0.1")
+	eventually(t, "the failed migration to be queued", func() bool { return tm.PendingRetries() == 1 })
+	tm.clock.BlockUntil(2)
+	tm.clock.Advance(10 * time.Second)
+	rebuilt.expect(t, "ban", "10.0.0.1")
+	eventually(t, "the retry to succeed", func() bool { return tm.PendingRetries() == 0 })
+	if ban, _ := tm.Get("10.0.0.1"); ban.State != StateActive || len(ban.Backends) != 1 || ban.Backends[0] != "fw" {
+		t.Fatalf("ban %+v, want active on fw", ban)
+	}
+
+	tm.clock.BlockUntil(1)
+	tm.clock.Advance(time.Hour)
+	rebuilt.expect(t, "unban", "10.0.0.1")
+	old.expectNone(t)
+}
+
+func TestBanManagerSwapRemovesBackend(t *testing.T) {
+	a, b := newFakeBackend("a"), newFakeBackend("b")
+	tm := startManager(t, testBackendConfig(), a, b)
+	tm.decide("10.0.0.1", time.Hour)
+	a.expect(t, "ban", "10.0.0.1")
+	b.expect(t, "ban", "10.0.0.1")
+	tm.waitState(t, "10.0.0.1", StateActive)
+
+	// b stays as it was; a is removed and its rule goes with it.
+	tm.swapBackends(newBackendSet([]Backend{tm.backends.get("b")}, config.BackendModeFanout))
+	a.expect(t, "unban", "10.0.0.1")
+	b.expectNone(t)
+	eventually(t, "a to drop out of the holders", func() bool {
+		ban, _ := tm.Get("10.0.0.1")
+		return len(ban.Backends) == 1 && ban.Backends[0] == "b"
+	})
+}
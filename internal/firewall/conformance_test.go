@@ -0,0 +1,281 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/logging"
+)
+
+// conformanceTarget is a backend wired to a fake it can be checked against.
+type conformanceTarget struct {
+	backend Backend
+	count   func(ip string) int // rules the fake holds for ip
+	fail    func(on bool)       // make every call to the fake fail
+	stall   func(on bool)       // make every call to the fake hang
+}
+
+// testBackend runs the conformance suite against the backend newTarget makes;
+// each subtest gets a fresh one.
+func testBackend(t *testing.T, newTarget func(t *testing.T) *conformanceTarget) {
+	const duration = time.Hour
+	ips := []string{"203.0.113.7", "2001:db8::7"}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		for _, ip := range ips {
+			tg := newTarget(t)
+			if err := tg.backend.Ban(context.Background(), ip, duration, "test", "login"); err != nil {
+				t.Fatalf("Ban(%s): %v", ip, err)
+			}
+			if tg.count(ip) == 0 {
+				t.Fatalf("no rule for %s after Ban", ip)
+			}
+			if err := tg.backend.Unban(context.Background(), ip); err != nil {
+				t.Fatalf("Unban(%s): %v", ip, err)
+			}
+			if n := tg.count(ip); n != 0 {
+				t.Fatalf("%d rules left for %s after Unban", n, ip)
+			}
+		}
+	})
+
+	t.Run("IdempotentBan", func(t *testing.T) {
+		tg := newTarget(t)
+		for _, ip := range ips {
+			if err := tg.backend.Ban(context.Background(), ip, duration, "test", "login"); err != nil {
+				t.Fatalf("Ban(%s): %v", ip, err)
+			}
+			n := tg.count(ip)
+			if err := tg.backend.Ban(context.Background(), ip, duration, "again", "other"); err != nil {
+				t.Fatalf("second Ban(%s): %v", ip, err)
+			}
+			if got := tg.count(ip); got != n {
+				t.Fatalf("%s has %d rules after banning twice, want %d", ip, got, n)
+			}
+			if err := tg.backend.Unban(context.Background(), ip); err != nil {
+				t.Fatalf("Unban(%s): %v", ip, err)
+			}
+			if n := tg.count(ip); n != 0 {
+				t.Fatalf("%d rules left for %s after Unban", n, ip)
+			}
+		}
+	})
+
+	t.Run("OnlyTouchesItsIP", func(t *testing.T) {
+		tg := newTarget(t)
+		for _, ip := range ips {
+			if err := tg.backend.Ban(context.Background(), ip, duration, "test", "login"); err != nil {
+				t.Fatalf("Ban(%s): %v", ip, err)
+			}
+		}
+		if err := tg.backend.Unban(context.Background(), ips[0]); err != nil {
+			t.Fatalf("Unban(%s): %v", ips[0], err)
+		}
+		if tg.count(ips[1]) == 0 {
+			t.Fatalf("unbanning %s removed the rule for %s", ips[0], ips[1])
+		}
+	})
+
+	t.Run("UnbanUnknown", func(t *testing.T) {
+		tg := newTarget(t)
+		for _, ip := range ips {
+			if err := tg.backend.Unban(context.Background(), ip); err != nil {
+				t.Fatalf("Unban(%s) of an IP never banned: %v", ip, err)
+			}
+		}
+		if err := tg.backend.Ban(context.Background(), ips[0], duration, "test", "login"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := tg.backend.Unban(context.Background(), ips[0]); err != nil {
+				t.Fatalf("Unban #%d: %v", i+1, err)
+			}
+		}
+	})
+
+	t.Run("InvalidIP", func(t *testing.T) {
+		tg := newTarget(t)
+		for _, ip := range []string{"", "not-an-ip", "203.0.113.0/24"} {
+			if err := tg.backend.Ban(context.Background(), ip, duration, "test", "login"); err == nil {
+				t.Errorf("Ban(%q) succeeded", ip)
+			}
+			if err := tg.backend.Unban(context.Background(), ip); err == nil {
+				t.Errorf("Unban(%q) succeeded", ip)
+			}
+		}
+	})
+
+	t.Run("BanError", func(t *testing.T) {
+		tg := newTarget(t)
+		tg.fail(true)
+		if err := tg.backend.Ban(context.Background(), ips[0], duration, "test", "login"); err == nil {
+			t.Fatal("Ban succeeded while the firewall was failing")
+		}
+		if n := tg.count(ips[0]); n != 0 {
+			t.Fatalf("%d rules after a failed Ban", n)
+		}
+		tg.fail(false)
+		if err := tg.backend.Ban(context.Background(), ips[0], duration, "test", "login"); err != nil {
+			t.Fatalf("Ban after recovery: %v", err)
+		}
+	})
+
+	t.Run("UnbanError", func(t *testing.T) {
+		tg := newTarget(t)
+		if err := tg.backend.Ban(context.Background(), ips[1], duration, "test", "login"); err != nil {
+			t.Fatal(err)
+		}
+		tg.fail(true)
+		if err := tg.backend.Unban(context.Background(), ips[1]); err == nil {
+			t.Fatal("Unban succeeded while the firewall was failing")
+		}
+		if tg.count(ips[1]) == 0 {
+			t.Fatal("rule gone after a failed Unban")
+		}
+		tg.fail(false)
+		if err := tg.backend.Unban(context.Background(), ips[1]); err != nil {
+			t.Fatalf("Unban after recovery: %v", err)
+		}
+		if n := tg.count(ips[1]); n != 0 {
+			t.Fatalf("%d rules left after Unban", n)
+		}
+	})
+
+	t.Run("CancelledContext", func(t *testing.T) {
+		tg := newTarget(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := tg.backend.Ban(ctx, ips[0], duration, "test", "login"); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Ban with a cancelled context: %v, want context.Canceled", err)
+		}
+		if n := tg.count(ips[0]); n != 0 {
+			t.Fatalf("%d rules after a cancelled Ban", n)
+		}
+		if err := tg.backend.Unban(ctx, ips[0]); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Unban with a cancelled context: %v, want context.Canceled", err)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		tg := newTarget(t)
+		tg.stall(true)
+		for _, op := range []string{"Ban", "Unban"} {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			start := time.Now()
+			var err error
+			if op == "Ban" {
+				err = tg.backend.Ban(ctx, ips[0], duration, "test", "login")
+			} else {
+				err = tg.backend.Unban(ctx, ips[0])
+			}
+			cancel()
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("%s against a hung firewall: %v, want context.DeadlineExceeded", op, err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("%s took %v to give up", op, elapsed)
+			}
+		}
+	})
+}
+
+func TestVultrConformance(t *testing.T) {
+	testBackend(t, func(t *testing.T) *conformanceTarget {
+		fake := newFakeVultr(t)
+		// Rules managed by hand, including one for a banned IP, must survive.
+		fake.add(vultrRule{IPType: "v4", Protocol: "tcp", Subnet: "198.51.100.1", SubnetSize: 32, Notes: "office"})
+		fake.add(vultrRule{IPType: "v4", Protocol: "icmp", Subnet: "203.0.113.7", SubnetSize: 32, Notes: "monitoring"})
+		fake.add(vultrRule{IPType: "v6", Protocol: "tcp", Subnet: "2001:db8::1", SubnetSize: 128})
+		t.Cleanup(func() {
+			if fake.count("198.51.100.1") != 1 || fake.count("2001:db8::1") != 1 {
+				t.Error("rules not created by the backend were removed")
+			}
+		})
+		return &conformanceTarget{
+			backend: NewVultrBackend(fake.config(), logging.NewLoggerTo(io.Discard)),
+			count:   func(ip string) int { return fake.count(ip) - fake.foreign(ip) },
+			fail:    fake.fail,
+			stall:   fake.stall,
+		}
+	})
+}
+
+func TestProxmoxConformance(t *testing.T) {
+	testBackend(t, func(t *testing.T) *conformanceTarget {
+		fake := newFakeProxmox(t)
+		fake.add(proxmoxRule{Action: "ACCEPT", Source: "198.51.100.1/32", Comment: "office"})
+		t.Cleanup(func() {
+			if fake.count("198.51.100.1") != 1 {
+				t.Error("rules not created by the backend were removed")
+			}
+		})
+		return &conformanceTarget{
+			backend: NewProxmoxBackend(fake.config(), logging.NewLoggerTo(io.Discard)),
+			count:   fake.count,
+			fail:    fake.fail,
+			stall:   fake.stall,
+		}
+	})
+}
+
+func TestHTTPAPIConformance(t *testing.T) {
+	testBackend(t, func(t *testing.T) *conformanceTarget {
+		fake := newFakeHTTPAPI(t)
+		return &conformanceTarget{
+			backend: NewHTTPAPIBackend(fake.config(), logging.NewLoggerTo(io.Discard)),
+			count:   fake.count,
+			fail:    fake.fail,
+			stall:   fake.stall,
+		}
+	})
+}
+
+func TestIPTablesConformance(t *testing.T) {
+	testBackend(t, func(t *testing.T) *conformanceTarget {
+		dir := fakeIPTablesDir(t)
+		toggle := func(name string) func(bool) {
+			return func(on bool) {
+				path := filepath.Join(dir, name)
+				if !on {
+					os.Remove(path)
+				} else if err := os.WriteFile(path, nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		cfg := &config.IPTablesConfig{Table: "filter", Chain: "INPUT"}
+		return &conformanceTarget{
+			backend: NewIPTablesBackend(cfg, logging.NewLoggerTo(io.Discard)),
+			count:   func(ip string) int { return fakeIPTablesCount(t, dir, ip) },
+			fail:    toggle("fail"),
+			stall:   toggle("stall"),
+		}
+	})
+}
+
+func TestIPTablesProbe(t *testing.T) {
+	dir := fakeIPTablesDir(t)
+	b := NewIPTablesBackend(&config.IPTablesConfig{Table: "filter", Chain: "INPUT"}, logging.NewLoggerTo(io.Discard))
+	p, ok := b.(Prober)
+	if !ok {
+		t.Fatal("iptables backend does not implement Prober")
+	}
+	if err := p.Probe(context.Background()); err != nil {
+		t.Fatalf("Probe: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "fail-ip6tables"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := p.Probe(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "ip6tables -t filter -S INPUT") {
+		t.Errorf("Probe with ip6tables failing: err %v, want it to name ip6tables", err)
+	}
+}
@@ -0,0 +1,190 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/rules"
+)
+
+// ManualRuleID is the rule ID recorded for bans requested through BanManager.Ban.
+const ManualRuleID = "manual"
+
+var (
+	// ErrWhitelisted is returned when a ban targets a whitelisted IP.
+	ErrWhitelisted = errors.New("ip is whitelisted")
+	// ErrAlreadyBanned is returned when a ban targets an IP with an active ban.
+	ErrAlreadyBanned = errors.New("ip is already banned")
+	// ErrNotBanned is returned when an IP has no active ban.
+	ErrNotBanned = errors.New("ip is not banned")
+	// ErrInvalidEntry is returned for a malformed whitelist entry.
+	ErrInvalidEntry = errors.New("invalid whitelist entry")
+	// ErrPastExpiry is returned when a ban's new expiry is not in the future.
+	ErrPastExpiry = errors.New("expiry is not in the future")
+)
+
+// ActiveBan describes a ban tracked by the BanManager.
+type ActiveBan struct {
+	IP        string    `json:"ip"`
+	RuleID    string    `json:"rule_id"`
+	Reason    string    `json:"reason"`
+	ExpiresAt time.Time `json:"expires_at"`
+	DryRun    bool      `json:"dry_run,omitempty"`
+	Evidence  []string  `json:"evidence,omitempty"` // raw log lines that led to the ban
+	Backends  []string  `json:"backends,omitempty"` // backends holding the ban
+	State     string    `json:"state"`              // StatePending, StateActive, StateFailed or StateExpiring
+}
+
+func (info banInfo) active(ip string) ActiveBan {
+	return ActiveBan{IP: ip, RuleID: info.RuleID, Reason: info.Reason, ExpiresAt: info.ExpiresAt, DryRun: info.DryRun,
+		Evidence: append([]string(nil), info.Evidence...), Backends: append([]string(nil), info.Backends...), State: info.State}
+}
+
+// listed reports whether the ban is shown by List and Get: until it expires,
+// or while backends still have to remove it.
+func (info banInfo) listed(now time.Time) bool {
+	return info.ExpiresAt.After(now) || info.State == StateExpiring
+}
+
+// DryRun reports whether bans are currently only simulated.
+func (m *BanManager) DryRun() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dryRun
+}
+
+// AddWhitelist whitelists an IP or CIDR until the daemon restarts and lifts
+// active bans it covers. Entries survive config reloads.
+func (m *BanManager) AddWhitelist(entry string) error {
+	if net.ParseIP(entry) == nil {
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return fmt.Errorf("%w: %q is not an IP address or CIDR", ErrInvalidEntry, entry)
+		}
+	}
+	m.mu.Lock()
+	if slices.Contains(m.extra, entry) {
+		m.mu.Unlock()
+		return nil
+	}
+	m.extra = append(m.extra, entry)
+	m.rebuildWhitelist()
+	m.mu.Unlock()
+
+	m.logger.Info("whitelist entry added at runtime", "entry", entry)
+	m.releaseWhitelisted()
+	return nil
+}
+
+// RuntimeWhitelist returns the whitelist entries added with AddWhitelist.
+func (m *BanManager) RuntimeWhitelist() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.extra...)
+}
+
+// List returns the active bans sorted by IP.
+func (m *BanManager) List() []ActiveBan {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock.Now()
+	out := make([]ActiveBan, 0, len(m.bans))
+	for ip, info := range m.bans {
+		if info.listed(now) {
+			out = append(out, info.active(ip))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].IP < out[j].IP })
+	return out
+}
+
+// Get returns the active ban for ip, if any.
+func (m *BanManager) Get(ip string) (ActiveBan, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, ok := m.bans[ip]
+	if !ok || !info.listed(m.clock.Now()) {
+		return ActiveBan{}, false
+	}
+	return info.active(ip), true
+}
+
+// Ban bans ip for d as if a rule had fired, so whitelist, dry-run and
+// unban scheduling apply. The backend call is queued; Ban does not wait for it.
+func (m *BanManager) Ban(ctx context.Context, ip string, d time.Duration, reason string) (ActiveBan, error) {
+	if err := ValidateIP(ip); err != nil {
+		return ActiveBan{}, err
+	}
+	if d <= 0 {
+		return ActiveBan{}, fmt.Errorf("ban duration must be > 0")
+	}
+	if reason == "" {
+		reason = "manual ban"
+	}
+	err := m.handleDecision(ctx, &rules.Decision{
+		IP:        ip,
+		RuleID:    ManualRuleID,
+		Violation: true,
+		Reason:    reason,
+		Ban:       true,
+		BanFor:    d,
+		Timestamp: m.clock.Now(),
+		Source:    rules.SourceManual,
+	})
+	if err != nil {
+		return ActiveBan{}, err
+	}
+	ban, _ := m.Get(ip)
+	return ban, nil
+}
+
+// Unban lifts the ban on ip immediately. Backends that fail to remove it
+// are retried in the background; the error reports them.
+func (m *BanManager) Unban(ctx context.Context, ip string) error {
+	m.mu.Lock()
+	info, ok := m.bans[ip]
+	m.mu.Unlock()
+	if !ok || !info.listed(m.clock.Now()) {
+		return ErrNotBanned
+	}
+
+	if err := m.lift(ctx, ip, info, "manual unban", rules.SourceManual); err != nil {
+		return fmt.Errorf("unban ip=%s (retrying): %w", ip, err)
+	}
+	m.logger.Info("unban (manual)", "ip", ip, "backend", strings.Join(info.Backends, ","), "dry_run", info.DryRun)
+	return nil
+}
+
+// Extend moves the expiry of the active ban on ip to until, earlier or later,
+// as long as until is still in the future. The rule stays installed until
+// then; backends that expire rules themselves are not told about the new
+// expiry.
+func (m *BanManager) Extend(ip string, until time.Time) (ActiveBan, error) {
+	m.mu.Lock()
+	info, ok := m.bans[ip]
+	if !ok || !info.ExpiresAt.After(m.clock.Now()) || info.State == StateExpiring {
+		m.mu.Unlock()
+		return ActiveBan{}, ErrNotBanned
+	}
+	if !until.After(m.clock.Now()) {
+		m.mu.Unlock()
+		return ActiveBan{}, fmt.Errorf("new expiry %s: %w", until.Format(time.RFC3339), ErrPastExpiry)
+	}
+	info.ExpiresAt = until
+	m.bans[ip] = info
+	if info.State != StatePending {
+		// Pending bans are scheduled once a backend accepts them.
+		m.expiry.schedule(ip, until)
+	}
+	m.mu.Unlock()
+
+	m.logger.Info("ban expiry moved", "ip", ip, "rule", info.RuleID, "until", until)
+	m.emit(BanEvent{Action: ActionExtend, IP: ip, RuleID: info.RuleID, Reason: info.Reason,
+		Backend: strings.Join(info.Backends, ","), DryRun: info.DryRun, ExpiresAt: until, Source: rules.SourceManual, Lines: info.Evidence})
+	return info.active(ip), nil
+}
@@ -0,0 +1,91 @@
+package firewall
+
+import (
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/rules"
+)
+
+// BanAction is what the BanManager did with an IP.
+type BanAction string
+
+const (
+	ActionBan    BanAction = "ban"
+	ActionUnban  BanAction = "unban"
+	ActionSkip   BanAction = "skip"   // ban not applied; Reason says why
+	ActionExtend BanAction = "extend" // expiry moved earlier or later
+)
+
+// SourceSystem marks unbans the BanManager makes on its own, on expiry or
+// when an IP becomes whitelisted. Bans carry the decision's source
+// (rules.SourceEngine or rules.SourceManual).
+const SourceSystem = "system"
+
+// BanEvent describes one ban, unban, skipped ban or extension.
+type BanEvent struct {
+	Time      time.Time
+	Action    BanAction
+	IP        string
+	RuleID    string
+	Reason    string
+	Backend   string
+	DryRun    bool
+	ExpiresAt time.Time // zero for unbans
+	Count     int       // errors counted when the rule fired
+	Source    string
+	Path      string   // request path of the triggering log line
+	Lines     []string // raw log lines that led to the ban
+	Err       error    // backend call failed
+}
+
+// Subscribe registers fn to be called for every BanEvent. fn runs on the
+// goroutine that handled the ban and should return quickly.
+func (m *BanManager) Subscribe(fn func(BanEvent)) {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	m.subs = append(m.subs, fn)
+}
+
+func (m *BanManager) emit(ev BanEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = m.clock.Now()
+	}
+	m.subsMu.RLock()
+	defer m.subsMu.RUnlock()
+	for _, fn := range m.subs {
+		fn(ev)
+	}
+}
+
+// decisionEvidence returns the raw lines behind d, falling back to the
+// triggering line when the engine kept no evidence.
+func decisionEvidence(d *rules.Decision) []string {
+	if len(d.Evidence) > 0 {
+		return d.Evidence
+	}
+	if d.Event != nil && d.Event.Raw != "" {
+		return []string{d.Event.Raw}
+	}
+	return nil
+}
+
+// decisionEvent builds the event for an action taken on d.
+func decisionEvent(action BanAction, d *rules.Decision, backend string, dryRun bool, expiry time.Time) BanEvent {
+	var path string
+	if d.Event != nil {
+		path = d.Event.Path
+	}
+	return BanEvent{
+		Action:    action,
+		IP:        d.IP,
+		RuleID:    d.RuleID,
+		Reason:    d.Reason,
+		Backend:   backend,
+		DryRun:    dryRun,
+		ExpiresAt: expiry,
+		Count:     d.Count,
+		Source:    d.Source,
+		Path:      path,
+		Lines:     decisionEvidence(d),
+	}
+}
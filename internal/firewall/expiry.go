@@ -0,0 +1,146 @@
+package firewall
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/clock"
+)
+
+// expiryScheduler tracks when each ban expires and hands expired IPs to a
+// callback, using one goroutine and one timer however many bans there are.
+// Expiries are kept in a min-heap indexed by IP, so moving or cancelling one
+// is O(log n). IPs found expired together are handed over as one batch.
+type expiryScheduler struct {
+	clock clock.Clock
+	wake  chan struct{}
+
+	mu    sync.Mutex
+	items expiryHeap
+	byIP  map[string]*expiryItem
+}
+
+type expiryItem struct {
+	ip    string
+	at    time.Time
+	index int // position in the heap
+}
+
+func newExpiryScheduler(c clock.Clock) *expiryScheduler {
+	return &expiryScheduler{clock: c, wake: make(chan struct{}, 1), byIP: make(map[string]*expiryItem)}
+}
+
+// schedule sets the expiry of ip to at, moving it earlier or later if it
+// was already scheduled.
+func (s *expiryScheduler) schedule(ip string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if it, ok := s.byIP[ip]; ok {
+		it.at = at
+		heap.Fix(&s.items, it.index)
+	} else {
+		it := &expiryItem{ip: ip, at: at}
+		heap.Push(&s.items, it)
+		s.byIP[ip] = it
+	}
+	s.signal()
+}
+
+// cancel forgets the expiry of ip.
+func (s *expiryScheduler) cancel(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if it, ok := s.byIP[ip]; ok {
+		heap.Remove(&s.items, it.index)
+		delete(s.byIP, ip)
+		s.signal()
+	}
+}
+
+// len returns the number of scheduled expiries.
+func (s *expiryScheduler) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items)
+}
+
+func (s *expiryScheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due removes and returns the IPs expired at now, and when the next one expires.
+func (s *expiryScheduler) due(now time.Time) ([]string, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ips []string
+	for len(s.items) > 0 && !s.items[0].at.After(now) {
+		it := heap.Pop(&s.items).(*expiryItem)
+		delete(s.byIP, it.ip)
+		ips = append(ips, it.ip)
+	}
+	if len(s.items) == 0 {
+		return ips, time.Time{}
+	}
+	return ips, s.items[0].at
+}
+
+// run calls fire with each batch of expired IPs until ctx is done. fire runs
+// on this goroutine; expiries due meanwhile make up the next batch.
+func (s *expiryScheduler) run(ctx context.Context, fire func(ips []string)) {
+	for {
+		ips, next := s.due(s.clock.Now())
+		if len(ips) > 0 {
+			fire(ips)
+			continue
+		}
+
+		var timer clock.Timer
+		var expired <-chan time.Time
+		if !next.IsZero() {
+			timer = s.clock.NewTimer(next.Sub(s.clock.Now()))
+			expired = timer.C()
+		}
+		select {
+		case <-ctx.Done():
+		case <-s.wake:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// expiryHeap orders items by expiry, earliest first; see container/heap.
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	it := x.(*expiryItem)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,138 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/clock"
+)
+
+// startScheduler runs an expiry scheduler on a fake clock and returns the
+// batches it fires.
+func startScheduler(t *testing.T) (*expiryScheduler, *clock.Fake, <-chan []string) {
+	t.Helper()
+	fake := clock.NewFake(time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC))
+	s := newExpiryScheduler(fake)
+	fired := make(chan []string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx, func(ips []string) {
+			slices.Sort(ips)
+			fired <- ips
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return s, fake, fired
+}
+
+func expectBatch(t *testing.T, fired <-chan []string, want ...string) {
+	t.Helper()
+	select {
+	case got := <-fired:
+		if !slices.Equal(got, want) {
+			t.Fatalf("fired %v, want %v", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("nothing fired, want %v", want)
+	}
+}
+
+func expectNone(t *testing.T, fired <-chan []string) {
+	t.Helper()
+	select {
+	case got := <-fired:
+		t.Fatalf("fired %v, want nothing", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestExpirySchedulerOrderAndBatching(t *testing.T) {
+	s, fake, fired := startScheduler(t)
+	now := fake.Now()
+
+	s.schedule("10.0.0.3", now.Add(3*time.Minute))
+	s.schedule("10.0.0.1", now.Add(time.Minute))
+	s.schedule("10.0.0.2", now.Add(time.Minute))
+	fake.BlockUntil(1)
+
+	fake.Advance(59 * time.Second)
+	expectNone(t, fired)
+	fake.BlockUntil(1)
+
+	fake.Advance(time.Second)
+	expectBatch(t, fired, "10.0.0.1", "10.0.0.2")
+	fake.BlockUntil(1)
+
+	fake.Advance(2 * time.Minute)
+	expectBatch(t, fired, "10.0.0.3")
+	if n := s.len(); n != 0 {
+		t.Fatalf("%d expiries left", n)
+	}
+}
+
+func TestExpirySchedulerMoveAndCancel(t *testing.T) {
+	s, fake, fired := startScheduler(t)
+	now := fake.Now()
+
+	s.schedule("extended", now.Add(time.Minute))
+	s.schedule("shortened", now.Add(time.Hour))
+	s.schedule("cancelled", now.Add(time.Minute))
+	s.schedule("extended", now.Add(2*time.Minute))
+	s.schedule("shortened", now.Add(time.Minute))
+	s.cancel("cancelled")
+	s.cancel("unknown")
+	fake.BlockUntil(1)
+
+	fake.Advance(time.Minute)
+	expectBatch(t, fired, "shortened")
+	fake.BlockUntil(1)
+
+	fake.Advance(time.Minute)
+	expectBatch(t, fired, "extended")
+	expectNone(t, fired)
+}
+
+func TestExpirySchedulerPastDeadline(t *testing.T) {
+	s, fake, fired := startScheduler(t)
+	s.schedule("10.0.0.1", fake.Now().Add(-time.Hour))
+	expectBatch(t, fired, "10.0.0.1")
+}
+
+func TestExpirySchedulerMany(t *testing.T) {
+	s, fake, fired := startScheduler(t)
+	now := fake.Now()
+	const n = 50000
+	for i := 0; i < n; i++ {
+		// Four distinct expiry times, scheduled out of order.
+		s.schedule(fmt.Sprintf("10.%d.%d.%d", i>>16, i>>8&0xff, i&0xff), now.Add(time.Duration(4-i%4)*time.Second))
+	}
+	fake.BlockUntil(1)
+
+	total := 0
+	for step := 0; step < 4; step++ {
+		fake.Advance(time.Second)
+		select {
+		case batch := <-fired:
+			if len(batch) != n/4 {
+				t.Fatalf("step %d: batch of %d, want %d", step, len(batch), n/4)
+			}
+			total += len(batch)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("step %d: nothing fired", step)
+		}
+		if step < 3 {
+			fake.BlockUntil(1)
+		}
+	}
+	if total != n || s.len() != 0 {
+		t.Fatalf("fired %d, %d left", total, s.len())
+	}
+}
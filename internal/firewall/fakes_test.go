@@ -0,0 +1,551 @@
+package firewall
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+)
+
+// TestMain lets the test binary stand in for iptables and ip6tables: when run
+// through a symlink of that name it acts as the fake and exits.
+func TestMain(m *testing.M) {
+	switch name := filepath.Base(os.Args[0]); name {
+	case "iptables", "ip6tables":
+		os.Exit(fakeIPTables(name, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// faults makes a fake server fail or hang on demand.
+type faults struct {
+	failing  atomic.Bool
+	stalling atomic.Bool
+	release  chan struct{} // closed when the test ends, to free stalled handlers
+}
+
+func newFaults(t *testing.T) *faults {
+	f := &faults{release: make(chan struct{})}
+	t.Cleanup(func() { close(f.release) })
+	return f
+}
+
+func (f *faults) fail(on bool)  { f.failing.Store(on) }
+func (f *faults) stall(on bool) { f.stalling.Store(on) }
+
+// wrap applies the current faults before calling h.
+func (f *faults) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.stalling.Load() {
+			io.Copy(io.Discard, r.Body)
+			select {
+			case <-r.Context().Done():
+			case <-f.release:
+			}
+			return
+		}
+		if f.failing.Load() {
+			http.Error(w, "injected failure", http.StatusInternalServerError)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// startServer serves h behind f until the test ends.
+func startServer(t *testing.T, f *faults, h http.Handler) *httptest.Server {
+	srv := httptest.NewServer(f.wrap(h))
+	t.Cleanup(srv.Close) // runs after f's cleanup releases stalled handlers
+	return srv
+}
+
+// checkHostRule reports a problem with a rule for subnet/size of the given
+// family, as the real APIs would reject it.
+func checkHostRule(subnet string, size int, family string) error {
+	ip := net.ParseIP(subnet)
+	switch {
+	case ip == nil:
+		return fmt.Errorf("invalid subnet %q", subnet)
+	case (ip.To4() == nil) != (family == "v6"):
+		return fmt.Errorf("subnet %s is not %s", subnet, family)
+	case family == "v4" && size != 32, family == "v6" && size != 128:
+		return fmt.Errorf("subnet size %d is not a single %s host", size, family)
+	}
+	return nil
+}
+
+// fakeVultr is an in-memory Vultr firewall group behind the v2 API.
+type fakeVultr struct {
+	*faults
+	srv *httptest.Server
+
+	mu     sync.Mutex
+	rules  []vultrRule
+	nextID int
+}
+
+const (
+	fakeVultrKey      = "vultr-test-key"
+	fakeVultrFirewall = "fw-1"
+	fakeVultrPageSize = 2 // small, so listing has to follow the cursor
+)
+
+func newFakeVultr(t *testing.T) *fakeVultr {
+	f := &fakeVultr{faults: newFaults(t), nextID: 1}
+	prefix := "/v2/firewalls/" + fakeVultrFirewall + "/rules"
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+prefix, f.list)
+	mux.HandleFunc("POST "+prefix, f.create)
+	mux.HandleFunc("DELETE "+prefix+"/{id}", f.delete)
+	f.srv = startServer(t, f.faults, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+fakeVultrKey {
+			http.Error(w, `{"error":"invalid API key"}`, http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return f
+}
+
+func (f *fakeVultr) config() *config.VultrConfig {
+	return &config.VultrConfig{APIKey: fakeVultrKey, FirewallID: fakeVultrFirewall, APIURL: f.srv.URL + "/v2"}
+}
+
+// add stores a rule as if created through the API and returns its ID.
+func (f *fakeVultr) add(r vultrRule) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r.ID = json.Number(strconv.Itoa(f.nextID))
+	f.nextID++
+	f.rules = append(f.rules, r)
+	return r.ID.String()
+}
+
+// count returns how many rules there are for ip.
+func (f *fakeVultr) count(ip string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.rules {
+		if sameIP(r.Subnet, ip) {
+			n++
+		}
+	}
+	return n
+}
+
+// foreign returns how many rules for ip were not created by the backend.
+func (f *fakeVultr) foreign(ip string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.rules {
+		if sameIP(r.Subnet, ip) && !strings.HasPrefix(r.Notes, vultrRuleNote) {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeVultr) list(w http.ResponseWriter, r *http.Request) {
+	perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || perPage <= 0 || perPage > fakeVultrPageSize {
+		perPage = fakeVultrPageSize
+	}
+	offset := 0
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		if offset, err = strconv.Atoi(c); err != nil {
+			http.Error(w, `{"error":"invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	f.mu.Lock()
+	total := len(f.rules)
+	page := f.rules[min(offset, total):min(offset+perPage, total)]
+	var resp struct {
+		FirewallRules []vultrRule `json:"firewall_rules"`
+		Meta          struct {
+			Total int `json:"total"`
+			Links struct {
+				Next string `json:"next"`
+				Prev string `json:"prev"`
+			} `json:"links"`
+		} `json:"meta"`
+	}
+	resp.FirewallRules = slices.Clone(page)
+	f.mu.Unlock()
+
+	resp.Meta.Total = total
+	if offset+perPage < total {
+		resp.Meta.Links.Next = strconv.Itoa(offset + perPage)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeVultr) create(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		vultrRule
+		Direction string `json:"direction"`
+		Port      string `json:"port"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	rule := req.vultrRule
+	if err := checkHostRule(rule.Subnet, rule.SubnetSize, rule.IPType); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, err), http.StatusBadRequest)
+		return
+	}
+	if req.Direction != "in" || (rule.Protocol != "tcp" && rule.Protocol != "udp") {
+		http.Error(w, `{"error":"invalid direction or protocol"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Like the real API, refuse an exact duplicate.
+	f.mu.Lock()
+	for _, r := range f.rules {
+		if sameIP(r.Subnet, rule.Subnet) && r.Protocol == rule.Protocol {
+			f.mu.Unlock()
+			http.Error(w, `{"error":"rule already exists"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	f.mu.Unlock()
+
+	id := f.add(rule)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"firewall_rule":{"id":%s}}`, id)
+}
+
+func (f *fakeVultr) delete(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := slices.IndexFunc(f.rules, func(rule vultrRule) bool { return rule.ID.String() == r.PathValue("id") })
+	if i < 0 {
+		http.Error(w, `{"error":"firewall rule not found"}`, http.StatusNotFound)
+		return
+	}
+	f.rules = slices.Delete(f.rules, i, i+1)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fakeProxmox is an in-memory node firewall behind the Proxmox API.
+type fakeProxmox struct {
+	*faults
+	srv *httptest.Server
+
+	mu    sync.Mutex
+	rules []proxmoxRule // index is the rule's position
+}
+
+const (
+	fakeProxmoxToken  = "foxhole@pve!fw"
+	fakeProxmoxSecret = "proxmox-test-secret"
+	fakeProxmoxNode   = "pve1"
+)
+
+func newFakeProxmox(t *testing.T) *fakeProxmox {
+	f := &fakeProxmox{faults: newFaults(t)}
+	prefix := "/api2/json/nodes/" + fakeProxmoxNode + "/firewall/rules"
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+prefix, f.list)
+	mux.HandleFunc("POST "+prefix, f.create)
+	mux.HandleFunc("DELETE "+prefix+"/{pos}", f.delete)
+	f.srv = startServer(t, f.faults, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "PVEAPIToken="+fakeProxmoxToken+"="+fakeProxmoxSecret {
+			http.Error(w, "authentication failure", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return f
+}
+
+func (f *fakeProxmox) config() *config.ProxmoxConfig {
+	return &config.ProxmoxConfig{
+		APIURL:      f.srv.URL + "/api2/json",
+		TokenID:     fakeProxmoxToken,
+		TokenSecret: fakeProxmoxSecret,
+		Node:        fakeProxmoxNode,
+	}
+}
+
+// add inserts a rule at the top, as the API does by default.
+func (f *fakeProxmox) add(r proxmoxRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = slices.Insert(f.rules, 0, r)
+}
+
+// count returns how many rules there are for ip.
+func (f *fakeProxmox) count(ip string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.rules {
+		if source, _, _ := strings.Cut(r.Source, "/"); sameIP(source, ip) {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeProxmox) list(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	data := slices.Clone(f.rules)
+	f.mu.Unlock()
+	for i := range data {
+		data[i].Pos = i
+	}
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func (f *fakeProxmox) create(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	source := r.PostForm.Get("source")
+	host, sizeStr, _ := strings.Cut(source, "/")
+	size, _ := strconv.Atoi(sizeStr)
+	family := "v4"
+	if strings.Contains(host, ":") {
+		family = "v6"
+	}
+	if err := checkHostRule(host, size, family); err != nil {
+		http.Error(w, "source: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := r.PostForm.Get("action")
+	if r.PostForm.Get("type") != "in" || action != "DROP" {
+		http.Error(w, "type or action: value does not match the regex pattern", http.StatusBadRequest)
+		return
+	}
+	// Unlike Vultr, Proxmox happily stores duplicates.
+	f.add(proxmoxRule{Action: action, Source: source, Comment: r.PostForm.Get("comment")})
+	json.NewEncoder(w).Encode(map[string]any{"data": nil})
+}
+
+func (f *fakeProxmox) delete(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pos, err := strconv.Atoi(r.PathValue("pos"))
+	if err != nil || pos < 0 || pos >= len(f.rules) {
+		http.Error(w, "no rule at position "+r.PathValue("pos"), http.StatusInternalServerError)
+		return
+	}
+	f.rules = slices.Delete(f.rules, pos, pos+1)
+	json.NewEncoder(w).Encode(map[string]any{"data": nil})
+}
+
+// fakeHTTPAPI is a generic http_api endpoint keeping a set of banned IPs.
+type fakeHTTPAPI struct {
+	*faults
+	srv *httptest.Server
+
+	mu     sync.Mutex
+	banned map[string]bool
+}
+
+const fakeHTTPAPIToken = "http-api-test-token"
+
+func newFakeHTTPAPI(t *testing.T) *fakeHTTPAPI {
+	f := &fakeHTTPAPI{faults: newFaults(t), banned: make(map[string]bool)}
+	f.srv = startServer(t, f.faults, http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeHTTPAPI) config() *config.HTTPAPIConfig {
+	return &config.HTTPAPIConfig{URL: f.srv.URL + "/ban", AuthToken: fakeHTTPAPIToken, Headers: map[string]string{"X-Tenant": "test"}}
+}
+
+func (f *fakeHTTPAPI) count(ip string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.banned[net.ParseIP(ip).String()] {
+		return 1
+	}
+	return 0
+}
+
+func (f *fakeHTTPAPI) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/ban" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+fakeHTTPAPIToken || r.Header.Get("X-Tenant") != "test" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req apiRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	ip := net.ParseIP(req.IP)
+	if ip == nil {
+		http.Error(w, "invalid ip", http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch req.Action {
+	case "ban":
+		if req.DurationSeconds <= 0 {
+			http.Error(w, "missing duration", http.StatusBadRequest)
+			return
+		}
+		f.banned[ip.String()] = true
+	case "unban":
+		delete(f.banned, ip.String())
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fakeIPTablesDirEnv names the directory holding the fake iptables state.
+const fakeIPTablesDirEnv = "FOXHOLE_FAKE_IPTABLES_DIR"
+
+// fakeIPTablesDir installs the test binary as iptables and ip6tables on PATH
+// for the rest of the test and returns its state directory. Creating a file
+// named "fail" or "stall" there makes every invocation fail or hang;
+// "fail-ip6tables" fails only that command.
+func fakeIPTablesDir(t *testing.T) string {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, state := t.TempDir(), t.TempDir()
+	for _, name := range []string{"iptables", "ip6tables"} {
+		if err := os.Symlink(exe, filepath.Join(bin, name)); err != nil {
+			t.Skipf("cannot install fake %s: %v", name, err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv(fakeIPTablesDirEnv, state)
+	return state
+}
+
+// fakeIPTablesCount returns how many rules the fake holds for ip.
+func fakeIPTablesCount(t *testing.T, dir, ip string) int {
+	name := "iptables"
+	if IsIPv6(ip) {
+		name = "ip6tables"
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		if f := strings.Fields(line); len(f) == 3 && sameIP(f[2], ip) {
+			n++
+		}
+	}
+	return n
+}
+
+// fakeIPTables implements the subset of iptables used by the backend:
+// -S of a chain and -C, -I and -D of "-s <ip> -j DROP" rules. Rules are
+// stored one per line as "table chain ip" in a file named after the command.
+func fakeIPTables(name string, args []string) int {
+	dir := os.Getenv(fakeIPTablesDirEnv)
+	if _, err := os.Stat(filepath.Join(dir, "stall")); err == nil {
+		time.Sleep(time.Minute)
+	}
+	for _, fail := range []string{"fail", "fail-" + name} {
+		if _, err := os.Stat(filepath.Join(dir, fail)); err == nil {
+			fmt.Fprintf(os.Stderr, "%s: Another app is currently holding the xtables lock.\n", name)
+			return 4
+		}
+	}
+
+	table, op, chain, source, target := "filter", "", "", "", ""
+	for i := 0; i < len(args); i++ {
+		next := func() string {
+			i++
+			if i < len(args) {
+				return args[i]
+			}
+			return ""
+		}
+		switch args[i] {
+		case "-t":
+			table = next()
+		case "-C", "-I", "-D":
+			op = args[i]
+			chain = next()
+			if op == "-I" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				next() // position
+			}
+		case "-S":
+			op = args[i]
+			chain = next()
+		case "-s":
+			source = next()
+		case "-j":
+			target = next()
+		default:
+			fmt.Fprintf(os.Stderr, "%s: unknown option %q\n", name, args[i])
+			return 2
+		}
+	}
+	if op == "-S" && chain != "" {
+		return 0
+	}
+	ip := net.ParseIP(source)
+	if op == "" || chain == "" || target != "DROP" || ip == nil || (ip.To4() == nil) != (name == "ip6tables") {
+		fmt.Fprintf(os.Stderr, "%s v1.8.9: host/network `%s' not found\n", name, source)
+		return 2
+	}
+
+	path := filepath.Join(dir, name)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, err)
+		return 4
+	}
+	rule := table + " " + chain + " " + ip.String()
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	i := slices.Index(lines, rule)
+
+	switch {
+	case op == "-I":
+		lines = slices.Insert(lines, 0, rule)
+	case i < 0:
+		fmt.Fprintf(os.Stderr, "%s: Bad rule (does a matching rule exist in that chain?).\n", name)
+		return 1
+	case op == "-D":
+		lines = slices.Delete(lines, i, i+1)
+	default: // -C
+		return 0
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 4
+	}
+	return 0
+}
@@ -47,7 +47,7 @@ func (b *httpAPIBackend) Ban(ctx context.Context, ip string, duration time.Durat
 	if err := ValidateIP(ip); err != nil {
 		return fmt.Errorf("http_api ban: %w", err)
 	}
-	b.logger.Infof("http_api ban: ip=%s rule=%s reason=%s for=%s", ip, ruleID, reason, duration)
+	b.logger.Debug("http_api ban", "ip", ip, "rule", ruleID, "reason", reason, "for", duration)
 	body := apiRequest{
 		Action:          "ban",
 		IP:              ip,
@@ -62,7 +62,7 @@ func (b *httpAPIBackend) Unban(ctx context.Context, ip string) error {
 	if err := ValidateIP(ip); err != nil {
 		return fmt.Errorf("http_api unban: %w", err)
 	}
-	b.logger.Infof("http_api unban: ip=%s", ip)
+	b.logger.Debug("http_api unban", "ip", ip)
 	body := apiRequest{
 		Action: "unban",
 		IP:     ip,
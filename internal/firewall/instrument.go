@@ -0,0 +1,45 @@
+package firewall
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/metrics"
+)
+
+// instrumentedBackend records call counts and latency for a Backend.
+type instrumentedBackend struct {
+	Backend
+}
+
+// instrument wraps b so its calls are reported in metrics. Wrapping twice is a no-op.
+func instrument(b Backend) Backend {
+	if _, ok := b.(instrumentedBackend); ok {
+		return b
+	}
+	return instrumentedBackend{b}
+}
+
+func (b instrumentedBackend) Ban(ctx context.Context, ip string, duration time.Duration, reason, ruleID string) error {
+	start := time.Now()
+	err := b.Backend.Ban(ctx, ip, duration, reason, ruleID)
+	b.observe("ban", start, err)
+	return err
+}
+
+func (b instrumentedBackend) Unban(ctx context.Context, ip string) error {
+	start := time.Now()
+	err := b.Backend.Unban(ctx, ip)
+	b.observe("unban", start, err)
+	return err
+}
+
+func (b instrumentedBackend) observe(op string, start time.Time, err error) {
+	name := b.Name()
+	metrics.BackendLatency.WithLabelValues(name, op).Observe(time.Since(start).Seconds())
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.BackendOps.WithLabelValues(name, op, result).Inc()
+}
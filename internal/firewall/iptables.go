@@ -2,8 +2,10 @@ package firewall
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/cyra/foxhole-fw/internal/config"
@@ -33,19 +35,18 @@ func (b *iptablesBackend) Ban(ctx context.Context, ip string, duration time.Dura
 	if err := ValidateIP(ip); err != nil {
 		return fmt.Errorf("iptables ban: %w", err)
 	}
+	iptablesCmd := b.command(ip)
+	b.logger.Debug("iptables ban", "cmd", iptablesCmd, "ip", ip, "table", b.table, "chain", b.chain, "rule", ruleID, "reason", reason, "for", duration)
 
-	// Use ip6tables for IPv6 addresses.
-	iptablesCmd := "iptables"
-	if IsIPv6(ip) {
-		iptablesCmd = "ip6tables"
-	}
-
-	args := []string{"-t", b.table, "-I", b.chain, "1", "-s", ip, "-j", "DROP"}
-	b.logger.Infof("%s ban: ip=%s table=%s chain=%s rule=%s reason=%s for=%s", iptablesCmd, ip, b.table, b.chain, ruleID, reason, duration)
-	cmd := exec.CommandContext(ctx, iptablesCmd, args...)
-	output, err := cmd.CombinedOutput()
+	exists, err := b.exists(ctx, iptablesCmd, ip)
 	if err != nil {
-		return fmt.Errorf("%s ban failed: %w (output=%s)", iptablesCmd, err, string(output))
+		return fmt.Errorf("%s ban failed: %w", iptablesCmd, err)
+	}
+	if exists {
+		return nil
+	}
+	if err := b.run(ctx, iptablesCmd, "-I", b.chain, "1", "-s", ip, "-j", "DROP"); err != nil {
+		return fmt.Errorf("%s ban failed: %w", iptablesCmd, err)
 	}
 	return nil
 }
@@ -54,19 +55,52 @@ func (b *iptablesBackend) Unban(ctx context.Context, ip string) error {
 	if err := ValidateIP(ip); err != nil {
 		return fmt.Errorf("iptables unban: %w", err)
 	}
+	iptablesCmd := b.command(ip)
+	b.logger.Debug("iptables unban", "cmd", iptablesCmd, "ip", ip, "table", b.table, "chain", b.chain)
+
+	exists, err := b.exists(ctx, iptablesCmd, ip)
+	if err != nil {
+		return fmt.Errorf("%s unban failed: %w", iptablesCmd, err)
+	}
+	if !exists {
+		b.logger.Debug("iptables unban: no rule found", "ip", ip)
+		return nil
+	}
+	if err := b.run(ctx, iptablesCmd, "-D", b.chain, "-s", ip, "-j", "DROP"); err != nil {
+		return fmt.Errorf("%s unban failed: %w", iptablesCmd, err)
+	}
+	return nil
+}
 
-	// Use ip6tables for IPv6 addresses.
-	iptablesCmd := "iptables"
+// command returns the binary managing ip's address family.
+func (b *iptablesBackend) command(ip string) string {
 	if IsIPv6(ip) {
-		iptablesCmd = "ip6tables"
+		return "ip6tables"
 	}
+	return "iptables"
+}
 
-	args := []string{"-t", b.table, "-D", b.chain, "-s", ip, "-j", "DROP"}
-	b.logger.Infof("%s unban: ip=%s table=%s chain=%s", iptablesCmd, ip, b.table, b.chain)
-	cmd := exec.CommandContext(ctx, iptablesCmd, args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%s unban failed: %w (output=%s)", iptablesCmd, err, string(output))
+// exists reports whether the drop rule for ip is in the chain. iptables -C
+// exits with status 1 when it is not; any other failure is an error.
+func (b *iptablesBackend) exists(ctx context.Context, iptablesCmd, ip string) (bool, error) {
+	err := b.run(ctx, iptablesCmd, "-C", b.chain, "-s", ip, "-j", "DROP")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
 	}
-	return nil
+	return err == nil, err
+}
+
+// run executes iptablesCmd on the configured table. If ctx ended, the
+// returned error wraps ctx.Err() rather than the resulting kill signal.
+func (b *iptablesBackend) run(ctx context.Context, iptablesCmd string, args ...string) error {
+	args = append([]string{"-t", b.table}, args...)
+	output, err := exec.CommandContext(ctx, iptablesCmd, args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("%w (output=%s)", err, strings.TrimSpace(string(output)))
 }
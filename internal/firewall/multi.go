@@ -0,0 +1,107 @@
+package firewall
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+)
+
+// backendSet holds the configured backends and how bans are spread over
+// them: on every backend (fan-out) or on the first one that succeeds
+// (fallback).
+type backendSet struct {
+	mode     string
+	backends []Backend      // instrumented, in configured order
+	calls    sync.WaitGroup // calls in flight; see BanManager.acquire
+}
+
+func newBackendSet(backends []Backend, mode string) *backendSet {
+	s := &backendSet{mode: mode, backends: make([]Backend, len(backends))}
+	for i, b := range backends {
+		s.backends[i] = instrument(b)
+	}
+	return s
+}
+
+// name returns the backend names for logging.
+func (s *backendSet) name() string {
+	return strings.Join(names(s.backends), ",")
+}
+
+// get returns the backend called name, or nil.
+func (s *backendSet) get(name string) Backend {
+	for _, b := range s.backends {
+		if b.Name() == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// targets returns the backends a ban goes to, in configured order: those
+// named in selected, or all of them if selected is empty.
+func (s *backendSet) targets(selected []string) []Backend {
+	if len(selected) == 0 {
+		return s.backends
+	}
+	var out []Backend
+	for _, b := range s.backends {
+		if slices.Contains(selected, b.Name()) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// ban installs the ban on targets according to the mode and returns the
+// names of the backends that now hold it. done is called after every
+// backend call. Fan-out calls run concurrently; fallback tries targets in
+// order until one succeeds.
+func (s *backendSet) ban(ctx context.Context, targets []Backend, ip string, d time.Duration, reason, ruleID string,
+	done func(b Backend, err error)) []string {
+	if s.mode == config.BackendModeFallback {
+		for _, b := range targets {
+			err := b.Ban(ctx, ip, d, reason, ruleID)
+			done(b, err)
+			if err == nil {
+				return []string{b.Name()}
+			}
+		}
+		return nil
+	}
+
+	errs := make([]error, len(targets))
+	if len(targets) == 1 {
+		errs[0] = targets[0].Ban(ctx, ip, d, reason, ruleID)
+	} else {
+		var wg sync.WaitGroup
+		for i, b := range targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = b.Ban(ctx, ip, d, reason, ruleID)
+			}()
+		}
+		wg.Wait()
+	}
+	var holders []string
+	for i, b := range targets {
+		done(b, errs[i])
+		if errs[i] == nil {
+			holders = append(holders, b.Name())
+		}
+	}
+	return holders
+}
+
+func names(backends []Backend) []string {
+	out := make([]string, len(backends))
+	for i, b := range backends {
+		out[i] = b.Name()
+	}
+	return out
+}
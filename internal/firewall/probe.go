@@ -0,0 +1,81 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// Prober is implemented by backends that can verify their settings and
+// credentials without changing any firewall state.
+type Prober interface {
+	// Probe performs a read-only request against the backend.
+	Probe(ctx context.Context) error
+}
+
+// Probe lists the configured chain with both iptables and ip6tables, since
+// bans of IPv6 addresses go through the latter. It fails if the table or chain
+// does not exist for either or one of them cannot be run.
+func (b *iptablesBackend) Probe(ctx context.Context) error {
+	var errs []error
+	for _, name := range []string{"iptables", "ip6tables"} {
+		if err := b.run(ctx, name, "-S", b.chain); err != nil {
+			errs = append(errs, fmt.Errorf("%s -t %s -S %s: %w", name, b.table, b.chain, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Probe fetches the firewall group, checking the API key and firewall_id.
+func (b *vultrBackend) Probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.base+"/firewalls/"+url.PathEscape(b.cfg.FirewallID), http.NoBody)
+	if err != nil {
+		return fmt.Errorf("vultr: build request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+b.cfg.APIKey)
+	return probeStatus(b.client, req, "vultr", "firewall group "+b.cfg.FirewallID)
+}
+
+// Probe lists the firewall rules of the configured node or VM, checking the
+// API URL, token and scope.
+func (b *proxmoxBackend) Probe(ctx context.Context) error {
+	u, err := url.Parse(b.cfg.APIURL)
+	if err != nil {
+		return fmt.Errorf("proxmox: invalid api_url: %w", err)
+	}
+	target := "node " + b.cfg.Node
+	if b.cfg.VMID != "" {
+		u.Path = path.Join(u.Path, "nodes", b.cfg.Node, "qemu", b.cfg.VMID, "firewall", "rules")
+		target = "vm " + b.cfg.VMID + " on " + target
+	} else {
+		u.Path = path.Join(u.Path, "nodes", b.cfg.Node, "firewall", "rules")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), http.NoBody)
+	if err != nil {
+		return fmt.Errorf("proxmox: build request: %w", err)
+	}
+	req.Header.Set("Authorization", "PVEAPIToken="+b.cfg.TokenID+"="+b.cfg.TokenSecret)
+	return probeStatus(b.client, req, "proxmox", target)
+}
+
+// probeStatus sends req and turns the response status into a descriptive error.
+func probeStatus(client *http.Client, req *http.Request, backend, target string) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: http error: %w", backend, err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%s: credentials rejected (%s)", backend, resp.Status)
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%s: %s not found", backend, target)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("%s: non-success status %s", backend, resp.Status)
+	}
+	return nil
+}
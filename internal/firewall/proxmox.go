@@ -3,27 +3,32 @@ package firewall
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/cyra/foxhole-fw/internal/config"
 	"github.com/cyra/foxhole-fw/internal/logging"
 )
 
+// proxmoxRuleComment prefixes the comment of every rule this backend creates,
+// so its rules can be told apart from the ones managed by hand.
+const proxmoxRuleComment = "foxhole-fw:"
+
 // proxmoxBackend integrates with the Proxmox firewall HTTP API.
-// It creates per-IP drop rules on all ports at node or VM level.
+// It creates per-IP drop rules on all ports at node or VM level. Proxmox
+// addresses rules by position, which shifts as rules come and go, so the
+// rules for an IP are looked up on every call.
 type proxmoxBackend struct {
 	cfg    *config.ProxmoxConfig
 	client *http.Client
 	logger *logging.Logger
-
-	mu    sync.Mutex
-	rules map[string][]int // ip -> []position
 }
 
 func NewProxmoxBackend(cfg *config.ProxmoxConfig, logger *logging.Logger) Backend {
@@ -31,7 +36,6 @@ func NewProxmoxBackend(cfg *config.ProxmoxConfig, logger *logging.Logger) Backen
 		cfg:    cfg,
 		client: &http.Client{Timeout: 10 * time.Second},
 		logger: logger,
-		rules:  make(map[string][]int),
 	}
 }
 
@@ -39,29 +43,27 @@ func (b *proxmoxBackend) Name() string {
 	return "proxmox"
 }
 
+// proxmoxRule is a firewall rule as listed by the API.
+type proxmoxRule struct {
+	Pos     int    `json:"pos"`
+	Action  string `json:"action"`
+	Source  string `json:"source"`
+	Comment string `json:"comment"`
+}
+
 func (b *proxmoxBackend) Ban(ctx context.Context, ip string, duration time.Duration, reason, ruleID string) error {
 	if err := ValidateIP(ip); err != nil {
 		return fmt.Errorf("proxmox ban: %w", err)
 	}
+	b.logger.Debug("proxmox ban", "ip", ip, "rule", ruleID, "for", duration, "reason", reason, "scope", b.scope(), "node", b.cfg.Node)
 
-	u, err := url.Parse(b.cfg.APIURL)
+	existing, err := b.ipRules(ctx, ip)
 	if err != nil {
-		return fmt.Errorf("proxmox: invalid api_url: %w", err)
+		return err
 	}
-
-	scope := "node"
-	if b.cfg.VMID != "" {
-		scope = "vm:" + b.cfg.VMID
-	}
-	b.logger.Infof("Proxmox backend ban: ip=%s rule=%s for=%s reason=%s (scope=%s node=%s)", ip, ruleID, duration, reason, scope, b.cfg.Node)
-
-	var rulesPath string
-	if b.cfg.VMID != "" {
-		rulesPath = path.Join("nodes", b.cfg.Node, "qemu", b.cfg.VMID, "firewall", "rules")
-	} else {
-		rulesPath = path.Join("nodes", b.cfg.Node, "firewall", "rules")
+	if len(existing) > 0 {
+		return nil
 	}
-	u.Path = path.Join(u.Path, rulesPath)
 
 	// Use /128 for IPv6 addresses, /32 for IPv4.
 	subnetSize := "32"
@@ -71,41 +73,26 @@ func (b *proxmoxBackend) Ban(ctx context.Context, ip string, duration time.Durat
 
 	form := url.Values{}
 	form.Set("type", "in")
-	form.Set("action", "drop")
+	form.Set("action", "DROP")
 	form.Set("enable", "1")
 	form.Set("source", ip+"/"+subnetSize)
-	form.Set("comment", fmt.Sprintf("foxhole-fw:%s", ruleID))
+	form.Set("comment", proxmoxRuleComment+ruleID)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(form.Encode()))
+	rulesURL, err := b.rulesURL()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rulesURL, strings.NewReader(form.Encode()))
 	if err != nil {
 		return fmt.Errorf("proxmox: build request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Authorization", "PVEAPIToken="+b.cfg.TokenID+"="+b.cfg.TokenSecret)
 
-	resp, err := b.client.Do(req)
+	resp, err := b.do(req)
 	if err != nil {
-		return fmt.Errorf("proxmox: http error: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 300 {
-		return fmt.Errorf("proxmox: non-success status %s", resp.Status)
-	}
-
-	var body struct {
-		Data struct {
-			Pos int `json:"pos"`
-		} `json:"data"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
-		b.logger.Errorf("proxmox: decode response failed (ip=%s): %v", ip, err)
-	} else if body.Data.Pos > 0 {
-		b.mu.Lock()
-		b.rules[ip] = append(b.rules[ip], body.Data.Pos)
-		b.mu.Unlock()
-	}
-
+	resp.Body.Close()
 	return nil
 }
 
@@ -113,57 +100,104 @@ func (b *proxmoxBackend) Unban(ctx context.Context, ip string) error {
 	if err := ValidateIP(ip); err != nil {
 		return fmt.Errorf("proxmox unban: %w", err)
 	}
+	b.logger.Debug("proxmox unban", "ip", ip, "scope", b.scope(), "node", b.cfg.Node)
 
-	uBase, err := url.Parse(b.cfg.APIURL)
+	rules, err := b.ipRules(ctx, ip)
 	if err != nil {
-		return fmt.Errorf("proxmox: invalid api_url: %w", err)
-	}
-
-	scope := "node"
-	if b.cfg.VMID != "" {
-		scope = "vm:" + b.cfg.VMID
+		return err
 	}
-	b.logger.Infof("Proxmox backend unban: ip=%s (scope=%s node=%s)", ip, scope, b.cfg.Node)
-
-	b.mu.Lock()
-	positions := b.rules[ip]
-	delete(b.rules, ip)
-	b.mu.Unlock()
-
-	if len(positions) == 0 {
-		b.logger.Infof("Proxmox backend unban: no recorded rules for ip=%s", ip)
+	if len(rules) == 0 {
+		b.logger.Debug("proxmox unban: no rules found", "ip", ip)
 		return nil
 	}
 
-	for _, pos := range positions {
-		u := *uBase
-		var rulesPath string
-		if b.cfg.VMID != "" {
-			rulesPath = path.Join("nodes", b.cfg.Node, "qemu", b.cfg.VMID, "firewall", "rules", fmt.Sprintf("%d", pos))
-		} else {
-			rulesPath = path.Join("nodes", b.cfg.Node, "firewall", "rules", fmt.Sprintf("%d", pos))
-		}
-		u.Path = path.Join(u.Path, rulesPath)
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), http.NoBody)
+	rulesURL, err := b.rulesURL()
+	if err != nil {
+		return err
+	}
+	// Highest position first, so deleting a rule does not move the others.
+	slices.SortFunc(rules, func(a, b proxmoxRule) int { return b.Pos - a.Pos })
+	var errs []error
+	for _, r := range rules {
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, rulesURL+"/"+strconv.Itoa(r.Pos), http.NoBody)
 		if err != nil {
-			b.logger.Errorf("proxmox: build delete request failed for ip=%s pos=%d: %v", ip, pos, err)
-			continue
+			return fmt.Errorf("proxmox: build request: %w", err)
 		}
-		req.Header.Set("Authorization", "PVEAPIToken="+b.cfg.TokenID+"="+b.cfg.TokenSecret)
-
-		resp, err := b.client.Do(req)
+		resp, err := b.do(req)
 		if err != nil {
-			b.logger.Errorf("proxmox: http delete failed for ip=%s pos=%d: %v", ip, pos, err)
+			errs = append(errs, fmt.Errorf("delete rule at pos %d: %w", r.Pos, err))
 			continue
 		}
 		resp.Body.Close()
+	}
+	return errors.Join(errs...)
+}
 
-		if resp.StatusCode >= 300 {
-			b.logger.Errorf("proxmox: delete rule failed for ip=%s pos=%d status=%s", ip, pos, resp.Status)
-			continue
+// ipRules lists the rules this backend created for ip.
+func (b *proxmoxBackend) ipRules(ctx context.Context, ip string) ([]proxmoxRule, error) {
+	rulesURL, err := b.rulesURL()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rulesURL, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("proxmox: build request: %w", err)
+	}
+	resp, err := b.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data []proxmoxRule `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("proxmox: decode rule list: %w", err)
+	}
+	var out []proxmoxRule
+	for _, r := range body.Data {
+		source, _, _ := strings.Cut(r.Source, "/")
+		if sameIP(source, ip) && strings.EqualFold(r.Action, "DROP") && strings.HasPrefix(r.Comment, proxmoxRuleComment) {
+			out = append(out, r)
 		}
 	}
+	return out, nil
+}
 
-	return nil
+// scope describes where rules are installed, for logging.
+func (b *proxmoxBackend) scope() string {
+	if b.cfg.VMID != "" {
+		return "vm:" + b.cfg.VMID
+	}
+	return "node"
+}
+
+// rulesURL returns the URL of the rule list of the configured node or VM.
+func (b *proxmoxBackend) rulesURL() (string, error) {
+	u, err := url.Parse(b.cfg.APIURL)
+	if err != nil {
+		return "", fmt.Errorf("proxmox: invalid api_url: %w", err)
+	}
+	if b.cfg.VMID != "" {
+		u.Path = path.Join(u.Path, "nodes", b.cfg.Node, "qemu", b.cfg.VMID, "firewall", "rules")
+	} else {
+		u.Path = path.Join(u.Path, "nodes", b.cfg.Node, "firewall", "rules")
+	}
+	return u.String(), nil
+}
+
+// do authenticates and sends req, turning transport errors and non-success
+// statuses into errors. The caller closes the body of a successful response.
+func (b *proxmoxBackend) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "PVEAPIToken="+b.cfg.TokenID+"="+b.cfg.TokenSecret)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("proxmox: http error: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("proxmox: non-success status %s", resp.Status)
+	}
+	return resp, nil
 }
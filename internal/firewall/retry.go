@@ -0,0 +1,654 @@
+package firewall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/clock"
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/metrics"
+)
+
+// Files kept in the state directory.
+const (
+	retryFile      = "retries.json"
+	deadLetterFile = "dead-letter.jsonl"
+)
+
+// retryTimeout bounds each retried backend call.
+const retryTimeout = 30 * time.Second
+
+// saveDelay is how long a change to the retry queue may wait to be saved, so
+// a burst of changes is written once.
+const saveDelay = time.Second
+
+// retryOp is a failed ban or unban call waiting to be retried. It carries
+// enough of the ban to restore it after a restart.
+type retryOp struct {
+	Action    BanAction `json:"action"` // ActionBan or ActionUnban
+	IP        string    `json:"ip"`
+	Backend   string    `json:"backend,omitempty"` // empty: the first target that succeeds, in fallback mode
+	RuleID    string    `json:"rule_id"`
+	Reason    string    `json:"reason"`
+	Source    string    `json:"source,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Selected  []string  `json:"selected,omitempty"` // backends the rule bans on
+	Attempts  int       `json:"attempts"`           // calls made so far
+	Next      time.Time `json:"next"`
+	LastError string    `json:"last_error,omitempty"`
+
+	busy bool // taken by due and not yet requeued or done
+}
+
+// backendLabel names the op's backend in logs and metrics.
+func (op *retryOp) backendLabel() string {
+	if op.Backend == "" {
+		return "any"
+	}
+	return op.Backend
+}
+
+// retryQueue holds failed backend calls until they are due. The delay after
+// each failed call doubles up to the configured maximum and is randomized by
+// the jitter fraction. Once a state directory is set, the queue is saved
+// there shortly after it changes and on shutdown, and abandoned calls are
+// appended to a dead-letter file.
+type retryQueue struct {
+	cfg    config.RetryConfig
+	logger *logging.Logger
+	clock  clock.Clock
+	wake   chan struct{}
+
+	mu    sync.Mutex
+	ops   []*retryOp
+	path  string // saved queue; empty keeps it in memory
+	dead  string // dead-letter file
+	dirty bool   // changed since the last save, which is scheduled
+	// stopSave cancels the scheduled save; nil when none is.
+	stopSave func()
+
+	saveMu sync.Mutex // serializes writes of the queue file
+}
+
+func newRetryQueue(cfg config.RetryConfig, logger *logging.Logger, clk clock.Clock) *retryQueue {
+	return &retryQueue{cfg: cfg, logger: logger, clock: clk, wake: make(chan struct{}, 1)}
+}
+
+// load reads the queue saved in dir, if any, and saves to dir from then on.
+func (q *retryQueue) load(dir string) ([]*retryOp, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create state dir: %w", err)
+	}
+	path := filepath.Join(dir, retryFile)
+	var ops []*retryOp
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("read retry queue: %w", err)
+	default:
+		if err := json.Unmarshal(data, &ops); err != nil {
+			return nil, fmt.Errorf("parse retry queue %s: %w", path, err)
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.path, q.dead = path, filepath.Join(dir, deadLetterFile)
+	if len(q.ops) > 0 {
+		// Queued before there was a file to save them to.
+		q.save()
+	}
+	q.ops = append(q.ops, ops...)
+	q.signal()
+	return ops, nil
+}
+
+// delay returns how long to wait after the given number of failed calls.
+func (q *retryQueue) delay(attempts int) time.Duration {
+	d := q.cfg.Backoff
+	for i := 1; i < attempts && d < q.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, q.cfg.MaxBackoff)
+	if q.cfg.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * q.cfg.Jitter * float64(d))
+	}
+	return d
+}
+
+// add queues op after a failed call with err, or right away if err is nil.
+// It returns false, leaving op out of the queue, once op has used up its
+// attempts.
+func (q *retryQueue) add(op *retryOp, err error) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.Index(q.ops, op)
+	if err != nil {
+		op.Attempts++
+		op.LastError = err.Error()
+		if q.cfg.MaxAttempts > 0 && op.Attempts >= q.cfg.MaxAttempts {
+			if i >= 0 {
+				q.ops = slices.Delete(q.ops, i, i+1)
+				q.save()
+			}
+			return false
+		}
+		op.Next = q.clock.Now().Add(q.delay(op.Attempts))
+	} else {
+		op.Next = q.clock.Now()
+	}
+	op.busy = false
+	if i < 0 {
+		q.ops = append(q.ops, op)
+	}
+	q.save()
+	q.signal()
+	return true
+}
+
+// done removes op from the queue.
+func (q *retryQueue) done(op *retryOp) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if i := slices.Index(q.ops, op); i >= 0 {
+		q.ops = slices.Delete(q.ops, i, i+1)
+		q.save()
+	}
+}
+
+// cancel drops the queued ops for ip with one of the given actions. Ops
+// being retried are left to the caller of due.
+func (q *retryQueue) cancel(ip string, actions ...BanAction) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.ops)
+	q.ops = slices.DeleteFunc(q.ops, func(op *retryOp) bool {
+		return !op.busy && op.IP == ip && slices.Contains(actions, op.Action)
+	})
+	if len(q.ops) != n {
+		q.save()
+		q.signal()
+	}
+}
+
+// has reports whether an op with action is queued or being retried for ip,
+// on backend if one is given.
+func (q *retryQueue) has(ip string, action BanAction, backend ...string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return slices.ContainsFunc(q.ops, func(op *retryOp) bool {
+		return op.IP == ip && op.Action == action && (len(backend) == 0 || op.Backend == backend[0])
+	})
+}
+
+// release puts back an op taken by due without retrying it.
+func (q *retryQueue) release(op *retryOp) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	op.busy = false
+}
+
+// due marks the ops due at now as busy and returns them.
+func (q *retryQueue) due(now time.Time) []*retryOp {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out []*retryOp
+	for _, op := range q.ops {
+		if !op.busy && !op.Next.After(now) {
+			op.busy = true
+			out = append(out, op)
+		}
+	}
+	return out
+}
+
+// next returns when the earliest waiting op is due.
+func (q *retryQueue) next() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var next time.Time
+	for _, op := range q.ops {
+		if !op.busy && (next.IsZero() || op.Next.Before(next)) {
+			next = op.Next
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// len returns the number of queued ops.
+func (q *retryQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.ops)
+}
+
+func (q *retryQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save schedules the queue to be written to its file. q.mu must be held.
+func (q *retryQueue) save() {
+	if q.path == "" || q.dirty {
+		return
+	}
+	q.dirty = true
+	timer := q.clock.NewTimer(saveDelay)
+	stop := make(chan struct{})
+	q.stopSave = func() {
+		timer.Stop()
+		close(stop)
+	}
+	go func() {
+		select {
+		case <-timer.C():
+			q.flush()
+		case <-stop:
+		}
+	}()
+}
+
+// flush writes the queue to its file, replacing it atomically, if it changed
+// since it was last written. A failed write is tried again later.
+func (q *retryQueue) flush() {
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return
+	}
+	q.dirty = false
+	q.stopSave()
+	q.stopSave = nil
+	path := q.path
+	data, err := json.MarshalIndent(q.ops, "", "  ")
+	q.mu.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		q.logger.Error("failed to save retry queue", "path", path, "err", err)
+		q.mu.Lock()
+		q.save()
+		q.mu.Unlock()
+	}
+}
+
+// deadLetter records an op that will not be retried again.
+func (q *retryQueue) deadLetter(op *retryOp) {
+	metrics.BackendRetries.WithLabelValues(op.backendLabel(), string(op.Action), "abandoned").Inc()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.dead == "" {
+		return
+	}
+	line, err := json.Marshal(struct {
+		*retryOp
+		AbandonedAt time.Time `json:"abandoned_at"`
+	}{op, q.clock.Now()})
+	if err == nil {
+		err = appendLine(q.dead, line)
+	}
+	if err != nil {
+		q.logger.Error("failed to write dead letter", "path", q.dead, "ip", op.IP, "err", err)
+	}
+}
+
+// writeJSONFile writes v to path through a temporary file and a rename, so
+// a crash never leaves a partial file.
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data and a newline to path through a temporary file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func appendLine(path string, line []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// PendingRetries returns the number of failed backend calls waiting to be retried.
+func (m *BanManager) PendingRetries() int {
+	return m.retries.len()
+}
+
+// retryLoop retries failed backend calls as they become due until ctx is
+// done, making the calls with calls. Up to one call per worker runs at once;
+// the loop keeps dispatching while they do, and waits for them on return.
+func (m *BanManager) retryLoop(ctx, calls context.Context) {
+	var running sync.WaitGroup
+	defer running.Wait()
+	sem := make(chan struct{}, m.workers)
+	for {
+		var timer clock.Timer
+		var due <-chan time.Time
+		if next, ok := m.retries.next(); ok {
+			timer = m.clock.NewTimer(next.Sub(m.clock.Now()))
+			due = timer.C()
+		}
+		select {
+		case <-ctx.Done():
+		case <-m.retries.wake:
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		for _, op := range m.retries.due(m.clock.Now()) {
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					m.retries.release(op)
+					return
+				}
+				defer func() { <-sem }()
+				switch op.Action {
+				case ActionBan:
+					m.retryBan(calls, op)
+				case ActionUnban:
+					m.retryUnban(calls, op)
+				}
+			}()
+		}
+	}
+}
+
+// queueRetry queues op after its call failed with err and gives up on it
+// once it has used its attempts.
+func (m *BanManager) queueRetry(ctx context.Context, op *retryOp, err error) {
+	if m.retries.add(op, err) {
+		return
+	}
+	m.retries.deadLetter(op)
+	m.logger.Error("giving up on backend call", "action", string(op.Action), "ip", op.IP, "rule", op.RuleID,
+		"backend", op.backendLabel(), "attempts", op.Attempts, "err", err)
+	m.emit(BanEvent{Action: op.Action, IP: op.IP, RuleID: op.RuleID, Reason: op.Reason, Backend: op.backendLabel(),
+		ExpiresAt: op.ExpiresAt, Source: op.Source, Err: fmt.Errorf("gave up after %d attempts: %w", op.Attempts, err)})
+
+	switch op.Action {
+	case ActionBan:
+		m.settle(ctx, op.IP)
+	case ActionUnban:
+		// The rule may still be installed; it is listed in the dead-letter
+		// file. A ban that became active again keeps relying on it.
+		m.mu.Lock()
+		info, ok := m.bans[op.IP]
+		m.mu.Unlock()
+		if ok && info.State == StateExpiring {
+			m.removeHolders(ctx, op.IP, op.Backend)
+		}
+	}
+}
+
+// retryBan retries a failed ban while the ban is still wanted.
+func (m *BanManager) retryBan(ctx context.Context, op *retryOp) {
+	m.mu.Lock()
+	info, ok := m.bans[op.IP]
+	m.mu.Unlock()
+	if !ok || info.State == StateExpiring || !info.ExpiresAt.After(m.clock.Now()) {
+		m.retries.done(op)
+		m.settle(ctx, op.IP)
+		return
+	}
+
+	set := m.acquire()
+	defer set.calls.Done()
+	var targets []Backend
+	switch {
+	case op.Backend == "":
+		if len(info.Backends) == 0 {
+			targets = set.targets(info.Selected)
+		}
+	case !slices.Contains(info.Backends, op.Backend):
+		if b := set.get(op.Backend); b != nil {
+			targets = []Backend{b}
+		}
+	}
+	var lastErr error
+	callCtx, cancel := context.WithTimeout(ctx, retryTimeout)
+	holders := set.ban(callCtx, targets, op.IP, info.ExpiresAt.Sub(m.clock.Now()), info.Reason, info.RuleID, func(b Backend, err error) {
+		if err != nil {
+			lastErr = err
+			metrics.BackendRetries.WithLabelValues(b.Name(), string(ActionBan), "failure").Inc()
+			m.logger.Warn("ban retry failed", "ip", op.IP, "rule", info.RuleID, "backend", b.Name(), "attempt", op.Attempts+1, "err", err)
+			return
+		}
+		metrics.BackendRetries.WithLabelValues(b.Name(), string(ActionBan), "success").Inc()
+		m.logger.Info("ban applied", "ip", op.IP, "rule", info.RuleID, "backend", b.Name(), "until", info.ExpiresAt, "attempt", op.Attempts+1)
+	})
+	cancel()
+	if len(holders) > 0 {
+		m.emit(BanEvent{Action: ActionBan, IP: op.IP, RuleID: info.RuleID, Reason: info.Reason, Backend: strings.Join(holders, ","),
+			ExpiresAt: info.ExpiresAt, Source: op.Source, Lines: info.Evidence})
+	}
+
+	switch {
+	case len(targets) == 0:
+		// Backend removed from the config, or the ban is already in place.
+		m.retries.done(op)
+		m.settle(ctx, op.IP)
+	case len(holders) > 0:
+		m.retries.done(op)
+		m.addHolders(ctx, op.IP, holders, info, op.Source)
+	default:
+		m.queueRetry(ctx, op, lastErr)
+	}
+}
+
+// retryUnban retries a failed unban while the backend is still recorded as
+// holding the ban.
+func (m *BanManager) retryUnban(ctx context.Context, op *retryOp) {
+	m.mu.Lock()
+	info, ok := m.bans[op.IP]
+	m.mu.Unlock()
+	if !ok || info.State != StateExpiring || !slices.Contains(info.Backends, op.Backend) {
+		m.retries.done(op)
+		return
+	}
+
+	set := m.acquire()
+	defer set.calls.Done()
+	b := set.get(op.Backend)
+	var err error
+	if b != nil {
+		callCtx, cancel := context.WithTimeout(ctx, retryTimeout)
+		err = b.Unban(callCtx, op.IP)
+		cancel()
+	}
+
+	switch {
+	case b == nil:
+		m.retries.done(op)
+		m.removeHolders(ctx, op.IP, op.Backend)
+	case err != nil:
+		metrics.BackendRetries.WithLabelValues(op.Backend, string(ActionUnban), "failure").Inc()
+		m.logger.Warn("unban retry failed", "ip", op.IP, "backend", op.Backend, "attempt", op.Attempts+1, "err", err)
+		m.queueRetry(ctx, op, err)
+	default:
+		metrics.BackendRetries.WithLabelValues(op.Backend, string(ActionUnban), "success").Inc()
+		m.retries.done(op)
+		m.emit(BanEvent{Action: ActionUnban, IP: op.IP, RuleID: info.RuleID, Reason: op.Reason, Backend: op.Backend, Source: SourceSystem})
+		if m.removeHolders(ctx, op.IP, op.Backend) {
+			m.logger.Info("unban", "ip", op.IP, "backend", op.Backend, "attempt", op.Attempts+1)
+		}
+	}
+}
+
+// queueBanRetries queues a retry for each backend in failed, or one for the
+// whole set in fallback mode. A nil err queues them to run right away.
+func (m *BanManager) queueBanRetries(ctx context.Context, ip string, info banInfo, source string, failed []string, err error) {
+	m.backendMu.RLock()
+	mode := m.backends.mode
+	m.backendMu.RUnlock()
+	if mode == config.BackendModeFallback {
+		failed = []string{""}
+	}
+	for _, name := range failed {
+		m.queueRetry(ctx, &retryOp{Action: ActionBan, IP: ip, Backend: name, RuleID: info.RuleID, Reason: info.Reason,
+			Source: source, ExpiresAt: info.ExpiresAt, Selected: info.Selected}, err)
+	}
+}
+
+// lift marks the ban on ip as expiring and removes it from the backends
+// holding it. Failed calls are queued for retry and the ban is listed as
+// expiring until they succeed; their error is returned.
+func (m *BanManager) lift(ctx context.Context, ip string, info banInfo, reason, source string) error {
+	m.retries.cancel(ip, ActionBan, ActionUnban)
+	m.expiry.cancel(ip)
+	info.State = StateExpiring
+	m.mu.Lock()
+	m.bans[ip] = info
+	m.mu.Unlock()
+
+	remaining, err := m.liftBan(ctx, ip, info, reason, source)
+	lifted := slices.DeleteFunc(slices.Clone(info.Backends), func(n string) bool { return slices.Contains(remaining, n) })
+	m.removeHolders(ctx, ip, lifted...)
+	for _, name := range remaining {
+		m.queueRetry(ctx, &retryOp{Action: ActionUnban, IP: ip, Backend: name, RuleID: info.RuleID, Reason: reason,
+			Source: source, ExpiresAt: info.ExpiresAt}, err)
+	}
+	return err
+}
+
+// addHolders records that backends now hold the ban on ip, activating it.
+// If the ban was lifted while the calls were in flight, the new rules are
+// queued for removal instead.
+func (m *BanManager) addHolders(ctx context.Context, ip string, backends []string, info banInfo, source string) {
+	m.mu.Lock()
+	cur, ok := m.bans[ip]
+	if !ok || cur.State == StateExpiring {
+		if !ok {
+			cur = info
+			cur.State = StateExpiring
+			cur.Backends = nil
+		}
+		cur.Backends = appendNew(cur.Backends, backends...)
+		m.bans[ip] = cur
+		m.mu.Unlock()
+		for _, name := range backends {
+			m.retries.add(&retryOp{Action: ActionUnban, IP: ip, Backend: name, RuleID: cur.RuleID, Reason: "lifted",
+				Source: SourceSystem, ExpiresAt: cur.ExpiresAt}, nil)
+		}
+		return
+	}
+	activated := cur.State != StateActive
+	cur.Backends = appendNew(cur.Backends, backends...)
+	cur.State = StateActive
+	m.bans[ip] = cur
+	m.mu.Unlock()
+
+	if activated {
+		m.expiry.schedule(ip, cur.ExpiresAt)
+	}
+}
+
+// removeHolders records that backends no longer hold the ban on ip. An
+// expiring ban is forgotten once no backend holds it, which is reported as
+// true. If the IP was banned again while the unbans were in flight, the ban
+// is queued to be reinstalled on those backends.
+func (m *BanManager) removeHolders(ctx context.Context, ip string, backends ...string) bool {
+	m.mu.Lock()
+	info, ok := m.bans[ip]
+	if !ok {
+		m.mu.Unlock()
+		return false
+	}
+	var removed []string
+	info.Backends = slices.DeleteFunc(slices.Clone(info.Backends), func(n string) bool {
+		if slices.Contains(backends, n) {
+			removed = append(removed, n)
+			return true
+		}
+		return false
+	})
+	expiring := info.State == StateExpiring
+	lifted := expiring && len(info.Backends) == 0
+	if lifted {
+		delete(m.bans, ip)
+	} else {
+		m.bans[ip] = info
+	}
+	m.mu.Unlock()
+
+	if !expiring && len(removed) > 0 {
+		m.queueBanRetries(ctx, ip, info, SourceSystem, removed, nil)
+	}
+	return lifted
+}
+
+// settle marks a pending ban that no backend holds and no retry is left for
+// as failed, or forgets it once expired.
+func (m *BanManager) settle(ctx context.Context, ip string) {
+	if m.retries.has(ip, ActionBan) {
+		return
+	}
+	m.mu.Lock()
+	info, ok := m.bans[ip]
+	if !ok || info.State != StatePending || len(info.Backends) > 0 {
+		m.mu.Unlock()
+		return
+	}
+	expired := !info.ExpiresAt.After(m.clock.Now())
+	if expired {
+		delete(m.bans, ip)
+	} else {
+		info.State = StateFailed
+		m.bans[ip] = info
+	}
+	m.mu.Unlock()
+
+	if !expired {
+		m.logger.Error("ban failed on every backend", "ip", ip, "rule", info.RuleID)
+		m.expiry.schedule(ip, info.ExpiresAt)
+	}
+}
+
+// appendNew appends the names not already in list.
+func appendNew(list []string, names ...string) []string {
+	list = slices.Clone(list)
+	for _, n := range names {
+		if !slices.Contains(list, n) {
+			list = append(list, n)
+		}
+	}
+	return list
+}
@@ -0,0 +1,70 @@
+package firewall
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cyra/foxhole-fw/internal/clock"
+	"github.com/cyra/foxhole-fw/internal/logging"
+)
+
+// savedRetries reads the retry queue file in dir; -1 means there is none.
+func savedRetries(t *testing.T, dir string) int {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, retryFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return -1
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []*retryOp
+	if err := json.Unmarshal(data, &ops); err != nil {
+		t.Fatal(err)
+	}
+	return len(ops)
+}
+
+func TestRetryQueueSavesInBatches(t *testing.T) {
+	dir := t.TempDir()
+	clk := clock.NewFake(epoch)
+	q := newRetryQueue(testBackendConfig().Retry, logging.NewLoggerTo(io.Discard), clk)
+	if _, err := q.load(dir); err != nil {
+		t.Fatal(err)
+	}
+	ops := make([]*retryOp, 100)
+	for i := range ops {
+		ops[i] = &retryOp{Action: ActionBan, IP: fmt.Sprintf("10.0.0.%d", i), Backend: "fw"}
+		q.add(ops[i], errors.New("refused"))
+	}
+	if n := savedRetries(t, dir); n != -1 {
+		t.Fatalf("queue written on every change (%d ops saved), want it deferred", n)
+	}
+
+	// One save is scheduled on the queue's clock.
+	clk.BlockUntil(1)
+	clk.Advance(saveDelay)
+	eventually(t, "the deferred save", func() bool { return savedRetries(t, dir) == 100 })
+	clk.BlockUntil(0)
+	q.done(ops[0])
+	q.cancel("10.0.0.1", ActionBan)
+	q.flush()
+	if n := savedRetries(t, dir); n != 98 {
+		t.Fatalf("saved %d ops, want 98", n)
+	}
+
+	// Reloading picks the saved ops up again.
+	q2 := newRetryQueue(testBackendConfig().Retry, logging.NewLoggerTo(io.Discard), clock.NewFake(epoch))
+	loaded, err := q2.load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 98 || loaded[0].IP != "10.0.0.2" || loaded[0].Attempts != 1 {
+		t.Fatalf("loaded %d ops starting with %+v", len(loaded), loaded[0])
+	}
+}
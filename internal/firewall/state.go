@@ -0,0 +1,162 @@
+package firewall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+)
+
+// bansFile holds the bans left installed at the last shutdown.
+const bansFile = "bans.json"
+
+// LoadState restores, from dir, the bans left installed when the daemon last
+// stopped and the backend calls still waiting to be retried, and keeps saving
+// state to dir from now on. Call it before Run, which resumes them: restored
+// bans are lifted when they expire, even if that was while the daemon was down.
+func (m *BanManager) LoadState(dir string) error {
+	ops, err := m.retries.load(dir)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, bansFile)
+	var saved map[string]banInfo
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("read saved bans: %w", err)
+	default:
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("parse saved bans %s: %w", path, err)
+		}
+		// Written again on shutdown; a stale copy must not outlive a crash.
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("remove saved bans: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stateDir = dir
+	maps.Copy(m.bans, saved)
+	for _, op := range ops {
+		info, ok := m.bans[op.IP]
+		if !ok {
+			info = banInfo{ExpiresAt: op.ExpiresAt, RuleID: op.RuleID, Reason: op.Reason, Selected: op.Selected, State: StatePending}
+		}
+		if op.Action == ActionUnban {
+			info.State = StateExpiring
+			info.Backends = appendNew(info.Backends, op.Backend)
+		}
+		m.bans[op.IP] = info
+	}
+	if len(saved)+len(ops) > 0 {
+		m.logger.Info("restored state", "bans", len(saved), "retries", len(ops), "path", dir)
+	}
+	return nil
+}
+
+// resume picks up the bans restored by LoadState: active ones are lifted on
+// expiry, and backend calls that were cut short are queued again.
+func (m *BanManager) resume(ctx context.Context) {
+	m.mu.Lock()
+	bans := maps.Clone(m.bans)
+	m.mu.Unlock()
+
+	for ip, info := range bans {
+		switch info.State {
+		case StateActive, StateFailed:
+			m.expiry.schedule(ip, info.ExpiresAt)
+		case StatePending:
+			if !m.retries.has(ip, ActionBan) {
+				m.backendMu.RLock()
+				targets := names(m.backends.targets(info.Selected))
+				m.backendMu.RUnlock()
+				m.queueBanRetries(ctx, ip, info, SourceSystem, targets, nil)
+			}
+		case StateExpiring:
+			for _, name := range info.Backends {
+				if !m.retries.has(ip, ActionUnban, name) {
+					m.retries.add(&retryOp{Action: ActionUnban, IP: ip, Backend: name, RuleID: info.RuleID, Reason: "expired",
+						Source: SourceSystem, ExpiresAt: info.ExpiresAt}, nil)
+				}
+			}
+		}
+	}
+}
+
+// stop applies the shutdown policy. With config.ShutdownRemove every
+// installed ban is lifted; unbans that fail are saved as retries for the
+// next start. Whatever is left is saved to the state directory.
+func (m *BanManager) stop(ctx context.Context, policy string) {
+	m.mu.Lock()
+	bans := maps.Clone(m.bans)
+	m.mu.Unlock()
+
+	if policy == config.ShutdownRemove {
+		m.removeAll(ctx, bans)
+	}
+
+	m.mu.Lock()
+	kept := make(map[string]banInfo, len(m.bans))
+	for ip, info := range m.bans {
+		if !info.DryRun {
+			kept[ip] = info
+		}
+	}
+	m.mu.Unlock()
+
+	m.retries.flush()
+	switch {
+	case m.stateDir != "":
+		path := filepath.Join(m.stateDir, bansFile)
+		if err := writeJSONFile(path, kept); err != nil {
+			m.logger.Error("failed to save bans", "path", path, "err", err)
+			return
+		}
+		m.logger.Info("bans saved for next start", "count", len(kept), "path", path)
+	case len(kept) > 0:
+		m.logger.Warn("bans left installed with no state_dir to resume them from; they will not be lifted", "count", len(kept))
+	}
+}
+
+// removeAll lifts bans from every backend holding them.
+func (m *BanManager) removeAll(ctx context.Context, bans map[string]banInfo) {
+	installed := make(map[string]banInfo, len(bans))
+	for ip, info := range bans {
+		switch {
+		case info.DryRun:
+		case len(info.Backends) == 0:
+			// Never installed.
+			m.retries.cancel(ip, ActionBan)
+			m.mu.Lock()
+			delete(m.bans, ip)
+			m.mu.Unlock()
+		default:
+			installed[ip] = info
+		}
+	}
+
+	var mu sync.Mutex
+	var removed, failed int
+	m.parallel(installed, func(ip string, info banInfo) {
+		err := m.lift(ctx, ip, info, "shutdown", SourceSystem)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			failed++
+			m.logger.Error("failed to remove ban on shutdown", "ip", ip, "err", err)
+			return
+		}
+		removed++
+	})
+	m.logger.Info("bans removed on shutdown", "removed", removed, "failed", failed)
+}
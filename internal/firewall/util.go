@@ -3,8 +3,6 @@ package firewall
 import (
 	"fmt"
 	"net"
-
-	"github.com/cyra/foxhole-fw/internal/config"
 )
 
 // ValidateIP checks if the given string is a valid IPv4 or IPv6 address.
@@ -29,17 +27,25 @@ func IsIPv6(ip string) bool {
 	return parsed.To4() == nil
 }
 
-// whitelistMatcher checks if an IP is in a configured whitelist.
-type whitelistMatcher struct {
+// sameIP reports whether a and b are the same address, however written.
+func sameIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	return ipA != nil && ipA.Equal(ipB)
+}
+
+// Whitelist checks if an IP is in a configured set of IPs and CIDRs.
+type Whitelist struct {
 	nets []*net.IPNet
 	ips  map[string]struct{}
 }
 
-func newWhitelistMatcher(cfg *config.BackendConfig) *whitelistMatcher {
-	m := &whitelistMatcher{
+// NewWhitelist builds a Whitelist from IP and CIDR entries.
+// Entries that are neither are ignored; config.Load rejects them.
+func NewWhitelist(entries []string) *Whitelist {
+	m := &Whitelist{
 		ips: make(map[string]struct{}),
 	}
-	for _, entry := range cfg.Whitelist {
+	for _, entry := range entries {
 		if ip := net.ParseIP(entry); ip != nil {
 			m.ips[ip.String()] = struct{}{}
 			continue
@@ -51,7 +57,8 @@ func newWhitelistMatcher(cfg *config.BackendConfig) *whitelistMatcher {
 	return m
 }
 
-func (m *whitelistMatcher) Contains(ipStr string) bool {
+// Contains reports whether ipStr is whitelisted.
+func (m *Whitelist) Contains(ipStr string) bool {
 	if m == nil {
 		return false
 	}
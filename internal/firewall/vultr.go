@@ -2,34 +2,44 @@ package firewall
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"sync"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/cyra/foxhole-fw/internal/config"
 	"github.com/cyra/foxhole-fw/internal/logging"
 )
 
+// vultrRuleNote prefixes the notes of every rule this backend creates, so
+// its rules can be told apart from the ones managed by hand.
+const vultrRuleNote = "foxhole-fw:"
+
+// vultrPageSize is how many rules are requested per page when listing.
+const vultrPageSize = 500
+
 // vultrBackend integrates with the Vultr firewall API.
-// It creates per-IP rules that block all TCP and UDP ports.
+// It creates per-IP rules that block all TCP and UDP ports. The rules for an
+// IP are looked up in the firewall group on every call, so bans survive a
+// restart and banning twice does not add rules twice.
 type vultrBackend struct {
 	cfg    *config.VultrConfig
+	base   string // API base URL, without trailing slash
 	client *http.Client
 	logger *logging.Logger
-
-	mu    sync.Mutex
-	rules map[string][]string // ip -> []ruleID
 }
 
 func NewVultrBackend(cfg *config.VultrConfig, logger *logging.Logger) Backend {
 	return &vultrBackend{
 		cfg:    cfg,
+		base:   strings.TrimSuffix(cmp.Or(cfg.APIURL, config.DefaultVultrAPIURL), "/"),
 		client: &http.Client{Timeout: 10 * time.Second},
 		logger: logger,
-		rules:  make(map[string][]string),
 	}
 }
 
@@ -37,45 +47,55 @@ func (b *vultrBackend) Name() string {
 	return "vultr"
 }
 
+// vultrRule is a firewall rule as listed by the API.
+type vultrRule struct {
+	ID         json.Number `json:"id"`
+	IPType     string      `json:"ip_type"`
+	Protocol   string      `json:"protocol"`
+	Subnet     string      `json:"subnet"`
+	SubnetSize int         `json:"subnet_size"`
+	Notes      string      `json:"notes"`
+}
+
 func (b *vultrBackend) Ban(ctx context.Context, ip string, duration time.Duration, reason, ruleID string) error {
 	if err := ValidateIP(ip); err != nil {
 		return fmt.Errorf("vultr ban: %w", err)
 	}
 
-	b.logger.Infof("Vultr backend ban: ip=%s rule=%s for=%s reason=%s (firewall_id=%s)", ip, ruleID, duration, reason, b.cfg.FirewallID)
+	b.logger.Debug("vultr ban", "ip", ip, "rule", ruleID, "for", duration, "reason", reason, "firewall_id", b.cfg.FirewallID)
 
 	ipType, subnetSize := "v4", 32
 	if IsIPv6(ip) {
 		ipType, subnetSize = "v6", 128
 	}
 
-	protocols := []string{"tcp", "udp"}
-	var createdIDs []string
-
-	for _, proto := range protocols {
-		id, err := b.createRule(ctx, ip, ipType, subnetSize, proto, ruleID)
-		if err != nil {
-			return err
+	existing, err := b.ipRules(ctx, ip)
+	if err != nil {
+		return err
+	}
+	for _, proto := range []string{"tcp", "udp"} {
+		if containsProtocol(existing, proto) {
+			continue
 		}
-		if id != "" {
-			createdIDs = append(createdIDs, id)
+		if err := b.createRule(ctx, ip, ipType, subnetSize, proto, ruleID); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	if len(createdIDs) == 0 {
-		return fmt.Errorf("vultr: no rule IDs returned for ip=%s", ip)
+func containsProtocol(rules []vultrRule, proto string) bool {
+	for _, r := range rules {
+		if r.Protocol == proto {
+			return true
+		}
 	}
-
-	b.mu.Lock()
-	b.rules[ip] = append(b.rules[ip], createdIDs...)
-	b.mu.Unlock()
-
-	return nil
+	return false
 }
 
-// createRule creates a single firewall rule and returns its ID.
+// createRule creates a single firewall rule.
 // Response body is properly closed before returning.
-func (b *vultrBackend) createRule(ctx context.Context, ip, ipType string, subnetSize int, proto, fwRuleID string) (string, error) {
+func (b *vultrBackend) createRule(ctx context.Context, ip, ipType string, subnetSize int, proto, fwRuleID string) error {
 	type ruleReq struct {
 		Direction  string `json:"direction"`
 		IPType     string `json:"ip_type"`
@@ -88,7 +108,7 @@ func (b *vultrBackend) createRule(ctx context.Context, ip, ipType string, subnet
 
 	type ruleResp struct {
 		FirewallRule struct {
-			ID string `json:"id"`
+			ID json.Number `json:"id"`
 		} `json:"firewall_rule"`
 	}
 
@@ -99,36 +119,76 @@ func (b *vultrBackend) createRule(ctx context.Context, ip, ipType string, subnet
 		Subnet:     ip,
 		SubnetSize: subnetSize,
 		Port:       "1-65535",
-		Notes:      fmt.Sprintf("foxhole-fw:%s", fwRuleID),
+		Notes:      vultrRuleNote + fwRuleID,
 	})
 	if err != nil {
-		return "", fmt.Errorf("vultr: marshal request: %w", err)
+		return fmt.Errorf("vultr: marshal request: %w", err)
 	}
 
-	url := fmt.Sprintf("https://api.vultr.com/v2/firewalls/%s/rules", b.cfg.FirewallID)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.rulesURL(), bytes.NewReader(body))
 	if err != nil {
-		return "", fmt.Errorf("vultr: build request: %w", err)
+		return fmt.Errorf("vultr: build request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+b.cfg.APIKey)
 
-	resp, err := b.client.Do(req)
+	resp, err := b.do(req)
 	if err != nil {
-		return "", fmt.Errorf("vultr: http error: %w", err)
+		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 300 {
-		return "", fmt.Errorf("vultr: non-success status %s", resp.Status)
-	}
-
 	var rr ruleResp
 	if err := json.NewDecoder(resp.Body).Decode(&rr); err != nil {
-		return "", fmt.Errorf("vultr: decode response: %w", err)
+		return fmt.Errorf("vultr: decode response: %w", err)
+	}
+	if rr.FirewallRule.ID == "" {
+		return fmt.Errorf("vultr: no rule ID returned for ip=%s", ip)
 	}
+	return nil
+}
 
-	return rr.FirewallRule.ID, nil
+// ipRules lists the rules this backend created for ip, following pagination.
+func (b *vultrBackend) ipRules(ctx context.Context, ip string) ([]vultrRule, error) {
+	type listResp struct {
+		FirewallRules []vultrRule `json:"firewall_rules"`
+		Meta          struct {
+			Links struct {
+				Next string `json:"next"`
+			} `json:"links"`
+		} `json:"meta"`
+	}
+
+	var out []vultrRule
+	cursor := ""
+	for {
+		q := url.Values{"per_page": {fmt.Sprint(vultrPageSize)}}
+		if cursor != "" {
+			q.Set("cursor", cursor)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.rulesURL()+"?"+q.Encode(), http.NoBody)
+		if err != nil {
+			return nil, fmt.Errorf("vultr: build request: %w", err)
+		}
+		resp, err := b.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var lr listResp
+		err = json.NewDecoder(resp.Body).Decode(&lr)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("vultr: decode rule list: %w", err)
+		}
+		for _, r := range lr.FirewallRules {
+			if sameIP(r.Subnet, ip) && strings.HasPrefix(r.Notes, vultrRuleNote) {
+				out = append(out, r)
+			}
+		}
+		if lr.Meta.Links.Next == "" {
+			return out, nil
+		}
+		cursor = lr.Meta.Links.Next
+	}
 }
 
 func (b *vultrBackend) Unban(ctx context.Context, ip string) error {
@@ -136,37 +196,55 @@ func (b *vultrBackend) Unban(ctx context.Context, ip string) error {
 		return fmt.Errorf("vultr unban: %w", err)
 	}
 
-	b.mu.Lock()
-	ids := b.rules[ip]
-	delete(b.rules, ip)
-	b.mu.Unlock()
-
-	if len(ids) == 0 {
-		b.logger.Infof("Vultr backend unban: no rules recorded for ip=%s", ip)
+	rules, err := b.ipRules(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		b.logger.Debug("vultr unban: no rules found", "ip", ip)
 		return nil
 	}
 
-	for _, id := range ids {
-		url := fmt.Sprintf("https://api.vultr.com/v2/firewalls/%s/rules/%s", b.cfg.FirewallID, id)
-		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, http.NoBody)
+	var errs []error
+	for _, r := range rules {
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, b.rulesURL()+"/"+url.PathEscape(r.ID.String()), http.NoBody)
 		if err != nil {
-			b.logger.Errorf("vultr: build delete request failed for ip=%s id=%s: %v", ip, id, err)
+			return fmt.Errorf("vultr: build request: %w", err)
+		}
+		resp, err := b.do(req)
+		if errors.Is(err, errVultrNotFound) {
+			// Deleted meanwhile.
 			continue
 		}
-		req.Header.Set("Authorization", "Bearer "+b.cfg.APIKey)
-
-		resp, err := b.client.Do(req)
 		if err != nil {
-			b.logger.Errorf("vultr: http delete failed for ip=%s id=%s: %v", ip, id, err)
+			errs = append(errs, fmt.Errorf("delete rule %s: %w", r.ID, err))
 			continue
 		}
 		resp.Body.Close()
+	}
+	return errors.Join(errs...)
+}
 
-		if resp.StatusCode >= 300 {
-			b.logger.Errorf("vultr: delete rule failed for ip=%s id=%s status=%s", ip, id, resp.Status)
-			continue
+func (b *vultrBackend) rulesURL() string {
+	return b.base + "/firewalls/" + url.PathEscape(b.cfg.FirewallID) + "/rules"
+}
+
+var errVultrNotFound = errors.New("not found")
+
+// do authenticates and sends req, turning transport errors and non-success
+// statuses into errors. The caller closes the body of a successful response.
+func (b *vultrBackend) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+b.cfg.APIKey)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vultr: http error: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("vultr: %s %s: %w", req.Method, req.URL.Path, errVultrNotFound)
 		}
+		return nil, fmt.Errorf("vultr: non-success status %s", resp.Status)
 	}
-
-	return nil
+	return resp, nil
 }
@@ -1,30 +1,100 @@
+// Package logging provides the daemon's leveled, structured logger, built on log/slog.
 package logging
 
 import (
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
+
+	"github.com/cyra/foxhole-fw/internal/config"
 )
 
-// Logger is a minimal interface-compatible logger that can be swapped later.
+// Logger writes leveled records with key-value fields, as text or JSON.
+// Loggers derived with With share their parent's level, so SetLevel and
+// Reload apply to all of them.
 type Logger struct {
-	l *log.Logger
+	l     *slog.Logger
+	level *slog.LevelVar
 }
 
-// NewLogger creates a new stdout logger with a simple prefix.
+// NewLogger creates a text logger on stdout at info level.
 func NewLogger() *Logger {
-	return &Logger{
-		l: log.New(os.Stdout, "[foxhole-fw] ", log.LstdFlags),
+	return NewLoggerTo(os.Stdout)
+}
+
+// NewLoggerTo creates a text logger at info level writing to w, e.g. os.Stderr or io.Discard.
+func NewLoggerTo(w io.Writer) *Logger {
+	l, _ := New(w, &config.LoggingConfig{})
+	return l
+}
+
+// New creates a logger writing to w with the configured level and format.
+// An empty level means info.
+func New(w io.Writer, cfg *config.LoggingConfig) (*Logger, error) {
+	level := new(slog.LevelVar)
+	if cfg.Level != "" {
+		lv, err := ParseLevel(cfg.Level)
+		if err != nil {
+			return nil, err
+		}
+		level.Set(lv)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	if cfg.JSON {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	return &Logger{l: slog.New(h), level: level}, nil
+}
+
+// ParseLevel parses debug, info, warn or error (case-insensitive).
+func ParseLevel(s string) (slog.Level, error) {
+	var lv slog.Level
+	if err := lv.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q (known: debug, info, warn, error)", s)
 	}
+	return lv, nil
 }
 
-func (l *Logger) Info(msg string) {
-	l.l.Println("INFO:", msg)
+// SetLevel changes the minimum level of l and every logger derived from it.
+func (l *Logger) SetLevel(level string) error {
+	lv, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	l.level.Set(lv)
+	return nil
 }
 
-func (l *Logger) Infof(format string, args ...any) {
-	l.l.Printf("INFO: "+format+"\n", args...)
+// Reload applies a changed logging.level. The output format is fixed at
+// startup. It is meant to be registered with config.Store.Subscribe.
+func (l *Logger) Reload(old, cur *config.Config) {
+	if old.Logging.Level == cur.Logging.Level {
+		return
+	}
+	if err := l.SetLevel(cur.Logging.Level); err != nil {
+		l.Error("log level not changed", "err", err)
+		return
+	}
+	l.Info("log level changed", "old", old.Logging.Level, "new", cur.Logging.Level)
 }
 
-func (l *Logger) Errorf(format string, args ...any) {
-	l.l.Printf("ERROR: "+format+"\n", args...)
+// With returns a logger that adds the given key-value pairs to every record.
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{l: l.l.With(args...), level: l.level}
 }
+
+// Debug logs msg with key-value pairs at debug level.
+func (l *Logger) Debug(msg string, args ...any) { l.l.Debug(msg, args...) }
+
+// Info logs msg with key-value pairs at info level.
+func (l *Logger) Info(msg string, args ...any) { l.l.Info(msg, args...) }
+
+// Warn logs msg with key-value pairs at warn level.
+func (l *Logger) Warn(msg string, args ...any) { l.l.Warn(msg, args...) }
+
+// Error logs msg with key-value pairs at error level.
+func (l *Logger) Error(msg string, args ...any) { l.l.Error(msg, args...) }
@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+)
+
+func TestNewFormats(t *testing.T) {
+	var text, js strings.Builder
+	tl, err := New(&text, &config.LoggingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jl, err := New(&js, &config.LoggingConfig{JSON: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tl.With("source", "access.log").Info("ban applied", "ip", "198.51.100.7", "hits", 3)
+	jl.With("source", "access.log").Info("ban applied", "ip", "198.51.100.7", "hits", 3)
+
+	for _, want := range []string{"level=INFO", `msg="ban applied"`, "source=access.log", "ip=198.51.100.7", "hits=3"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text output %q does not contain %s", text.String(), want)
+		}
+	}
+
+	var rec map[string]any
+	if err := json.Unmarshal([]byte(js.String()), &rec); err != nil {
+		t.Fatalf("JSON output %q: %v", js.String(), err)
+	}
+	want := map[string]any{"level": "INFO", "msg": "ban applied", "source": "access.log", "ip": "198.51.100.7", "hits": 3.0}
+	for k, v := range want {
+		if rec[k] != v {
+			t.Errorf("JSON field %s = %v, want %v", k, rec[k], v)
+		}
+	}
+}
+
+func TestLevelFiltering(t *testing.T) {
+	var b strings.Builder
+	l, err := New(&b, &config.LoggingConfig{Level: "info"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("hidden")
+	l.Info("shown")
+	if strings.Contains(b.String(), "hidden") || !strings.Contains(b.String(), "shown") {
+		t.Errorf("output at info level = %q, want only the info record", b.String())
+	}
+
+	if _, err := New(&b, &config.LoggingConfig{Level: "verbose"}); err == nil {
+		t.Error("New accepted an unknown level")
+	}
+}
+
+func TestReloadLevel(t *testing.T) {
+	var b strings.Builder
+	l, err := New(&b, &config.LoggingConfig{Level: "info"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived := l.With("component", "engine")
+
+	old := &config.Config{Logging: config.LoggingConfig{Level: "info"}}
+	cur := &config.Config{Logging: config.LoggingConfig{Level: "debug"}}
+	l.Reload(old, cur)
+	derived.Debug("derived debug")
+	if !strings.Contains(b.String(), "derived debug") {
+		t.Errorf("debug record of a derived logger dropped after reload to debug:\n%s", b.String())
+	}
+
+	b.Reset()
+	l.Reload(cur, &config.Config{Logging: config.LoggingConfig{Level: "warn"}})
+	derived.Info("derived info")
+	if strings.Contains(b.String(), "derived info") {
+		t.Errorf("info record of a derived logger kept after reload to warn:\n%s", b.String())
+	}
+}
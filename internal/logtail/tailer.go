@@ -2,8 +2,13 @@ package logtail
 
 import (
 	"context"
+	"io"
+	"os"
+	"sync/atomic"
 
 	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/metrics"
+	"github.com/cyra/foxhole-fw/internal/queue"
 	"github.com/hpcloud/tail"
 )
 
@@ -11,6 +16,17 @@ import (
 type Tailer struct {
 	path   string
 	logger *logging.Logger
+	start  *Position
+
+	file   os.FileInfo // the file Tail opened
+	offset atomic.Int64
+}
+
+// Position is how far a Tailer got: the file it read and the offset just past
+// the last line it emitted.
+type Position struct {
+	file   os.FileInfo
+	Offset int64
 }
 
 // New creates a new Tailer for the given file path.
@@ -21,8 +37,22 @@ func New(path string, logger *logging.Logger) *Tailer {
 	}
 }
 
-// Tail follows the file and sends each line to the provided channel until ctx is done.
-func (t *Tailer) Tail(ctx context.Context, out chan<- string) error {
+// SetStart makes Tail continue where a previous Tailer on the same path
+// stopped, e.g. when a pipeline restarts on a file it already read. If the
+// file was rotated or truncated since, Tail reads the new file from the start.
+func (t *Tailer) SetStart(p Position) {
+	t.start = &p
+}
+
+// Position returns how far Tail got. Lines read while the file was rotated
+// during Tail are counted against the original file, so a Tailer resuming
+// from it reads the new file from the start. Call it after Tail returns.
+func (t *Tailer) Position() Position {
+	return Position{file: t.file, Offset: t.offset.Load()}
+}
+
+// Tail follows the file and pushes each line onto the provided queue until ctx is done.
+func (t *Tailer) Tail(ctx context.Context, out *queue.Queue[string]) error {
 	cfg := tail.Config{
 		Follow:    true,
 		ReOpen:    true,
@@ -30,13 +60,23 @@ func (t *Tailer) Tail(ctx context.Context, out chan<- string) error {
 		Poll:      true,
 		Logger:    tail.DiscardingLogger,
 	}
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	t.file = fi
+	if p := t.start; p != nil && os.SameFile(p.file, fi) && p.Offset <= fi.Size() {
+		cfg.Location = &tail.SeekInfo{Offset: p.Offset, Whence: io.SeekStart}
+		t.offset.Store(p.Offset)
+	}
 
 	tf, err := tail.TailFile(t.path, cfg)
 	if err != nil {
 		return err
 	}
 
-	t.logger.Infof("tailing log file %s", t.path)
+	t.logger.Info("tailing log file", "source", t.path)
+	tailed := metrics.LinesTailed.WithLabelValues(t.path)
 
 	for {
 		select {
@@ -49,10 +89,14 @@ func (t *Tailer) Tail(ctx context.Context, out chan<- string) error {
 				return nil
 			}
 			if line.Err != nil {
-				t.logger.Errorf("tail error: %v", line.Err)
+				t.logger.Error("tail error", "source", t.path, "err", line.Err)
 				continue
 			}
-			out <- line.Text
+			tailed.Inc()
+			if !out.Push(ctx, line.Text) && ctx.Err() != nil {
+				continue // not handed on; a resumed Tailer reads it again
+			}
+			t.offset.Add(int64(len(line.Text)) + 1)
 		}
 	}
 }
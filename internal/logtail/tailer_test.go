@@ -0,0 +1,86 @@
+package logtail
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/queue"
+)
+
+func appendLines(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range lines {
+		if _, err := f.WriteString(line + "\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// run tails path until n lines arrived, then stops the tailer and returns them.
+func run(t *testing.T, tl *Tailer, n int) []string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	out := queue.New[string]("lines", 16, queue.Block, 0)
+	done := make(chan error, 1)
+	go func() { done <- tl.Tail(ctx, out) }()
+
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for len(got) < n {
+		select {
+		case line := <-out.C():
+			got = append(got, line)
+		case err := <-done:
+			t.Fatalf("Tail returned early: %v", err)
+		case <-timeout:
+			t.Fatalf("got %q, want %d lines", got, n)
+		}
+	}
+	cancel()
+	<-done
+	return got
+}
+
+func TestTailerResume(t *testing.T) {
+	logger := logging.NewLoggerTo(io.Discard)
+	path := filepath.Join(t.TempDir(), "access.log")
+	appendLines(t, path, "one", "two")
+
+	first := New(path, logger)
+	if got := run(t, first, 2); !slices.Equal(got, []string{"one", "two"}) {
+		t.Fatalf("first tailer got %q", got)
+	}
+
+	// Lines written between two tailers are read by the second one.
+	appendLines(t, path, "three", "four")
+	second := New(path, logger)
+	second.SetStart(first.Position())
+	if got := run(t, second, 2); !slices.Equal(got, []string{"three", "four"}) {
+		t.Fatalf("resumed tailer got %q, want the lines after the first tailer's", got)
+	}
+	if got, want := second.Position().Offset, int64(len("one\ntwo\nthree\nfour\n")); got != want {
+		t.Errorf("Position().Offset = %d, want %d", got, want)
+	}
+
+	// A replaced file is read from the start.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, path, "five")
+	third := New(path, logger)
+	third.SetStart(second.Position())
+	if got := run(t, third, 1); !slices.Equal(got, []string{"five"}) {
+		t.Fatalf("tailer on a rotated file got %q", got)
+	}
+}
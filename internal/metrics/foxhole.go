@@ -0,0 +1,40 @@
+package metrics
+
+// Daemon metrics, registered with Default. Gauges that read live state
+// (queue depths, active bans, tracked IPs) are registered by cmd/fwld.
+var (
+	LinesTailed = Default.NewCounterVec("foxhole_lines_tailed_total",
+		"Lines read from the web server log.", "source")
+
+	ParseErrors = Default.NewCounterVec("foxhole_parse_errors_total",
+		"Log lines that failed to parse.", "parser")
+
+	Events = Default.NewCounterVec("foxhole_events_total",
+		"Parsed requests by HTTP status class (2xx, 4xx, ...).", "status_class")
+
+	RuleMatches = Default.NewCounterVec("foxhole_rule_matches_total",
+		"Events matching a rule's method and path.", "rule")
+
+	RuleViolations = Default.NewCounterVec("foxhole_rule_violations_total",
+		"Events that pushed an IP over a rule's max_errors.", "rule")
+
+	BackendOps = Default.NewCounterVec("foxhole_backend_operations_total",
+		"Firewall backend calls by operation (ban, unban) and result (success, failure).", "backend", "op", "result")
+
+	BackendRetries = Default.NewCounterVec("foxhole_backend_retries_total",
+		"Retried firewall backend calls by operation and result (success, failure, abandoned).", "backend", "op", "result")
+
+	Notifications = Default.NewCounterVec("foxhole_notifications_total",
+		"Notification messages by sink and result (sent, failed, dropped).", "sink", "result")
+
+	BackendLatency = Default.NewHistogramVec("foxhole_backend_call_duration_seconds",
+		"Firewall backend call latency.", nil, "backend", "op")
+)
+
+// StatusClass returns "1xx" to "5xx" for an HTTP status, or "other".
+func StatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "other"
+	}
+	return string(rune('0'+status/100)) + "xx"
+}
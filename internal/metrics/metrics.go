@@ -0,0 +1,357 @@
+// Package metrics implements the small subset of Prometheus metric types
+// foxhole needs — counters, gauges and histograms with labels — and renders
+// them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are the default histogram buckets, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and writes them out sorted by name.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]collector
+}
+
+// collector is a registered metric family.
+type collector interface {
+	write(w io.Writer, name string)
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]collector)}
+}
+
+// Default is the registry the daemon's metrics are registered with.
+var Default = NewRegistry()
+
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic("metrics: duplicate registration of " + name)
+	}
+	r.metrics[name] = c
+}
+
+// WriteText writes all metrics in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	collectors := make(map[string]collector, len(r.metrics))
+	for k, v := range r.metrics {
+		collectors[k] = v
+	}
+	r.mu.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		collectors[name].write(w, name)
+	}
+}
+
+// Handler serves the registry for Prometheus to scrape.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+// family holds the children of a labeled metric, keyed by label values.
+type family[T any] struct {
+	help   string
+	typ    string
+	labels []string
+	newT   func() T
+
+	mu       sync.Mutex
+	children map[string]T
+	values   map[string][]string
+}
+
+func newFamily[T any](help, typ string, labels []string, newT func() T) *family[T] {
+	return &family[T]{
+		help:     help,
+		typ:      typ,
+		labels:   labels,
+		newT:     newT,
+		children: make(map[string]T),
+		values:   make(map[string][]string),
+	}
+}
+
+func (f *family[T]) with(values []string) T {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: got %d label values, want %d", len(values), len(f.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.children[key]
+	if !ok {
+		c = f.newT()
+		f.children[key] = c
+		f.values[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+// each calls fn for every child in a stable order.
+func (f *family[T]) each(fn func(labels string, c T)) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.children))
+	for k := range f.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	type entry struct {
+		labels string
+		c      T
+	}
+	entries := make([]entry, len(keys))
+	for i, k := range keys {
+		entries[i] = entry{formatLabels(f.labels, f.values[k]), f.children[k]}
+	}
+	f.mu.Unlock()
+
+	for _, e := range entries {
+		fn(e.labels, e.c)
+	}
+}
+
+func (f *family[T]) header(w io.Writer, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(f.help), name, f.typ)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc adds one.
+func (c *Counter) Inc() { c.v.Add(1) }
+
+// Add adds n.
+func (c *Counter) Add(n uint64) { c.v.Add(n) }
+
+// Value returns the current count.
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	f *family[*Counter]
+}
+
+// NewCounterVec registers a counter family with the given label names.
+// With no labels, use WithLabelValues() to get the single counter.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newFamily(help, "counter", labels, func() *Counter { return &Counter{} })}
+	r.register(name, v)
+	return v
+}
+
+// WithLabelValues returns the counter for the given label values, creating it if needed.
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	return v.f.with(values)
+}
+
+func (v *CounterVec) write(w io.Writer, name string) {
+	v.f.header(w, name)
+	v.f.each(func(labels string, c *Counter) {
+		fmt.Fprintf(w, "%s%s %d\n", name, labels, c.Value())
+	})
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) { g.bits.Store(math.Float64bits(v)) }
+
+// Add adds d (which may be negative).
+func (g *Gauge) Add(d float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+d)) {
+			return
+		}
+	}
+}
+
+// Value returns the current value.
+func (g *Gauge) Value() float64 { return math.Float64frombits(g.bits.Load()) }
+
+// GaugeVec is a set of gauges partitioned by label values.
+type GaugeVec struct {
+	f *family[*Gauge]
+}
+
+// NewGaugeVec registers a gauge family with the given label names.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{newFamily(help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+	r.register(name, v)
+	return v
+}
+
+// WithLabelValues returns the gauge for the given label values, creating it if needed.
+func (v *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return v.f.with(values)
+}
+
+func (v *GaugeVec) write(w io.Writer, name string) {
+	v.f.header(w, name)
+	v.f.each(func(labels string, g *Gauge) {
+		fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(g.Value()))
+	})
+}
+
+// funcMetric is a gauge or counter whose values are read from a callback at scrape time.
+type funcMetric struct {
+	help    string
+	typ     string
+	labels  []string
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a gauge read at scrape time. collect calls emit once
+// per series with the label values matching labels.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.register(name, &funcMetric{help: help, typ: "gauge", labels: labels, collect: collect})
+}
+
+// NewCounterFunc is like NewGaugeFunc for values that only increase, such as
+// totals kept by another package.
+func (r *Registry) NewCounterFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.register(name, &funcMetric{help: help, typ: "counter", labels: labels, collect: collect})
+}
+
+func (m *funcMetric) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(m.help), name, m.typ)
+	m.collect(func(value float64, labelValues ...string) {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(m.labels, labelValues), formatFloat(value))
+	})
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	upper  []float64
+	counts []atomic.Uint64 // per bucket, not cumulative; last is +Inf
+	sum    Gauge
+	count  atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{upper: buckets, counts: make([]atomic.Uint64, len(buckets)+1)}
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	h.counts[i].Add(1)
+	h.sum.Add(v)
+	h.count.Add(1)
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	f *family[*Histogram]
+}
+
+// NewHistogramVec registers a histogram family with the given upper bucket
+// bounds (sorted ascending; DefBuckets if nil) and label names.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	v := &HistogramVec{newFamily(help, "histogram", labels, func() *Histogram { return newHistogram(buckets) })}
+	r.register(name, v)
+	return v
+}
+
+// WithLabelValues returns the histogram for the given label values, creating it if needed.
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return v.f.with(values)
+}
+
+func (v *HistogramVec) write(w io.Writer, name string) {
+	v.f.header(w, name)
+	v.f.each(func(labels string, h *Histogram) {
+		var cum uint64
+		for i, upper := range h.upper {
+			cum += h.counts[i].Load()
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", formatFloat(upper)), cum)
+		}
+		cum += h.counts[len(h.upper)].Load()
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), cum)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum.Value()))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count.Load())
+	})
+}
+
+// formatLabels renders {a="x",b="y"}, or "" without labels.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", n, escapeLabel(v))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withLabel adds name="value" to a rendered label set.
+func withLabel(labels, name, value string) string {
+	pair := fmt.Sprintf("%s=\"%s\"", name, value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
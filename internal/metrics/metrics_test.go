@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+
+	bans := r.NewCounterVec("test_bans_total", "Bans by rule and backend.", "rule", "backend")
+	bans.WithLabelValues("login", "iptables").Add(3)
+	bans.WithLabelValues(`say "hi"`+"\n"+`C:\path`, "vultr").Inc()
+
+	r.NewGaugeFunc("test_queue_length", "Items waiting.\nSecond line with a \\.", []string{"queue"},
+		func(emit func(float64, ...string)) {
+			emit(7, "lines")
+			emit(0.5, `e"v\`)
+		})
+
+	latency := r.NewHistogramVec("test_call_seconds", "Backend call latency.", []float64{1, 0.1, 0.5}, "op")
+	h := latency.WithLabelValues("ban")
+	for _, v := range []float64{0.05, 0.1, 0.3, 2} {
+		h.Observe(v)
+	}
+
+	var b strings.Builder
+	r.WriteText(&b)
+
+	const want = `# HELP test_bans_total Bans by rule and backend.
+# TYPE test_bans_total counter
+test_bans_total{rule="login",backend="iptables"} 3
+test_bans_total{rule="say \"hi\"\nC:\\path",backend="vultr"} 1
+# HELP test_call_seconds Backend call latency.
+# TYPE test_call_seconds histogram
+test_call_seconds_bucket{op="ban",le="0.1"} 2
+test_call_seconds_bucket{op="ban",le="0.5"} 3
+test_call_seconds_bucket{op="ban",le="1"} 3
+test_call_seconds_bucket{op="ban",le="+Inf"} 4
+test_call_seconds_sum{op="ban"} 2.45
+test_call_seconds_count{op="ban"} 4
+# HELP test_queue_length Items waiting.\nSecond line with a \\.
+# TYPE test_queue_length gauge
+test_queue_length{queue="lines"} 7
+test_queue_length{queue="e\"v\\"} 0.5
+`
+	if got := b.String(); got != want {
+		t.Errorf("WriteText mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "A counter.").WithLabelValues().Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if want := "# HELP test_total A counter.\n# TYPE test_total counter\ntest_total 1\n"; string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestDuplicateRegistration(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeVec("test_gauge", "A gauge.")
+	defer func() {
+		if recover() == nil {
+			t.Error("registering test_gauge twice did not panic")
+		}
+	}()
+	r.NewCounterVec("test_gauge", "Again.")
+}
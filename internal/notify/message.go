@@ -0,0 +1,199 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/firewall"
+)
+
+// Event is the template data for a single ban event.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	IP        string    `json:"ip"`
+	RuleID    string    `json:"rule,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Backend   string    `json:"backend,omitempty"`
+	DryRun    bool      `json:"dry_run"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	Count     int       `json:"count,omitempty"`
+	Source    string    `json:"source"`
+	Path      string    `json:"path,omitempty"`
+	Lines     []string  `json:"lines,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func newEvent(ev firewall.BanEvent) Event {
+	e := Event{
+		Time:      ev.Time,
+		Action:    string(ev.Action),
+		IP:        ev.IP,
+		RuleID:    ev.RuleID,
+		Reason:    ev.Reason,
+		Backend:   ev.Backend,
+		DryRun:    ev.DryRun,
+		ExpiresAt: ev.ExpiresAt,
+		Count:     ev.Count,
+		Source:    ev.Source,
+		Path:      ev.Path,
+		Lines:     ev.Lines,
+	}
+	if ev.Err != nil {
+		e.Error = ev.Err.Error()
+	}
+	return e
+}
+
+// Digest is the template data for events held back by the rate limit.
+type Digest struct {
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	Total  int       `json:"total"`
+	Rules  []Tally   `json:"rules"`   // events per rule, most first
+	IPs    []Tally   `json:"ips"`     // events per IP, most first
+	Events []Event   `json:"events"`  // oldest first, at most maxDigestEvents
+	Errors int       `json:"errors"`  // events whose backend call failed
+	DryRun bool      `json:"dry_run"` // all events were dry-run
+}
+
+// Tally counts events for one key.
+type Tally struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// maxDigestEvents bounds the events listed in a digest; totals still cover all of them.
+const maxDigestEvents = 50
+
+// digestBuilder accumulates held-back events without keeping all of them.
+type digestBuilder struct {
+	d     Digest
+	rules map[string]int
+	ips   map[string]int
+}
+
+func (b *digestBuilder) add(e Event) {
+	if b.d.Total == 0 {
+		b.d = Digest{Since: e.Time, DryRun: true}
+		b.rules = make(map[string]int)
+		b.ips = make(map[string]int)
+	}
+	b.d.Total++
+	b.rules[e.RuleID]++
+	b.ips[e.IP]++
+	if e.Error != "" {
+		b.d.Errors++
+	}
+	if !e.DryRun {
+		b.d.DryRun = false
+	}
+	if len(b.d.Events) < maxDigestEvents {
+		b.d.Events = append(b.d.Events, e)
+	}
+}
+
+func (b *digestBuilder) empty() bool { return b.d.Total == 0 }
+
+// build returns the digest and resets the builder.
+func (b *digestBuilder) build(until time.Time) Digest {
+	d := b.d
+	d.Until = until
+	d.Rules = tallies(b.rules)
+	d.IPs = tallies(b.ips)
+	*b = digestBuilder{}
+	return d
+}
+
+func tallies(m map[string]int) []Tally {
+	out := make([]Tally, 0, len(m))
+	for k, n := range m {
+		out = append(out, Tally{Key: k, Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// Template functions available in sink templates.
+var funcs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join": strings.Join,
+	"top": func(n int, t []Tally) []Tally {
+		if len(t) > n {
+			return t[:n]
+		}
+		return t
+	},
+	"time": func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+}
+
+// Default templates. Text templates are used for chat messages; the webhook
+// defaults send the data as JSON.
+const (
+	defaultEventText = `{{if .DryRun}}[dry-run] {{end}}{{.Action}} {{.IP}}` +
+		`{{if .RuleID}} rule={{.RuleID}}{{end}}{{if .Count}} errors={{.Count}}{{end}}` +
+		`{{if .Backend}} backend={{.Backend}}{{end}}{{if not .ExpiresAt.IsZero}} until={{time .ExpiresAt}}{{end}}` +
+		`{{if .Reason}} ({{.Reason}}){{end}}{{if .Error}} FAILED: {{.Error}}{{end}}` +
+		`{{range .Lines}}
+> {{.}}{{end}}`
+
+	defaultDigestText = `{{if .DryRun}}[dry-run] {{end}}{{.Total}} more ban events from {{time .Since}} to {{time .Until}}` +
+		`{{if .Errors}}, {{.Errors}} failed{{end}}
+rules:{{range top 5 .Rules}} {{.Key}}={{.Count}}{{end}}
+top IPs:{{range top 10 .IPs}} {{.Key}}={{.Count}}{{end}}`
+
+	defaultEventJSON  = `{"type":"event","event":{{json .}}}`
+	defaultDigestJSON = `{"type":"digest","digest":{{json .}}}`
+)
+
+// templates renders events and digests for one sink.
+type templates struct {
+	event  *template.Template
+	digest *template.Template
+}
+
+func newTemplates(name, event, digest, defEvent, defDigest string) (*templates, error) {
+	if event == "" {
+		event = defEvent
+	}
+	if digest == "" {
+		digest = defDigest
+	}
+	et, err := template.New(name + " template").Funcs(funcs).Option("missingkey=error").Parse(event)
+	if err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	dt, err := template.New(name + " digest_template").Funcs(funcs).Option("missingkey=error").Parse(digest)
+	if err != nil {
+		return nil, fmt.Errorf("digest_template: %w", err)
+	}
+	return &templates{event: et, digest: dt}, nil
+}
+
+// render executes the template for m.
+func (t *templates) render(m message) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if m.digest != nil {
+		err = t.digest.Execute(&buf, m.digest)
+	} else {
+		err = t.event.Execute(&buf, m.event)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("render: %w", err)
+	}
+	return buf.Bytes(), nil
+}
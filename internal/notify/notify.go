@@ -0,0 +1,182 @@
+// Package notify sends ban events to webhooks and chat rooms (Slack-compatible
+// webhooks, Matrix). Floods are folded into digest messages and failed
+// deliveries are retried with backoff.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/firewall"
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/metrics"
+)
+
+const (
+	// eventBuffer is how many events may wait for the notifier before new ones are dropped.
+	eventBuffer = 1000
+	// sinkBuffer is how many messages may wait for a slow sink before new ones are dropped.
+	sinkBuffer = 100
+)
+
+// message is an event or a digest, rendered by each sink.
+type message struct {
+	id     uint64 // unique per notifier; used for idempotent retries
+	event  *Event
+	digest *Digest
+}
+
+// Notifier forwards ban events to sinks. Up to Burst messages go out per
+// Interval; further events are held and sent as one digest when the
+// interval ends.
+type Notifier struct {
+	logger   *logging.Logger
+	actions  map[firewall.BanAction]bool
+	interval time.Duration
+	burst    int
+	retries  int
+	backoff  time.Duration
+	timeout  time.Duration
+	sinks    []sink
+
+	events chan firewall.BanEvent
+	nextID atomic.Uint64
+}
+
+// New builds a notifier and its sinks. It fails on invalid templates.
+func New(cfg *config.NotifyConfig, logger *logging.Logger) (*Notifier, error) {
+	n := &Notifier{
+		logger:   logger,
+		actions:  make(map[firewall.BanAction]bool, len(cfg.Actions)),
+		interval: cfg.Interval,
+		burst:    cfg.Burst,
+		retries:  max(cfg.Retries, 0),
+		backoff:  cfg.RetryBackoff,
+		timeout:  cfg.Timeout,
+		events:   make(chan firewall.BanEvent, eventBuffer),
+	}
+	for _, a := range cfg.Actions {
+		n.actions[firewall.BanAction(a)] = true
+	}
+	client := &http.Client{}
+	for i := range cfg.Sinks {
+		s, err := newSink(&cfg.Sinks[i], client)
+		if err != nil {
+			return nil, fmt.Errorf("notify.sinks[%d]: %w", i, err)
+		}
+		n.sinks = append(n.sinks, s)
+	}
+	return n, nil
+}
+
+// Notify queues ev if its action is enabled. It never blocks; events are
+// dropped while the queue is full. It is meant to be registered with
+// firewall.BanManager.Subscribe.
+func (n *Notifier) Notify(ev firewall.BanEvent) {
+	if !n.actions[ev.Action] {
+		return
+	}
+	select {
+	case n.events <- ev:
+	default:
+		for _, s := range n.sinks {
+			metrics.Notifications.WithLabelValues(s.Name(), "dropped").Inc()
+		}
+	}
+}
+
+// Run delivers queued events until ctx is done. Held events that were not
+// yet sent as a digest are discarded on shutdown.
+func (n *Notifier) Run(ctx context.Context) {
+	outs := make([]chan message, len(n.sinks))
+	var wg sync.WaitGroup
+	for i, s := range n.sinks {
+		outs[i] = make(chan message, sinkBuffer)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.deliver(ctx, s, outs[i])
+		}()
+	}
+	defer func() {
+		for _, out := range outs {
+			close(out)
+		}
+		wg.Wait()
+	}()
+
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+	sent := 0
+	var held digestBuilder
+	banned := make(map[string]time.Time) // expiry of the last ban notified per IP
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-n.events:
+			if ev.Action == firewall.ActionBan && ev.Err == nil && !ev.ExpiresAt.IsZero() {
+				// A ban a retry installs on further backends is reported
+				// again; notify it once.
+				if banned[ev.IP].Equal(ev.ExpiresAt) {
+					continue
+				}
+				banned[ev.IP] = ev.ExpiresAt
+			}
+			e := newEvent(ev)
+			if sent < n.burst {
+				n.dispatch(outs, message{event: &e})
+				sent++
+				continue
+			}
+			held.add(e)
+		case now := <-ticker.C:
+			if !held.empty() {
+				d := held.build(now)
+				n.dispatch(outs, message{digest: &d})
+				n.logger.Info("notifications digested", "events", d.Total)
+			}
+			sent = 0
+			for ip, expires := range banned {
+				if !expires.After(now) {
+					delete(banned, ip)
+				}
+			}
+		}
+	}
+}
+
+// dispatch hands m to every sink without waiting for slow ones.
+func (n *Notifier) dispatch(outs []chan message, m message) {
+	m.id = n.nextID.Add(1)
+	for i, out := range outs {
+		select {
+		case out <- m:
+		default:
+			name := n.sinks[i].Name()
+			metrics.Notifications.WithLabelValues(name, "dropped").Inc()
+			n.logger.Warn("notification dropped: sink is backed up", "sink", name)
+		}
+	}
+}
+
+// deliver sends messages to s until in is closed.
+func (n *Notifier) deliver(ctx context.Context, s sink, in <-chan message) {
+	for m := range in {
+		if ctx.Err() != nil {
+			continue
+		}
+		err := sendWithRetry(ctx, s, m, n.retries, n.backoff, n.timeout)
+		if err != nil {
+			metrics.Notifications.WithLabelValues(s.Name(), "failed").Inc()
+			n.logger.Error("notification failed", "sink", s.Name(), "err", err)
+			continue
+		}
+		metrics.Notifications.WithLabelValues(s.Name(), "sent").Inc()
+	}
+}
@@ -0,0 +1,331 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/firewall"
+	"github.com/cyra/foxhole-fw/internal/logging"
+)
+
+// request is what a test server received.
+type request struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+// recorder is an httptest server that records requests and answers with the
+// queued status codes, then 200.
+type recorder struct {
+	*httptest.Server
+	mu       sync.Mutex
+	reqs     []request
+	statuses []int
+	got      chan struct{}
+}
+
+func newRecorder(t *testing.T, statuses ...int) *recorder {
+	r := &recorder{statuses: statuses, got: make(chan struct{}, 100)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.reqs = append(r.reqs, request{req.Method, req.URL.Path, req.Header.Clone(), string(body)})
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		r.mu.Unlock()
+		w.WriteHeader(status)
+		r.got <- struct{}{}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// wait blocks until n requests arrived and returns them.
+func (r *recorder) wait(t *testing.T, n int) []request {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d requests, want %d", i, n)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]request(nil), r.reqs...)
+}
+
+func testConfig(sinks ...config.NotifySink) *config.NotifyConfig {
+	return &config.NotifyConfig{
+		Actions:      []string{"ban", "unban"},
+		Interval:     time.Hour,
+		Burst:        10,
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+		Timeout:      time.Second,
+		Sinks:        sinks,
+	}
+}
+
+func startNotifier(t *testing.T, cfg *config.NotifyConfig) *Notifier {
+	t.Helper()
+	n, err := New(cfg, logging.NewLoggerTo(io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		n.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return n
+}
+
+func banEvent(ip string) firewall.BanEvent {
+	return firewall.BanEvent{
+		Time:      time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Action:    firewall.ActionBan,
+		IP:        ip,
+		RuleID:    "login-bruteforce",
+		Reason:    "too many 401s",
+		Backend:   "iptables",
+		ExpiresAt: time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC),
+		Count:     20,
+		Source:    "engine",
+		Lines:     []string{`1.2.3.4 - - "POST /login" 401`},
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	srv := newRecorder(t)
+	n := startNotifier(t, testConfig(config.NotifySink{
+		Name:     "hook",
+		Type:     "webhook",
+		URL:      srv.URL + "/hook",
+		Headers:  map[string]string{"X-Token": "s3cret"},
+		Template: `{"ip":{{json .IP}},"rule":{{json .RuleID}},"lines":{{len .Lines}}}`,
+	}))
+	n.Notify(banEvent("1.2.3.4"))
+
+	reqs := srv.wait(t, 1)
+	r := reqs[0]
+	if r.method != http.MethodPost || r.path != "/hook" {
+		t.Errorf("request = %s %s, want POST /hook", r.method, r.path)
+	}
+	if got := r.header.Get("X-Token"); got != "s3cret" {
+		t.Errorf("X-Token = %q", got)
+	}
+	if want := `{"ip":"1.2.3.4","rule":"login-bruteforce","lines":1}`; r.body != want {
+		t.Errorf("body = %s, want %s", r.body, want)
+	}
+}
+
+func TestWebhookDefaultJSON(t *testing.T) {
+	srv := newRecorder(t)
+	n := startNotifier(t, testConfig(config.NotifySink{Name: "hook", Type: "webhook", URL: srv.URL}))
+	n.Notify(banEvent("1.2.3.4"))
+
+	var got struct {
+		Type  string `json:"type"`
+		Event Event  `json:"event"`
+	}
+	if err := json.Unmarshal([]byte(srv.wait(t, 1)[0].body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != "event" || got.Event.IP != "1.2.3.4" || got.Event.Action != "ban" || got.Event.Count != 20 {
+		t.Errorf("payload = %+v", got)
+	}
+}
+
+func TestSlackText(t *testing.T) {
+	srv := newRecorder(t)
+	n := startNotifier(t, testConfig(config.NotifySink{Name: "slack", Type: "slack", URL: srv.URL}))
+	n.Notify(banEvent("1.2.3.4"))
+
+	var got map[string]string
+	if err := json.Unmarshal([]byte(srv.wait(t, 1)[0].body), &got); err != nil {
+		t.Fatal(err)
+	}
+	text := got["text"]
+	for _, want := range []string{"ban 1.2.3.4", "rule=login-bruteforce", "backend=iptables", "(too many 401s)", "> 1.2.3.4"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text %q does not contain %q", text, want)
+		}
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	srv := newRecorder(t)
+	n := startNotifier(t, testConfig(config.NotifySink{
+		Name:        "matrix",
+		Type:        "matrix",
+		Homeserver:  srv.URL + "/",
+		RoomID:      "!room:example.org",
+		AccessToken: "tok",
+	}))
+	n.Notify(banEvent("1.2.3.4"))
+
+	r := srv.wait(t, 1)[0]
+	if r.method != http.MethodPut {
+		t.Errorf("method = %s, want PUT", r.method)
+	}
+	if prefix := "/_matrix/client/v3/rooms/!room:example.org/send/m.room.message/"; !strings.HasPrefix(r.path, prefix) {
+		t.Errorf("path = %s, want prefix %s", r.path, prefix)
+	}
+	if got := r.header.Get("Authorization"); got != "Bearer tok" {
+		t.Errorf("Authorization = %q", got)
+	}
+	var body map[string]string
+	if err := json.Unmarshal([]byte(r.body), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["msgtype"] != "m.text" || !strings.Contains(body["body"], "ban 1.2.3.4") {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	srv := newRecorder(t, http.StatusInternalServerError, http.StatusTooManyRequests)
+	n := startNotifier(t, testConfig(config.NotifySink{
+		Name: "matrix", Type: "matrix", Homeserver: srv.URL, RoomID: "!r", AccessToken: "tok",
+	}))
+	n.Notify(banEvent("1.2.3.4"))
+
+	reqs := srv.wait(t, 3)
+	// Retries reuse the transaction ID so Matrix drops duplicates.
+	if reqs[0].path != reqs[2].path {
+		t.Errorf("retry path %s differs from first attempt %s", reqs[2].path, reqs[0].path)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	srv := newRecorder(t, http.StatusBadRequest, http.StatusOK)
+	n := startNotifier(t, testConfig(config.NotifySink{Name: "hook", Type: "webhook", URL: srv.URL}))
+	n.Notify(banEvent("1.2.3.4"))
+	n.Notify(banEvent("5.6.7.8"))
+
+	// The second request is the next event, not a retry of the first.
+	reqs := srv.wait(t, 2)
+	if !strings.Contains(reqs[1].body, "5.6.7.8") {
+		t.Errorf("second request = %s, want the second event", reqs[1].body)
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	srv := newRecorder(t, 500, 500, 500, 500)
+	cfg := testConfig(config.NotifySink{Name: "hook", Type: "webhook", URL: srv.URL})
+	cfg.Retries = 1
+	n := startNotifier(t, cfg)
+	n.Notify(banEvent("1.2.3.4"))
+	n.Notify(banEvent("5.6.7.8"))
+
+	reqs := srv.wait(t, 3)
+	if !strings.Contains(reqs[2].body, "5.6.7.8") {
+		t.Errorf("third request = %s, want the second event after one retry", reqs[2].body)
+	}
+}
+
+func TestActionFilter(t *testing.T) {
+	srv := newRecorder(t)
+	n := startNotifier(t, testConfig(config.NotifySink{Name: "hook", Type: "webhook", URL: srv.URL}))
+	skip := banEvent("1.2.3.4")
+	skip.Action = firewall.ActionSkip
+	n.Notify(skip)
+	n.Notify(banEvent("5.6.7.8"))
+
+	if reqs := srv.wait(t, 1); !strings.Contains(reqs[0].body, "5.6.7.8") {
+		t.Errorf("request = %s, want only the ban", reqs[0].body)
+	}
+}
+
+func TestBanNotifiedOnce(t *testing.T) {
+	srv := newRecorder(t)
+	n := startNotifier(t, testConfig(config.NotifySink{Name: "hook", Type: "webhook", URL: srv.URL}))
+	ev := banEvent("1.2.3.4")
+	ev.Backend = "iptables,vultr"
+	n.Notify(ev)
+	ev.Backend = "proxmox" // installed there on retry
+	n.Notify(ev)
+	again := banEvent("1.2.3.4")
+	again.ExpiresAt = again.ExpiresAt.Add(time.Hour) // banned again later
+	n.Notify(again)
+
+	reqs := srv.wait(t, 2)
+	if !strings.Contains(reqs[0].body, "iptables,vultr") || !strings.Contains(reqs[1].body, again.ExpiresAt.Format(time.RFC3339)) {
+		t.Errorf("requests = %q, want the first ban and the later one", []string{reqs[0].body, reqs[1].body})
+	}
+	time.Sleep(100 * time.Millisecond)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.reqs) != 2 {
+		t.Errorf("sent %d messages, want 2", len(srv.reqs))
+	}
+}
+
+func TestFloodDigest(t *testing.T) {
+	srv := newRecorder(t)
+	cfg := testConfig(config.NotifySink{Name: "hook", Type: "webhook", URL: srv.URL})
+	cfg.Burst = 2
+	cfg.Interval = 200 * time.Millisecond
+	n := startNotifier(t, cfg)
+	for i := 0; i < 50; i++ {
+		ev := banEvent(fmt.Sprintf("10.0.0.%d", i%5))
+		ev.ExpiresAt = ev.ExpiresAt.Add(time.Duration(i) * time.Second) // a new ban each time
+		if i%10 == 0 {
+			ev.RuleID = "scanner"
+		}
+		n.Notify(ev)
+	}
+
+	reqs := srv.wait(t, 3)
+	var got struct {
+		Type   string `json:"type"`
+		Digest Digest `json:"digest"`
+	}
+	if err := json.Unmarshal([]byte(reqs[2].body), &got); err != nil {
+		t.Fatal(err)
+	}
+	d := got.Digest
+	if got.Type != "digest" || d.Total != 48 {
+		t.Fatalf("third message = %s, want a digest of 48 events", reqs[2].body)
+	}
+	if len(d.Rules) != 2 || d.Rules[0].Key != "login-bruteforce" || d.Rules[0].Count != 44 {
+		t.Errorf("rules = %+v", d.Rules)
+	}
+	if len(d.IPs) != 5 {
+		t.Errorf("ips = %+v", d.IPs)
+	}
+
+	// Nothing else is sent for the flood.
+	time.Sleep(3 * cfg.Interval)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.reqs) != 3 {
+		t.Errorf("sent %d messages, want 3", len(srv.reqs))
+	}
+}
+
+func TestInvalidTemplate(t *testing.T) {
+	_, err := New(testConfig(config.NotifySink{Name: "hook", Type: "webhook", URL: "http://x", Template: "{{.IP"}), logging.NewLoggerTo(io.Discard))
+	if err == nil || !strings.Contains(err.Error(), "notify.sinks[0]: template") {
+		t.Errorf("err = %v, want template error", err)
+	}
+}
@@ -0,0 +1,191 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/config"
+)
+
+// sink delivers rendered messages to one target.
+type sink interface {
+	Name() string
+	Send(ctx context.Context, m message) error
+}
+
+// newSink builds a sink from its config.
+func newSink(cfg *config.NotifySink, client *http.Client) (sink, error) {
+	switch cfg.Type {
+	case "webhook":
+		t, err := newTemplates(cfg.Name, cfg.Template, cfg.DigestTemplate, defaultEventJSON, defaultDigestJSON)
+		if err != nil {
+			return nil, err
+		}
+		return &webhookSink{name: cfg.Name, url: cfg.URL, headers: cfg.Headers, tmpl: t, client: client}, nil
+	case "slack":
+		t, err := newTemplates(cfg.Name, cfg.Template, cfg.DigestTemplate, defaultEventText, defaultDigestText)
+		if err != nil {
+			return nil, err
+		}
+		return &slackSink{name: cfg.Name, url: cfg.URL, tmpl: t, client: client}, nil
+	case "matrix":
+		t, err := newTemplates(cfg.Name, cfg.Template, cfg.DigestTemplate, defaultEventText, defaultDigestText)
+		if err != nil {
+			return nil, err
+		}
+		return &matrixSink{
+			name:       cfg.Name,
+			homeserver: cfg.Homeserver,
+			room:       cfg.RoomID,
+			token:      cfg.AccessToken,
+			tmpl:       t,
+			client:     client,
+			txnPrefix:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+	}
+}
+
+// webhookSink POSTs the rendered template as the request body.
+type webhookSink struct {
+	name    string
+	url     string
+	headers map[string]string
+	tmpl    *templates
+	client  *http.Client
+}
+
+func (s *webhookSink) Name() string { return s.name }
+
+func (s *webhookSink) Send(ctx context.Context, m message) error {
+	body, err := s.tmpl.render(m)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	for k, v := range s.headers {
+		headers[k] = v
+	}
+	return post(ctx, s.client, http.MethodPost, s.url, headers, body)
+}
+
+// slackSink posts {"text": ...} to a Slack-compatible incoming webhook.
+type slackSink struct {
+	name   string
+	url    string
+	tmpl   *templates
+	client *http.Client
+}
+
+func (s *slackSink) Name() string { return s.name }
+
+func (s *slackSink) Send(ctx context.Context, m message) error {
+	text, err := s.tmpl.render(m)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{"text": string(text)})
+	if err != nil {
+		return err
+	}
+	return post(ctx, s.client, http.MethodPost, s.url, map[string]string{"Content-Type": "application/json"}, body)
+}
+
+// matrixSink sends an m.text message to a room through the client-server API.
+type matrixSink struct {
+	name       string
+	homeserver string
+	room       string
+	token      string
+	tmpl       *templates
+	client     *http.Client
+	txnPrefix  string
+}
+
+func (s *matrixSink) Name() string { return s.name }
+
+func (s *matrixSink) Send(ctx context.Context, m message) error {
+	text, err := s.tmpl.render(m)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{"msgtype": "m.text", "body": string(text)})
+	if err != nil {
+		return err
+	}
+	// The transaction ID makes retries of the same message idempotent.
+	u := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s-%d",
+		strings.TrimRight(s.homeserver, "/"), url.PathEscape(s.room), s.txnPrefix, m.id)
+	headers := map[string]string{
+		"Content-Type":  "application/json",
+		"Authorization": "Bearer " + s.token,
+	}
+	return post(ctx, s.client, http.MethodPut, u, headers, body)
+}
+
+// permanentError is a failure that retrying will not fix, e.g. a 4xx response.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// post sends body and treats any non-2xx response as an error. 4xx responses
+// other than 408 and 429 are permanent.
+func post(ctx context.Context, client *http.Client, method, u string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{fmt.Errorf("build request: %w", err)}
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("unexpected status %s", resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// sendWithRetry calls s.Send up to retries+1 times, doubling the delay
+// between attempts. Permanent errors are not retried.
+func sendWithRetry(ctx context.Context, s sink, m message, retries int, backoff, timeout time.Duration) error {
+	delay := backoff
+	for attempt := 0; ; attempt++ {
+		sendCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := s.Send(sendCtx, m)
+		cancel()
+		var perm permanentError
+		if err == nil || errors.As(err, &perm) || attempt >= retries {
+			return err
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,232 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultAutoSample is how many lines the auto parser samples before locking onto a format.
+const DefaultAutoSample = 50
+
+// registered lists the canonical parser names tried by auto-detection, in order
+// of preference when several parse the same share of lines.
+var registered = []string{"nginx_combined", "apache_common", "caddy", "traefik"}
+
+// Names returns the canonical names of the registered parsers.
+func Names() []string {
+	return append([]string(nil), registered...)
+}
+
+// Detection is the result of log format auto-detection.
+type Detection struct {
+	Parser  string
+	Parsed  int // sample lines the chosen parser handled
+	Sampled int
+}
+
+// Rate returns the share of sampled lines the chosen parser handled.
+func (d Detection) Rate() float64 {
+	if d.Sampled == 0 {
+		return 0
+	}
+	return float64(d.Parsed) / float64(d.Sampled)
+}
+
+func (d Detection) String() string {
+	return fmt.Sprintf("%s (%d/%d lines)", d.Parser, d.Parsed, d.Sampled)
+}
+
+// Detect tries every registered parser on the sample lines and returns the one
+// with the best success rate. It fails if no parser handles any line.
+func Detect(lines []string) (Detection, error) {
+	s := newScorer()
+	for _, line := range lines {
+		s.record(s.match(line))
+	}
+	return s.detect()
+}
+
+// autoParser samples the first lines it sees with every registered parser,
+// then locks onto the best one. If none handled a sample line, it samples the
+// next lines instead. It is safe for concurrent use.
+type autoParser struct {
+	sample   int
+	onDetect func(Detection, error)
+
+	locked atomic.Pointer[Parser] // set once a format is chosen
+
+	mu     sync.Mutex
+	scorer *scorer
+}
+
+// NewAuto returns a parser that detects the log format from the first sample
+// lines it parses. Until then each line is parsed with the best parser so far;
+// afterwards with the chosen one. If no parser handled any of the sample
+// lines, detection starts over on the next sample lines. onDetect, if
+// non-nil, is called after every sample: with an error for each one that
+// matched nothing, then once with the chosen format.
+func NewAuto(sample int, onDetect func(Detection, error)) Parser {
+	if sample < 1 {
+		sample = DefaultAutoSample
+	}
+	return &autoParser{
+		sample:   sample,
+		onDetect: onDetect,
+		scorer:   newScorer(),
+	}
+}
+
+func (p *autoParser) Parse(line string) (*Event, error) {
+	if locked := p.locked.Load(); locked != nil {
+		return (*locked).Parse(line)
+	}
+
+	// Parsing is the expensive part; only the scores are kept under p.mu.
+	results := p.scorer.match(line)
+	p.mu.Lock()
+	detecting := p.locked.Load() == nil
+	if detecting {
+		p.scorer.record(results)
+	}
+	best := p.scorer.best()
+	sampled := detecting && p.scorer.sampled >= p.sample
+	var detectErr error
+	if sampled {
+		if _, err := p.scorer.detect(); err != nil {
+			detectErr = fmt.Errorf("auto parser: log format not detected: %w", err)
+			p.scorer.reset()
+		} else {
+			chosen := p.scorer.parsers[best.Parser]
+			p.locked.Store(&chosen)
+		}
+	}
+	p.mu.Unlock()
+
+	if sampled && p.onDetect != nil {
+		p.onDetect(best, detectErr)
+	}
+
+	if ev := results[best.Parser]; ev != nil {
+		return ev, nil
+	}
+	for _, name := range registered {
+		if ev := results[name]; ev != nil {
+			return ev, nil
+		}
+	}
+	return nil, fmt.Errorf("auto parser: line does not match any known format")
+}
+
+// scorer counts how many lines each registered parser handles plausibly.
+type scorer struct {
+	parsers map[string]Parser
+	scores  map[string]int
+	sampled int
+}
+
+func newScorer() *scorer {
+	s := &scorer{
+		parsers: make(map[string]Parser, len(registered)),
+		scores:  make(map[string]int, len(registered)),
+	}
+	for _, name := range registered {
+		p, _ := New(name)
+		s.parsers[name] = p
+	}
+	return s
+}
+
+// match parses line with every parser and returns the plausible events by
+// parser name. It does not change s and may run concurrently with itself.
+func (s *scorer) match(line string) map[string]*Event {
+	keys := jsonKeys(line)
+	results := make(map[string]*Event, len(registered))
+	for _, name := range registered {
+		if keys != nil && !jsonSignatureMatches(name, keys) {
+			continue
+		}
+		ev, err := s.parsers[name].Parse(line)
+		if err != nil || !plausible(ev) {
+			continue
+		}
+		results[name] = ev
+	}
+	return results
+}
+
+// record counts one sampled line that the parsers in results handled.
+func (s *scorer) record(results map[string]*Event) {
+	s.sampled++
+	for name := range results {
+		s.scores[name]++
+	}
+}
+
+// reset forgets the sampled lines.
+func (s *scorer) reset() {
+	s.sampled = 0
+	clear(s.scores)
+}
+
+// detect returns the best parser, or an error if none handled any sampled line.
+func (s *scorer) detect() (Detection, error) {
+	d := s.best()
+	if d.Parsed == 0 {
+		return d, fmt.Errorf("no parser matched any of %d sample lines", d.Sampled)
+	}
+	return d, nil
+}
+
+func (s *scorer) best() Detection {
+	d := Detection{Sampled: s.sampled}
+	for _, name := range registered {
+		if d.Parser == "" || s.scores[name] > d.Parsed {
+			d.Parser = name
+			d.Parsed = s.scores[name]
+		}
+	}
+	return d
+}
+
+// plausible rejects events that parsed without error but lack the fields rules
+// need, e.g. a Traefik line decoded by the Caddy parser.
+func plausible(ev *Event) bool {
+	return ev != nil && ev.RemoteAddr != "" && ev.Method != "" && ev.Status > 0
+}
+
+// jsonKeys returns the top-level keys of a JSON object line, or nil if the
+// line is not a JSON object.
+func jsonKeys(line string) map[string]json.RawMessage {
+	if !strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return nil
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &keys); err != nil {
+		return nil
+	}
+	return keys
+}
+
+// jsonSignatureMatches reports whether a JSON line has the fields that identify
+// the given JSON-based format. Non-JSON parsers never match JSON lines.
+func jsonSignatureMatches(name string, keys map[string]json.RawMessage) bool {
+	switch name {
+	case "caddy":
+		var req map[string]json.RawMessage
+		if err := json.Unmarshal(keys["request"], &req); err != nil {
+			return false
+		}
+		_, ok := req["remote_ip"]
+		return ok
+	case "traefik":
+		_, status := keys["DownstreamStatus"]
+		_, host := keys["ClientHost"]
+		_, addr := keys["ClientAddr"]
+		return status && (host || addr)
+	default:
+		return false
+	}
+}
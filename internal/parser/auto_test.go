@@ -0,0 +1,180 @@
+package parser
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+const (
+	nginxLine   = `192.0.2.1 - - [10/Oct/2024:13:55:36 +0000] "GET /login HTTP/1.1" 404 153 "-" "curl/8.0"`
+	apacheLine  = `192.0.2.2 - frank [10/Oct/2024:13:55:36 +0000] "POST /admin HTTP/1.0" 403 2326`
+	caddyLine   = `{"ts":"2024-10-10T13:55:36Z","request":{"remote_ip":"192.0.2.3","method":"GET","uri":"/wp-login.php"},"status":404}`
+	traefikLine = `{"ClientHost":"192.0.2.4","DownstreamStatus":502,"RequestMethod":"GET","RequestPath":"/api","StartUTC":"2024-10-10T13:55:36Z"}`
+	junkLine    = `not a log line`
+)
+
+func repeat(line string, n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = line
+	}
+	return lines
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		want    string
+		parsed  int
+		wantErr bool
+	}{
+		{name: "nginx", lines: repeat(nginxLine, 5), want: "nginx_combined", parsed: 5},
+		{name: "apache", lines: repeat(apacheLine, 5), want: "apache_common", parsed: 5},
+		{name: "caddy json", lines: repeat(caddyLine, 5), want: "caddy", parsed: 5},
+		{name: "traefik json", lines: repeat(traefikLine, 5), want: "traefik", parsed: 5},
+		{name: "mixed picks the majority", lines: []string{caddyLine, nginxLine, caddyLine, junkLine, caddyLine}, want: "caddy", parsed: 3},
+		{name: "nginx with junk", lines: append(repeat(nginxLine, 3), junkLine, traefikLine), want: "nginx_combined", parsed: 3},
+		{name: "nothing matches", lines: repeat(junkLine, 5), wantErr: true},
+		{name: "empty", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := Detect(tt.lines)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Detect = %v, want error", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Parser != tt.want || d.Parsed != tt.parsed || d.Sampled != len(tt.lines) {
+				t.Errorf("Detect = %v, want %s (%d/%d lines)", d, tt.want, tt.parsed, len(tt.lines))
+			}
+		})
+	}
+}
+
+func TestNewAuto(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string // parser locked onto; empty if detection fails
+		other string // line the locked parser rejects
+	}{
+		{name: "nginx", lines: repeat(nginxLine, 3), want: "nginx_combined", other: caddyLine},
+		{name: "caddy json", lines: repeat(caddyLine, 3), want: "caddy", other: nginxLine},
+		{name: "mixed", lines: []string{traefikLine, nginxLine, traefikLine}, want: "traefik", other: nginxLine},
+		{name: "nothing matches", lines: repeat(junkLine, 3)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			var got Detection
+			var detectErr error
+			p := NewAuto(len(tt.lines), func(d Detection, err error) {
+				calls++
+				got, detectErr = d, err
+			})
+			for i, line := range tt.lines {
+				ev, err := p.Parse(line)
+				if line != junkLine && (err != nil || ev.RemoteAddr == "") {
+					t.Errorf("sample line %d: Parse = %v, %v", i, ev, err)
+				}
+			}
+			if calls != 1 {
+				t.Fatalf("onDetect called %d times, want 1", calls)
+			}
+
+			if tt.want == "" {
+				if detectErr == nil {
+					t.Fatalf("detection succeeded with %v, want error", got)
+				}
+				// Detection starts over on the next lines.
+				for range tt.lines {
+					if _, err := p.Parse(apacheLine); err != nil {
+						t.Errorf("Parse after failed detection: %v", err)
+					}
+				}
+				if calls != 2 || detectErr != nil || got.Parser != "apache_common" {
+					t.Errorf("after %d detections: %v, %v; want apache_common", calls, got, detectErr)
+				}
+				return
+			}
+			if detectErr != nil || got.Parser != tt.want {
+				t.Fatalf("detected %v, %v; want %s", got, detectErr, tt.want)
+			}
+			if ev, err := p.Parse(tt.other); err == nil {
+				t.Errorf("locked onto %s, but %q parsed as %+v", tt.want, tt.other, ev)
+			}
+			if calls != 1 {
+				t.Errorf("onDetect called %d times, want 1", calls)
+			}
+		})
+	}
+}
+
+func TestNewAutoConcurrent(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	p := NewAuto(20, func(d Detection, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if err != nil || d.Parser != "nginx_combined" {
+			t.Errorf("detected %v, %v; want nginx_combined", d, err)
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				line := fmt.Sprintf(`192.0.2.%d - - [10/Oct/2024:13:55:36 +0000] "GET /%d HTTP/1.1" 404 153 "-" "curl/8.0"`, i, j)
+				if _, err := p.Parse(line); err != nil {
+					t.Errorf("Parse: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("onDetect called %d times, want 1", calls)
+	}
+}
+
+func TestNewAutoRetriesEachWindow(t *testing.T) {
+	var outcomes []error
+	var got Detection
+	p := NewAuto(2, func(d Detection, err error) {
+		outcomes = append(outcomes, err)
+		got = d
+	})
+	// A startup banner and partial lines fill the first two windows.
+	for _, line := range []string{"starting up", "", junkLine, `192.0.2.1 - - [10/Oct`} {
+		if _, err := p.Parse(line); err == nil {
+			t.Errorf("Parse(%q) succeeded", line)
+		}
+	}
+	for _, line := range []string{junkLine, nginxLine} {
+		p.Parse(line)
+	}
+	if len(outcomes) != 3 || outcomes[0] == nil || outcomes[1] == nil || outcomes[2] != nil {
+		t.Fatalf("outcomes = %v, want two failures then a detection", outcomes)
+	}
+	// One matching line of two is enough once the window is full.
+	if got.Parser != "nginx_combined" || got.Parsed != 1 || got.Sampled != 2 {
+		t.Errorf("detected %v, want nginx_combined (1/2 lines)", got)
+	}
+	if _, err := p.Parse(nginxLine); err != nil {
+		t.Errorf("Parse after detection: %v", err)
+	}
+}
@@ -19,8 +19,11 @@ type Parser interface {
 }
 
 // New returns a parser implementation by name.
+// "auto" detects the format from the first DefaultAutoSample lines.
 func New(name string) (Parser, error) {
 	switch name {
+	case "auto":
+		return NewAuto(DefaultAutoSample, nil), nil
 	case "nginx_combined", "nginx":
 		return newNginxCombinedParser(), nil
 	case "apache_common", "apache":
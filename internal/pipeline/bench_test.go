@@ -0,0 +1,50 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cyra/foxhole-fw/internal/parser"
+)
+
+func benchLines(n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf(`10.%d.%d.%d - - [10/Oct/2026:13:55:36 +0000] "GET /wp-login.php?id=%d HTTP/1.1" 404 153 "-" "Mozilla/5.0 (X11; Linux x86_64)"`,
+			i>>16&0xff, i>>8&0xff, i&0xff, i)
+	}
+	return lines
+}
+
+func BenchmarkParseLines(b *testing.B) {
+	p, err := parser.New("nginx_combined")
+	if err != nil {
+		b.Fatal(err)
+	}
+	lines := benchLines(4096)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			ctx := context.Background()
+			in := make(chan string, 1024)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					in <- lines[i%len(lines)]
+				}
+				close(in)
+			}()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			var n int
+			ParseLines(ctx, p, workers, in,
+				func(*parser.Event) { n++ },
+				func(_ string, err error) { b.Error(err) },
+			)
+			if n != b.N {
+				b.Fatalf("emitted %d events, want %d", n, b.N)
+			}
+		})
+	}
+}
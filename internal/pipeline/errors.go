@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/clock"
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/parser"
+)
+
+// ParseErrorTracker counts parse failures for one log source, logs a sample of
+// them at a bounded rate, and optionally appends the raw lines to a quarantine file.
+type ParseErrorTracker struct {
+	source   string
+	logger   *logging.Logger
+	clock    clock.Clock
+	interval time.Duration
+	maxSize  int64
+
+	errors atomic.Uint64
+
+	mu          sync.Mutex
+	lastLog     time.Time
+	suppressed  uint64
+	quarantine  *os.File
+	written     int64
+	quarantined bool // quarantine size limit was reached
+}
+
+// NewParseErrorTracker creates a tracker for the log source described by cfg,
+// opening cfg.QuarantineFile for appending if set. Error logs are rate-limited on clk.
+func NewParseErrorTracker(cfg *config.LogConfig, logger *logging.Logger, clk clock.Clock) (*ParseErrorTracker, error) {
+	t := &ParseErrorTracker{
+		source:   cfg.Path,
+		logger:   logger,
+		clock:    clk,
+		interval: cfg.ErrorLogInterval,
+		maxSize:  cfg.QuarantineMaxSize,
+	}
+	if cfg.QuarantineFile != "" {
+		f, err := os.OpenFile(cfg.QuarantineFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("open quarantine file: %w", err)
+		}
+		if info, err := f.Stat(); err == nil {
+			t.written = info.Size()
+		}
+		t.quarantine = f
+	}
+	return t, nil
+}
+
+// Source returns the log path this tracker counts errors for.
+func (t *ParseErrorTracker) Source() string {
+	return t.source
+}
+
+// Errors returns the number of lines that failed to parse.
+func (t *ParseErrorTracker) Errors() uint64 {
+	return t.errors.Load()
+}
+
+// Observe records a line that failed to parse.
+func (t *ParseErrorTracker) Observe(line string, err error) {
+	t.errors.Add(1)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.writeQuarantine(line)
+
+	now := t.clock.Now()
+	if now.Sub(t.lastLog) < t.interval {
+		t.suppressed++
+		return
+	}
+	if t.suppressed > 0 {
+		t.logger.Error("parse error", "source", t.source, "err", err, "suppressed", t.suppressed, "total", t.errors.Load())
+	} else {
+		t.logger.Error("parse error", "source", t.source, "err", err)
+	}
+	t.lastLog = now
+	t.suppressed = 0
+}
+
+// writeQuarantine appends line to the quarantine file. Caller must hold t.mu.
+func (t *ParseErrorTracker) writeQuarantine(line string) {
+	if t.quarantine == nil || t.quarantined {
+		return
+	}
+	if t.written+int64(len(line))+1 > t.maxSize {
+		t.quarantined = true
+		t.logger.Warn("quarantine file full; no longer recording unparseable lines", "file", t.quarantine.Name(), "max_size", t.maxSize)
+		return
+	}
+	n, err := t.quarantine.WriteString(line + "\n")
+	t.written += int64(n)
+	if err != nil {
+		t.quarantined = true
+		t.logger.Error("write quarantine file", "file", t.quarantine.Name(), "err", err)
+	}
+}
+
+// Close closes the quarantine file, if any.
+func (t *ParseErrorTracker) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.quarantine == nil {
+		return nil
+	}
+	err := t.quarantine.Close()
+	t.quarantine = nil
+	return err
+}
+
+// SelfCheckResult is the outcome of parsing the first lines of a log.
+type SelfCheckResult struct {
+	Checked int
+	Failed  int
+	Example error // first parse error, if any
+}
+
+// SelfCheck parses up to n non-empty lines from the start of path with p.
+func SelfCheck(path string, p parser.Parser, n int) (SelfCheckResult, error) {
+	var res SelfCheckResult
+	lines, err := readHead(path, n)
+	if err != nil {
+		return res, err
+	}
+	for _, line := range lines {
+		res.Checked++
+		if _, err := p.Parse(line); err != nil {
+			res.Failed++
+			if res.Example == nil {
+				res.Example = err
+			}
+		}
+	}
+	return res, nil
+}
+
+// readHead returns up to n non-empty lines from the start of path.
+func readHead(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for len(lines) < n && sc.Scan() {
+		if line := sc.Text(); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, sc.Err()
+}
+
+// runSelfCheck logs the outcome of SelfCheck, warning loudly when most of the
+// sampled lines do not parse with the configured parser.
+func runSelfCheck(cfg *config.LogConfig, name string, p parser.Parser, logger *logging.Logger) {
+	if cfg.SelfCheckLines <= 0 || name == "auto" {
+		return
+	}
+	res, err := SelfCheck(cfg.Path, p, cfg.SelfCheckLines)
+	if err != nil {
+		logger.Warn("parser self-check skipped", "source", cfg.Path, "err", err)
+		return
+	}
+	if res.Checked == 0 {
+		logger.Info("parser self-check skipped: log is empty", "source", cfg.Path)
+		return
+	}
+	if res.Failed*2 > res.Checked {
+		logger.Warn("PARSER SELF-CHECK FAILED: most lines do not parse; is log.parser correct?",
+			"source", cfg.Path, "parser", name, "failed", res.Failed, "checked", res.Checked, "first_error", res.Example)
+		return
+	}
+	logger.Info("parser self-check passed", "source", cfg.Path, "parser", name, "parsed", res.Checked-res.Failed, "checked", res.Checked)
+}
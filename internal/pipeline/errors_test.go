@@ -0,0 +1,149 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/clock"
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/queue"
+)
+
+var epoch = time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+
+// logBuffer collects log output written from several goroutines.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines returns the log lines containing substr.
+func (b *logBuffer) lines(substr string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []string
+	for _, line := range strings.Split(b.buf.String(), "\n") {
+		if strings.Contains(line, substr) {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+func TestParseErrorTrackerRateLimit(t *testing.T) {
+	var logs logBuffer
+	fake := clock.NewFake(epoch)
+	cfg := &config.LogConfig{Path: "/var/log/access.log", ErrorLogInterval: 10 * time.Second}
+	tr, err := NewParseErrorTracker(cfg, logging.NewLoggerTo(&logs), fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	bad := errors.New("bad line")
+	tr.Observe("a", bad)
+	tr.Observe("b", bad)
+	tr.Observe("c", bad)
+	fake.Advance(9 * time.Second)
+	tr.Observe("d", bad)
+	if got := logs.lines("parse error"); len(got) != 1 {
+		t.Fatalf("logged %d parse errors within the interval, want 1:\n%s", len(got), strings.Join(got, "\n"))
+	}
+
+	fake.Advance(time.Second)
+	tr.Observe("e", bad)
+	got := logs.lines("parse error")
+	if len(got) != 2 || !strings.Contains(got[1], "suppressed=3") || !strings.Contains(got[1], "total=5") {
+		t.Fatalf("second log line %q, want suppressed=3 total=5", got[len(got)-1])
+	}
+	if tr.Errors() != 5 {
+		t.Fatalf("Errors() = %d, want 5", tr.Errors())
+	}
+}
+
+func TestParseErrorTrackerQuarantine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quarantine.log")
+	cfg := &config.LogConfig{QuarantineFile: path, QuarantineMaxSize: 12, ErrorLogInterval: time.Minute}
+	var logs logBuffer
+	tr, err := NewParseErrorTracker(cfg, logging.NewLoggerTo(&logs), clock.NewFake(epoch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first", "second", "third"} {
+		tr.Observe(line, errors.New("bad line"))
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first\n" {
+		t.Fatalf("quarantine file %q, want only the line that fit", data)
+	}
+	if got := logs.lines("quarantine file full"); len(got) != 1 {
+		t.Fatalf("logged %d quarantine warnings, want 1", len(got))
+	}
+}
+
+func TestReportDrops(t *testing.T) {
+	var logs logBuffer
+	fake := clock.NewFake(epoch)
+	q := queue.New[int]("lines", 1, queue.DropNewest, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ReportDrops(ctx, logging.NewLoggerTo(&logs), fake, time.Minute, q)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	fake.BlockUntil(1)
+
+	report := func(want int) {
+		t.Helper()
+		fake.Advance(time.Minute)
+		deadline := time.Now().Add(2 * time.Second)
+		for len(logs.lines("queue overloaded")) < want {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for report %d", want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		q.Push(ctx, i) // three dropped
+	}
+	report(1)
+	if got := logs.lines("queue overloaded"); !strings.Contains(got[0], "dropped=3") {
+		t.Fatalf("report %q, want dropped=3", got[0])
+	}
+
+	// A quiet interval logs nothing; the next one reports only the new drops.
+	fake.Advance(time.Minute)
+	q.Push(ctx, 4)
+	report(2)
+	got := logs.lines("queue overloaded")
+	if len(got) != 2 || !strings.Contains(got[1], "dropped=1") || !strings.Contains(got[1], "total_dropped=4") {
+		t.Fatalf("reports %q, want a second one with dropped=1 total_dropped=4", got)
+	}
+}
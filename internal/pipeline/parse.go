@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"context"
+
+	"github.com/cyra/foxhole-fw/internal/parser"
+)
+
+// parseBatchSize bounds how many lines a parse worker handles per job.
+const parseBatchSize = 64
+
+// parseJob is a batch of lines parsed by one worker.
+type parseJob struct {
+	lines  []string
+	events []*parser.Event
+	errs   []error
+	done   chan struct{}
+}
+
+// ParseLines parses lines from in and passes each event to emit in input order,
+// calling onErr for lines that fail to parse. With workers > 1, batches of lines
+// are parsed concurrently and reassembled in order, so per-IP ordering is kept.
+// The parser must be safe for concurrent use. Returns when in is closed or ctx is done.
+func ParseLines(ctx context.Context, p parser.Parser, workers int, in <-chan string, emit func(*parser.Event), onErr func(line string, err error)) {
+	if workers <= 1 {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case line, ok := <-in:
+				if !ok {
+					return
+				}
+				ev, err := p.Parse(line)
+				if err != nil {
+					onErr(line, err)
+					continue
+				}
+				emit(ev)
+			}
+		}
+	}
+
+	jobs := make(chan *parseJob, workers)
+	ordered := make(chan *parseJob, workers*2)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range jobs {
+				for k, line := range j.lines {
+					j.events[k], j.errs[k] = p.Parse(line)
+				}
+				close(j.done)
+			}
+		}()
+	}
+
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for j := range ordered {
+			<-j.done
+			for k, ev := range j.events {
+				if j.errs[k] != nil {
+					onErr(j.lines[k], j.errs[k])
+					continue
+				}
+				emit(ev)
+			}
+		}
+	}()
+
+	defer func() {
+		close(jobs)
+		close(ordered)
+		<-collected
+	}()
+
+	for {
+		batch, ok := nextBatch(ctx, in)
+		if len(batch) > 0 {
+			j := &parseJob{
+				lines:  batch,
+				events: make([]*parser.Event, len(batch)),
+				errs:   make([]error, len(batch)),
+				done:   make(chan struct{}),
+			}
+			// Hand the job to a worker before queueing it for collection so the
+			// collector never waits on a job no worker will run.
+			select {
+			case jobs <- j:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case ordered <- j:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// nextBatch blocks for one line, then takes whatever else is immediately
+// available up to parseBatchSize. ok is false once in is closed or ctx is done.
+func nextBatch(ctx context.Context, in <-chan string) (batch []string, ok bool) {
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case line, open := <-in:
+		if !open {
+			return nil, false
+		}
+		batch = append(make([]string, 0, parseBatchSize), line)
+	}
+	for len(batch) < parseBatchSize {
+		select {
+		case line, open := <-in:
+			if !open {
+				return batch, false
+			}
+			batch = append(batch, line)
+		default:
+			return batch, true
+		}
+	}
+	return batch, true
+}
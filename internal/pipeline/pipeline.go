@@ -2,48 +2,243 @@ package pipeline
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
 
+	"github.com/cyra/foxhole-fw/internal/clock"
 	"github.com/cyra/foxhole-fw/internal/config"
 	"github.com/cyra/foxhole-fw/internal/logging"
 	"github.com/cyra/foxhole-fw/internal/logtail"
+	"github.com/cyra/foxhole-fw/internal/metrics"
 	"github.com/cyra/foxhole-fw/internal/parser"
+	"github.com/cyra/foxhole-fw/internal/queue"
 )
 
-// StartLogPipeline wires together the log tailer and parser and emits parsed events on the channel.
-// The caller is responsible for closing the events channel when context is canceled.
-func StartLogPipeline(ctx context.Context, cfg *config.Config, logger *logging.Logger, events chan<- *parser.Event) error {
-	p, err := parser.New(cfg.Log.Parser)
+// LogPipeline tails and parses one log source and pushes parsed events onto a
+// shared queue. It can be restarted with a new configuration without closing the queue.
+type LogPipeline struct {
+	logger *logging.Logger
+	events *queue.Queue[*parser.Event]
+	clock  clock.Clock
+
+	mu     sync.Mutex
+	ctx    context.Context
+	cur    *generation
+	errors *ParseErrorTracker
+	lines  *queue.Queue[string]
+}
+
+// generation is one run of the tailer and parser for a given configuration.
+type generation struct {
+	tailer   *logtail.Tailer
+	stopTail context.CancelFunc
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// stop ends the generation once the lines it already read are parsed, so the
+// next one can continue from the tailer's position.
+func (g *generation) stop() {
+	g.stopTail()
+	<-g.done
+	g.cancel()
+}
+
+// NewLogPipeline creates a pipeline that pushes events onto the given queue,
+// rate-limiting error logs and drop reports on clk.
+// The caller is responsible for closing the events queue when the pipeline's context is canceled.
+func NewLogPipeline(logger *logging.Logger, events *queue.Queue[*parser.Event], clk clock.Clock) *LogPipeline {
+	return &LogPipeline{
+		logger: logger,
+		events: events,
+		clock:  clk,
+	}
+}
+
+// Start begins tailing and parsing cfg.Log.Path until ctx is done.
+func (lp *LogPipeline) Start(ctx context.Context, cfg *config.Config) error {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	lp.ctx = ctx
+	run, err := lp.prepare(cfg, false)
 	if err != nil {
 		return err
 	}
+	run()
+	return nil
+}
+
+// Reload restarts the pipeline when the log source or parse settings changed.
+// If the path is unchanged, the new generation continues after the last line
+// the old one read, so lines are neither skipped nor evaluated twice. It is
+// meant to be registered with config.Store.Subscribe.
+func (lp *LogPipeline) Reload(old, cur *config.Config) {
+	if !config.Diff(old, cur).LogSource {
+		return
+	}
 
-	t := logtail.New(cfg.Log.Path, logger)
-	lines := make(chan string, 100)
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if lp.ctx == nil || lp.ctx.Err() != nil {
+		return
+	}
 
-	go func() {
-		// Tail will exit when ctx is canceled.
-		_ = t.Tail(ctx, lines)
-		close(lines)
-	}()
+	// Build the new parser and tracker before stopping the old generation so a
+	// bad setting leaves the current pipeline running.
+	run, err := lp.prepare(cur, old.Log.Path == cur.Log.Path)
+	if err != nil {
+		lp.logger.Error("log pipeline not restarted", "keeping", old.Log.Path, "err", err)
+		return
+	}
+	if lp.cur != nil {
+		lp.cur.stop()
+	}
+	run()
+	lp.logger.Info("log pipeline restarted", "source", cur.Log.Path, "parser", cur.Log.Parser)
+}
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case line, ok := <-lines:
-				if !ok {
-					return
-				}
-				ev, err := p.Parse(line)
-				if err != nil {
-					logger.Errorf("parse error: %v", err)
+// ParseErrors returns the parse error tracker of the running generation.
+func (lp *LogPipeline) ParseErrors() *ParseErrorTracker {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.errors
+}
+
+// Lines returns the line queue of the running generation, or nil before Start.
+func (lp *LogPipeline) Lines() queue.Stats {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if lp.lines == nil {
+		return nil
+	}
+	return lp.lines
+}
+
+// prepare builds everything that can fail for a new generation and returns a
+// function that starts it. Caller must hold lp.mu.
+func (lp *LogPipeline) prepare(cfg *config.Config, resume bool) (func(), error) {
+	p, name, err := newParser(&cfg.Log, lp.logger)
+	if err != nil {
+		return nil, err
+	}
+	if !resume {
+		runSelfCheck(&cfg.Log, name, p, lp.logger)
+	}
+
+	parseErrors, err := NewParseErrorTracker(&cfg.Log, lp.logger, lp.clock)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		ctx, cancel := context.WithCancel(lp.ctx)
+		tailCtx, stopTail := context.WithCancel(ctx)
+		t := logtail.New(cfg.Log.Path, lp.logger)
+		if resume && lp.cur != nil {
+			t.SetStart(lp.cur.tailer.Position())
+		}
+		gen := &generation{tailer: t, stopTail: stopTail, cancel: cancel, done: make(chan struct{})}
+
+		lines := NewQueue[string]("lines", cfg.Pipeline.LinesBuffer, &cfg.Pipeline)
+		parseFailures := metrics.ParseErrors.WithLabelValues(name)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			// Tail will exit when tailCtx is canceled; the parser then
+			// drains the lines already queued.
+			if err := t.Tail(tailCtx, lines); err != nil && tailCtx.Err() == nil {
+				lp.logger.Error("tail failed", "source", cfg.Log.Path, "err", err)
+			}
+			lines.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			ParseLines(ctx, p, cfg.Pipeline.ParseWorkers, lines.C(),
+				func(ev *parser.Event) {
+					metrics.Events.WithLabelValues(metrics.StatusClass(ev.Status)).Inc()
+					lp.events.Push(ctx, ev)
+				},
+				func(line string, err error) {
+					parseFailures.Inc()
+					parseErrors.Observe(line, err)
+				},
+			)
+		}()
+		go ReportDrops(ctx, lp.logger, lp.clock, time.Minute, lines)
+
+		go func() {
+			wg.Wait()
+			_ = parseErrors.Close()
+			close(gen.done)
+		}()
+
+		lp.cur = gen
+		lp.errors = parseErrors
+		lp.lines = lines
+	}, nil
+}
+
+// newParser builds the configured parser and returns it with its resolved name.
+// For "auto", the start of the log is sampled to pick a format right away; if the
+// log is empty or missing, detection happens on the first lines tailed instead.
+func newParser(cfg *config.LogConfig, logger *logging.Logger) (parser.Parser, string, error) {
+	if cfg.Parser != "auto" {
+		p, err := parser.New(cfg.Parser)
+		if err != nil {
+			return nil, "", fmt.Errorf("parser %q: %w", cfg.Parser, err)
+		}
+		return p, cfg.Parser, nil
+	}
+
+	if sample, err := readHead(cfg.Path, parser.DefaultAutoSample); err == nil && len(sample) > 0 {
+		if d, err := parser.Detect(sample); err == nil {
+			logger.Info("log format auto-detected", "source", cfg.Path, "parser", d.Parser, "parsed", d.Parsed, "sampled", d.Sampled)
+			p, err := parser.New(d.Parser)
+			return p, d.Parser, err
+		}
+		logger.Warn("log format auto-detection found no matching parser; retrying on new lines", "source", cfg.Path, "sampled", len(sample))
+	}
+
+	p := parser.NewAuto(parser.DefaultAutoSample, func(d parser.Detection, err error) {
+		if err != nil {
+			logger.Error("log format auto-detection failed; retrying on the next lines", "source", cfg.Path, "sampled", d.Sampled, "err", err)
+			return
+		}
+		logger.Info("log format auto-detected", "source", cfg.Path, "parser", d.Parser, "parsed", d.Parsed, "sampled", d.Sampled)
+	})
+	return p, "auto", nil
+}
+
+// NewQueue creates a queue of the given size using the configured overload policy.
+func NewQueue[T any](name string, size int, cfg *config.PipelineConfig) *queue.Queue[T] {
+	return queue.New[T](name, size, queue.Policy(cfg.OverloadPolicy), cfg.SampleRate)
+}
+
+// ReportDrops logs, once per interval on clk, how many items each queue dropped
+// since the previous report. It returns when ctx is done.
+func ReportDrops(ctx context.Context, logger *logging.Logger, clk clock.Clock, interval time.Duration, queues ...queue.Stats) {
+	last := make([]uint64, len(queues))
+	ticker := clk.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			for i, q := range queues {
+				dropped := q.Dropped()
+				if dropped == last[i] {
 					continue
 				}
-				events <- ev
+				logger.Error("queue overloaded", "queue", q.Name(), "dropped", dropped-last[i],
+					"total_dropped", dropped, "len", q.Len(), "cap", q.Cap())
+				last[i] = dropped
 			}
 		}
-	}()
-
-	return nil
+	}
 }
@@ -0,0 +1,161 @@
+// Package queue provides bounded channels with an explicit overload policy,
+// used between pipeline stages so a slow consumer cannot silently stall producers.
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Policy decides what happens when an item is pushed onto a full queue.
+type Policy string
+
+const (
+	// Block waits for free space (or context cancellation).
+	Block Policy = "block"
+	// DropOldest discards the oldest queued item to make room.
+	DropOldest Policy = "drop_oldest"
+	// DropNewest discards the item being pushed.
+	DropNewest Policy = "drop_newest"
+	// Sample keeps one in every N items pushed while full (blocking for it) and drops the rest.
+	Sample Policy = "sample"
+)
+
+// ParsePolicy validates a policy name. An empty name means Block.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case "":
+		return Block, nil
+	case Block, DropOldest, DropNewest, Sample:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown overload policy %q", s)
+	}
+}
+
+// Stats is the read-only view of a queue used for reporting.
+type Stats interface {
+	Name() string
+	Len() int
+	Cap() int
+	Dropped() uint64
+}
+
+// Queue is a bounded FIFO of T with an overload policy.
+// Push is safe for concurrent use and never panics after Close.
+type Queue[T any] struct {
+	name       string
+	ch         chan T
+	policy     Policy
+	sampleRate uint64
+
+	dropped  atomic.Uint64
+	overflow atomic.Uint64 // pushes seen while full, for sampling
+
+	mu        sync.RWMutex
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New creates a queue holding up to size items.
+// sampleRate is only used by the Sample policy; values < 1 are treated as 1.
+func New[T any](name string, size int, policy Policy, sampleRate int) *Queue[T] {
+	if size < 1 {
+		size = 1
+	}
+	if sampleRate < 1 {
+		sampleRate = 1
+	}
+	if policy == "" {
+		policy = Block
+	}
+	return &Queue[T]{
+		name:       name,
+		ch:         make(chan T, size),
+		policy:     policy,
+		sampleRate: uint64(sampleRate),
+		done:       make(chan struct{}),
+	}
+}
+
+// Push enqueues v according to the queue policy. It returns false if v was
+// dropped, the queue is closed, or ctx was canceled while blocking.
+func (q *Queue[T]) Push(ctx context.Context, v T) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false
+	}
+
+	// Fast path: there is room.
+	select {
+	case q.ch <- v:
+		return true
+	default:
+	}
+
+	switch q.policy {
+	case DropNewest:
+		q.dropped.Add(1)
+		return false
+	case DropOldest:
+		for {
+			select {
+			case q.ch <- v:
+				return true
+			default:
+			}
+			select {
+			case <-q.ch:
+				q.dropped.Add(1)
+			default:
+			}
+		}
+	case Sample:
+		if q.overflow.Add(1)%q.sampleRate != 0 {
+			q.dropped.Add(1)
+			return false
+		}
+	}
+
+	select {
+	case q.ch <- v:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-q.done:
+		return false
+	}
+}
+
+// C returns the channel consumers read from. It is closed by Close.
+func (q *Queue[T]) C() <-chan T {
+	return q.ch
+}
+
+// Close stops accepting items and closes the consumer channel.
+// Pushers blocked on a full queue are released.
+func (q *Queue[T]) Close() {
+	q.closeOnce.Do(func() {
+		close(q.done)
+		q.mu.Lock()
+		q.closed = true
+		close(q.ch)
+		q.mu.Unlock()
+	})
+}
+
+// Name returns the queue name used in logs.
+func (q *Queue[T]) Name() string { return q.name }
+
+// Len returns the number of queued items.
+func (q *Queue[T]) Len() int { return len(q.ch) }
+
+// Cap returns the queue capacity.
+func (q *Queue[T]) Cap() int { return cap(q.ch) }
+
+// Dropped returns the number of items discarded by the overload policy.
+func (q *Queue[T]) Dropped() uint64 { return q.dropped.Load() }
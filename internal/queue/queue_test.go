@@ -0,0 +1,219 @@
+package queue
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// drain returns the queued items without waiting.
+func drain[T any](q *Queue[T]) []T {
+	var out []T
+	for q.Len() > 0 {
+		out = append(out, <-q.C())
+	}
+	return out
+}
+
+func TestParsePolicy(t *testing.T) {
+	for in, want := range map[string]Policy{"": Block, "block": Block, "drop_oldest": DropOldest, "drop_newest": DropNewest, "sample": Sample} {
+		if got, err := ParsePolicy(in); err != nil || got != want {
+			t.Errorf("ParsePolicy(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParsePolicy("drop_all"); err == nil {
+		t.Error("ParsePolicy accepted an unknown policy")
+	}
+}
+
+func TestDropNewest(t *testing.T) {
+	q := New[int]("test", 2, DropNewest, 0)
+	for i := 0; i < 5; i++ {
+		if ok := q.Push(context.Background(), i); ok != (i < 2) {
+			t.Fatalf("Push(%d) = %v", i, ok)
+		}
+	}
+	if got := drain(q); !slices.Equal(got, []int{0, 1}) || q.Dropped() != 3 {
+		t.Fatalf("kept %v, dropped %d; want [0 1] and 3", got, q.Dropped())
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	q := New[int]("test", 2, DropOldest, 0)
+	for i := 0; i < 5; i++ {
+		if !q.Push(context.Background(), i) {
+			t.Fatalf("Push(%d) dropped the new item", i)
+		}
+	}
+	if got := drain(q); !slices.Equal(got, []int{3, 4}) || q.Dropped() != 3 {
+		t.Fatalf("kept %v, dropped %d; want [3 4] and 3", got, q.Dropped())
+	}
+}
+
+func TestDropOldestConcurrent(t *testing.T) {
+	q := New[int]("test", 4, DropOldest, 0)
+	var wg sync.WaitGroup
+	for p := 0; p < 8; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				q.Push(context.Background(), i)
+			}
+		}()
+	}
+	received := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range q.C() {
+			received++
+		}
+	}()
+	wg.Wait()
+	q.Close()
+	<-done
+	if uint64(received)+q.Dropped() != 8000 {
+		t.Fatalf("received %d + dropped %d, want 8000 items accounted for", received, q.Dropped())
+	}
+}
+
+func TestSample(t *testing.T) {
+	q := New[int]("test", 1, Sample, 3)
+	q.Push(context.Background(), 0)
+
+	// While full, one push in three waits for room and the rest are dropped.
+	results := make(chan bool, 6)
+	var wg sync.WaitGroup
+	for i := 1; i <= 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- q.Push(context.Background(), i)
+		}()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Dropped() < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("dropped %d of 6 pushes on a full queue, want 4", q.Dropped())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	received := 0
+	for range 3 {
+		<-q.C()
+		received++
+	}
+	wg.Wait()
+	close(results)
+	kept := 0
+	for ok := range results {
+		if ok {
+			kept++
+		}
+	}
+	if kept != 2 || q.Dropped() != 4 {
+		t.Fatalf("kept %d, dropped %d; want 2 and 4", kept, q.Dropped())
+	}
+}
+
+func TestBlock(t *testing.T) {
+	q := New[int]("test", 1, Block, 0)
+	q.Push(context.Background(), 0)
+
+	pushed := make(chan bool)
+	go func() { pushed <- q.Push(context.Background(), 1) }()
+	select {
+	case <-pushed:
+		t.Fatal("Push returned on a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if v := <-q.C(); v != 0 {
+		t.Fatalf("got %d, want 0", v)
+	}
+	if !<-pushed {
+		t.Fatal("blocked Push failed once there was room")
+	}
+	if v := <-q.C(); v != 1 || q.Dropped() != 0 {
+		t.Fatalf("got %d with %d dropped, want 1 and none", v, q.Dropped())
+	}
+}
+
+func TestBlockContextCancel(t *testing.T) {
+	q := New[int]("test", 1, Block, 0)
+	q.Push(context.Background(), 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	pushed := make(chan bool)
+	go func() { pushed <- q.Push(ctx, 1) }()
+	cancel()
+	if <-pushed {
+		t.Fatal("Push succeeded after its context was canceled")
+	}
+}
+
+func TestCloseReleasesBlockedPushers(t *testing.T) {
+	q := New[int]("test", 1, Block, 0)
+	q.Push(context.Background(), 0)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var results []bool
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok := q.Push(context.Background(), i)
+			mu.Lock()
+			results = append(results, ok)
+			mu.Unlock()
+		}()
+	}
+	time.Sleep(20 * time.Millisecond) // let them block
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		q.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close waited for blocked pushers")
+	}
+	wg.Wait()
+	if slices.Contains(results, true) {
+		t.Fatalf("push results %v, want all false after Close", results)
+	}
+
+	// Items queued before Close are still delivered, then the channel ends.
+	if v, ok := <-q.C(); !ok || v != 0 {
+		t.Fatalf("got %d, %v; want the queued 0", v, ok)
+	}
+	if _, ok := <-q.C(); ok {
+		t.Fatal("channel still open after Close")
+	}
+}
+
+func TestPushAfterClose(t *testing.T) {
+	for _, policy := range []Policy{Block, DropOldest, DropNewest, Sample} {
+		q := New[int]("test", 1, policy, 1)
+		q.Close()
+		q.Close() // idempotent
+		if q.Push(context.Background(), 1) {
+			t.Errorf("%s: Push succeeded after Close", policy)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	q := New[string]("lines", 0, "", 0)
+	if q.Name() != "lines" || q.Cap() != 1 || q.Len() != 0 {
+		t.Fatalf("name %q cap %d len %d, want lines 1 0", q.Name(), q.Cap(), q.Len())
+	}
+	q.Push(context.Background(), "a")
+	if q.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", q.Len())
+	}
+}
@@ -0,0 +1,188 @@
+// Package report summarizes ban activity recorded in the audit log and mails
+// the summary on a daily or weekly schedule.
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/audit"
+)
+
+// Tally counts bans for one key.
+type Tally struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// Failure is a backend call that failed.
+type Failure struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	IP      string    `json:"ip"`
+	Backend string    `json:"backend,omitempty"`
+	Error   string    `json:"error"`
+}
+
+// Report summarizes the audit records in [Since, Until).
+type Report struct {
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+
+	Bans    int `json:"bans"`    // applied, including dry-run
+	DryRun  int `json:"dry_run"` // bans only logged because of dry-run
+	Unbans  int `json:"unbans"`  // applied
+	Skips   int `json:"skips"`   // bans not applied (whitelisted, already banned)
+	Extends int `json:"extends"` // ban expiries moved later
+	Failed  int `json:"failed"`  // backend calls that failed
+	Invalid int `json:"invalid"` // unreadable audit lines
+
+	TopIPs   []Tally   `json:"top_ips"`
+	TopRules []Tally   `json:"top_rules"`
+	TopPaths []Tally   `json:"top_paths"`
+	Backends []Tally   `json:"backends"` // bans per backend holding them
+	Errors   []Failure `json:"errors"`   // most recent failures, newest first
+}
+
+// banKey identifies one ban across the records written for it.
+type banKey struct {
+	ip      string
+	expires int64 // unix nanoseconds
+}
+
+// Build reads the audit log files and summarizes the records in
+// [since, until), keeping top entries per list. A ban recorded more than
+// once, e.g. again for the backends a retry installed it on, counts once.
+func Build(files []string, since, until time.Time, top int) (*Report, error) {
+	r := &Report{Since: since, Until: until}
+	ips := make(map[string]int)
+	ruleIDs := make(map[string]int)
+	paths := make(map[string]int)
+	backends := make(map[string]int)
+	held := make(map[banKey]map[string]bool) // backends seen per ban
+	var failures []Failure
+
+	invalid, err := audit.Read(files, func(rec audit.Record) {
+		if rec.Time.Before(since) || !rec.Time.Before(until) {
+			return
+		}
+		if rec.Error != "" {
+			r.Failed++
+			failures = append(failures, Failure{
+				Time: rec.Time, Action: rec.Action, IP: rec.IP, Backend: rec.Backend, Error: rec.Error,
+			})
+			return
+		}
+		switch rec.Action {
+		case "ban":
+			seen, first := make(map[string]bool), true
+			if rec.ExpiresAt != nil {
+				key := banKey{ip: rec.IP, expires: rec.ExpiresAt.UnixNano()}
+				if prev, ok := held[key]; ok {
+					seen, first = prev, false
+				} else {
+					held[key] = seen
+				}
+			}
+			if first {
+				r.Bans++
+				if rec.DryRun {
+					r.DryRun++
+				}
+				ips[rec.IP]++
+				if rec.RuleID != "" {
+					ruleIDs[rec.RuleID]++
+				}
+				if rec.Path != "" {
+					paths[rec.Path]++
+				}
+			}
+			for _, name := range strings.Split(rec.Backend, ",") {
+				if name != "" && !seen[name] {
+					seen[name] = true
+					backends[name]++
+				}
+			}
+		case "unban":
+			r.Unbans++
+		case "skip":
+			r.Skips++
+		case "extend":
+			r.Extends++
+		}
+	})
+	r.Invalid = invalid
+	if err != nil {
+		return nil, err
+	}
+
+	r.TopIPs = tallies(ips, top)
+	r.TopRules = tallies(ruleIDs, top)
+	r.TopPaths = tallies(paths, top)
+	r.Backends = tallies(backends, 0)
+	sort.SliceStable(failures, func(i, j int) bool { return failures[i].Time.After(failures[j].Time) })
+	if len(failures) > top {
+		failures = failures[:top]
+	}
+	r.Errors = failures
+	return r, nil
+}
+
+// tallies sorts counts, most first, keeping at most top entries (all if top is 0).
+func tallies(m map[string]int, top int) []Tally {
+	out := make([]Tally, 0, len(m))
+	for k, n := range m {
+		out = append(out, Tally{Key: k, Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	if top > 0 && len(out) > top {
+		out = out[:top]
+	}
+	return out
+}
+
+// WriteText writes the report as plain text, suitable for an email body.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	const layout = "2006-01-02 15:04 MST"
+	fmt.Fprintf(tw, "Ban activity from %s to %s\n\n", r.Since.Format(layout), r.Until.Format(layout))
+	fmt.Fprintf(tw, "Bans:\t%d", r.Bans)
+	if r.DryRun > 0 {
+		fmt.Fprintf(tw, " (%d dry-run)", r.DryRun)
+	}
+	fmt.Fprintf(tw, "\nUnbans:\t%d\nSkipped:\t%d\nExtended:\t%d\nFailed backend calls:\t%d\n", r.Unbans, r.Skips, r.Extends, r.Failed)
+	if r.Invalid > 0 {
+		fmt.Fprintf(tw, "Unreadable audit lines:\t%d\n", r.Invalid)
+	}
+
+	section := func(title string, t []Tally) {
+		if len(t) == 0 {
+			return
+		}
+		fmt.Fprintf(tw, "\n%s\n", title)
+		for _, e := range t {
+			fmt.Fprintf(tw, "  %s\t%d\n", e.Key, e.Count)
+		}
+	}
+	section("Top banned IPs", r.TopIPs)
+	section("Top rules", r.TopRules)
+	section("Top targeted paths", r.TopPaths)
+	section("Bans per backend", r.Backends)
+
+	if len(r.Errors) > 0 {
+		fmt.Fprintf(tw, "\nRecent errors\n")
+		for _, f := range r.Errors {
+			fmt.Fprintf(tw, "  %s\t%s %s\t%s\t%s\n", f.Time.In(r.Until.Location()).Format(layout), f.Action, f.IP, f.Backend, f.Error)
+		}
+	}
+	return tw.Flush()
+}
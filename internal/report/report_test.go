@@ -0,0 +1,322 @@
+package report
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/audit"
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/logging"
+)
+
+// mail is what the fake SMTP server received.
+type mail struct {
+	auth string // decoded AUTH PLAIN credentials
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTP accepts one session per connection and sends each message on the
+// returned channel. It offers AUTH PLAIN but not STARTTLS.
+func fakeSMTP(t *testing.T) (host string, port int, mails <-chan mail) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan mail, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, ch)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return "127.0.0.1", addr.Port, ch
+}
+
+func serveSMTP(conn net.Conn, ch chan<- mail) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	var m mail
+	_ = tp.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			_ = tp.PrintfLine("250-fake")
+			_ = tp.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			_, initial, _ := strings.Cut(arg, " ")
+			creds, _ := base64.StdEncoding.DecodeString(initial)
+			m.auth = string(creds)
+			_ = tp.PrintfLine("235 ok")
+		case "MAIL":
+			m.from = strings.TrimSuffix(strings.TrimPrefix(arg, "FROM:<"), ">")
+			_ = tp.PrintfLine("250 ok")
+		case "RCPT":
+			m.to = append(m.to, strings.TrimSuffix(strings.TrimPrefix(arg, "TO:<"), ">"))
+			_ = tp.PrintfLine("250 ok")
+		case "DATA":
+			_ = tp.PrintfLine("354 go ahead")
+			data, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			m.data = string(data)
+			_ = tp.PrintfLine("250 queued")
+			ch <- m
+			m = mail{}
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+var base = time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+// writeAudit writes records to an audit log in dir, rotating so that the
+// report has to read the backup too.
+func writeAudit(t *testing.T, dir string, recs []audit.Record) *config.AuditConfig {
+	t.Helper()
+	cfg := &config.AuditConfig{Path: filepath.Join(dir, "audit.jsonl"), MaxSize: 1000, MaxBackups: 5}
+	l, err := audit.Open(cfg, logging.NewLoggerTo(io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range recs {
+		if err := l.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(audit.Files(cfg.Path, cfg.MaxBackups)) < 2 {
+		t.Fatal("audit log was not rotated")
+	}
+	return cfg
+}
+
+func testRecords() []audit.Record {
+	rec := func(min int, action, ip, rule, path, backend string) audit.Record {
+		return audit.Record{
+			Time: base.Add(time.Duration(min) * time.Minute), Action: action, IP: ip,
+			RuleID: rule, Path: path, Backend: backend, Source: "engine",
+		}
+	}
+	recs := []audit.Record{
+		rec(-10, "ban", "9.9.9.9", "old", "/old", "iptables"), // before the period
+		rec(1, "ban", "1.1.1.1", "login", "/login", "iptables"),
+		rec(2, "ban", "1.1.1.1", "login", "/login", "iptables"),
+		rec(3, "ban", "2.2.2.2", "login", "/wp-login.php", "iptables"),
+		rec(4, "ban", "3.3.3.3", "scanner", "/.env", "vultr"),
+		rec(5, "ban", "1.1.1.1", "scanner", "/.env", "iptables"),
+		rec(6, "unban", "2.2.2.2", "login", "", "iptables"),
+		rec(7, "skip", "4.4.4.4", "login", "/login", "iptables"),
+		rec(8, "extend", "1.1.1.1", "login", "", ""),
+	}
+	failed := rec(9, "ban", "5.5.5.5", "login", "/login", "vultr")
+	failed.Error = "vultr: unexpected status 503"
+	recs = append(recs, failed)
+	dry := rec(10, "ban", "6.6.6.6", "login", "/login", "iptables")
+	dry.DryRun = true
+	recs = append(recs, dry)
+	return append(recs, rec(24*60+1, "ban", "7.7.7.7", "late", "/late", "iptables")) // after
+}
+
+func TestBuild(t *testing.T) {
+	cfg := writeAudit(t, t.TempDir(), testRecords())
+	rep, err := Build(audit.Files(cfg.Path, cfg.MaxBackups), base, base.Add(24*time.Hour), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rep.Bans != 6 || rep.DryRun != 1 || rep.Unbans != 1 || rep.Skips != 1 || rep.Extends != 1 || rep.Failed != 1 {
+		t.Errorf("counts = bans %d dry-run %d unbans %d skips %d extends %d failed %d, want 6 1 1 1 1 1",
+			rep.Bans, rep.DryRun, rep.Unbans, rep.Skips, rep.Extends, rep.Failed)
+	}
+	check := func(name string, got []Tally, want ...Tally) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Errorf("%s = %v, want %v", name, got, want)
+			return
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s = %v, want %v", name, got, want)
+				return
+			}
+		}
+	}
+	check("TopIPs", rep.TopIPs, Tally{"1.1.1.1", 3}, Tally{"2.2.2.2", 1})
+	check("TopRules", rep.TopRules, Tally{"login", 4}, Tally{"scanner", 2})
+	check("TopPaths", rep.TopPaths, Tally{"/login", 3}, Tally{"/.env", 2})
+	check("Backends", rep.Backends, Tally{"iptables", 5}, Tally{"vultr", 1})
+	if len(rep.Errors) != 1 || rep.Errors[0].IP != "5.5.5.5" || !strings.Contains(rep.Errors[0].Error, "503") {
+		t.Errorf("Errors = %+v", rep.Errors)
+	}
+}
+
+func TestBuildCountsBansOnce(t *testing.T) {
+	evidence := []string{strings.Repeat("x", 400)} // enough to rotate the log
+	rec := func(min int, ip string, expires time.Duration, backend string) audit.Record {
+		at := base.Add(expires)
+		return audit.Record{
+			Time: base.Add(time.Duration(min) * time.Minute), Action: "ban", IP: ip, RuleID: "login",
+			Path: "/login", Backend: backend, ExpiresAt: &at, Source: "engine", Lines: evidence,
+		}
+	}
+	cfg := writeAudit(t, t.TempDir(), []audit.Record{
+		rec(1, "1.1.1.1", time.Hour, "iptables,vultr"),
+		rec(2, "1.1.1.1", time.Hour, "proxmox"), // installed on retry
+		rec(3, "2.2.2.2", time.Hour, "iptables"),
+		rec(3, "2.2.2.2", time.Hour, "vultr"), // one record per backend
+		rec(4, "2.2.2.2", time.Hour, "vultr"),
+		rec(5, "1.1.1.1", 2*time.Hour, "iptables"), // banned again
+	})
+	rep, err := Build(audit.Files(cfg.Path, cfg.MaxBackups), base, base.Add(24*time.Hour), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rep.Bans != 3 {
+		t.Errorf("bans = %d, want 3", rep.Bans)
+	}
+	want := map[string][]Tally{
+		"TopIPs":   {{"1.1.1.1", 2}, {"2.2.2.2", 1}},
+		"TopRules": {{"login", 3}},
+		"Backends": {{"iptables", 3}, {"vultr", 2}, {"proxmox", 1}},
+	}
+	for name, got := range map[string][]Tally{"TopIPs": rep.TopIPs, "TopRules": rep.TopRules, "Backends": rep.Backends} {
+		if !slices.Equal(got, want[name]) {
+			t.Errorf("%s = %v, want %v", name, got, want[name])
+		}
+	}
+}
+
+func TestSendReport(t *testing.T) {
+	dir := t.TempDir()
+	auditCfg := writeAudit(t, dir, testRecords())
+	host, port, mails := fakeSMTP(t)
+	cfg := &config.ReportConfig{
+		Schedule: "daily",
+		At:       "08:00",
+		Top:      10,
+		SMTP: config.SMTPConfig{
+			Host: host, Port: port, Username: "fw", Password: "pw",
+			From: "fw@example.org", To: []string{"ops@example.org", "sec@example.org"},
+			Timeout: 5 * time.Second,
+		},
+	}
+	r := New(cfg, auditCfg, logging.NewLoggerTo(io.Discard))
+	rep, err := r.Build(base, base.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Send(rep); err != nil {
+		t.Fatal(err)
+	}
+
+	var m mail
+	select {
+	case m = <-mails:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+	}
+	if m.auth != "\x00fw\x00pw" {
+		t.Errorf("auth = %q", m.auth)
+	}
+	if m.from != "fw@example.org" || strings.Join(m.to, ",") != "ops@example.org,sec@example.org" {
+		t.Errorf("envelope = %s -> %v", m.from, m.to)
+	}
+	hdr, err := textproto.NewReader(bufio.NewReader(strings.NewReader(m.data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subj := hdr.Get("Subject"); !strings.Contains(subj, "daily report") || !strings.Contains(subj, "6 bans, 1 errors") {
+		t.Errorf("Subject = %q", subj)
+	}
+	for _, want := range []string{
+		"Bans:", "(1 dry-run)",
+		"Top banned IPs", "1.1.1.1", "Top rules", "scanner",
+		"Top targeted paths", "/wp-login.php",
+		"Bans per backend", "vultr",
+		"Recent errors", "unexpected status 503",
+	} {
+		if !strings.Contains(m.data, want) {
+			t.Errorf("mail body does not contain %q:\n%s", want, m.data)
+		}
+	}
+	if strings.Contains(m.data, "9.9.9.9") || strings.Contains(m.data, "7.7.7.7") {
+		t.Errorf("mail body includes records outside the period:\n%s", m.data)
+	}
+}
+
+func TestSendError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	cfg := &config.SMTPConfig{Host: "127.0.0.1", Port: port, From: "a@b", To: []string{"c@d"}, Timeout: time.Second}
+	if err := Send(cfg, "x", []byte("x")); err == nil || !strings.Contains(err.Error(), "smtp dial") {
+		t.Errorf("err = %v, want dial error", err)
+	}
+}
+
+func TestNext(t *testing.T) {
+	loc := time.FixedZone("X", 2*3600)
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		schedule, weekday string
+		now, want         string
+	}{
+		{"daily", "", "2024-05-01 07:00", "2024-05-01 08:30"},
+		{"daily", "", "2024-05-01 08:30", "2024-05-02 08:30"},
+		{"daily", "", "2024-05-01 23:00", "2024-05-02 08:30"},
+		// 2024-05-01 is a Wednesday.
+		{"weekly", "monday", "2024-05-01 07:00", "2024-05-06 08:30"},
+		{"weekly", "Wednesday", "2024-05-01 07:00", "2024-05-01 08:30"},
+		{"weekly", "wednesday", "2024-05-01 09:00", "2024-05-08 08:30"},
+	}
+	for _, tt := range tests {
+		r := New(&config.ReportConfig{Schedule: tt.schedule, At: "08:30", Weekday: tt.weekday}, nil, nil)
+		if got := r.Next(at(tt.now)); !got.Equal(at(tt.want)) {
+			t.Errorf("%s %s: Next(%s) = %s, want %s", tt.schedule, tt.weekday, tt.now, got, tt.want)
+		}
+	}
+
+	r := New(&config.ReportConfig{Schedule: "weekly"}, nil, nil)
+	if got := r.Period(at("2024-05-08 08:30")); !got.Equal(at("2024-05-01 08:30")) {
+		t.Errorf("weekly Period = %s", got)
+	}
+}
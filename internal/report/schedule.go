@@ -0,0 +1,137 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/audit"
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/logging"
+)
+
+const (
+	// sendAttempts and retryDelay bound how hard a scheduled report is retried.
+	sendAttempts = 3
+	retryDelay   = time.Minute
+)
+
+// Reporter builds reports from the audit log and mails them.
+type Reporter struct {
+	cfg    *config.ReportConfig
+	audit  *config.AuditConfig
+	logger *logging.Logger
+}
+
+// New returns a reporter for the given report and audit log settings.
+func New(cfg *config.ReportConfig, audit *config.AuditConfig, logger *logging.Logger) *Reporter {
+	return &Reporter{cfg: cfg, audit: audit, logger: logger}
+}
+
+// Build summarizes the audit log over [since, until).
+func (r *Reporter) Build(since, until time.Time) (*Report, error) {
+	return Build(audit.Files(r.audit.Path, r.audit.MaxBackups), since, until, r.cfg.Top)
+}
+
+// Send mails rep.
+func (r *Reporter) Send(rep *Report) error {
+	var body bytes.Buffer
+	if err := rep.WriteText(&body); err != nil {
+		return err
+	}
+	return Send(&r.cfg.SMTP, r.subject(rep), body.Bytes())
+}
+
+func (r *Reporter) subject(rep *Report) string {
+	if r.cfg.Subject != "" {
+		return r.cfg.Subject
+	}
+	host, _ := os.Hostname()
+	kind := r.cfg.Schedule
+	if kind == "" {
+		kind = "ban"
+	}
+	return fmt.Sprintf("foxhole-fw %s report for %s: %d bans, %d errors", kind, host, rep.Bans, rep.Failed)
+}
+
+// Period returns the start of the reporting period ending at until.
+func (r *Reporter) Period(until time.Time) time.Time {
+	if r.cfg.Schedule == "weekly" {
+		return until.AddDate(0, 0, -7)
+	}
+	return until.AddDate(0, 0, -1)
+}
+
+// Next returns the first scheduled report time after t, in t's location.
+func (r *Reporter) Next(t time.Time) time.Time {
+	at, _ := time.Parse("15:04", r.cfg.At) // validated by config.Load
+	next := time.Date(t.Year(), t.Month(), t.Day(), at.Hour(), at.Minute(), 0, 0, t.Location())
+	if r.cfg.Schedule == "weekly" {
+		day := weekday(r.cfg.Weekday)
+		for next.Weekday() != day || !next.After(t) {
+			next = next.AddDate(0, 0, 1)
+		}
+		return next
+	}
+	if !next.After(t) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+func weekday(name string) time.Weekday {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), name) {
+			return d
+		}
+	}
+	return time.Monday
+}
+
+// Run sends a report at every scheduled time until ctx is done.
+func (r *Reporter) Run(ctx context.Context) {
+	for {
+		next := r.Next(time.Now())
+		r.logger.Debug("next report scheduled", "at", next)
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		r.runOnce(ctx, next)
+	}
+}
+
+// runOnce builds and sends the report for the period ending at until,
+// retrying failed sends a few times.
+func (r *Reporter) runOnce(ctx context.Context, until time.Time) {
+	rep, err := r.Build(r.Period(until), until)
+	if err != nil {
+		r.logger.Error("report failed", "err", err)
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err = r.Send(rep)
+		if err == nil {
+			r.logger.Info("report sent", "bans", rep.Bans, "to", strings.Join(r.cfg.SMTP.To, ","))
+			return
+		}
+		if attempt == sendAttempts {
+			r.logger.Error("report not sent", "attempts", attempt, "err", err)
+			return
+		}
+		r.logger.Warn("report send failed, retrying", "attempt", attempt, "err", err)
+		t := time.NewTimer(retryDelay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
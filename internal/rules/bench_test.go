@@ -0,0 +1,85 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/clock"
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/parser"
+	"github.com/cyra/foxhole-fw/internal/queue"
+)
+
+func benchConfig(shards int) *config.Config {
+	return &config.Config{
+		Pipeline: config.PipelineConfig{EngineShards: shards},
+		Rules: []config.Rule{
+			{ID: "login", Method: "POST", Path: "/login", MaxErrors: 1 << 30, Window: time.Minute, BanDuration: time.Hour},
+			{ID: "root", Method: "GET", Path: "/", MaxErrors: 1 << 30, Window: time.Minute, BanDuration: time.Hour},
+		},
+	}
+}
+
+func benchEvents(n, ips int) []*parser.Event {
+	now := time.Now()
+	events := make([]*parser.Event, n)
+	for i := range events {
+		events[i] = &parser.Event{
+			RemoteAddr: fmt.Sprintf("10.0.%d.%d", i%ips>>8&0xff, i%ips&0xff),
+			Method:     "GET",
+			Path:       "/",
+			Status:     404,
+			Timestamp:  now.Add(time.Duration(i) * time.Microsecond),
+		}
+	}
+	return events
+}
+
+func BenchmarkShardedStoreRecordError(b *testing.B) {
+	for _, shards := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := NewShardedStore(shards, time.Minute, 0, clock.Real)
+			defer s.Close()
+			now := time.Now()
+
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					ip := fmt.Sprintf("10.1.%d.%d", i>>8&0xff, i&0xff)
+					s.RecordError(ip, now, "")
+					s.ApplyWindow(ip, now, time.Minute)
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkEngineRun(b *testing.B) {
+	events := benchEvents(1<<16, 4096)
+	logger := logging.NewLoggerTo(io.Discard)
+
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			e := NewEngine(config.NewStore(benchConfig(shards)), logger, clock.Real)
+			defer e.Close()
+
+			in := make(chan *parser.Event, 1024)
+			decisions := queue.New[*Decision]("decisions", 1024, queue.DropNewest, 0)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					in <- events[i%len(events)]
+				}
+				close(in)
+			}()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			e.Run(context.Background(), in, decisions)
+		})
+	}
+}
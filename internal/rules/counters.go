@@ -0,0 +1,85 @@
+package rules
+
+import (
+	"sort"
+	"time"
+)
+
+// RuleProgress is how close an IP is to a rule's threshold.
+type RuleProgress struct {
+	RuleID    string `json:"rule_id"`
+	Count     int    `json:"count"` // errors within the rule window
+	MaxErrors int    `json:"max_errors"`
+}
+
+// Ratio returns Count/MaxErrors; 1 or more means the threshold is reached.
+func (p RuleProgress) Ratio() float64 {
+	if p.MaxErrors <= 0 {
+		return 0
+	}
+	return float64(p.Count) / float64(p.MaxErrors)
+}
+
+// IPCounter is the current error state of one tracked IP.
+type IPCounter struct {
+	IP        string         `json:"ip"`
+	Errors    int            `json:"errors"` // errors within the store TTL
+	LastError time.Time      `json:"last_error"`
+	Rules     []RuleProgress `json:"rules"` // sorted by ratio, closest to banning first
+}
+
+// Closest returns the rule the IP is nearest to violating, if any.
+func (c IPCounter) Closest() (RuleProgress, bool) {
+	if len(c.Rules) == 0 {
+		return RuleProgress{}, false
+	}
+	return c.Rules[0], true
+}
+
+// Counters returns the per-IP error counters relative to now, with progress
+// toward each rule's max_errors, ordered by how close each IP is to a ban.
+// Errors are counted per IP across all requests, so every rule applies.
+func (e *Engine) Counters(now time.Time) []IPCounter {
+	cfg := e.cfgStore.Current()
+	snap := e.store.Snapshot()
+
+	// Entries past the TTL linger until the next sweep; leave them out.
+	ttlCutoff := now.Add(-storeTTL(cfg))
+	out := make([]IPCounter, 0, len(snap))
+	for ip, errs := range snap {
+		for len(errs) > 0 && !errs[0].After(ttlCutoff) {
+			errs = errs[1:]
+		}
+		if len(errs) == 0 {
+			continue
+		}
+		c := IPCounter{IP: ip, Errors: len(errs), LastError: errs[len(errs)-1]}
+		for _, r := range cfg.Rules {
+			cutoff := now.Add(-r.Window)
+			n := 0
+			for _, ts := range errs {
+				if ts.After(cutoff) {
+					n++
+				}
+			}
+			if n > 0 {
+				c.Rules = append(c.Rules, RuleProgress{RuleID: r.ID, Count: n, MaxErrors: r.MaxErrors})
+			}
+		}
+		sort.SliceStable(c.Rules, func(i, j int) bool { return c.Rules[i].Ratio() > c.Rules[j].Ratio() })
+		out = append(out, c)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		a, _ := out[i].Closest()
+		b, _ := out[j].Closest()
+		if a.Ratio() != b.Ratio() {
+			return a.Ratio() > b.Ratio()
+		}
+		if out[i].Errors != out[j].Errors {
+			return out[i].Errors > out[j].Errors
+		}
+		return out[i].IP < out[j].IP
+	})
+	return out
+}
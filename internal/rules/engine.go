@@ -2,24 +2,67 @@ package rules
 
 import (
 	"context"
+	"sync"
 	"time"
 
+	"github.com/cyra/foxhole-fw/internal/clock"
 	"github.com/cyra/foxhole-fw/internal/config"
 	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/metrics"
 	"github.com/cyra/foxhole-fw/internal/parser"
+	"github.com/cyra/foxhole-fw/internal/queue"
 )
 
 // Engine evaluates events against configured rules and emits decisions.
 type Engine struct {
 	cfgStore *config.Store
-	store    *Store
+	store    *ShardedStore
 	logger   *logging.Logger
+	clock    clock.Clock
+
+	// replay mode sweeps the store against event time instead of the wall clock.
+	replay    bool
+	lastSweep time.Time
 }
 
-// NewEngine creates a new Engine backed by a config.Store.
-func NewEngine(cfgStore *config.Store, logger *logging.Logger) *Engine {
-	cfg := cfgStore.Current()
-	// TTL for the store: max window across rules, or 5m by default.
+const (
+	// replaySweepInterval is how much log time passes between store sweeps in replay mode.
+	replaySweepInterval = time.Minute
+
+	// shardBuffer is the per-shard event buffer used when evaluation is sharded.
+	shardBuffer = 256
+)
+
+// NewEngine creates a new Engine backed by a config.Store. Events without a
+// timestamp are evaluated at clk's current time, and stale state is collected
+// once a minute on clk.
+// Per-IP state is split into pipeline.engine_shards shards, each evaluated on its own goroutine.
+func NewEngine(cfgStore *config.Store, logger *logging.Logger, clk clock.Clock) *Engine {
+	return newEngine(cfgStore, logger, clk, cfgStore.Current().Pipeline.EngineShards, time.Minute)
+}
+
+// NewReplayEngine creates an Engine for evaluating historical logs offline.
+// Stale per-IP state is collected based on event timestamps rather than the
+// wall clock, so windows behave as they did when the lines were written.
+func NewReplayEngine(cfgStore *config.Store, logger *logging.Logger) *Engine {
+	e := newEngine(cfgStore, logger, clock.Real, 1, 0)
+	e.replay = true
+	return e
+}
+
+func newEngine(cfgStore *config.Store, logger *logging.Logger, clk clock.Clock, shards int, gcInterval time.Duration) *Engine {
+	store := NewShardedStore(shards, storeTTL(cfgStore.Current()), gcInterval, clk)
+	store.SetEvidenceLines(evidenceLines(cfgStore.Current()))
+	return &Engine{
+		cfgStore: cfgStore,
+		store:    store,
+		logger:   logger,
+		clock:    clk,
+	}
+}
+
+// storeTTL returns the max window across rules, or 5m by default.
+func storeTTL(cfg *config.Config) time.Duration {
 	var maxWindow time.Duration
 	for _, r := range cfg.Rules {
 		if r.Window > maxWindow {
@@ -29,16 +72,36 @@ func NewEngine(cfgStore *config.Store, logger *logging.Logger) *Engine {
 	if maxWindow == 0 {
 		maxWindow = 5 * time.Minute
 	}
-	store := NewStore(maxWindow, time.Minute)
-	return &Engine{
-		cfgStore: cfgStore,
-		store:    store,
-		logger:   logger,
+	return maxWindow
+}
+
+// evidenceLines returns the configured evidence size; -1 means none.
+func evidenceLines(cfg *config.Config) int {
+	return max(cfg.Pipeline.EvidenceLines, 0)
+}
+
+// Reload recomputes the store TTL when rules change and applies a new evidence
+// size. Rules themselves are read from the config store on every event, so no
+// other state needs rebuilding.
+// It is meant to be registered with config.Store.Subscribe.
+func (e *Engine) Reload(old, cur *config.Config) {
+	e.store.SetEvidenceLines(evidenceLines(cur))
+	oldTTL, newTTL := storeTTL(old), storeTTL(cur)
+	if oldTTL == newTTL {
+		return
 	}
+	e.store.SetTTL(newTTL)
+	e.logger.Info("rule state ttl changed", "old", oldTTL, "new", newTTL)
 }
 
 // Run starts consuming events and emitting decisions until ctx is canceled or events channel closes.
-func (e *Engine) Run(ctx context.Context, events <-chan *parser.Event, decisions chan<- *Decision) {
+// Decisions are pushed according to the queue's overload policy. With more than one
+// shard, events are routed by IP hash so each IP is still evaluated in arrival order.
+func (e *Engine) Run(ctx context.Context, events <-chan *parser.Event, decisions *queue.Queue[*Decision]) {
+	if e.store.Len() > 1 {
+		e.runSharded(ctx, events, decisions)
+		return
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -47,30 +110,86 @@ func (e *Engine) Run(ctx context.Context, events <-chan *parser.Event, decisions
 			if !ok {
 				return
 			}
-			e.processEvent(ev, decisions)
+			e.processEvent(ctx, ev, decisions)
 		}
 	}
 }
 
-func (e *Engine) processEvent(ev *parser.Event, decisions chan<- *Decision) {
+func (e *Engine) runSharded(ctx context.Context, events <-chan *parser.Event, decisions *queue.Queue[*Decision]) {
+	shardCh := make([]chan *parser.Event, e.store.Len())
+	var wg sync.WaitGroup
+	for i := range shardCh {
+		ch := make(chan *parser.Event, shardBuffer)
+		shardCh[i] = ch
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ev := range ch {
+				e.processEvent(ctx, ev, decisions)
+			}
+		}()
+	}
+	defer func() {
+		for _, ch := range shardCh {
+			close(ch)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			ch := shardCh[ShardIndex(ev.RemoteAddr, len(shardCh))]
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (e *Engine) processEvent(ctx context.Context, ev *parser.Event, decisions *queue.Queue[*Decision]) {
+	for _, dec := range e.Evaluate(ev) {
+		decisions.Push(ctx, dec)
+	}
+}
+
+// Evaluate records the event and returns the decisions it triggers, if any.
+// Concurrent calls are safe for different IPs; events for one IP must be
+// evaluated in order. Replay engines must be driven from a single goroutine.
+func (e *Engine) Evaluate(ev *parser.Event) []*Decision {
 	cfg := e.cfgStore.Current()
 	evalTime := ev.Timestamp
 	if evalTime.IsZero() {
-		evalTime = time.Now()
+		evalTime = e.clock.Now()
+	}
+
+	if e.replay && evalTime.Sub(e.lastSweep) >= replaySweepInterval {
+		e.store.Sweep(evalTime)
+		e.lastSweep = evalTime
 	}
 
 	// For MVP: treat 4xx/5xx as errors and count them per-IP.
 	if ev.Status >= 400 {
-		_ = e.store.RecordError(ev.RemoteAddr, evalTime)
+		_ = e.store.RecordError(ev.RemoteAddr, evalTime, ev.Raw)
 	}
 
+	var out []*Decision
 	for _, r := range cfg.Rules {
 		if !matchRule(&r, ev) {
 			continue
 		}
+		metrics.RuleMatches.WithLabelValues(r.ID).Inc()
 
 		count := e.store.ApplyWindow(ev.RemoteAddr, evalTime, r.Window)
 		if count >= r.MaxErrors {
+			metrics.RuleViolations.WithLabelValues(r.ID).Inc()
 			dec := &Decision{
 				IP:        ev.RemoteAddr,
 				RuleID:    r.ID,
@@ -80,11 +199,21 @@ func (e *Engine) processEvent(ev *parser.Event, decisions chan<- *Decision) {
 				BanFor:    r.BanDuration,
 				Event:     ev,
 				Timestamp: evalTime,
+				Count:     count,
+				Source:    SourceEngine,
+				Evidence:  e.store.Evidence(ev.RemoteAddr, evalTime.Add(-r.Window)),
+				Backends:  r.Backends,
 			}
-			decisions <- dec
-			e.logger.Infof("violation: ip=%s rule=%s count=%d", dec.IP, dec.RuleID, count)
+			out = append(out, dec)
+			e.logger.Info("violation", "ip", dec.IP, "rule", dec.RuleID, "count", count)
 		}
 	}
+	return out
+}
+
+// TrackedIPs returns the number of IPs with recorded errors.
+func (e *Engine) TrackedIPs() int {
+	return e.store.IPs()
 }
 
 // Close stops the engine's internal store GC goroutine.
@@ -0,0 +1,235 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/clock"
+	"github.com/cyra/foxhole-fw/internal/config"
+	"github.com/cyra/foxhole-fw/internal/logging"
+	"github.com/cyra/foxhole-fw/internal/parser"
+	"github.com/cyra/foxhole-fw/internal/queue"
+)
+
+func testConfig(rules ...config.Rule) *config.Config {
+	if len(rules) == 0 {
+		rules = []config.Rule{{ID: "login", Method: "POST", Path: "/login", MaxErrors: 3, Window: time.Minute, BanDuration: time.Hour}}
+	}
+	return &config.Config{Pipeline: config.PipelineConfig{EngineShards: 1, EvidenceLines: 10}, Rules: rules}
+}
+
+func newTestEngine(t *testing.T, cfg *config.Config, clk clock.Clock) *Engine {
+	t.Helper()
+	e := NewEngine(config.NewStore(cfg), logging.NewLoggerTo(io.Discard), clk)
+	t.Cleanup(e.Close)
+	return e
+}
+
+// loginFailure is a failed login from ip at t; a zero t leaves the timestamp unset.
+func loginFailure(ip string, t time.Time) *parser.Event {
+	return &parser.Event{RemoteAddr: ip, Method: "POST", Path: "/login", Status: 401, Timestamp: t,
+		Raw: fmt.Sprintf("%s POST /login 401 %s", ip, t.Format(time.TimeOnly))}
+}
+
+func TestEngineThreshold(t *testing.T) {
+	e := newTestEngine(t, testConfig(), clock.Real)
+
+	for _, at := range []time.Duration{0, 20 * time.Second} {
+		if decs := e.Evaluate(loginFailure("10.0.0.1", epoch.Add(at))); len(decs) != 0 {
+			t.Fatalf("decision at +%v with too few errors: %+v", at, decs[0])
+		}
+	}
+	ev := loginFailure("10.0.0.1", epoch.Add(40*time.Second))
+	decs := e.Evaluate(ev)
+	if len(decs) != 1 {
+		t.Fatalf("got %d decisions on the third error, want 1", len(decs))
+	}
+	d := decs[0]
+	if d.IP != "10.0.0.1" || d.RuleID != "login" || !d.Ban || !d.Violation || d.BanFor != time.Hour ||
+		d.Count != 3 || d.Source != SourceEngine || d.Event != ev || !d.Timestamp.Equal(ev.Timestamp) {
+		t.Fatalf("unexpected decision %+v", d)
+	}
+	if len(d.Evidence) != 3 || d.Evidence[2] != ev.Raw {
+		t.Fatalf("evidence %q, want the three errors ending with %q", d.Evidence, ev.Raw)
+	}
+
+	// Each further error in the window fires again; the ban manager drops duplicates.
+	if decs := e.Evaluate(loginFailure("10.0.0.1", epoch.Add(50*time.Second))); len(decs) != 1 || decs[0].Count != 4 {
+		t.Fatalf("fourth error: %d decisions, want 1 with count 4", len(decs))
+	}
+}
+
+func TestEngineWindowSlides(t *testing.T) {
+	e := newTestEngine(t, testConfig(), clock.Real)
+
+	for _, at := range []time.Duration{0, 50 * time.Second, 70 * time.Second} {
+		if decs := e.Evaluate(loginFailure("10.0.0.1", epoch.Add(at))); len(decs) != 0 {
+			t.Fatalf("decision at +%v although the first error left the window", at)
+		}
+	}
+	decs := e.Evaluate(loginFailure("10.0.0.1", epoch.Add(80*time.Second)))
+	if len(decs) != 1 || decs[0].Count != 3 {
+		t.Fatalf("got %d decisions, want 1 with count 3", len(decs))
+	}
+	if len(decs[0].Evidence) != 3 {
+		t.Fatalf("evidence %q, want the three errors in the window", decs[0].Evidence)
+	}
+}
+
+func TestEngineMatching(t *testing.T) {
+	e := newTestEngine(t, testConfig(), clock.Real)
+
+	for i := 0; i < 5; i++ {
+		ok := &parser.Event{RemoteAddr: "10.0.0.1", Method: "POST", Path: "/login", Status: 200, Timestamp: epoch.Add(time.Duration(i) * time.Second)}
+		if decs := e.Evaluate(ok); len(decs) != 0 {
+			t.Fatal("successful request counted as an error")
+		}
+	}
+	for i := 0; i < 5; i++ {
+		other := &parser.Event{RemoteAddr: "10.0.0.2", Method: "GET", Path: "/login", Status: 404, Timestamp: epoch.Add(time.Duration(i) * time.Second)}
+		if decs := e.Evaluate(other); len(decs) != 0 {
+			t.Fatal("request not matching the rule fired it")
+		}
+	}
+
+	// Errors on other paths count toward the rule once a matching request comes in.
+	decs := e.Evaluate(loginFailure("10.0.0.2", epoch.Add(5*time.Second)))
+	if len(decs) != 1 || decs[0].Count != 6 {
+		t.Fatalf("got %d decisions, want 1 counting all six errors", len(decs))
+	}
+}
+
+func TestEngineRulesAndBackends(t *testing.T) {
+	cfg := testConfig(
+		config.Rule{ID: "strict", Path: "/login", MaxErrors: 2, Window: time.Minute, BanDuration: time.Hour, Backends: []string{"edge"}},
+		config.Rule{ID: "loose", Path: "/login", MaxErrors: 3, Window: time.Minute, BanDuration: 10 * time.Minute},
+	)
+	e := newTestEngine(t, cfg, clock.Real)
+
+	e.Evaluate(loginFailure("10.0.0.1", epoch))
+	decs := e.Evaluate(loginFailure("10.0.0.1", epoch.Add(time.Second)))
+	if len(decs) != 1 || decs[0].RuleID != "strict" || !slices.Equal(decs[0].Backends, []string{"edge"}) {
+		t.Fatalf("second error: %+v, want one strict decision for backend edge", decs)
+	}
+	decs = e.Evaluate(loginFailure("10.0.0.1", epoch.Add(2*time.Second)))
+	if len(decs) != 2 || decs[1].RuleID != "loose" || decs[1].BanFor != 10*time.Minute || decs[1].Backends != nil {
+		t.Fatalf("third error: %+v, want strict and loose decisions", decs)
+	}
+}
+
+func TestEngineUsesClockWithoutTimestamp(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	e := newTestEngine(t, testConfig(), fake)
+
+	e.Evaluate(loginFailure("10.0.0.1", time.Time{}))
+	e.Evaluate(loginFailure("10.0.0.1", time.Time{}))
+	fake.Advance(2 * time.Minute)
+	if decs := e.Evaluate(loginFailure("10.0.0.1", time.Time{})); len(decs) != 0 {
+		t.Fatal("errors outside the window counted")
+	}
+
+	fake.Advance(10 * time.Second)
+	e.Evaluate(loginFailure("10.0.0.1", time.Time{}))
+	fake.Advance(10 * time.Second)
+	decs := e.Evaluate(loginFailure("10.0.0.1", time.Time{}))
+	if len(decs) != 1 {
+		t.Fatalf("got %d decisions, want 1", len(decs))
+	}
+	if !decs[0].Timestamp.Equal(fake.Now()) {
+		t.Fatalf("decision at %v, want the clock's time %v", decs[0].Timestamp, fake.Now())
+	}
+}
+
+func TestEngineGC(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	e := newTestEngine(t, testConfig(), fake)
+	e.Evaluate(loginFailure("10.0.0.1", epoch))
+	e.Evaluate(loginFailure("10.0.0.2", epoch.Add(90*time.Second)))
+	if e.TrackedIPs() != 2 {
+		t.Fatalf("TrackedIPs() = %d, want 2", e.TrackedIPs())
+	}
+
+	// State is kept for the longest rule window and swept once a minute.
+	fake.Advance(time.Minute)
+	eventually(t, "10.0.0.1 to be collected", func() bool { return e.TrackedIPs() == 1 })
+	fake.Advance(time.Minute)
+	fake.Advance(time.Minute)
+	eventually(t, "10.0.0.2 to be collected", func() bool { return e.TrackedIPs() == 0 })
+}
+
+func TestEngineReloadTTL(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	old := testConfig()
+	e := newTestEngine(t, old, fake)
+	e.Evaluate(loginFailure("10.0.0.1", epoch))
+
+	cur := testConfig(config.Rule{ID: "login", Path: "/login", MaxErrors: 3, Window: 10 * time.Minute, BanDuration: time.Hour})
+	e.Reload(old, cur)
+	for i := 0; i < 5; i++ {
+		fake.Advance(time.Minute)
+	}
+	// Give the GC goroutine a chance to (wrongly) collect the IP.
+	time.Sleep(20 * time.Millisecond)
+	if e.TrackedIPs() != 1 {
+		t.Fatal("state collected before the new, longer window ran out")
+	}
+	for i := 0; i < 5; i++ {
+		fake.Advance(time.Minute)
+	}
+	eventually(t, "10.0.0.1 to be collected", func() bool { return e.TrackedIPs() == 0 })
+}
+
+func TestReplayEngineSweepsOnEventTime(t *testing.T) {
+	e := NewReplayEngine(config.NewStore(testConfig()), logging.NewLoggerTo(io.Discard))
+	defer e.Close()
+
+	e.Evaluate(loginFailure("10.0.0.1", epoch))
+	e.Evaluate(loginFailure("10.0.0.2", epoch.Add(30*time.Second)))
+	if e.TrackedIPs() != 2 {
+		t.Fatalf("TrackedIPs() = %d, want 2", e.TrackedIPs())
+	}
+	// An hour of log time later, both are stale however little wall time passed.
+	e.Evaluate(loginFailure("10.0.0.3", epoch.Add(time.Hour)))
+	if e.TrackedIPs() != 1 {
+		t.Fatalf("TrackedIPs() = %d after an hour of log time, want 1", e.TrackedIPs())
+	}
+}
+
+func TestEngineRunSharded(t *testing.T) {
+	cfg := testConfig()
+	cfg.Pipeline.EngineShards = 4
+	e := newTestEngine(t, cfg, clock.Real)
+
+	events := make(chan *parser.Event)
+	decisions := queue.New[*Decision]("decisions", 100, queue.Block, 0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Run(context.Background(), events, decisions)
+	}()
+
+	// Interleave IPs so each shard sees its IPs' events in order.
+	for i := 0; i < 3; i++ {
+		for ip := 0; ip < 20; ip++ {
+			events <- loginFailure(fmt.Sprintf("10.0.0.%d", ip), epoch.Add(time.Duration(i)*time.Second))
+		}
+	}
+	close(events)
+	<-done
+
+	banned := make(map[string]bool)
+	for decisions.Len() > 0 {
+		d := <-decisions.C()
+		if d.Count != 3 || banned[d.IP] {
+			t.Fatalf("unexpected decision %+v", d)
+		}
+		banned[d.IP] = true
+	}
+	if len(banned) != 20 {
+		t.Fatalf("%d IPs banned, want 20", len(banned))
+	}
+}
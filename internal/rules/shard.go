@@ -0,0 +1,123 @@
+package rules
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/clock"
+)
+
+// ShardedStore splits per-IP state across several Stores keyed by IP hash,
+// so concurrent evaluation of different IPs does not contend on one mutex.
+// All state for a given IP lives in exactly one shard.
+type ShardedStore struct {
+	shards []*Store
+}
+
+// NewShardedStore creates n shards (at least one) sharing the TTL, GC interval and clock.
+// The default limits apply to the whole store, not to each shard.
+func NewShardedStore(n int, ttl, gcInterval time.Duration, clk clock.Clock) *ShardedStore {
+	if n < 1 {
+		n = 1
+	}
+	s := &ShardedStore{shards: make([]*Store, n)}
+	for i := range s.shards {
+		s.shards[i] = NewStore(ttl, gcInterval, clk)
+	}
+	s.SetLimits(DefaultMaxIPs, DefaultMaxErrorsPerIP)
+	return s
+}
+
+// ShardIndex returns the shard index for ip out of n shards.
+func ShardIndex(ip string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(ip))
+	return int(h.Sum32() % uint32(n))
+}
+
+// Len returns the number of shards.
+func (s *ShardedStore) Len() int {
+	return len(s.shards)
+}
+
+// IPs returns the number of tracked IPs across all shards.
+func (s *ShardedStore) IPs() int {
+	n := 0
+	for _, st := range s.shards {
+		n += st.IPs()
+	}
+	return n
+}
+
+// Shard returns the store holding state for ip.
+func (s *ShardedStore) Shard(ip string) *Store {
+	return s.shards[ShardIndex(ip, len(s.shards))]
+}
+
+// SetLimits divides maxIPs evenly across shards; maxErrorsPerIP applies to every IP.
+func (s *ShardedStore) SetLimits(maxIPs, maxErrorsPerIP int) {
+	perShard := 0
+	if maxIPs > 0 {
+		perShard = (maxIPs + len(s.shards) - 1) / len(s.shards)
+	}
+	for _, st := range s.shards {
+		st.SetLimits(perShard, maxErrorsPerIP)
+	}
+}
+
+// SetTTL changes the TTL of every shard.
+func (s *ShardedStore) SetTTL(ttl time.Duration) {
+	for _, st := range s.shards {
+		st.SetTTL(ttl)
+	}
+}
+
+// RecordError records an error for ip in its shard. See Store.RecordError.
+func (s *ShardedStore) RecordError(ip string, t time.Time, line string) int {
+	return s.Shard(ip).RecordError(ip, t, line)
+}
+
+// Evidence returns the kept lines for ip from its shard. See Store.Evidence.
+func (s *ShardedStore) Evidence(ip string, since time.Time) []string {
+	return s.Shard(ip).Evidence(ip, since)
+}
+
+// SetEvidenceLines sets the evidence size of every shard.
+func (s *ShardedStore) SetEvidenceLines(n int) {
+	for _, st := range s.shards {
+		st.SetEvidenceLines(n)
+	}
+}
+
+// ApplyWindow trims entries for ip in its shard. See Store.ApplyWindow.
+func (s *ShardedStore) ApplyWindow(ip string, t time.Time, window time.Duration) int {
+	return s.Shard(ip).ApplyWindow(ip, t, window)
+}
+
+// Snapshot merges the snapshots of all shards. See Store.Snapshot.
+func (s *ShardedStore) Snapshot() map[string][]time.Time {
+	out := make(map[string][]time.Time)
+	for _, st := range s.shards {
+		for ip, errs := range st.Snapshot() {
+			out[ip] = errs
+		}
+	}
+	return out
+}
+
+// Sweep sweeps every shard. See Store.Sweep.
+func (s *ShardedStore) Sweep(now time.Time) {
+	for _, st := range s.shards {
+		st.Sweep(now)
+	}
+}
+
+// Close stops GC on every shard.
+func (s *ShardedStore) Close() {
+	for _, st := range s.shards {
+		st.Close()
+	}
+}
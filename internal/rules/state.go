@@ -4,6 +4,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/cyra/foxhole-fw/internal/clock"
 	"github.com/cyra/foxhole-fw/internal/parser"
 )
 
@@ -13,11 +14,54 @@ const (
 
 	// DefaultMaxErrorsPerIP is the default maximum errors to track per IP.
 	DefaultMaxErrorsPerIP = 1000
+
+	// DefaultEvidenceLines is the default number of raw lines kept per IP as ban evidence.
+	DefaultEvidenceLines = 10
 )
 
 // ipStats holds per-IP counters over time.
 type ipStats struct {
 	Errors []time.Time
+
+	// evidence is a ring buffer of the most recent error lines; once full,
+	// evidenceNext is the index of the oldest entry.
+	evidence     []evidenceLine
+	evidenceNext int
+}
+
+// evidenceLine is a raw log line recorded for an error.
+type evidenceLine struct {
+	at   time.Time
+	line string
+}
+
+// addEvidence records line, overwriting the oldest entry once max are kept.
+func (st *ipStats) addEvidence(at time.Time, line string, max int) {
+	if max <= 0 {
+		st.evidence, st.evidenceNext = nil, 0
+		return
+	}
+	if len(st.evidence) > max {
+		st.evidence, st.evidenceNext = st.orderedEvidence()[len(st.evidence)-max:], 0
+	} else if len(st.evidence) < max && st.evidenceNext != 0 {
+		// max was raised while the ring was wrapped; unwrap it so appending
+		// keeps the lines in order.
+		st.evidence, st.evidenceNext = st.orderedEvidence(), 0
+	}
+	e := evidenceLine{at: at, line: line}
+	if len(st.evidence) < max {
+		st.evidence = append(st.evidence, e)
+		return
+	}
+	st.evidence[st.evidenceNext] = e
+	st.evidenceNext = (st.evidenceNext + 1) % max
+}
+
+// orderedEvidence returns the ring contents oldest first.
+func (st *ipStats) orderedEvidence() []evidenceLine {
+	out := make([]evidenceLine, 0, len(st.evidence))
+	out = append(out, st.evidence[st.evidenceNext:]...)
+	return append(out, st.evidence[:st.evidenceNext]...)
 }
 
 // Store tracks per-IP state with basic GC and memory limits.
@@ -25,24 +69,31 @@ type Store struct {
 	mu             sync.Mutex
 	byIP           map[string]*ipStats
 	ttl            time.Duration
-	ticker         *time.Ticker
+	clock          clock.Clock
+	ticker         clock.Ticker
 	done           chan struct{}
 	maxIPs         int
 	maxErrorsPerIP int
+	evidenceLines  int
 }
 
-// NewStore creates a new Store with the given TTL and GC interval.
+// NewStore creates a new Store with the given TTL and GC interval, measured on clk.
 // Uses default memory limits which can be changed with SetLimits.
-func NewStore(ttl, gcInterval time.Duration) *Store {
+// A gcInterval <= 0 disables background GC; callers must then call Sweep themselves.
+func NewStore(ttl, gcInterval time.Duration, clk clock.Clock) *Store {
 	s := &Store{
 		byIP:           make(map[string]*ipStats),
 		ttl:            ttl,
-		ticker:         time.NewTicker(gcInterval),
+		clock:          clk,
 		done:           make(chan struct{}),
 		maxIPs:         DefaultMaxIPs,
 		maxErrorsPerIP: DefaultMaxErrorsPerIP,
+		evidenceLines:  DefaultEvidenceLines,
+	}
+	if gcInterval > 0 {
+		s.ticker = clk.NewTicker(gcInterval)
+		go s.gcLoop()
 	}
-	go s.gcLoop()
 	return s
 }
 
@@ -58,15 +109,35 @@ func (s *Store) SetLimits(maxIPs, maxErrorsPerIP int) {
 	}
 }
 
+// SetEvidenceLines sets how many raw lines are kept per IP; 0 keeps none.
+// Buffers shrink on the next recorded error.
+func (s *Store) SetEvidenceLines(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n >= 0 {
+		s.evidenceLines = n
+	}
+}
+
+// SetTTL changes how long entries are kept. It takes effect on the next record or sweep.
+func (s *Store) SetTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ttl = ttl
+}
+
 // Close stops the GC goroutine and releases resources.
 func (s *Store) Close() {
-	s.ticker.Stop()
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
 	close(s.done)
 }
 
-// RecordError records an error-like event (4xx/5xx) for an IP at time t.
-// Returns the current error count for the IP, or -1 if the IP limit was reached.
-func (s *Store) RecordError(ip string, t time.Time) int {
+// RecordError records an error-like event (4xx/5xx) for an IP at time t, keeping
+// line as evidence. Returns the current error count for the IP, or -1 if the IP
+// limit was reached.
+func (s *Store) RecordError(ip string, t time.Time, line string) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -100,9 +171,27 @@ func (s *Store) RecordError(ip string, t time.Time) int {
 	}
 
 	stats.Errors = append(stats.Errors, now)
+	stats.addEvidence(now, line, s.evidenceLines)
 	return len(stats.Errors)
 }
 
+// Evidence returns the kept lines for ip recorded after since, oldest first.
+func (s *Store) Evidence(ip string, since time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats, ok := s.byIP[ip]
+	if !ok {
+		return nil
+	}
+	var out []string
+	for _, e := range stats.orderedEvidence() {
+		if e.at.After(since) {
+			out = append(out, e.line)
+		}
+	}
+	return out
+}
+
 // ApplyWindow trims old entries for a specific IP based on the given window.
 func (s *Store) ApplyWindow(ip string, t time.Time, window time.Duration) int {
 	s.mu.Lock()
@@ -123,23 +212,42 @@ func (s *Store) ApplyWindow(ip string, t time.Time, window time.Duration) int {
 	return len(stats.Errors)
 }
 
+// IPs returns the number of tracked IPs.
+func (s *Store) IPs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.byIP)
+}
+
+// Snapshot returns a copy of the recorded error times for every tracked IP.
+func (s *Store) Snapshot() map[string][]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string][]time.Time, len(s.byIP))
+	for ip, stats := range s.byIP {
+		out[ip] = append([]time.Time(nil), stats.Errors...)
+	}
+	return out
+}
+
 // gcLoop periodically removes stale IP entries.
 func (s *Store) gcLoop() {
 	for {
 		select {
 		case <-s.done:
 			return
-		case <-s.ticker.C:
-			s.gc()
+		case <-s.ticker.C():
+			s.Sweep(s.clock.Now())
 		}
 	}
 }
 
-func (s *Store) gc() {
+// Sweep removes entries older than the store TTL relative to now and drops
+// IPs with no remaining entries.
+func (s *Store) Sweep(now time.Time) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	now := time.Now()
 	cutoff := now.Add(-s.ttl)
 
 	for ip, stats := range s.byIP {
@@ -157,6 +265,12 @@ func (s *Store) gc() {
 	}
 }
 
+// Decision sources: who asked for a ban.
+const (
+	SourceEngine = "engine" // a rule fired
+	SourceManual = "manual" // requested through the admin API
+)
+
 // Decision represents the outcome of evaluating an event.
 type Decision struct {
 	IP        string
@@ -167,4 +281,8 @@ type Decision struct {
 	BanFor    time.Duration
 	Event     *parser.Event
 	Timestamp time.Time
+	Count     int      // errors counted in the rule's window when it fired
+	Source    string   // SourceEngine or SourceManual
+	Evidence  []string // most recent raw lines counted toward the threshold, oldest first
+	Backends  []string // backends to ban on; empty means all
 }
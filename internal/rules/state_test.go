@@ -0,0 +1,229 @@
+package rules
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cyra/foxhole-fw/internal/clock"
+)
+
+var epoch = time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+
+// eventually polls cond until it holds, for state changed by a goroutine
+// woken by a fake clock.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStoreRecordErrorTTL(t *testing.T) {
+	s := NewStore(time.Minute, 0, clock.Real)
+	defer s.Close()
+
+	steps := []struct {
+		at   time.Duration
+		want int
+	}{
+		{0, 1},
+		{20 * time.Second, 2},
+		{59 * time.Second, 3},
+		{60 * time.Second, 3}, // the first error is exactly one TTL old and dropped
+		{80 * time.Second, 3},
+		{3 * time.Minute, 1},
+	}
+	for _, step := range steps {
+		if got := s.RecordError("10.0.0.1", epoch.Add(step.at), ""); got != step.want {
+			t.Fatalf("at +%v: count %d, want %d", step.at, got, step.want)
+		}
+	}
+}
+
+func TestStoreLimits(t *testing.T) {
+	s := NewStore(time.Hour, 0, clock.Real)
+	defer s.Close()
+	s.SetLimits(2, 3)
+
+	for i := 0; i < 5; i++ {
+		got := s.RecordError("10.0.0.1", epoch.Add(time.Duration(i)*time.Second), "")
+		if want := min(i+1, 3); got != want {
+			t.Fatalf("error %d: count %d, want %d", i, got, want)
+		}
+	}
+	if got := s.RecordError("10.0.0.2", epoch, ""); got != 1 {
+		t.Fatalf("second ip: count %d, want 1", got)
+	}
+	if got := s.RecordError("10.0.0.3", epoch, ""); got != -1 {
+		t.Fatalf("ip over the limit: count %d, want -1", got)
+	}
+	if s.IPs() != 2 {
+		t.Fatalf("IPs() = %d, want 2", s.IPs())
+	}
+
+	// Non-positive limits leave the current ones in place.
+	s.SetLimits(0, -1)
+	if got := s.RecordError("10.0.0.3", epoch, ""); got != -1 {
+		t.Fatalf("after SetLimits(0, -1): count %d, want -1", got)
+	}
+}
+
+func TestStoreApplyWindow(t *testing.T) {
+	s := NewStore(time.Hour, 0, clock.Real)
+	defer s.Close()
+	for _, at := range []time.Duration{0, 10 * time.Second, 50 * time.Second} {
+		s.RecordError("10.0.0.1", epoch.Add(at), "")
+	}
+
+	if got := s.ApplyWindow("10.0.0.1", epoch.Add(time.Minute), 30*time.Second); got != 1 {
+		t.Fatalf("ApplyWindow = %d, want 1", got)
+	}
+	if got := s.ApplyWindow("10.0.0.2", epoch, time.Minute); got != 0 {
+		t.Fatalf("ApplyWindow for unknown ip = %d, want 0", got)
+	}
+	if errs := s.Snapshot()["10.0.0.1"]; len(errs) != 1 || !errs[0].Equal(epoch.Add(50*time.Second)) {
+		t.Fatalf("kept %v, want only the error at +50s", errs)
+	}
+}
+
+func TestStoreEvidence(t *testing.T) {
+	s := NewStore(time.Hour, 0, clock.Real)
+	defer s.Close()
+	s.SetEvidenceLines(3)
+	for i := 0; i < 5; i++ {
+		s.RecordError("10.0.0.1", epoch.Add(time.Duration(i)*time.Second), fmt.Sprintf("line %d", i))
+	}
+
+	if got, want := s.Evidence("10.0.0.1", time.Time{}), []string{"line 2", "line 3", "line 4"}; !slices.Equal(got, want) {
+		t.Fatalf("Evidence = %q, want %q", got, want)
+	}
+	if got, want := s.Evidence("10.0.0.1", epoch.Add(3*time.Second)), []string{"line 4"}; !slices.Equal(got, want) {
+		t.Fatalf("Evidence since +3s = %q, want %q", got, want)
+	}
+
+	// Growing a wrapped ring keeps the lines in order.
+	s.SetEvidenceLines(5)
+	s.RecordError("10.0.0.1", epoch.Add(5*time.Second), "line 5")
+	if got, want := s.Evidence("10.0.0.1", time.Time{}), []string{"line 2", "line 3", "line 4", "line 5"}; !slices.Equal(got, want) {
+		t.Fatalf("Evidence after growing = %q, want %q", got, want)
+	}
+	for i := 6; i < 9; i++ {
+		s.RecordError("10.0.0.1", epoch.Add(time.Duration(i)*time.Second), fmt.Sprintf("line %d", i))
+	}
+	if got, want := s.Evidence("10.0.0.1", time.Time{}), []string{"line 4", "line 5", "line 6", "line 7", "line 8"}; !slices.Equal(got, want) {
+		t.Fatalf("Evidence after refilling = %q, want %q", got, want)
+	}
+
+	// Shrinking keeps the newest lines.
+	s.SetEvidenceLines(2)
+	s.RecordError("10.0.0.1", epoch.Add(9*time.Second), "line 9")
+	if got, want := s.Evidence("10.0.0.1", time.Time{}), []string{"line 8", "line 9"}; !slices.Equal(got, want) {
+		t.Fatalf("Evidence after shrinking = %q, want %q", got, want)
+	}
+
+	s.SetEvidenceLines(0)
+	s.RecordError("10.0.0.1", epoch.Add(10*time.Second), "line 10")
+	if got := s.Evidence("10.0.0.1", time.Time{}); got != nil {
+		t.Fatalf("Evidence with none kept = %q, want nil", got)
+	}
+}
+
+func TestStoreSweep(t *testing.T) {
+	s := NewStore(time.Minute, 0, clock.Real)
+	defer s.Close()
+	s.RecordError("10.0.0.1", epoch, "")
+	s.RecordError("10.0.0.2", epoch, "")
+	s.RecordError("10.0.0.2", epoch.Add(45*time.Second), "")
+
+	s.Sweep(epoch.Add(time.Minute))
+	snap := s.Snapshot()
+	if _, ok := snap["10.0.0.1"]; ok {
+		t.Fatal("stale ip not swept")
+	}
+	if got := len(snap["10.0.0.2"]); got != 1 {
+		t.Fatalf("10.0.0.2 kept %d errors, want 1", got)
+	}
+
+	s.SetTTL(10 * time.Second)
+	s.Sweep(epoch.Add(time.Minute))
+	if s.IPs() != 0 {
+		t.Fatalf("IPs() = %d after sweeping with a shorter TTL, want 0", s.IPs())
+	}
+}
+
+func TestStoreGC(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	s := NewStore(time.Minute, 30*time.Second, fake)
+	defer s.Close()
+	s.RecordError("10.0.0.1", epoch, "")
+	s.RecordError("10.0.0.2", epoch.Add(50*time.Second), "")
+
+	fake.Advance(30 * time.Second)
+	fake.Advance(30 * time.Second) // first error is one TTL old
+	eventually(t, "10.0.0.1 to be collected", func() bool { return s.IPs() == 1 })
+
+	fake.Advance(time.Minute)
+	eventually(t, "10.0.0.2 to be collected", func() bool { return s.IPs() == 0 })
+}
+
+func TestShardedStore(t *testing.T) {
+	s := NewShardedStore(4, time.Minute, 0, clock.Real)
+	defer s.Close()
+	if s.Len() != 4 {
+		t.Fatalf("Len() = %d, want 4", s.Len())
+	}
+	if NewShardedStore(0, time.Minute, 0, clock.Real).Len() != 1 {
+		t.Fatal("zero shards not raised to one")
+	}
+
+	for i := 0; i < 100; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		if s.Shard(ip) != s.Shard(ip) {
+			t.Fatalf("%s maps to different shards", ip)
+		}
+		s.RecordError(ip, epoch, "")
+	}
+	if s.IPs() != 100 || len(s.Snapshot()) != 100 {
+		t.Fatalf("IPs() = %d, snapshot has %d; want 100", s.IPs(), len(s.Snapshot()))
+	}
+
+	s.Sweep(epoch.Add(time.Minute))
+	if s.IPs() != 0 {
+		t.Fatalf("IPs() = %d after sweep, want 0", s.IPs())
+	}
+}
+
+func TestShardedStoreLimits(t *testing.T) {
+	s := NewShardedStore(4, time.Minute, 0, clock.Real)
+	defer s.Close()
+	s.SetLimits(10, 0) // three IPs per shard
+
+	rejected := 0
+	for i := 0; i < 100; i++ {
+		if s.RecordError(fmt.Sprintf("10.0.0.%d", i), epoch, "") < 0 {
+			rejected++
+		}
+	}
+	if s.IPs() != 12 || rejected != 88 {
+		t.Fatalf("tracked %d, rejected %d; want 12 and 88", s.IPs(), rejected)
+	}
+}
+
+func TestShardedStoreDefaultLimit(t *testing.T) {
+	s := NewShardedStore(8, time.Minute, 0, clock.Real)
+	defer s.Close()
+
+	// Twice the default cap, spread over every shard: the total stays at the cap.
+	for i := 0; i < 2*DefaultMaxIPs; i++ {
+		s.RecordError(fmt.Sprintf("10.%d.%d.%d", i>>16, i>>8&0xff, i&0xff), epoch, "")
+	}
+	if s.IPs() != DefaultMaxIPs {
+		t.Fatalf("tracked %d IPs over 8 shards, want the default cap %d", s.IPs(), DefaultMaxIPs)
+	}
+}